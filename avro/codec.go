@@ -0,0 +1,175 @@
+package avro
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"sync"
+
+	"github.com/linkedin/goavro/v2"
+	"github.com/quintans/faults"
+
+	"github.com/quintans/eventsourcing"
+)
+
+// ContentType is the content type of the events encoded with AvroCodec
+const ContentType = "application/vnd.confluent.avro"
+
+// magicByte starts the Confluent wire format, followed by the 4 bytes of the schema ID and the Avro binary data
+const magicByte = 0
+
+// Registry is a schema registry client, like the one returned by NewRegistryClient
+type Registry interface {
+	// GetLatestSchema returns the ID and the definition of the latest schema of the subject
+	GetLatestSchema(subject string) (int, string, error)
+	// GetSchema returns the definition of the schema with the ID
+	GetSchema(id int) (string, error)
+}
+
+type Option func(*AvroCodec)
+
+// WithSubjectNameStrategy sets how the subject of the schemas is named after the kind of the events,
+// or the type of the aggregates. By default, the subject is the kind.
+func WithSubjectNameStrategy(fn func(kind string) string) Option {
+	return func(c *AvroCodec) {
+		c.subject = fn
+	}
+}
+
+type schema struct {
+	id    int
+	codec *goavro.Codec
+}
+
+// AvroCodec encodes and decodes events and aggregate snapshots with Avro, using the Confluent wire format,
+// so that they can be shared with services in other languages.
+// Values are encoded with the latest schema of the subject of their kind, fetched once from the registry,
+// and decoded with the schema they were written with.
+//
+// The values are converted through their JSON representation, so their JSON field names must match the names of the schema fields,
+// and fields that can be omitted, eg: with omitempty, must have a default in the schema.
+// Unions, including the nullable fields, and bytes are not supported, since their JSON representation differs from the one of Avro.
+type AvroCodec struct {
+	registry Registry
+	subject  func(kind string) string
+
+	mu     sync.RWMutex
+	latest map[string]schema
+	byID   map[int]*goavro.Codec
+}
+
+func NewAvroCodec(registry Registry, options ...Option) *AvroCodec {
+	c := &AvroCodec{
+		registry: registry,
+		subject: func(kind string) string {
+			return kind
+		},
+		latest: map[string]schema{},
+		byID:   map[int]*goavro.Codec{},
+	}
+	for _, opt := range options {
+		opt(c)
+	}
+	return c
+}
+
+func (*AvroCodec) ContentType() string {
+	return ContentType
+}
+
+func (c *AvroCodec) Encode(v interface{}) ([]byte, error) {
+	t, ok := v.(eventsourcing.Typer)
+	if !ok {
+		return nil, faults.Errorf("unable to encode %T: it does not implement eventsourcing.Typer", v)
+	}
+	s, err := c.latestSchema(c.subject(t.GetType()))
+	if err != nil {
+		return nil, err
+	}
+
+	text, err := json.Marshal(v)
+	if err != nil {
+		return nil, faults.Wrap(err)
+	}
+	native, _, err := s.codec.NativeFromTextual(text)
+	if err != nil {
+		return nil, faults.Errorf("unable to encode %s with schema %d: %w", t.GetType(), s.id, err)
+	}
+	buf := make([]byte, 5, 5+len(text))
+	buf[0] = magicByte
+	binary.BigEndian.PutUint32(buf[1:], uint32(s.id))
+	buf, err = s.codec.BinaryFromNative(buf, native)
+	if err != nil {
+		return nil, faults.Errorf("unable to encode %s with schema %d: %w", t.GetType(), s.id, err)
+	}
+	return buf, nil
+}
+
+func (c *AvroCodec) Decode(data []byte, v interface{}) error {
+	if len(data) < 5 || data[0] != magicByte {
+		return faults.New("invalid Avro data: missing the schema ID")
+	}
+	id := int(binary.BigEndian.Uint32(data[1:5]))
+	codec, err := c.schemaByID(id)
+	if err != nil {
+		return err
+	}
+
+	native, _, err := codec.NativeFromBinary(data[5:])
+	if err != nil {
+		return faults.Errorf("unable to decode with schema %d: %w", id, err)
+	}
+	text, err := codec.TextualFromNative(nil, native)
+	if err != nil {
+		return faults.Errorf("unable to decode with schema %d: %w", id, err)
+	}
+	err = json.Unmarshal(text, v)
+	return faults.Wrap(err)
+}
+
+func (c *AvroCodec) latestSchema(subject string) (schema, error) {
+	c.mu.RLock()
+	s, ok := c.latest[subject]
+	c.mu.RUnlock()
+	if ok {
+		return s, nil
+	}
+
+	id, definition, err := c.registry.GetLatestSchema(subject)
+	if err != nil {
+		return schema{}, faults.Errorf("Unable to get the latest schema of subject '%s': %w", subject, err)
+	}
+	codec, err := goavro.NewCodec(definition)
+	if err != nil {
+		return schema{}, faults.Errorf("Invalid schema %d of subject '%s': %w", id, subject, err)
+	}
+	s = schema{id: id, codec: codec}
+
+	c.mu.Lock()
+	c.latest[subject] = s
+	c.byID[id] = codec
+	c.mu.Unlock()
+	return s, nil
+}
+
+func (c *AvroCodec) schemaByID(id int) (*goavro.Codec, error) {
+	c.mu.RLock()
+	codec, ok := c.byID[id]
+	c.mu.RUnlock()
+	if ok {
+		return codec, nil
+	}
+
+	definition, err := c.registry.GetSchema(id)
+	if err != nil {
+		return nil, faults.Errorf("Unable to get schema %d: %w", id, err)
+	}
+	codec, err = goavro.NewCodec(definition)
+	if err != nil {
+		return nil, faults.Errorf("Invalid schema %d: %w", id, err)
+	}
+
+	c.mu.Lock()
+	c.byID[id] = codec
+	c.mu.Unlock()
+	return codec, nil
+}
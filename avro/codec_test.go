@@ -0,0 +1,125 @@
+package avro_test
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/quintans/eventsourcing"
+	"github.com/quintans/eventsourcing/avro"
+	"github.com/quintans/eventsourcing/test"
+)
+
+const (
+	accountCreatedSchema = `{"type": "record", "name": "AccountCreated", "fields": [
+		{"name": "id", "type": "string"},
+		{"name": "money", "type": "long", "default": 0},
+		{"name": "owner", "type": "string", "default": ""}
+	]}`
+	ownerUpdatedV1Schema = `{"type": "record", "name": "OwnerUpdated", "fields": [
+		{"name": "owner", "type": "string", "default": ""}
+	]}`
+	ownerUpdatedV2Schema = `{"type": "record", "name": "OwnerUpdated", "fields": [
+		{"name": "owner", "type": "string", "default": ""},
+		{"name": "reason", "type": "string", "default": ""}
+	]}`
+)
+
+// registry serves the schemas by ID, the latest of each subject being the one with the highest ID
+func registry(t *testing.T, subjects map[string][]string) *httptest.Server {
+	ids := map[int]string{}
+	latest := map[string]int{}
+	id := 0
+	for subject, schemas := range subjects {
+		for _, s := range schemas {
+			id++
+			ids[id] = s
+			latest[subject] = id
+		}
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var res map[string]interface{}
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/subjects/"):
+			subject := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/subjects/"), "/versions/latest")
+			if id, ok := latest[subject]; ok {
+				res = map[string]interface{}{"id": id, "schema": ids[id]}
+			}
+		case strings.HasPrefix(r.URL.Path, "/schemas/ids/"):
+			id, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/schemas/ids/"))
+			if s, ok := ids[id]; ok {
+				res = map[string]interface{}{"schema": s}
+			}
+		}
+		if res == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		require.NoError(t, json.NewEncoder(w).Encode(res))
+	}))
+}
+
+func TestRoundTrip(t *testing.T) {
+	srv := registry(t, map[string][]string{
+		"AccountCreated": {accountCreatedSchema},
+	})
+	defer srv.Close()
+	codec := avro.NewAvroCodec(avro.NewRegistryClient(srv.URL))
+
+	id := uuid.New()
+	b, err := codec.Encode(test.AccountCreated{ID: id, Owner: "Paulo"})
+	require.NoError(t, err)
+	// Confluent wire format
+	assert.Equal(t, byte(0), b[0])
+	assert.Equal(t, uint32(1), binary.BigEndian.Uint32(b[1:5]))
+
+	e, err := eventsourcing.RehydrateEvent(test.AggregateFactory{}, codec, nil, "AccountCreated", b)
+	require.NoError(t, err)
+	assert.Equal(t, test.AccountCreated{ID: id, Owner: "Paulo"}, e)
+
+	// no schema for the subject
+	_, err = codec.Encode(test.MoneyDeposited{Money: 10})
+	require.Error(t, err)
+}
+
+func TestWriterSchema(t *testing.T) {
+	srv := registry(t, map[string][]string{
+		"OwnerUpdated": {ownerUpdatedV1Schema},
+	})
+	defer srv.Close()
+	old := avro.NewAvroCodec(avro.NewRegistryClient(srv.URL))
+	b, err := old.Encode(test.OwnerUpdated{Owner: "Paulo"})
+	require.NoError(t, err)
+	srv.Close()
+
+	// the new schema adds a field
+	srv = registry(t, map[string][]string{
+		"OwnerUpdated-value": {ownerUpdatedV1Schema, ownerUpdatedV2Schema},
+	})
+	defer srv.Close()
+	codec := avro.NewAvroCodec(avro.NewRegistryClient(srv.URL), avro.WithSubjectNameStrategy(func(kind string) string {
+		return kind + "-value"
+	}))
+	b2, err := codec.Encode(test.OwnerUpdated{Owner: "Pedro"})
+	require.NoError(t, err)
+	assert.Equal(t, uint32(2), binary.BigEndian.Uint32(b2[1:5]))
+
+	// decoded with the schema it was written with
+	e, err := eventsourcing.RehydrateEvent(test.AggregateFactory{}, codec, nil, "OwnerUpdated", b)
+	require.NoError(t, err)
+	assert.Equal(t, test.OwnerUpdated{Owner: "Paulo"}, e)
+	e, err = eventsourcing.RehydrateEvent(test.AggregateFactory{}, codec, nil, "OwnerUpdated", b2)
+	require.NoError(t, err)
+	assert.Equal(t, test.OwnerUpdated{Owner: "Pedro"}, e)
+
+	err = codec.Decode([]byte(`{"owner":"Paulo"}`), &test.OwnerUpdated{})
+	require.Error(t, err)
+}
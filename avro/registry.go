@@ -0,0 +1,70 @@
+package avro
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/quintans/faults"
+)
+
+var _ Registry = RegistryClient{}
+
+// RegistryClient is a client of the REST API of a Confluent schema registry
+type RegistryClient struct {
+	baseURL string
+	client  *http.Client
+}
+
+func NewRegistryClient(baseURL string) RegistryClient {
+	return RegistryClient{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+	}
+}
+
+type schemaResponse struct {
+	ID     int    `json:"id"`
+	Schema string `json:"schema"`
+}
+
+func (r RegistryClient) GetLatestSchema(subject string) (int, string, error) {
+	res := schemaResponse{}
+	err := r.get(fmt.Sprintf("/subjects/%s/versions/latest", url.PathEscape(subject)), &res)
+	if err != nil {
+		return 0, "", err
+	}
+	return res.ID, res.Schema, nil
+}
+
+func (r RegistryClient) GetSchema(id int) (string, error) {
+	res := schemaResponse{}
+	err := r.get(fmt.Sprintf("/schemas/ids/%d", id), &res)
+	if err != nil {
+		return "", err
+	}
+	return res.Schema, nil
+}
+
+func (r RegistryClient) get(path string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, r.baseURL+path, nil)
+	if err != nil {
+		return faults.Wrap(err)
+	}
+	req.Header.Set("Accept", "application/vnd.schemaregistry.v1+json")
+	res, err := r.client.Do(req)
+	if err != nil {
+		return faults.Wrap(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return faults.Errorf("schema registry responded to %s with %s", path, res.Status)
+	}
+	err = json.NewDecoder(res.Body).Decode(v)
+	return faults.Wrap(err)
+}
@@ -8,8 +8,21 @@ import (
 	"github.com/quintans/eventsourcing/common"
 )
 
+// JSONContentType is the content type of the events encoded with JSONCodec
+const JSONContentType = "application/json"
+
+// ContentTyper is implemented by codecs that identify the format of the data they encode.
+// The content type is saved along side the events, so that they can later be decoded by the matching codec.
+type ContentTyper interface {
+	ContentType() string
+}
+
 type JSONCodec struct{}
 
+func (JSONCodec) ContentType() string {
+	return JSONContentType
+}
+
 func (JSONCodec) Encode(v interface{}) ([]byte, error) {
 	b, err := json.Marshal(v)
 	return b, faults.Wrap(err)
@@ -21,7 +34,7 @@ func (JSONCodec) Decode(data []byte, v interface{}) error {
 }
 
 func RehydrateAggregate(factory Factory, decoder Decoder, upcaster Upcaster, aggregateType AggregateType, body []byte) (Aggregater, error) {
-	a, err := rehydrate(factory, decoder, upcaster, aggregateType.String(), body, false)
+	a, err := rehydrate(factory, decoder, upcaster, aggregateType.String(), 0, body, false)
 	if err != nil {
 		return nil, err
 	}
@@ -29,10 +42,16 @@ func RehydrateAggregate(factory Factory, decoder Decoder, upcaster Upcaster, agg
 }
 
 func RehydrateEvent(factory Factory, decoder Decoder, upcaster Upcaster, kind EventKind, body []byte) (Typer, error) {
-	return rehydrate(factory, decoder, upcaster, kind.String(), body, true)
+	return rehydrate(factory, decoder, upcaster, kind.String(), 0, body, true)
+}
+
+// RehydrateEventVersion is like RehydrateEvent but, if the upcaster is a VersionedUpcaster, upcasting starts from the stored event version.
+// A zero version is unknown.
+func RehydrateEventVersion(factory Factory, decoder Decoder, upcaster Upcaster, kind EventKind, version uint16, body []byte) (Typer, error) {
+	return rehydrate(factory, decoder, upcaster, kind.String(), version, body, true)
 }
 
-func rehydrate(factory Factory, decoder Decoder, upcaster Upcaster, kind string, body []byte, dereference bool) (Typer, error) {
+func rehydrate(factory Factory, decoder Decoder, upcaster Upcaster, kind string, version uint16, body []byte, dereference bool) (Typer, error) {
 	e, err := factory.New(kind)
 	if err != nil {
 		return nil, err
@@ -43,7 +62,9 @@ func rehydrate(factory Factory, decoder Decoder, upcaster Upcaster, kind string,
 			return nil, faults.Errorf("Unable to decode event %s: %w", kind, err)
 		}
 	}
-	if upcaster != nil {
+	if vu, ok := upcaster.(VersionedUpcaster); ok && version > 0 {
+		e = vu.UpcastVersion(e, version)
+	} else if upcaster != nil {
 		e = upcaster.Upcast(e)
 	}
 
@@ -0,0 +1,109 @@
+package eventsourcing_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/quintans/eventsourcing"
+	"github.com/quintans/eventsourcing/store/inmem"
+	"github.com/quintans/eventsourcing/test"
+)
+
+var kinds = []string{"Account", "AccountCreated", "MoneyDeposited", "MoneyWithdrawn", "OwnerUpdated"}
+
+func TestGobCodec(t *testing.T) {
+	codec, err := eventsourcing.NewGobCodec(test.AggregateFactory{}, kinds...)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	r := inmem.NewStore()
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{},
+		eventsourcing.WithCodec(codec),
+		eventsourcing.WithSnapshotThreshold(3),
+	)
+
+	id := uuid.New()
+	acc := test.CreateAccount("Paulo", id, 100)
+	acc.Deposit(10)
+	acc.Deposit(20)
+	err = es.Save(ctx, acc)
+	require.NoError(t, err)
+	acc.Withdraw(15)
+	err = es.Save(ctx, acc)
+	require.NoError(t, err)
+
+	events, err := r.GetAggregateEvents(ctx, id.String(), -1)
+	require.NoError(t, err)
+	require.Len(t, events, 4)
+	assert.Equal(t, eventsourcing.GobContentType, events[0].ContentType)
+	e, err := es.RehydrateEvent(events[0].Kind, events[0].Body)
+	require.NoError(t, err)
+	assert.Equal(t, test.AccountCreated{ID: id, Money: 100, Owner: "Paulo"}, e)
+
+	// from the snapshot and the last event
+	a, err := es.GetByID(ctx, id.String())
+	require.NoError(t, err)
+	acc2 := a.(*test.Account)
+	assert.Equal(t, id, acc2.ID)
+	assert.Equal(t, "Paulo", acc2.Owner)
+	assert.Equal(t, int64(115), acc2.Balance)
+	assert.Equal(t, uint32(4), acc2.GetVersion())
+
+	// the events of the aggregate still apply to the decoded snapshot
+	acc2.Deposit(5)
+	assert.Equal(t, int64(120), acc2.Balance)
+}
+
+func TestGobCodecUnregistered(t *testing.T) {
+	codec, err := eventsourcing.NewGobCodec(test.AggregateFactory{}, "MoneyDeposited")
+	require.NoError(t, err)
+
+	_, err = codec.Encode(test.MoneyWithdrawn{Money: 10})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "not registered")
+	err = codec.Decode([]byte{}, &test.MoneyWithdrawn{})
+	require.Error(t, err)
+
+	_, err = eventsourcing.NewGobCodec(test.AggregateFactory{}, "Unknown")
+	require.Error(t, err)
+}
+
+func BenchmarkCodecs(b *testing.B) {
+	gobCodec, err := eventsourcing.NewGobCodec(test.AggregateFactory{}, kinds...)
+	require.NoError(b, err)
+	codecs := map[string]eventsourcing.Codec{
+		"json": eventsourcing.JSONCodec{},
+		"gob":  gobCodec,
+	}
+	acc := test.CreateAccount("Paulo", uuid.New(), 100)
+	for name, codec := range codecs {
+		codec := codec
+		b.Run(name+"/event", func(b *testing.B) {
+			e := test.OwnerUpdated{Owner: "Paulo Quintans"}
+			for i := 0; i < b.N; i++ {
+				data, err := codec.Encode(e)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err := codec.Decode(data, &test.OwnerUpdated{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(name+"/snapshot", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				data, err := codec.Encode(acc)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err := codec.Decode(data, test.NewAccount()); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
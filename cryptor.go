@@ -0,0 +1,211 @@
+package eventsourcing
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+
+	"github.com/quintans/faults"
+)
+
+// Cryptor encrypts the bodies of the events and snapshots before they are saved, eg: for events with personal data.
+type Cryptor interface {
+	Encrypt(data []byte) ([]byte, error)
+	Decrypt(data []byte) ([]byte, error)
+}
+
+// KeyStore keeps a data key per aggregate, used to encrypt the bodies of its events and snapshots.
+// Deleting the key makes all of them unreadable, which is known as crypto-shredding.
+type KeyStore interface {
+	// GetKey returns the data key of the aggregate, or nil if it has none, eg: because it was deleted
+	GetKey(ctx context.Context, aggregateID string) ([]byte, error)
+	// CreateKey keeps the key for the aggregate, unless it already has one, and returns the key of the aggregate
+	CreateKey(ctx context.Context, aggregateID string, key []byte) ([]byte, error)
+	DeleteKey(ctx context.Context, aggregateID string) error
+}
+
+// dataKeySize is the size of the AES-256 data keys of the aggregates
+const dataKeySize = 32
+
+// encryptedPrefix marks an encrypted body. It is followed by how it was encrypted, the length of the key ID, the key ID and the encrypted data.
+// Since it starts with a zero byte, it is not mistaken for a JSON body.
+var encryptedPrefix = []byte{0, 'e', 'n', 'c'}
+
+const (
+	// encryptedByCryptor is for bodies encrypted by a Cryptor, identified by its key ID
+	encryptedByCryptor byte = 1
+	// encryptedByDataKey is for bodies encrypted with the data key of the aggregate, identified by the aggregate ID
+	encryptedByDataKey byte = 2
+)
+
+// WithCryptor encrypts the bodies of the events and snapshots with the cryptor, after they are encoded.
+// The key ID is saved with every encrypted body, so that the bodies encrypted with a previous key can still be decrypted
+// by the cryptor registered with WithDecryptor for that key.
+func WithCryptor(keyID string, cryptor Cryptor) EsOptions {
+	return func(r *EventStore) {
+		r.cryptor = cryptor
+		r.cryptKeyID = keyID
+		r.cryptors[keyID] = cryptor
+	}
+}
+
+// WithDecryptor registers the cryptor for the bodies encrypted with a key other than the one of the current cryptor, eg: after a key rotation.
+func WithDecryptor(keyID string, cryptor Cryptor) EsOptions {
+	return func(r *EventStore) {
+		r.cryptors[keyID] = cryptor
+	}
+}
+
+// WithKeyStore encrypts the bodies of the events and snapshots of each aggregate with its own data key, kept in the key store,
+// so that an aggregate can be forgotten with ForgetByKeyDeletion. It takes precedence over WithCryptor for the new bodies.
+func WithKeyStore(keyStore KeyStore) EsOptions {
+	return func(r *EventStore) {
+		r.keyStore = keyStore
+	}
+}
+
+// encrypt encrypts the body of the aggregate with its data key, if there is a key store, or with the current cryptor, if any
+func (es EventStore) encrypt(ctx context.Context, aggregateID string, body []byte) ([]byte, error) {
+	if len(body) == 0 {
+		return body, nil
+	}
+	if es.keyStore != nil {
+		key, err := es.dataKey(ctx, aggregateID)
+		if err != nil {
+			return nil, err
+		}
+		data, err := sealAES(key, body)
+		if err != nil {
+			return nil, faults.Errorf("Unable to encrypt with the key of aggregate '%s': %w", aggregateID, err)
+		}
+		return envelope(encryptedByDataKey, aggregateID, data), nil
+	}
+	if es.cryptor == nil {
+		return body, nil
+	}
+	data, err := es.cryptor.Encrypt(body)
+	if err != nil {
+		return nil, faults.Errorf("Unable to encrypt with key '%s': %w", es.cryptKeyID, err)
+	}
+	return envelope(encryptedByCryptor, es.cryptKeyID, data), nil
+}
+
+// dataKey returns the data key of the aggregate, creating it if it has none
+func (es EventStore) dataKey(ctx context.Context, aggregateID string) ([]byte, error) {
+	key, err := es.keyStore.GetKey(ctx, aggregateID)
+	if err != nil {
+		return nil, faults.Errorf("Unable to get the key of aggregate '%s': %w", aggregateID, err)
+	}
+	if key != nil {
+		return key, nil
+	}
+	key = make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, faults.Wrap(err)
+	}
+	key, err = es.keyStore.CreateKey(ctx, aggregateID, key)
+	if err != nil {
+		return nil, faults.Errorf("Unable to create the key of aggregate '%s': %w", aggregateID, err)
+	}
+	return key, nil
+}
+
+// decrypt decrypts the body with the cryptor or the data key it was encrypted with.
+// Bodies that are not encrypted, eg: saved before using a cryptor, are returned as is.
+func (es EventStore) decrypt(ctx context.Context, body []byte) ([]byte, error) {
+	if !bytes.HasPrefix(body, encryptedPrefix) {
+		return body, nil
+	}
+	data := body[len(encryptedPrefix):]
+	if len(data) == 0 {
+		return nil, faults.New("Invalid encrypted body")
+	}
+	by := data[0]
+	data = data[1:]
+	size, n := binary.Uvarint(data)
+	if n <= 0 || uint64(len(data)-n) < size {
+		return nil, faults.New("Invalid encrypted body")
+	}
+	keyID := string(data[n : n+int(size)])
+	data = data[n+int(size):]
+
+	switch by {
+	case encryptedByCryptor:
+		cryptor, ok := es.cryptors[keyID]
+		if !ok {
+			return nil, faults.Errorf("No cryptor registered for key '%s'", keyID)
+		}
+		plain, err := cryptor.Decrypt(data)
+		if err != nil {
+			return nil, faults.Errorf("Unable to decrypt with key '%s': %w", keyID, err)
+		}
+		return plain, nil
+	case encryptedByDataKey:
+		if es.keyStore == nil {
+			return nil, faults.Errorf("No key store to decrypt the body of aggregate '%s'", keyID)
+		}
+		key, err := es.keyStore.GetKey(ctx, keyID)
+		if err != nil {
+			return nil, faults.Errorf("Unable to get the key of aggregate '%s': %w", keyID, err)
+		}
+		if key == nil {
+			return nil, faults.Errorf("%w: aggregate '%s'", ErrForgotten, keyID)
+		}
+		plain, err := openAES(key, data)
+		if err != nil {
+			return nil, faults.Errorf("Unable to decrypt with the key of aggregate '%s': %w", keyID, err)
+		}
+		return plain, nil
+	default:
+		return nil, faults.Errorf("Unknown encryption %d", by)
+	}
+}
+
+func envelope(by byte, keyID string, data []byte) []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, len(encryptedPrefix)+1+binary.MaxVarintLen64+len(keyID)+len(data)))
+	buf.Write(encryptedPrefix)
+	buf.WriteByte(by)
+	size := make([]byte, binary.MaxVarintLen64)
+	buf.Write(size[:binary.PutUvarint(size, uint64(len(keyID)))])
+	buf.WriteString(keyID)
+	buf.Write(data)
+	return buf.Bytes()
+}
+
+// sealAES encrypts with AES-GCM, prefixing the random nonce
+func sealAES(key, plain []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(plain)+gcm.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, faults.Wrap(err)
+	}
+	return gcm.Seal(nonce, nonce, plain, nil), nil
+}
+
+func openAES(key, data []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, faults.New("encrypted data too short")
+	}
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	return plain, faults.Wrap(err)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, faults.Wrap(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	return gcm, faults.Wrap(err)
+}
@@ -0,0 +1,141 @@
+package eventsourcing_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/quintans/eventsourcing"
+	"github.com/quintans/eventsourcing/store/inmem"
+	"github.com/quintans/eventsourcing/test"
+)
+
+// xorCryptor is a toy cryptor, only good for tests
+type xorCryptor byte
+
+func (c xorCryptor) Encrypt(data []byte) ([]byte, error) {
+	out := make([]byte, len(data))
+	for k, b := range data {
+		out[k] = b ^ byte(c)
+	}
+	return out, nil
+}
+
+func (c xorCryptor) Decrypt(data []byte) ([]byte, error) {
+	return c.Encrypt(data)
+}
+
+func TestCryptor(t *testing.T) {
+	ctx := context.Background()
+	r := inmem.NewStore()
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{},
+		eventsourcing.WithSnapshotThreshold(3),
+		eventsourcing.WithCryptor("k1", xorCryptor(0x5a)),
+	)
+
+	id := uuid.New()
+	acc := test.CreateAccount("Paulo", id, 100)
+	acc.Deposit(10)
+	acc.Deposit(20)
+	err := es.Save(ctx, acc)
+	require.NoError(t, err)
+
+	events, err := r.GetAggregateEvents(ctx, id.String(), -1)
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+	assert.False(t, bytes.Contains(events[0].Body, []byte("Paulo")))
+	snap, err := r.GetSnapshot(ctx, id.String())
+	require.NoError(t, err)
+	assert.False(t, bytes.Contains(snap.Body, []byte("Paulo")))
+
+	// after rotating the key, the bodies encrypted with the previous key are still read
+	es = eventsourcing.NewEventStore(r, test.AggregateFactory{},
+		eventsourcing.WithSnapshotThreshold(3),
+		eventsourcing.WithCryptor("k2", xorCryptor(0x33)),
+		eventsourcing.WithDecryptor("k1", xorCryptor(0x5a)),
+	)
+	a, err := es.GetByID(ctx, id.String())
+	require.NoError(t, err)
+	acc2 := a.(*test.Account)
+	assert.Equal(t, "Paulo", acc2.Owner)
+	assert.Equal(t, int64(130), acc2.Balance)
+
+	e, err := es.RehydrateEvent(events[0].Kind, events[0].Body)
+	require.NoError(t, err)
+	assert.Equal(t, "Paulo", e.(test.AccountCreated).Owner)
+
+	err = es.Forget(ctx, eventsourcing.ForgetRequest{AggregateID: id.String(), EventKind: "AccountCreated"}, func(i interface{}) interface{} {
+		switch v := i.(type) {
+		case test.AccountCreated:
+			v.Owner = ""
+			return v
+		case test.Account:
+			v.Owner = ""
+			return v
+		}
+		return i
+	})
+	require.NoError(t, err)
+
+	events, err = r.GetAggregateEvents(ctx, id.String(), -1)
+	require.NoError(t, err)
+	e, err = es.RehydrateEvent(events[0].Kind, events[0].Body)
+	require.NoError(t, err)
+	assert.Empty(t, e.(test.AccountCreated).Owner)
+	a, err = es.GetByID(ctx, id.String())
+	require.NoError(t, err)
+	assert.Empty(t, a.(*test.Account).Owner)
+
+	// without the previous key, the old bodies can't be read
+	es = eventsourcing.NewEventStore(r, test.AggregateFactory{}, eventsourcing.WithCryptor("k2", xorCryptor(0x33)))
+	_, err = es.RehydrateEvent(events[1].Kind, events[1].Body)
+	require.Error(t, err)
+}
+
+func TestForgetByKeyDeletion(t *testing.T) {
+	ctx := context.Background()
+	r := inmem.NewStore()
+	keys := inmem.NewKeyStore()
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{},
+		eventsourcing.WithSnapshotThreshold(3),
+		eventsourcing.WithKeyStore(keys),
+	)
+
+	id := uuid.New()
+	acc := test.CreateAccount("Paulo", id, 100)
+	acc.Deposit(10)
+	acc.Deposit(20)
+	err := es.Save(ctx, acc)
+	require.NoError(t, err)
+	other := uuid.New()
+	err = es.Save(ctx, test.CreateAccount("Pedro", other, 50))
+	require.NoError(t, err)
+
+	events, err := r.GetAggregateEvents(ctx, id.String(), -1)
+	require.NoError(t, err)
+	assert.False(t, bytes.Contains(events[0].Body, []byte("Paulo")))
+	a, err := es.GetByID(ctx, id.String())
+	require.NoError(t, err)
+	assert.Equal(t, "Paulo", a.(*test.Account).Owner)
+
+	err = es.ForgetByKeyDeletion(ctx, id.String(), true)
+	require.NoError(t, err)
+
+	_, err = es.GetByID(ctx, id.String())
+	require.True(t, errors.Is(err, eventsourcing.ErrForgotten), err)
+	_, err = es.RehydrateEvent(events[0].Kind, events[0].Body)
+	require.True(t, errors.Is(err, eventsourcing.ErrForgotten), err)
+	snap, err := r.GetSnapshot(ctx, id.String())
+	require.NoError(t, err)
+	assert.True(t, snap.ID.IsZero())
+
+	// other aggregates are not affected
+	a, err = es.GetByID(ctx, other.String())
+	require.NoError(t, err)
+	assert.Equal(t, int64(50), a.(*test.Account).Balance)
+}
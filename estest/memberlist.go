@@ -0,0 +1,138 @@
+package estest
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/quintans/eventsourcing/worker"
+)
+
+// MemberList is an in memory list of members, shared by all the members created from it,
+// that can be mutated by the tests to simulate other members joining or leaving.
+type MemberList struct {
+	mu       sync.Mutex
+	members  map[string][]string
+	watchers []chan struct{}
+}
+
+func NewMemberList() *MemberList {
+	return &MemberList{
+		members: map[string][]string{},
+	}
+}
+
+// Member returns the worker.Memberlister for the named member
+func (l *MemberList) Member(name string) *Member {
+	return &Member{
+		name: name,
+		list: l,
+	}
+}
+
+// Set registers, or replaces, the workers of a member
+func (l *MemberList) Set(name string, workers ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, ok := l.members[name]
+	l.members[name] = append([]string{}, workers...)
+	if !ok {
+		l.notify()
+	}
+}
+
+// Remove simulates a member leaving
+func (l *MemberList) Remove(name string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.members[name]; ok {
+		delete(l.members, name)
+		l.notify()
+	}
+}
+
+func (l *MemberList) notify() {
+	for _, w := range l.watchers {
+		select {
+		case w <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (l *MemberList) watch(ctx context.Context) <-chan struct{} {
+	ch := make(chan struct{}, 1)
+	l.mu.Lock()
+	l.watchers = append(l.watchers, ch)
+	l.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		for k, w := range l.watchers {
+			if w == ch {
+				l.watchers = append(l.watchers[:k], l.watchers[k+1:]...)
+				break
+			}
+		}
+		close(ch)
+	}()
+
+	return ch
+}
+
+// Workers returns the workers registered by a member
+func (l *MemberList) Workers(name string) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return append([]string{}, l.members[name]...)
+}
+
+func (l *MemberList) list() []worker.MemberWorkers {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	members := make([]worker.MemberWorkers, 0, len(l.members))
+	for k, v := range l.members {
+		members = append(members, worker.MemberWorkers{
+			Name:    k,
+			Workers: append([]string{}, v...),
+		})
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Name < members[j].Name
+	})
+	return members
+}
+
+var (
+	_ worker.Memberlister      = (*Member)(nil)
+	_ worker.MembershipWatcher = (*Member)(nil)
+)
+
+type Member struct {
+	name string
+	list *MemberList
+}
+
+func (m *Member) Name() string {
+	return m.name
+}
+
+func (m *Member) List(context.Context) ([]worker.MemberWorkers, error) {
+	return m.list.list(), nil
+}
+
+func (m *Member) Register(_ context.Context, workers []string) error {
+	m.list.Set(m.name, workers...)
+	return nil
+}
+
+// Watch signals when members join or leave the list
+func (m *Member) Watch(ctx context.Context) <-chan struct{} {
+	return m.list.watch(ctx)
+}
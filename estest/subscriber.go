@@ -0,0 +1,111 @@
+package estest
+
+import (
+	"context"
+	"sync"
+
+	"github.com/quintans/eventsourcing"
+	"github.com/quintans/eventsourcing/projection"
+)
+
+var _ projection.Subscriber = (*Subscriber)(nil)
+
+type consumer struct {
+	resume  projection.StreamResume
+	handler projection.EventHandlerFunc
+	filter  func(e eventsourcing.Event) bool
+}
+
+// Subscriber is an in memory projection.Subscriber whose resume tokens and consumers can be driven by the tests.
+type Subscriber struct {
+	mu        sync.Mutex
+	tokens    map[string]string
+	consumers map[string]consumer
+}
+
+func NewSubscriber() *Subscriber {
+	return &Subscriber{
+		tokens:    map[string]string{},
+		consumers: map[string]consumer{},
+	}
+}
+
+// StartConsumer registers a consumer that runs until the context is done, closing the returned channel
+func (s *Subscriber) StartConsumer(ctx context.Context, resume projection.StreamResume, handler projection.EventHandlerFunc, options ...projection.ConsumerOption) (chan struct{}, error) {
+	opts := projection.ConsumerOptions{}
+	for _, o := range options {
+		o(&opts)
+	}
+
+	key := resume.String()
+	s.mu.Lock()
+	s.consumers[key] = consumer{
+		resume:  resume,
+		handler: handler,
+		filter:  opts.Filter,
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		s.mu.Lock()
+		delete(s.consumers, key)
+		s.mu.Unlock()
+		close(done)
+	}()
+
+	return done, nil
+}
+
+func (s *Subscriber) GetResumeToken(ctx context.Context, topic string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.tokens[topic], nil
+}
+
+// SetResumeToken sets the token returned by GetResumeToken for the topic
+func (s *Subscriber) SetResumeToken(topic, token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tokens[topic] = token
+}
+
+// Publish delivers the event to the running consumers of the topic, that accept it,
+// and moves the topic resume token to the event ID.
+func (s *Subscriber) Publish(ctx context.Context, topic string, e eventsourcing.Event) error {
+	s.mu.Lock()
+	s.tokens[topic] = e.ID.String()
+	consumers := []consumer{}
+	for _, c := range s.consumers {
+		if c.resume.Topic == topic {
+			consumers = append(consumers, c)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, c := range consumers {
+		if c.filter != nil && !c.filter(e) {
+			continue
+		}
+		err := c.handler(ctx, e)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Consumers returns the running consumers
+func (s *Subscriber) Consumers() []projection.StreamResume {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	resumes := make([]projection.StreamResume, 0, len(s.consumers))
+	for _, c := range s.consumers {
+		resumes = append(resumes, c.resume)
+	}
+	return resumes
+}
@@ -0,0 +1,47 @@
+package estest_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/quintans/eventsourcing"
+	"github.com/quintans/eventsourcing/estest"
+	"github.com/quintans/eventsourcing/eventid"
+	"github.com/quintans/eventsourcing/projection"
+)
+
+func TestSubscriber(t *testing.T) {
+	s := estest.NewSubscriber()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	resume := projection.StreamResume{Topic: "accounts", Stream: "balance"}
+	events := []eventsourcing.Event{}
+	done, err := s.StartConsumer(ctx, resume, func(ctx context.Context, e eventsourcing.Event) error {
+		events = append(events, e)
+		return nil
+	}, projection.WithFilter(func(e eventsourcing.Event) bool {
+		return e.Kind == "MoneyDeposited"
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, []projection.StreamResume{resume}, s.Consumers())
+
+	now := time.Now().UTC()
+	id, err := eventid.New(now, eventid.EntropyFactory(now))
+	require.NoError(t, err)
+	require.NoError(t, s.Publish(ctx, "accounts", eventsourcing.Event{ID: id, Kind: "MoneyDeposited"}))
+	require.NoError(t, s.Publish(ctx, "accounts", eventsourcing.Event{ID: id, Kind: "MoneyWithdrawn"}))
+	require.NoError(t, s.Publish(ctx, "other", eventsourcing.Event{ID: id, Kind: "MoneyDeposited"}))
+	require.Len(t, events, 1)
+
+	token, err := s.GetResumeToken(ctx, "accounts")
+	require.NoError(t, err)
+	assert.Equal(t, id.String(), token)
+
+	cancel()
+	<-done
+	assert.Empty(t, s.Consumers())
+}
@@ -0,0 +1,84 @@
+package estest
+
+import (
+	"context"
+	"sync"
+
+	"github.com/quintans/eventsourcing/worker"
+)
+
+var _ worker.Worker = (*Worker)(nil)
+
+// Worker is a worker.Worker that records the start and stop calls.
+type Worker struct {
+	name string
+
+	mu        sync.RWMutex
+	running   bool
+	startable bool
+	starts    int
+	stops     int
+}
+
+func NewWorker(name string) *Worker {
+	return &Worker{
+		name:      name,
+		startable: true,
+	}
+}
+
+func (w *Worker) Name() string {
+	return w.name
+}
+
+func (w *Worker) IsRunning() bool {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	return w.running
+}
+
+// Start starts the worker, unless it was made unstartable
+func (w *Worker) Start(context.Context) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.starts++
+	if !w.startable {
+		return false
+	}
+	w.running = true
+	return true
+}
+
+func (w *Worker) Stop(context.Context) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.stops++
+	w.running = false
+}
+
+// SetStartable controls if the worker can be started, eg: to simulate the worker lock being held by another member
+func (w *Worker) SetStartable(startable bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.startable = startable
+}
+
+// Starts returns the number of times Start was called
+func (w *Worker) Starts() int {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	return w.starts
+}
+
+// Stops returns the number of times Stop was called
+func (w *Worker) Stops() int {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	return w.stops
+}
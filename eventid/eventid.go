@@ -1,6 +1,7 @@
 package eventid
 
 import (
+	cryptorand "crypto/rand"
 	"database/sql/driver"
 	"errors"
 	"io"
@@ -41,6 +42,36 @@ func New(t time.Time, entropy io.Reader) (EventID, error) {
 	return EventID{u: id}, nil
 }
 
+// Generator generates the ID of the event of an aggregate version, created at a time.
+// The IDs of the events saved together, with the same creation time, must increase with the version.
+// The entropy, from NewEntropy, is monotonic and only shared by the events saved together.
+type Generator func(entropy io.Reader, createdAt time.Time, aggregateID string, version uint32) (EventID, error)
+
+// NewEntropy returns the entropy for the IDs of the events saved together.
+// Since it is monotonic, the IDs created with it in the same millisecond are increasing,
+// and since each save has its own, concurrent saves don't reset it.
+func NewEntropy() io.Reader {
+	return ulid.Monotonic(cryptorand.Reader, 0)
+}
+
+// Generate is the default Generator, using the entropy for the random part of the IDs.
+func Generate(entropy io.Reader, createdAt time.Time, _ string, _ uint32) (EventID, error) {
+	return New(createdAt, entropy)
+}
+
+// New generates an ID, failing if it doesn't have the creation time,
+// since the feeds rely on the IDs being ordered by creation time.
+func (g Generator) New(entropy io.Reader, createdAt time.Time, aggregateID string, version uint32) (EventID, error) {
+	id, err := g(entropy, createdAt, aggregateID, version)
+	if err != nil {
+		return Zero, faults.Errorf("Unable to generate the ID of event %d of aggregate '%s': %w", version, aggregateID, err)
+	}
+	if id.u.Time() != ulid.Timestamp(createdAt) {
+		return Zero, faults.Errorf("the ID %s of event %d of aggregate '%s' doesn't have the creation time %s", id, version, aggregateID, createdAt)
+	}
+	return id, nil
+}
+
 func TimeOnly(t time.Time) EventID {
 	var id ulid.ULID
 	id.SetTime(ulid.Timestamp(t))
@@ -1,7 +1,9 @@
 package eventid
 
 import (
+	"io"
 	"testing"
+	"time"
 
 	"github.com/oklog/ulid/v2"
 	"github.com/stretchr/testify/assert"
@@ -84,3 +86,37 @@ func TestUnmarshalWithCount(t *testing.T) {
 		})
 	}
 }
+
+func TestGenerate(t *testing.T) {
+	now := time.Now()
+	gen := Generator(Generate)
+	entropy := NewEntropy()
+	last := Zero
+	for k := 0; k < 100; k++ {
+		id, err := gen.New(entropy, now, "a", uint32(k+1))
+		require.NoError(t, err)
+		// the same millisecond does not repeat, or reorder, the IDs
+		require.Equal(t, 1, id.Compare(last))
+		last = id
+	}
+
+	// interleaved saves, with different creation times, don't reorder the IDs of each other
+	entropies := []io.Reader{NewEntropy(), NewEntropy()}
+	times := []time.Time{now, now.Add(time.Millisecond)}
+	lasts := []EventID{Zero, Zero}
+	for k := 0; k < 100; k++ {
+		for r := range entropies {
+			id, err := gen.New(entropies[r], times[r], "a", uint32(k+1))
+			require.NoError(t, err)
+			require.Equal(t, 1, id.Compare(lasts[r]))
+			lasts[r] = id
+		}
+	}
+
+	// the IDs without the creation time would break the ordering of the feeds
+	gen = func(_ io.Reader, createdAt time.Time, aggregateID string, version uint32) (EventID, error) {
+		return TimeOnly(createdAt.Add(time.Second)), nil
+	}
+	_, err := gen.New(entropy, now, "a", 1)
+	require.Error(t, err)
+}
@@ -3,24 +3,74 @@ package eventsourcing
 import (
 	"context"
 	"errors"
+	"fmt"
 	"time"
 
+	"github.com/cenkalti/backoff/v4"
 	"github.com/quintans/faults"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/quintans/eventsourcing/common"
 	"github.com/quintans/eventsourcing/encoding"
 	"github.com/quintans/eventsourcing/eventid"
+	"github.com/quintans/eventsourcing/log"
 )
 
 const (
 	EmptyIdempotencyKey = ""
 )
 
+// IdempotencyScope defines where an idempotency key must be unique
+type IdempotencyScope int
+
+const (
+	// IdempotencyScopeGlobal makes the idempotency keys unique across all the aggregates
+	IdempotencyScopeGlobal IdempotencyScope = iota
+	// IdempotencyScopeAggregate makes the idempotency keys unique per aggregate ID,
+	// so that different aggregates can use the same key
+	IdempotencyScopeAggregate
+)
+
 var (
-	ErrConcurrentModification = errors.New("concurrent modification")
-	ErrUnknownAggregateID     = errors.New("unknown aggregate ID")
+	ErrConcurrentModification  = errors.New("concurrent modification")
+	ErrDuplicateIdempotencyKey = errors.New("duplicate idempotency key")
+	ErrUnknownAggregateID      = errors.New("unknown aggregate ID")
+	ErrEventTooLarge           = errors.New("event body too large")
+	ErrUnknownAggregateVersion = errors.New("unknown aggregate version")
+	ErrNotSupported            = errors.New("not supported by the repository")
+	// ErrForgotten is returned when reading an aggregate forgotten by ForgetByKeyDeletion
+	ErrForgotten = errors.New("aggregate was forgotten")
+	// ErrDispatchFailed is returned by Save when the events were saved but the dispatcher failed
+	ErrDispatchFailed = errors.New("dispatch of the saved events failed")
+	// ErrVersionGap is returned by Save when the version of the aggregate was raised after its new events were applied
+	ErrVersionGap = errors.New("aggregate version gap")
+	// ErrMissingTenant is returned by multi tenant repositories when the context has no tenant
+	ErrMissingTenant = errors.New("missing tenant")
 )
 
+// WrapCause returns an error that matches err with errors.Is, while keeping the cause retrievable with errors.As.
+// The repositories use it to keep the database error behind errors like ErrConcurrentModification, for diagnostics.
+func WrapCause(err error, cause error) error {
+	return causeError{err: err, cause: cause}
+}
+
+type causeError struct {
+	err   error
+	cause error
+}
+
+func (e causeError) Error() string {
+	return e.err.Error() + ": " + e.cause.Error()
+}
+
+func (e causeError) Is(target error) bool {
+	return errors.Is(e.err, target)
+}
+
+func (e causeError) Unwrap() error {
+	return e.cause
+}
+
 type Factory interface {
 	New(kind string) (Typer, error)
 }
@@ -42,6 +92,12 @@ type Decoder interface {
 	Decode(data []byte, v interface{}) error
 }
 
+// ChangesVersioner is implemented by the aggregates that keep the version they had when the first of their new events was applied,
+// like the ones embedding RootAggregate. It is what allows Save to detect versions changed out of band.
+type ChangesVersioner interface {
+	GetChangesVersion() uint32
+}
+
 type Aggregater interface {
 	Typer
 	GetID() string
@@ -66,15 +122,27 @@ type Event struct {
 	AggregateType    AggregateType
 	Kind             EventKind
 	Body             encoding.Base64
+	ContentType      string
 	IdempotencyKey   string
 	Metadata         map[string]interface{}
 	CreatedAt        time.Time
+	// TenantID is the tenant that saved the event, for multi tenant repositories
+	TenantID string
+	// EventVersion is the schema version of the event body. Zero means unknown, for repositories that do not keep it.
+	EventVersion uint16
+	// ForgottenAt is when the body was erased by Forget. Zero if it was never forgotten.
+	ForgottenAt time.Time
 }
 
 func (e Event) IsZero() bool {
 	return e.ID.IsZero()
 }
 
+// IsForgotten tells if the body of the event was erased by Forget
+func (e Event) IsForgotten() bool {
+	return !e.ForgottenAt.IsZero()
+}
+
 type Snapshot struct {
 	ID               eventid.EventID
 	AggregateID      string
@@ -82,30 +150,213 @@ type Snapshot struct {
 	AggregateType    AggregateType
 	Body             []byte
 	CreatedAt        time.Time
+	// TenantID is the tenant of the aggregate, for multi tenant repositories
+	TenantID string
 }
 
-type EsRepository interface {
-	SaveEvent(ctx context.Context, eRec EventRecord) (id eventid.EventID, version uint32, err error)
+// SnapshotStore is where the snapshots are kept.
+// By default the snapshots are kept in the same repository as the events, but they can also be kept elsewhere,
+// like a key value store.
+type SnapshotStore interface {
 	GetSnapshot(ctx context.Context, aggregateID string) (Snapshot, error)
 	SaveSnapshot(ctx context.Context, snapshot Snapshot) error
+}
+
+// SnapshotDeleter is implemented by snapshot stores, other than the EsRepository, that can delete the snapshots of an aggregate.
+// It is used when forgetting an aggregate.
+type SnapshotDeleter interface {
+	DeleteSnapshot(ctx context.Context, aggregateID string) error
+}
+
+// SnapshotPruner is implemented by snapshot stores that keep several snapshots per aggregate and can delete the superseded ones
+type SnapshotPruner interface {
+	// DeleteSnapshots deletes the snapshots of the aggregate, except for the latest keepLast
+	DeleteSnapshots(ctx context.Context, aggregateID string, keepLast int) error
+	// PruneSnapshots deletes the snapshots of all the aggregates, except for the latest keepLast of each, returning how many were deleted
+	PruneSnapshots(ctx context.Context, keepLast int) (int64, error)
+}
+
+// EventRecordResult is the outcome of saving an EventRecord: the ID of the last event and the resulting aggregate version
+type EventRecordResult struct {
+	ID      eventid.EventID
+	Version uint32
+}
+
+// BatchSaver is implemented by repositories that are able to save the events of several aggregates in a single transaction.
+// The results are in the same order as the records.
+type BatchSaver interface {
+	SaveEvents(ctx context.Context, eRecs []EventRecord) ([]EventRecordResult, error)
+}
+
+// EventIDsSaver is implemented by repositories that are able to return the IDs of all the saved events, and not only of the last one.
+// The IDs are in the same order as the details of the record.
+type EventIDsSaver interface {
+	SaveEventIDs(ctx context.Context, eRec EventRecord) ([]eventid.EventID, uint32, error)
+}
+
+// HashFunc computes the hash that partitions the events of an aggregate, saved as the aggregate ID hash.
+// All the events of an aggregate must have the same hash, so that they are kept in order in the same partition.
+type HashFunc func(aggregateID string, labels map[string]interface{}) uint32
+
+// HashAggregateID is the default HashFunc, hashing the aggregate ID
+func HashAggregateID(aggregateID string, _ map[string]interface{}) uint32 {
+	return common.Hash(aggregateID)
+}
+
+// HashLabel returns a HashFunc that hashes the value of the label, eg: a tenant ID, falling back to the aggregate ID if there is no such label.
+// The label must be set in every save of the aggregate.
+func HashLabel(label string) HashFunc {
+	return func(aggregateID string, labels map[string]interface{}) uint32 {
+		if v, ok := labels[label]; ok && v != nil {
+			return common.Hash(fmt.Sprint(v))
+		}
+		return common.Hash(aggregateID)
+	}
+}
+
+// AggregateHasher is implemented by repositories with a custom HashFunc,
+// so that the events passed to the after save hooks have the same hash as the saved ones.
+type AggregateHasher interface {
+	AggregateIDHash(aggregateID string, labels map[string]interface{}) uint32
+}
+
+// EventStreamer is implemented by repositories that are able to stream the events of an aggregate,
+// so that aggregates with many events can be loaded with bounded memory.
+// The events channel is closed at the end, after any error is sent to the error channel.
+type EventStreamer interface {
+	GetAggregateEventsStream(ctx context.Context, aggregateID string, snapVersion int) (<-chan Event, <-chan error)
+}
+
+// AggregateLoader is implemented by repositories that can get the latest snapshot and the events after it in a single round trip.
+// It is used by GetByID, instead of GetSnapshot and GetAggregateEvents, when the snapshots are kept in the repository
+// and the repository is not an EventStreamer.
+// The snapshot is zero if there is none.
+type AggregateLoader interface {
+	LoadAggregate(ctx context.Context, aggregateID string) (Snapshot, []Event, error)
+}
+
+// BoundedSnapshotGetter is implemented by snapshot stores that can get the newest snapshot not exceeding a version.
+// It is used to rehydrate an aggregate at a past version.
+type BoundedSnapshotGetter interface {
+	GetSnapshotUpTo(ctx context.Context, aggregateID string, maxVersion uint32) (Snapshot, error)
+}
+
+// BoundedEventsGetter is implemented by repositories that can get the events of an aggregate up to, and including, a version.
+// It is used to rehydrate an aggregate at a past version.
+type BoundedEventsGetter interface {
+	GetAggregateEventsUpTo(ctx context.Context, aggregateID string, snapVersion int, maxVersion uint32) ([]Event, error)
+}
+
+// TimeBoundedSnapshotGetter is implemented by snapshot stores that can get the newest snapshot created until a time.
+// It is used to rehydrate an aggregate as it was at a past time.
+type TimeBoundedSnapshotGetter interface {
+	GetSnapshotUntil(ctx context.Context, aggregateID string, at time.Time) (Snapshot, error)
+}
+
+// TimeBoundedEventsGetter is implemented by repositories that can get the events of an aggregate created until, and including, a time.
+// It is used to rehydrate an aggregate as it was at a past time.
+type TimeBoundedEventsGetter interface {
+	GetAggregateEventsUntil(ctx context.Context, aggregateID string, snapVersion int, at time.Time) ([]Event, error)
+}
+
+type EsRepository interface {
+	SnapshotStore
+	SaveEvent(ctx context.Context, eRec EventRecord) (id eventid.EventID, version uint32, err error)
 	GetAggregateEvents(ctx context.Context, aggregateID string, snapVersion int) ([]Event, error)
 	HasIdempotencyKey(ctx context.Context, idempotencyKey string) (bool, error)
 	Forget(ctx context.Context, request ForgetRequest, forget func(kind string, body []byte) ([]byte, error)) error
 }
 
+// AggregateIdempotencyKeyChecker is implemented by repositories that can check idempotency keys scoped by aggregate ID
+type AggregateIdempotencyKeyChecker interface {
+	HasAggregateIdempotencyKey(ctx context.Context, aggregateID, idempotencyKey string) (bool, error)
+}
+
+// ForgetPreviewer is implemented by repositories that can list the events and snapshots that Forget would change
+type ForgetPreviewer interface {
+	PreviewForget(ctx context.Context, request ForgetRequest) (ForgetPreview, error)
+}
+
+// StatsGetter is implemented by repositories that can compute the statistics of the stored events
+type StatsGetter interface {
+	Stats(ctx context.Context) (StoreStats, error)
+}
+
+// EventsStats are the statistics of a set of events. The IDs and times are zero if there are no events.
+type EventsStats struct {
+	Events       int64
+	FirstEventID eventid.EventID
+	LastEventID  eventid.EventID
+	Oldest       time.Time
+	Newest       time.Time
+}
+
+// add merges the statistics of other into s
+func (s EventsStats) add(other EventsStats) EventsStats {
+	if other.Events == 0 {
+		return s
+	}
+	if s.Events == 0 {
+		return other
+	}
+	s.Events += other.Events
+	if other.FirstEventID.Compare(s.FirstEventID) < 0 {
+		s.FirstEventID = other.FirstEventID
+	}
+	if other.LastEventID.Compare(s.LastEventID) > 0 {
+		s.LastEventID = other.LastEventID
+	}
+	if other.Oldest.Before(s.Oldest) {
+		s.Oldest = other.Oldest
+	}
+	if other.Newest.After(s.Newest) {
+		s.Newest = other.Newest
+	}
+	return s
+}
+
+// StoreStats are the statistics of all the events in the store, and for each aggregate type
+type StoreStats struct {
+	EventsStats
+	ByAggregateType map[AggregateType]EventsStats
+}
+
+// NewStoreStats creates the store statistics from the statistics of each aggregate type
+func NewStoreStats(byAggregateType map[AggregateType]EventsStats) StoreStats {
+	stats := StoreStats{
+		ByAggregateType: byAggregateType,
+	}
+	if stats.ByAggregateType == nil {
+		stats.ByAggregateType = map[AggregateType]EventsStats{}
+	}
+	for _, s := range stats.ByAggregateType {
+		stats.EventsStats = stats.EventsStats.add(s)
+	}
+	return stats
+}
+
 type EventRecord struct {
 	AggregateID    string
 	Version        uint32
 	AggregateType  AggregateType
 	IdempotencyKey string
-	Labels         map[string]interface{}
-	CreatedAt      time.Time
-	Details        []EventRecordDetail
+	// IdempotencyScope is where the idempotency key must be unique.
+	// Repositories relying on database indexes enforce the scope of their unique index.
+	IdempotencyScope IdempotencyScope
+	Labels           map[string]interface{}
+	CreatedAt        time.Time
+	// ContentType identifies the codec used to encode the bodies
+	ContentType string
+	// TenantID is the tenant of the context, set with WithTenant. Multi tenant repositories require it.
+	TenantID string
+	Details  []EventRecordDetail
 }
 
 type EventRecordDetail struct {
 	Kind EventKind
 	Body []byte
+	// EventVersion is the schema version of the event, 1 for events not implementing EventVersioner
+	EventVersion uint16
 }
 
 type Options struct {
@@ -140,12 +391,35 @@ var _ EventStorer = (*EventStore)(nil)
 
 type EsOptions func(*EventStore)
 
+// WithFactory sets the factory that instantiates the aggregates and events, replacing the one passed to NewEventStore
+func WithFactory(factory Factory) EsOptions {
+	return func(r *EventStore) {
+		r.factory = factory
+	}
+}
+
 func WithCodec(codec Codec) EsOptions {
 	return func(r *EventStore) {
 		r.codec = codec
 	}
 }
 
+// WithCodecFor sets the codec used to encode and decode the events and snapshots of the aggregate type,
+// overriding the codec set by WithCodec.
+func WithCodecFor(aggregateType AggregateType, codec Codec) EsOptions {
+	return func(r *EventStore) {
+		r.codecs[aggregateType] = codec
+	}
+}
+
+// WithDecoder registers a decoder for the events saved with a content type other than the one of the current codec.
+// This allows to migrate to a different codec while still being able to read the events encoded with the previous one.
+func WithDecoder(contentType string, decoder Decoder) EsOptions {
+	return func(r *EventStore) {
+		r.decoders[contentType] = decoder
+	}
+}
+
 func WithUpcaster(upcaster Upcaster) EsOptions {
 	return func(r *EventStore) {
 		r.upcaster = upcaster
@@ -158,13 +432,197 @@ func WithSnapshotThreshold(snapshotThreshold uint32) EsOptions {
 	}
 }
 
+// WithMaxBodySize makes Save fail with ErrEventTooLarge if the encoded body of any event exceeds the size, in bytes.
+// Zero, the default, means no limit.
+func WithMaxBodySize(size int) EsOptions {
+	return func(r *EventStore) {
+		r.maxBodySize = size
+	}
+}
+
+// WithIdempotencyScope sets where the idempotency keys must be unique. The default is IdempotencyScopeGlobal.
+// For the SQL and MongoDB repositories, the unique index on the idempotency key must match the scope.
+func WithIdempotencyScope(scope IdempotencyScope) EsOptions {
+	return func(r *EventStore) {
+		r.idempotencyScope = scope
+	}
+}
+
+// WithReadTrailingLag makes GetByID ignore the events, and snapshots, created less than the lag ago,
+// like the trailing lag of the feeds, so that with concurrent writers and clock skews an aggregate
+// is not rehydrated with events that may still be committing out of order.
+// A writer will not see its own changes until the lag has passed, but Exec always reads everything.
+// Zero, the default, reads everything.
+func WithReadTrailingLag(lag time.Duration) EsOptions {
+	return func(r *EventStore) {
+		r.readTrailingLag = lag
+	}
+}
+
+// WithSnapshotStore sets where the snapshots are kept. By default they are kept in the events repository.
+func WithSnapshotStore(snapshotStore SnapshotStore) EsOptions {
+	return func(r *EventStore) {
+		r.snapshotStore = snapshotStore
+	}
+}
+
+// WithSnapshotPruning deletes the superseded snapshots of an aggregate after saving a new one, keeping the latest keepLast.
+// It only applies if the snapshot store implements SnapshotPruner. Since snapshots are disposable, a failure to prune is only logged.
+func WithSnapshotPruning(keepLast int) EsOptions {
+	return func(r *EventStore) {
+		if keepLast > 0 {
+			r.snapshotKeepLast = keepLast
+		}
+	}
+}
+
+func WithLogger(logger log.Logger) EsOptions {
+	return func(r *EventStore) {
+		r.logger = logger
+	}
+}
+
+// WithAsyncSnapshots makes the snapshots to be written in the background by a pool of workers,
+// fed by a queue with the provided buffer size. If the queue is full, Save will block until there is room.
+//
+// The snapshot is still serialized synchronously, but the write happens after Save returns,
+// so a GetByID issued right after may not see the latest snapshot, and will replay more events.
+// Since snapshots are only an optimization, the loaded aggregate is always consistent.
+// Snapshots still in the queue are lost if the process stops without calling Close.
+// A snapshot that can't be queued, after Close or when the context of Save is done while waiting for room,
+// doesn't fail Save, since the events are already saved. It is logged and reported to the SnapshotFailureRecorder.
+// A negative buffer is the same as zero, an unbuffered queue.
+func WithAsyncSnapshots(workers int, buffer int) EsOptions {
+	return func(r *EventStore) {
+		if buffer < 0 {
+			buffer = 0
+		}
+		r.snapshotWorkers = workers
+		r.snapshotBuffer = buffer
+	}
+}
+
+// BeforeSaveHook is called before saving an aggregate. The options can be changed and returning an error aborts the save.
+type BeforeSaveHook func(ctx context.Context, aggregate Aggregater, opts *Options) error
+
+// AfterSaveHook is called after the events of an aggregate are committed.
+// If the repository does not implement EventIDsSaver, only the last event has its ID set.
+type AfterSaveHook func(ctx context.Context, aggregate Aggregater, events []Event) error
+
+// WithBeforeSave adds a hook that is called before each save. Hooks are called in the order they were added.
+func WithBeforeSave(hook BeforeSaveHook) EsOptions {
+	return func(r *EventStore) {
+		r.beforeSave = append(r.beforeSave, hook)
+	}
+}
+
+// WithAfterSave adds a hook that is called after each successful save. Hooks are called in the order they were added.
+// Since the events are already committed, an error returned by a hook does not undo the save.
+func WithAfterSave(hook AfterSaveHook) EsOptions {
+	return func(r *EventStore) {
+		r.afterSave = append(r.afterSave, hook)
+	}
+}
+
+// EventDispatcher hands over the saved events, eg: to an in-process bus, without waiting for a feed
+type EventDispatcher func(ctx context.Context, events []Event) error
+
+// WithEventDispatcher adds a dispatcher that is called with the saved events after each successful save, like a hook added with WithAfterSave.
+// Since the events are already committed, a failed dispatch does not undo the save,
+// but Save returns an error matching ErrDispatchFailed, so that it can be told apart from a failed save.
+func WithEventDispatcher(dispatcher EventDispatcher) EsOptions {
+	return WithAfterSave(func(ctx context.Context, _ Aggregater, events []Event) error {
+		if err := dispatcher(ctx, events); err != nil {
+			return WrapCause(ErrDispatchFailed, err)
+		}
+		return nil
+	})
+}
+
+// StaleSnapshotHandler is called when an aggregate is loaded with a snapshot that is too far behind the current version
+type StaleSnapshotHandler func(aggregateID string, snapshotVersion, currentVersion uint32)
+
+// WithStaleSnapshotThreshold logs a warning, when loading an aggregate, if the number of events applied after the snapshot
+// is above the threshold. This usually means that snapshotting is not working.
+// An optional handler can be supplied to, for example, collect metrics.
+func WithStaleSnapshotThreshold(threshold uint32, handler StaleSnapshotHandler) EsOptions {
+	return func(r *EventStore) {
+		r.staleSnapshotThreshold = threshold
+		r.staleSnapshotHandler = handler
+	}
+}
+
+// WithRetryBackOff sets the policy used by ExecRetry to wait between attempts.
+// By default, it is an exponential backoff starting at 10ms.
+func WithRetryBackOff(factory func() backoff.BackOff) EsOptions {
+	return func(r *EventStore) {
+		r.retryBackOff = factory
+	}
+}
+
+func defaultRetryBackOff() backoff.BackOff {
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = 10 * time.Millisecond
+	b.MaxInterval = time.Second
+	// the number of attempts is what limits the retries
+	b.MaxElapsedTime = 0
+	return b
+}
+
+// WithMetadataFromContext sets a function that extracts, from the context, metadata to be added to every saved event,
+// eg: trace or user IDs. The metadata set with WithMetadata, when saving, takes precedence.
+func WithMetadataFromContext(fn func(ctx context.Context) map[string]interface{}) EsOptions {
+	return func(r *EventStore) {
+		r.metadataFromContext = fn
+	}
+}
+
+// mergeMetadata returns a new map with the entries of both maps, where the entries of the second win
+func mergeMetadata(m1, m2 map[string]interface{}) map[string]interface{} {
+	if len(m1) == 0 {
+		return m2
+	}
+	m := make(map[string]interface{}, len(m1)+len(m2))
+	for k, v := range m1 {
+		m[k] = v
+	}
+	for k, v := range m2 {
+		m[k] = v
+	}
+	return m
+}
+
 // EventStore represents the event store
 type EventStore struct {
-	store             EsRepository
-	snapshotThreshold uint32
-	upcaster          Upcaster
-	factory           Factory
-	codec             Codec
+	store                  EsRepository
+	snapshotStore          SnapshotStore
+	snapshotThreshold      uint32
+	snapshotPolicy         SnapshotPolicy
+	upcaster               Upcaster
+	factory                Factory
+	codec                  Codec
+	codecs                 map[AggregateType]Codec
+	decoders               map[string]Decoder
+	cryptor                Cryptor
+	cryptKeyID             string
+	cryptors               map[string]Cryptor
+	keyStore               KeyStore
+	logger                 log.Logger
+	snapshotWorkers        int
+	staleSnapshotThreshold uint32
+	staleSnapshotHandler   StaleSnapshotHandler
+	beforeSave             []BeforeSaveHook
+	afterSave              []AfterSaveHook
+	snapshotBuffer         int
+	snapshotKeepLast       int
+	snapshotter            *asyncSnapshotter
+	retryBackOff           func() backoff.BackOff
+	metadataFromContext    func(ctx context.Context) map[string]interface{}
+	tracer                 trace.Tracer
+	recorder               Recorder
+	readTrailingLag        time.Duration
+	maxBodySize            int
+	idempotencyScope       IdempotencyScope
 }
 
 // NewEventStore creates a new instance of ESPostgreSQL
@@ -174,18 +632,48 @@ func NewEventStore(repo EsRepository, factory Factory, options ...EsOptions) Eve
 		snapshotThreshold: 100,
 		factory:           factory,
 		codec:             JSONCodec{},
+		codecs:            map[AggregateType]Codec{},
+		decoders:          map[string]Decoder{},
+		cryptors:          map[string]Cryptor{},
+		logger:            log.NopLogger{},
+		retryBackOff:      defaultRetryBackOff,
 	}
 	for _, v := range options {
 		v(&es)
 	}
+	if es.snapshotStore == nil {
+		es.snapshotStore = repo
+	}
+	if es.recorder == nil {
+		es.recorder = nopRecorder{}
+	}
+	if es.snapshotPolicy == nil {
+		es.snapshotPolicy = EventsThresholdPolicy(es.snapshotThreshold)
+	}
+	if es.snapshotWorkers > 0 {
+		es.snapshotter = newAsyncSnapshotter(es.logger, es.recorder, es.saveSnapshot, es.snapshotWorkers, es.snapshotBuffer)
+	}
 	return es
 }
 
+// Close waits for the pending asynchronous snapshots to be written.
+// After Close, the snapshots are no longer written, and Save only logs and reports them to the SnapshotFailureRecorder.
+func (es EventStore) Close(ctx context.Context) error {
+	if es.snapshotter == nil {
+		return nil
+	}
+	return es.snapshotter.close(ctx)
+}
+
 // Exec loads the aggregate from the event store and handles it to the handler function, saving the returning Aggregater in the event store.
 // If no aggregate is found for the provided ID the error ErrUnknownAggregateID is returned.
 // If the handler function returns nil for the Aggregater or an error, the save action is ignored.
-func (es EventStore) Exec(ctx context.Context, id string, do func(Aggregater) (Aggregater, error), options ...SaveOption) error {
-	a, err := es.GetByID(ctx, id)
+func (es EventStore) Exec(ctx context.Context, id string, do func(Aggregater) (Aggregater, error), options ...SaveOption) (err error) {
+	ctx, _, end := es.startSpan(ctx, "EventStore.Exec", attrAggregateID.String(id))
+	defer func() { end(err) }()
+
+	// the trailing lag is ignored, since saving from a stale aggregate would only fail
+	a, err := es.getByID(ctx, id, 0)
 	if err != nil {
 		return err
 	}
@@ -203,50 +691,341 @@ func (es EventStore) Exec(ctx context.Context, id string, do func(Aggregater) (A
 	return es.Save(ctx, a, options...)
 }
 
+// ExecRetry calls Exec and, if the save fails with ErrConcurrentModification, reloads the aggregate and calls the handler function again,
+// making at most maxAttempts, with a backoff between them. The error of the last attempt is returned.
+// A repeated idempotency key fails with ErrDuplicateIdempotencyKey, and it is not retried, since the operation was already done.
+func (es EventStore) ExecRetry(ctx context.Context, id string, maxAttempts int, do func(Aggregater) (Aggregater, error), options ...SaveOption) error {
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	b := backoff.WithContext(backoff.WithMaxRetries(es.retryBackOff(), uint64(maxAttempts-1)), ctx)
+	return backoff.Retry(func() error {
+		err := es.Exec(ctx, id, do, options...)
+		if err != nil && !errors.Is(err, ErrConcurrentModification) {
+			return backoff.Permanent(err)
+		}
+		return err
+	}, b)
+}
+
 func (es EventStore) GetByID(ctx context.Context, aggregateID string) (Aggregater, error) {
-	snap, err := es.store.GetSnapshot(ctx, aggregateID)
+	return es.getByID(ctx, aggregateID, es.readTrailingLag)
+}
+
+// GetByIDUsing is like GetByID, but the aggregate and its events are instantiated by the factory,
+// eg: when aggregates of different bounded contexts, with their own factories, share the same repository.
+func (es EventStore) GetByIDUsing(ctx context.Context, aggregateID string, factory Factory) (Aggregater, error) {
+	es.factory = factory
+	return es.getByID(ctx, aggregateID, es.readTrailingLag)
+}
+
+func (es EventStore) getByID(ctx context.Context, aggregateID string, trailingLag time.Duration) (_ Aggregater, err error) {
+	ctx, span, end := es.startSpan(ctx, "EventStore.GetByID", attrAggregateID.String(aggregateID))
+	defer func() { end(err) }()
+
+	start := time.Now()
+	replayed := 0
+
+	var snap Snapshot
+	var events []Event
+	// streaming keeps the memory bounded, so it is preferred to loading all the events in a single round trip
+	_, stream := es.store.(EventStreamer)
+	loader, load := es.store.(AggregateLoader)
+	load = load && !stream && es.snapshotStore == SnapshotStore(es.store)
+	switch {
+	case trailingLag > 0:
+		snap, events, err = es.getUntil(ctx, aggregateID, time.Now().Add(-trailingLag))
+		load = true
+	case load:
+		snap, events, err = es.loadAggregate(ctx, loader, aggregateID)
+	default:
+		snap, err = es.getSnapshot(ctx, aggregateID)
+	}
 	if err != nil {
 		return nil, err
 	}
 	var aggregate Aggregater
 	if len(snap.Body) != 0 {
-		aggregate, err = es.RehydrateAggregate(snap.AggregateType, snap.Body)
+		aggregate, err = es.rehydrateAggregate(ctx, snap.AggregateType, snap.Body)
 		if err != nil {
 			return nil, err
 		}
 		aggregate.SetVersion(snap.AggregateVersion)
 		aggregate.SetUpdatedAt(snap.CreatedAt)
+		setSnapshotAt(aggregate, snap.CreatedAt)
+	}
+
+	snapVersion := -1
+	if snap.AggregateID != "" {
+		snapVersion = int(snap.AggregateVersion)
 	}
 
+	apply := func(v Event) error {
+		// if the aggregate was not instantiated because the snap was not found
+		if aggregate == nil {
+			a, err := es.RehydrateAggregate(v.AggregateType, nil)
+			if err != nil {
+				return err
+			}
+			aggregate = a.(Aggregater)
+		}
+		replayed++
+		return es.applyChangeFromHistory(ctx, aggregate, v)
+	}
+
+	if streamer, ok := es.store.(EventStreamer); ok && !load {
+		err = es.streamEvents(ctx, streamer, aggregateID, snapVersion, apply)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if !load {
+			events, err = es.getAggregateEvents(ctx, aggregateID, snapVersion)
+			if err != nil {
+				return nil, err
+			}
+		}
+		for _, v := range events {
+			if err := apply(v); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if aggregate != nil {
+		es.checkStaleSnapshot(aggregateID, snap.AggregateVersion, aggregate.GetVersion())
+		span.SetAttributes(
+			attrAggregateType.String(aggregate.GetType()),
+			attrAggregateVersion.Int64(int64(aggregate.GetVersion())),
+		)
+		es.recorder.AggregateLoaded(aggregate.GetType(), time.Since(start), replayed)
+	}
+
+	return aggregate, nil
+}
+
+// GetByIDAt rehydrates the aggregate as it was at the version, for debugging and audit.
+// It starts from the newest snapshot not exceeding the version and applies the events up to, and including, the version.
+// It fails with ErrUnknownAggregateVersion if the version is higher than the current version of the aggregate.
+func (es EventStore) GetByIDAt(ctx context.Context, aggregateID string, version uint32) (_ Aggregater, err error) {
+	ctx, _, end := es.startSpan(ctx, "EventStore.GetByIDAt",
+		attrAggregateID.String(aggregateID),
+		attrAggregateVersion.Int64(int64(version)),
+	)
+	defer func() { end(err) }()
+
+	var snap Snapshot
+	if getter, ok := es.snapshotStore.(BoundedSnapshotGetter); ok {
+		snap, err = getter.GetSnapshotUpTo(ctx, aggregateID, version)
+	} else {
+		snap, err = es.snapshotStore.GetSnapshot(ctx, aggregateID)
+		if snap.AggregateVersion > version {
+			snap = Snapshot{}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	snapVersion := snapshotVersion(snap)
 	var events []Event
-	if snap.AggregateID == "" {
-		events, err = es.store.GetAggregateEvents(ctx, aggregateID, -1)
+	if getter, ok := es.store.(BoundedEventsGetter); ok {
+		events, err = getter.GetAggregateEventsUpTo(ctx, aggregateID, snapVersion, version)
 	} else {
-		events, err = es.store.GetAggregateEvents(ctx, aggregateID, int(snap.AggregateVersion))
+		events, err = es.store.GetAggregateEvents(ctx, aggregateID, snapVersion)
+		events = filterEvents(events, func(e Event) bool {
+			return e.AggregateVersion <= version
+		})
 	}
 	if err != nil {
 		return nil, err
 	}
 
-	for _, v := range events {
-		// if the aggregate was not instantiated because the snap was not found
+	aggregate, err := es.rehydrateFromSnapshot(ctx, snap, events)
+	if err != nil {
+		return nil, err
+	}
+	if aggregate == nil {
+		return nil, faults.Errorf("%w: %s", ErrUnknownAggregateID, aggregateID)
+	}
+	if aggregate.GetVersion() < version {
+		return nil, faults.Errorf("%w: aggregate %s is at version %d, below %d", ErrUnknownAggregateVersion, aggregateID, aggregate.GetVersion(), version)
+	}
+	return aggregate, nil
+}
+
+// GetByIDAtTime rehydrates the aggregate as it was at the time, for compliance reporting.
+// It starts from the newest snapshot created until then and applies the events created until then.
+// Beware that the time of an event is the clock of the service that saved it, not a logical time of the domain,
+// so clock skews between services can misplace events saved close to each other.
+// It fails with ErrUnknownAggregateID if the aggregate did not exist at the time.
+func (es EventStore) GetByIDAtTime(ctx context.Context, aggregateID string, at time.Time) (_ Aggregater, err error) {
+	ctx, _, end := es.startSpan(ctx, "EventStore.GetByIDAtTime",
+		attrAggregateID.String(aggregateID),
+		attrAt.String(at.Format(time.RFC3339Nano)),
+	)
+	defer func() { end(err) }()
+
+	snap, events, err := es.getUntil(ctx, aggregateID, at)
+	if err != nil {
+		return nil, err
+	}
+
+	aggregate, err := es.rehydrateFromSnapshot(ctx, snap, events)
+	if err != nil {
+		return nil, err
+	}
+	if aggregate == nil {
+		return nil, faults.Errorf("%w: %s at %s", ErrUnknownAggregateID, aggregateID, at)
+	}
+	return aggregate, nil
+}
+
+// getUntil gets the newest snapshot created until the time and the events, after it, created until the time
+func (es EventStore) getUntil(ctx context.Context, aggregateID string, at time.Time) (Snapshot, []Event, error) {
+	var snap Snapshot
+	var err error
+	if getter, ok := es.snapshotStore.(TimeBoundedSnapshotGetter); ok {
+		snap, err = getter.GetSnapshotUntil(ctx, aggregateID, at)
+	} else {
+		snap, err = es.snapshotStore.GetSnapshot(ctx, aggregateID)
+		if snap.CreatedAt.After(at) {
+			snap = Snapshot{}
+		}
+	}
+	if err != nil {
+		return Snapshot{}, nil, err
+	}
+
+	snapVersion := snapshotVersion(snap)
+	var events []Event
+	if getter, ok := es.store.(TimeBoundedEventsGetter); ok {
+		events, err = getter.GetAggregateEventsUntil(ctx, aggregateID, snapVersion, at)
+	} else {
+		events, err = es.store.GetAggregateEvents(ctx, aggregateID, snapVersion)
+		events = filterEvents(events, func(e Event) bool {
+			return !e.CreatedAt.After(at)
+		})
+	}
+	if err != nil {
+		return Snapshot{}, nil, err
+	}
+	return snap, events, nil
+}
+
+func snapshotVersion(snap Snapshot) int {
+	if snap.AggregateID == "" {
+		return -1
+	}
+	return int(snap.AggregateVersion)
+}
+
+func filterEvents(events []Event, keep func(Event) bool) []Event {
+	var filtered []Event
+	for _, e := range events {
+		if keep(e) {
+			filtered = append(filtered, e)
+		}
+	}
+	return filtered
+}
+
+// rehydrateFromSnapshot creates the aggregate from the snapshot, if any, and applies the events.
+// If there is no snapshot and no events, it returns nil.
+func (es EventStore) rehydrateFromSnapshot(ctx context.Context, snap Snapshot, events []Event) (Aggregater, error) {
+	var aggregate Aggregater
+	if len(snap.Body) != 0 {
+		a, err := es.rehydrateAggregate(ctx, snap.AggregateType, snap.Body)
+		if err != nil {
+			return nil, err
+		}
+		a.SetVersion(snap.AggregateVersion)
+		a.SetUpdatedAt(snap.CreatedAt)
+		setSnapshotAt(a, snap.CreatedAt)
+		aggregate = a
+	}
+
+	for _, e := range events {
 		if aggregate == nil {
-			a, err := es.RehydrateAggregate(v.AggregateType, nil)
+			a, err := es.RehydrateAggregate(e.AggregateType, nil)
 			if err != nil {
 				return nil, err
 			}
-			aggregate = a.(Aggregater)
+			aggregate = a
 		}
-		if err := es.ApplyChangeFromHistory(aggregate, v); err != nil {
+		if err := es.applyChangeFromHistory(ctx, aggregate, e); err != nil {
 			return nil, err
 		}
 	}
-
 	return aggregate, nil
 }
 
+func (es EventStore) getSnapshot(ctx context.Context, aggregateID string) (_ Snapshot, err error) {
+	ctx, _, end := es.startSpan(ctx, "SnapshotStore.GetSnapshot", attrAggregateID.String(aggregateID))
+	defer func() { end(err) }()
+
+	return es.snapshotStore.GetSnapshot(ctx, aggregateID)
+}
+
+func (es EventStore) loadAggregate(ctx context.Context, loader AggregateLoader, aggregateID string) (_ Snapshot, _ []Event, err error) {
+	ctx, span, end := es.startSpan(ctx, "EsRepository.LoadAggregate", attrAggregateID.String(aggregateID))
+	defer func() { end(err) }()
+
+	snap, events, err := loader.LoadAggregate(ctx, aggregateID)
+	span.SetAttributes(attrEventCount.Int(len(events)))
+	return snap, events, err
+}
+
+func (es EventStore) getAggregateEvents(ctx context.Context, aggregateID string, snapVersion int) (_ []Event, err error) {
+	ctx, span, end := es.startSpan(ctx, "EsRepository.GetAggregateEvents", attrAggregateID.String(aggregateID))
+	defer func() { end(err) }()
+
+	events, err := es.store.GetAggregateEvents(ctx, aggregateID, snapVersion)
+	span.SetAttributes(attrEventCount.Int(len(events)))
+	return events, err
+}
+
+// streamEvents applies the streamed events. Since the events are applied as they arrive, the span also includes the time applying them.
+func (es EventStore) streamEvents(ctx context.Context, streamer EventStreamer, aggregateID string, snapVersion int, apply func(Event) error) (err error) {
+	ctx, span, end := es.startSpan(ctx, "EsRepository.GetAggregateEventsStream", attrAggregateID.String(aggregateID))
+	defer func() { end(err) }()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	count := 0
+	events, errCh := streamer.GetAggregateEventsStream(ctx, aggregateID, snapVersion)
+	for v := range events {
+		if err := apply(v); err != nil {
+			return err
+		}
+		count++
+	}
+	span.SetAttributes(attrEventCount.Int(count))
+	return <-errCh
+}
+
+func (es EventStore) checkStaleSnapshot(aggregateID string, snapshotVersion, currentVersion uint32) {
+	if es.staleSnapshotThreshold == 0 || currentVersion-snapshotVersion <= es.staleSnapshotThreshold {
+		return
+	}
+
+	es.logger.WithTags(log.Tags{
+		"aggregateID":     aggregateID,
+		"snapshotVersion": snapshotVersion,
+		"currentVersion":  currentVersion,
+	}).Warnf("Snapshot is %d versions behind, above the threshold of %d", currentVersion-snapshotVersion, es.staleSnapshotThreshold)
+
+	if es.staleSnapshotHandler != nil {
+		es.staleSnapshotHandler(aggregateID, snapshotVersion, currentVersion)
+	}
+}
+
 func (es EventStore) ApplyChangeFromHistory(agg Aggregater, e Event) error {
-	evt, err := es.RehydrateEvent(e.Kind, e.Body)
+	return es.applyChangeFromHistory(context.Background(), agg, e)
+}
+
+func (es EventStore) applyChangeFromHistory(ctx context.Context, agg Aggregater, e Event) error {
+	evt, err := es.RehydrateEventOf(ctx, e)
 	if err != nil {
 		return err
 	}
@@ -258,13 +1037,74 @@ func (es EventStore) ApplyChangeFromHistory(agg Aggregater, e Event) error {
 }
 
 func (es EventStore) RehydrateAggregate(aggregateType AggregateType, body []byte) (Aggregater, error) {
-	return RehydrateAggregate(es.factory, es.codec, es.upcaster, aggregateType, body)
+	return es.rehydrateAggregate(context.Background(), aggregateType, body)
 }
 
+func (es EventStore) rehydrateAggregate(ctx context.Context, aggregateType AggregateType, body []byte) (Aggregater, error) {
+	body, err := es.decrypt(ctx, body)
+	if err != nil {
+		return nil, err
+	}
+	return RehydrateAggregate(es.factory, es.codecFor(aggregateType), es.upcaster, aggregateType, body)
+}
+
+// RehydrateEvent decodes the body of an event with the global codec only.
+// Events of aggregate types with a codec of their own, set with WithCodecFor, or encoded by another codec,
+// should be rehydrated with RehydrateEventOf.
 func (es EventStore) RehydrateEvent(kind EventKind, body []byte) (Typer, error) {
+	body, err := es.decrypt(context.Background(), body)
+	if err != nil {
+		return nil, err
+	}
 	return RehydrateEvent(es.factory, es.codec, es.upcaster, kind, body)
 }
 
+// RehydrateEventOf decodes a stored event, eg: received by a projection from a feed,
+// with the codec of its aggregate type or the decoder of its content type, upcasting it from its event version.
+func (es EventStore) RehydrateEventOf(ctx context.Context, e Event) (Typer, error) {
+	decoder, err := es.decoder(e.AggregateType, e.ContentType)
+	if err != nil {
+		return nil, err
+	}
+	body, err := es.decrypt(ctx, e.Body)
+	if err != nil {
+		return nil, err
+	}
+	return RehydrateEventVersion(es.factory, decoder, es.upcaster, e.Kind, e.EventVersion, body)
+}
+
+// codecFor returns the codec of the aggregate type, falling back to the global codec
+func (es EventStore) codecFor(aggregateType AggregateType) Codec {
+	if codec, ok := es.codecs[aggregateType]; ok {
+		return codec
+	}
+	return es.codec
+}
+
+// decoder returns the decoder for the content type of an event of the aggregate type.
+// Events without content type are considered to be encoded with the current codec of the aggregate type.
+func (es EventStore) decoder(aggregateType AggregateType, contentType string) (Decoder, error) {
+	codec := es.codecFor(aggregateType)
+	if contentType == "" || contentType == contentTypeOf(codec) {
+		return codec, nil
+	}
+	if contentType == contentTypeOf(es.codec) {
+		return es.codec, nil
+	}
+	decoder, ok := es.decoders[contentType]
+	if !ok {
+		return nil, faults.Errorf("No decoder registered for content type '%s'", contentType)
+	}
+	return decoder, nil
+}
+
+func contentTypeOf(codec Codec) string {
+	if ct, ok := codec.(ContentTyper); ok {
+		return ct.ContentType()
+	}
+	return ""
+}
+
 // Save saves the events of the aggregater into the event store
 func (es EventStore) Save(ctx context.Context, aggregate Aggregater, options ...SaveOption) (err error) {
 	events := aggregate.GetEvents()
@@ -272,12 +1112,36 @@ func (es EventStore) Save(ctx context.Context, aggregate Aggregater, options ...
 	if eventsLen == 0 {
 		return nil
 	}
+	// the repositories number the new events after the aggregate version,
+	// so a version raised after the events were applied would leave a gap in the versions.
+	// A version lowered, eg: to the version expected by the caller, overlaps the saved versions and fails with ErrConcurrentModification.
+	if cv, ok := aggregate.(ChangesVersioner); ok && aggregate.GetVersion() > cv.GetChangesVersion() {
+		return faults.Errorf("%w: aggregate %s has version %d, but its new events follow version %d",
+			ErrVersionGap, aggregate.GetID(), aggregate.GetVersion(), cv.GetChangesVersion())
+	}
+
+	ctx, span, end := es.startSpan(ctx, "EventStore.Save",
+		attrAggregateID.String(aggregate.GetID()),
+		attrAggregateType.String(aggregate.GetType()),
+		attrEventCount.Int(eventsLen),
+	)
+	defer func() { end(err) }()
 
 	opts := Options{}
 	for _, fn := range options {
 		fn(&opts)
 	}
 
+	if es.metadataFromContext != nil {
+		opts.Labels = mergeMetadata(es.metadataFromContext(ctx), opts.Labels)
+	}
+
+	for _, hook := range es.beforeSave {
+		if err := hook(ctx, aggregate, &opts); err != nil {
+			return err
+		}
+	}
+
 	now := time.Now().UTC()
 	// we only need millisecond precision
 	now = now.Truncate(time.Millisecond)
@@ -291,62 +1155,177 @@ func (es EventStore) Save(ctx context.Context, aggregate Aggregater, options ...
 	}
 
 	tName := aggregate.GetType()
+	codec := es.codecFor(AggregateType(tName))
 	details := make([]EventRecordDetail, eventsLen)
 	for i := 0; i < eventsLen; i++ {
 		e := events[i]
-		body, err := es.codec.Encode(e)
+		body, err := codec.Encode(e)
+		if err != nil {
+			return err
+		}
+		es.recorder.EventBodySize(tName, len(body))
+		if es.maxBodySize > 0 && len(body) > es.maxBodySize {
+			return faults.Errorf("%w: event %s of aggregate %s has %d bytes, above the limit of %d", ErrEventTooLarge, e.GetType(), aggregate.GetID(), len(body), es.maxBodySize)
+		}
+		body, err = es.encrypt(ctx, aggregate.GetID(), body)
 		if err != nil {
 			return err
 		}
 		details[i] = EventRecordDetail{
-			Kind: EventKind(e.GetType()),
-			Body: body,
+			Kind:         EventKind(e.GetType()),
+			Body:         body,
+			EventVersion: eventVersion(e),
 		}
 	}
 
 	rec := EventRecord{
-		AggregateID:    aggregate.GetID(),
-		Version:        aggregate.GetVersion(),
-		AggregateType:  AggregateType(tName),
-		IdempotencyKey: opts.IdempotencyKey,
-		Labels:         opts.Labels,
-		CreatedAt:      now,
-		Details:        details,
+		AggregateID:      aggregate.GetID(),
+		Version:          aggregate.GetVersion(),
+		AggregateType:    AggregateType(tName),
+		IdempotencyKey:   opts.IdempotencyKey,
+		IdempotencyScope: es.idempotencyScope,
+		Labels:           opts.Labels,
+		CreatedAt:        now,
+		ContentType:      contentTypeOf(codec),
+		TenantID:         TenantOf(ctx),
+		Details:          details,
 	}
 
-	id, lastVersion, err := es.store.SaveEvent(ctx, rec)
+	ids, lastVersion, err := es.saveEvent(ctx, rec)
 	if err != nil {
+		if errors.Is(err, ErrConcurrentModification) {
+			es.recorder.ConcurrencyConflict(tName)
+		}
 		return err
 	}
+	es.recorder.EventsSaved(tName, eventsLen)
 	aggregate.SetVersion(lastVersion)
+	span.SetAttributes(attrAggregateVersion.Int64(int64(lastVersion)))
 
-	eventsCounter := aggregate.GetEventsCounter()
-	if eventsCounter >= es.snapshotThreshold {
-		body, err := es.codec.Encode(aggregate)
-		if err != nil {
-			return faults.Errorf("Failed to create serialize snapshot: %w", err)
+	if es.snapshotPolicy.ShouldSnapshot(aggregate, lastSnapshotAt(aggregate)) {
+		// the events are already committed, so a snapshot that fails is only reported
+		if err := es.snapshot(ctx, codec, aggregate, ids[len(ids)-1]); err != nil {
+			es.logger.WithTags(log.Tags{
+				"aggregateID": aggregate.GetID(),
+				"version":     aggregate.GetVersion(),
+			}).WithError(err).Warn("Failed to snapshot")
+			if r, ok := es.recorder.(SnapshotFailureRecorder); ok {
+				r.SnapshotFailed(tName)
+			}
 		}
+	}
+
+	aggregate.ClearEvents()
 
-		snap := Snapshot{
-			ID:               id,
-			AggregateID:      aggregate.GetID(),
-			AggregateVersion: aggregate.GetVersion(),
-			AggregateType:    AggregateType(aggregate.GetType()),
-			Body:             body,
-			CreatedAt:        time.Now().UTC(),
+	if len(es.afterSave) > 0 {
+		hasher, _ := es.store.(AggregateHasher)
+		saved := savedEvents(rec, ids, lastVersion, hasher)
+		for _, hook := range es.afterSave {
+			if err := hook(ctx, aggregate, saved); err != nil {
+				return err
+			}
 		}
+	}
+
+	return nil
+}
+
+// snapshot saves, or queues with asynchronous snapshots, the snapshot of the aggregate, identified by the last saved event
+func (es EventStore) snapshot(ctx context.Context, codec Codec, aggregate Aggregater, id eventid.EventID) error {
+	body, err := codec.Encode(aggregate)
+	if err != nil {
+		return faults.Errorf("Failed to create serialize snapshot: %w", err)
+	}
+	body, err = es.encrypt(ctx, aggregate.GetID(), body)
+	if err != nil {
+		return err
+	}
+
+	snap := Snapshot{
+		ID:               id,
+		AggregateID:      aggregate.GetID(),
+		AggregateVersion: aggregate.GetVersion(),
+		AggregateType:    AggregateType(aggregate.GetType()),
+		Body:             body,
+		CreatedAt:        time.Now().UTC(),
+		TenantID:         TenantOf(ctx),
+	}
 
-		// TODO this could be done asynchronously.
-		err = es.store.SaveSnapshot(ctx, snap)
+	if es.snapshotter != nil {
+		// the snapshotter reports the snapshot once it is written
+		err = es.snapshotter.submit(ctx, snap)
 		if err != nil {
 			return err
 		}
+		setSnapshotAt(aggregate, snap.CreatedAt)
+		return nil
 	}
-
-	aggregate.ClearEvents()
+	err = es.saveSnapshot(ctx, snap)
+	if err != nil {
+		return err
+	}
+	setSnapshotAt(aggregate, snap.CreatedAt)
+	es.recorder.SnapshotSaved(aggregate.GetType())
 	return nil
 }
 
+// saveEvent saves the record, returning the IDs of all the events if the repository implements EventIDsSaver,
+// or only the ID of the last event otherwise
+func (es EventStore) saveEvent(ctx context.Context, rec EventRecord) (_ []eventid.EventID, _ uint32, err error) {
+	ctx, _, end := es.startSpan(ctx, "EsRepository.SaveEvent",
+		attrAggregateID.String(rec.AggregateID),
+		attrEventCount.Int(len(rec.Details)),
+	)
+	defer func() { end(err) }()
+
+	if saver, ok := es.store.(EventIDsSaver); ok {
+		return saver.SaveEventIDs(ctx, rec)
+	}
+	id, version, err := es.store.SaveEvent(ctx, rec)
+	if err != nil {
+		return nil, 0, err
+	}
+	return []eventid.EventID{id}, version, nil
+}
+
+// savedEvents builds the saved events. If there are less IDs than events, only the last events get an ID.
+func savedEvents(rec EventRecord, ids []eventid.EventID, lastVersion uint32, hasher AggregateHasher) []Event {
+	events := make([]Event, len(rec.Details))
+	hash := common.Hash(rec.AggregateID)
+	if hasher != nil {
+		hash = hasher.AggregateIDHash(rec.AggregateID, rec.Labels)
+	}
+	// some repositories (eg: mongodb) use a single version for all the events of a save
+	perEvent := lastVersion-rec.Version == uint32(len(rec.Details))
+	for k, d := range rec.Details {
+		version := lastVersion
+		if perEvent {
+			version = rec.Version + uint32(k) + 1
+		}
+		events[k] = Event{
+			AggregateID:      rec.AggregateID,
+			AggregateIDHash:  hash,
+			AggregateVersion: version,
+			AggregateType:    rec.AggregateType,
+			Kind:             d.Kind,
+			Body:             d.Body,
+			ContentType:      rec.ContentType,
+			IdempotencyKey:   rec.IdempotencyKey,
+			Metadata:         rec.Labels,
+			CreatedAt:        rec.CreatedAt,
+			EventVersion:     d.EventVersion,
+			TenantID:         rec.TenantID,
+		}
+	}
+	offset := len(events) - len(ids)
+	for k, id := range ids {
+		events[offset+k].ID = id
+	}
+	return events
+}
+
+// HasIdempotencyKey checks if the idempotency key was used by any aggregate.
+// With IdempotencyScopeAggregate, HasAggregateIdempotencyKey should be used instead.
 func (es EventStore) HasIdempotencyKey(ctx context.Context, idempotencyKey string) (bool, error) {
 	if idempotencyKey == EmptyIdempotencyKey {
 		return false, nil
@@ -354,30 +1333,139 @@ func (es EventStore) HasIdempotencyKey(ctx context.Context, idempotencyKey strin
 	return es.store.HasIdempotencyKey(ctx, idempotencyKey)
 }
 
+// HasAggregateIdempotencyKey checks if the idempotency key was used by the aggregate.
+// It fails with ErrNotSupported if the repository does not implement AggregateIdempotencyKeyChecker.
+func (es EventStore) HasAggregateIdempotencyKey(ctx context.Context, aggregateID, idempotencyKey string) (bool, error) {
+	if idempotencyKey == EmptyIdempotencyKey {
+		return false, nil
+	}
+	checker, ok := es.store.(AggregateIdempotencyKeyChecker)
+	if !ok {
+		return false, faults.Errorf("%w: checking idempotency keys by aggregate", ErrNotSupported)
+	}
+	return checker.HasAggregateIdempotencyKey(ctx, aggregateID, idempotencyKey)
+}
+
+// Stats returns the statistics of the stored events, eg: for monitoring.
+// It fails with ErrNotSupported if the repository does not implement StatsGetter.
+func (es EventStore) Stats(ctx context.Context) (StoreStats, error) {
+	getter, ok := es.store.(StatsGetter)
+	if !ok {
+		return StoreStats{}, faults.Errorf("%w: reading the store statistics", ErrNotSupported)
+	}
+	return getter.Stats(ctx)
+}
+
+// saveSnapshot saves the snapshot and, if pruning is on, deletes the superseded ones
+func (es EventStore) saveSnapshot(ctx context.Context, snap Snapshot) error {
+	err := es.snapshotStore.SaveSnapshot(ctx, snap)
+	if err != nil {
+		return err
+	}
+	if es.snapshotKeepLast == 0 {
+		return nil
+	}
+	pruner, ok := es.snapshotStore.(SnapshotPruner)
+	if !ok {
+		return nil
+	}
+	err = pruner.DeleteSnapshots(ctx, snap.AggregateID, es.snapshotKeepLast)
+	if err != nil {
+		es.logger.WithTags(log.Tags{
+			"aggregateID": snap.AggregateID,
+			"version":     snap.AggregateVersion,
+		}).WithError(err).Warn("Failed to prune snapshots")
+	}
+	return nil
+}
+
+// PruneSnapshots deletes the superseded snapshots of all the aggregates, keeping the latest keepLast of each, eg: in a maintenance job.
+// It fails with ErrNotSupported if the snapshot store does not implement SnapshotPruner.
+func (es EventStore) PruneSnapshots(ctx context.Context, keepLast int) (int64, error) {
+	pruner, ok := es.snapshotStore.(SnapshotPruner)
+	if !ok {
+		return 0, faults.Errorf("%w: pruning snapshots", ErrNotSupported)
+	}
+	if keepLast < 1 {
+		return 0, faults.New("at least one snapshot must be kept")
+	}
+	return pruner.PruneSnapshots(ctx, keepLast)
+}
+
 type ForgetRequest struct {
 	AggregateID string
 	EventKind   EventKind
+	// AggregateType selects the codec registered with WithCodecFor. If empty, the global codec is used.
+	AggregateType AggregateType
+}
+
+// ForgetPreview has the IDs of the events and snapshots that Forget would change
+type ForgetPreview struct {
+	EventIDs    []eventid.EventID
+	SnapshotIDs []eventid.EventID
+	// DeletesSnapshots tells if the snapshots of the aggregate kept outside the repository would be deleted
+	DeletesSnapshots bool
+}
+
+// PreviewForget returns what Forget would change for the request, without changing anything,
+// so that the scope of an erasure can be confirmed before running it.
+func (es EventStore) PreviewForget(ctx context.Context, request ForgetRequest) (ForgetPreview, error) {
+	previewer, ok := es.store.(ForgetPreviewer)
+	if !ok {
+		return ForgetPreview{}, faults.Errorf("%w: previewing forget", ErrNotSupported)
+	}
+	preview, err := previewer.PreviewForget(ctx, request)
+	if err != nil {
+		return ForgetPreview{}, err
+	}
+	if _, ok := es.snapshotStore.(SnapshotDeleter); ok && es.snapshotStore != SnapshotStore(es.store) {
+		preview.DeletesSnapshots = true
+	}
+	return preview, nil
 }
 
-func (es EventStore) Forget(ctx context.Context, request ForgetRequest, forget func(interface{}) interface{}) error {
+func (es EventStore) Forget(ctx context.Context, request ForgetRequest, forget func(interface{}) interface{}) (err error) {
+	ctx, _, end := es.startSpan(ctx, "EventStore.Forget",
+		attrAggregateID.String(request.AggregateID),
+		attrEventKind.String(request.EventKind.String()),
+	)
+	defer func() { end(err) }()
+
+	codec := es.codecFor(request.AggregateType)
 	fun := func(kind string, body []byte) ([]byte, error) {
 		e, err := es.factory.New(kind)
 		if err != nil {
 			return nil, err
 		}
-		err = es.codec.Decode(body, e)
+		body, err = es.decrypt(ctx, body)
+		if err != nil {
+			return nil, err
+		}
+		err = codec.Decode(body, e)
 		if err != nil {
 			return nil, err
 		}
 		e2 := common.Dereference(e)
 		e2 = forget(e2)
-		body, err = es.codec.Encode(e2)
+		body, err = codec.Encode(e2)
 		if err != nil {
 			return nil, err
 		}
 
-		return body, nil
+		return es.encrypt(ctx, request.AggregateID, body)
+	}
+
+	err = es.store.Forget(ctx, request, fun)
+	if err != nil {
+		return err
 	}
 
-	return es.store.Forget(ctx, request, fun)
+	// snapshots kept outside the repository are simply discarded
+	if deleter, ok := es.snapshotStore.(SnapshotDeleter); ok && es.snapshotStore != SnapshotStore(es.store) {
+		err = deleter.DeleteSnapshot(ctx, request.AggregateID)
+		if err != nil {
+			return faults.Errorf("Unable to delete snapshot of aggregate '%s': %w", request.AggregateID, err)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,971 @@
+package eventsourcing_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/label"
+	"go.opentelemetry.io/otel/oteltest"
+
+	"github.com/quintans/eventsourcing"
+	"github.com/quintans/eventsourcing/eventid"
+	"github.com/quintans/eventsourcing/store/inmem"
+	"github.com/quintans/eventsourcing/test"
+)
+
+func TestSaveHooks(t *testing.T) {
+	ctx := context.Background()
+	r := inmem.NewStore()
+
+	var saved []eventsourcing.Event
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{},
+		eventsourcing.WithBeforeSave(func(ctx context.Context, aggregate eventsourcing.Aggregater, opts *eventsourcing.Options) error {
+			if aggregate.GetVersion() > 0 {
+				return errors.New("read only")
+			}
+			opts.Labels = map[string]interface{}{"geo": "EU"}
+			return nil
+		}),
+		eventsourcing.WithAfterSave(func(ctx context.Context, aggregate eventsourcing.Aggregater, events []eventsourcing.Event) error {
+			saved = events
+			return nil
+		}),
+	)
+
+	id := uuid.New()
+	acc := test.CreateAccount("Paulo", id, 100)
+	acc.Deposit(10)
+	err := es.Save(ctx, acc)
+	require.NoError(t, err)
+
+	require.Len(t, saved, 2)
+	assert.Equal(t, "AccountCreated", saved[0].Kind.String())
+	assert.Equal(t, uint32(1), saved[0].AggregateVersion)
+	assert.Equal(t, uint32(2), saved[1].AggregateVersion)
+	assert.Equal(t, "EU", saved[1].Metadata["geo"])
+	assert.False(t, saved[1].ID.IsZero())
+
+	events, err := r.GetAggregateEvents(ctx, id.String(), -1)
+	require.NoError(t, err)
+	assert.Equal(t, "EU", events[0].Metadata["geo"])
+	// every saved event has its ID
+	assert.Equal(t, saved[0].ID, events[0].ID)
+	assert.Equal(t, saved[1].ID, events[1].ID)
+
+	// aborted by the before hook
+	saved = nil
+	acc.Deposit(10)
+	err = es.Save(ctx, acc)
+	require.Error(t, err)
+	require.Nil(t, saved)
+	events, err = r.GetAggregateEvents(ctx, id.String(), -1)
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+}
+
+func TestEventDispatcher(t *testing.T) {
+	ctx := context.Background()
+	r := inmem.NewStore()
+
+	var dispatched []eventsourcing.Event
+	fail := false
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{},
+		eventsourcing.WithEventDispatcher(func(ctx context.Context, events []eventsourcing.Event) error {
+			if fail {
+				return errors.New("bus is down")
+			}
+			dispatched = append(dispatched, events...)
+			return nil
+		}),
+	)
+
+	id := uuid.New()
+	acc := test.CreateAccount("Paulo", id, 100)
+	acc.Deposit(10)
+	err := es.Save(ctx, acc)
+	require.NoError(t, err)
+	require.Len(t, dispatched, 2)
+	assert.False(t, dispatched[0].ID.IsZero())
+	assert.Equal(t, uint32(2), dispatched[1].AggregateVersion)
+	assert.False(t, dispatched[1].CreatedAt.IsZero())
+	assert.Empty(t, dispatched[1].TenantID)
+
+	// the events carry the tenant they were saved for
+	dispatched = nil
+	err = es.Save(eventsourcing.WithTenant(ctx, "A"), test.CreateAccount("Pedro", uuid.New(), 50))
+	require.NoError(t, err)
+	require.Len(t, dispatched, 1)
+	assert.Equal(t, "A", dispatched[0].TenantID)
+
+	// the save is kept when the dispatch fails
+	fail = true
+	acc.Deposit(20)
+	err = es.Save(ctx, acc)
+	require.True(t, errors.Is(err, eventsourcing.ErrDispatchFailed))
+	events, err := r.GetAggregateEvents(ctx, id.String(), -1)
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+}
+
+// failingSnapshotStore fails to save the snapshots
+type failingSnapshotStore struct {
+	*inmem.EsRepository
+}
+
+func (failingSnapshotStore) SaveSnapshot(context.Context, eventsourcing.Snapshot) error {
+	return errors.New("snapshot store is down")
+}
+
+func TestSnapshotFailureAfterCommit(t *testing.T) {
+	ctx := context.Background()
+	r := inmem.NewStore()
+	rec := &recorder{
+		saved:     map[string]int{},
+		snapshots: map[string]int{},
+		failed:    map[string]int{},
+		conflicts: map[string]int{},
+	}
+	var dispatched []eventsourcing.Event
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{},
+		eventsourcing.WithSnapshotThreshold(1),
+		eventsourcing.WithSnapshotStore(failingSnapshotStore{inmem.NewStore()}),
+		eventsourcing.WithMetrics(rec),
+		eventsourcing.WithEventDispatcher(func(ctx context.Context, events []eventsourcing.Event) error {
+			dispatched = append(dispatched, events...)
+			return nil
+		}),
+	)
+
+	// the events are committed, so the failed snapshot doesn't fail the save
+	id := uuid.New()
+	acc := test.CreateAccount("Paulo", id, 100)
+	err := es.Save(ctx, acc)
+	require.NoError(t, err)
+	assert.Empty(t, acc.GetEvents())
+	require.Len(t, dispatched, 1)
+	assert.Equal(t, 0, rec.snapshots["Account"])
+	assert.Equal(t, 1, rec.failed["Account"])
+
+	acc.Deposit(10)
+	err = es.Save(ctx, acc)
+	require.NoError(t, err)
+	require.Len(t, dispatched, 2)
+}
+
+// countingFactory counts the instances it creates
+type countingFactory struct {
+	test.AggregateFactory
+	count *int
+}
+
+func (f countingFactory) New(kind string) (eventsourcing.Typer, error) {
+	*f.count++
+	return f.AggregateFactory.New(kind)
+}
+
+func TestFactoryOverride(t *testing.T) {
+	ctx := context.Background()
+	r := inmem.NewStore()
+	es := eventsourcing.NewEventStore(r, nil, eventsourcing.WithFactory(test.AggregateFactory{}))
+
+	id := uuid.New()
+	acc := test.CreateAccount("Paulo", id, 100)
+	acc.Deposit(10)
+	err := es.Save(ctx, acc)
+	require.NoError(t, err)
+
+	count := 0
+	a, err := es.GetByIDUsing(ctx, id.String(), countingFactory{count: &count})
+	require.NoError(t, err)
+	assert.Equal(t, int64(110), a.(*test.Account).Balance)
+	// the aggregate and its two events
+	assert.Equal(t, 3, count)
+
+	// the factory of the event store is not changed
+	a, err = es.GetByID(ctx, id.String())
+	require.NoError(t, err)
+	assert.Equal(t, int64(110), a.(*test.Account).Balance)
+	assert.Equal(t, 3, count)
+}
+
+func TestExecRetry(t *testing.T) {
+	ctx := context.Background()
+	r := inmem.NewStore()
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{},
+		eventsourcing.WithRetryBackOff(func() backoff.BackOff {
+			return &backoff.ZeroBackOff{}
+		}),
+	)
+
+	id := uuid.New()
+	acc := test.CreateAccount("Paulo", id, 100)
+	err := es.Save(ctx, acc)
+	require.NoError(t, err)
+
+	// a concurrent writer commits in between, on the first two attempts
+	calls := 0
+	err = es.ExecRetry(ctx, id.String(), 3, func(a eventsourcing.Aggregater) (eventsourcing.Aggregater, error) {
+		calls++
+		if calls < 3 {
+			other, err := es.GetByID(ctx, id.String())
+			require.NoError(t, err)
+			other.(*test.Account).Deposit(1)
+			require.NoError(t, es.Save(ctx, other))
+		}
+		a.(*test.Account).Deposit(10)
+		return a, nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 3, calls)
+
+	a, err := es.GetByID(ctx, id.String())
+	require.NoError(t, err)
+	assert.Equal(t, int64(112), a.(*test.Account).Balance)
+
+	// attempts exhausted
+	calls = 0
+	err = es.ExecRetry(ctx, id.String(), 2, func(a eventsourcing.Aggregater) (eventsourcing.Aggregater, error) {
+		calls++
+		other, err := es.GetByID(ctx, id.String())
+		require.NoError(t, err)
+		other.(*test.Account).Deposit(1)
+		require.NoError(t, es.Save(ctx, other))
+		a.(*test.Account).Deposit(10)
+		return a, nil
+	})
+	require.True(t, errors.Is(err, eventsourcing.ErrConcurrentModification))
+	assert.Equal(t, 2, calls)
+
+	// other errors are not retried
+	calls = 0
+	err = es.ExecRetry(ctx, id.String(), 3, func(a eventsourcing.Aggregater) (eventsourcing.Aggregater, error) {
+		calls++
+		return nil, errors.New("boom")
+	})
+	require.EqualError(t, err, "boom")
+	assert.Equal(t, 1, calls)
+}
+
+type traceKey struct{}
+
+func TestMetadataFromContext(t *testing.T) {
+	r := inmem.NewStore()
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{},
+		eventsourcing.WithMetadataFromContext(func(ctx context.Context) map[string]interface{} {
+			traceID, _ := ctx.Value(traceKey{}).(string)
+			return map[string]interface{}{"trace": traceID, "geo": "US"}
+		}),
+	)
+	ctx := context.WithValue(context.Background(), traceKey{}, "trace-123")
+
+	id := uuid.New()
+	acc := test.CreateAccount("Paulo", id, 100)
+	labels := map[string]interface{}{"geo": "EU"}
+	err := es.Save(ctx, acc, eventsourcing.WithMetadata(labels))
+	require.NoError(t, err)
+	// the caller map is not changed
+	assert.Equal(t, map[string]interface{}{"geo": "EU"}, labels)
+
+	events, err := r.GetAggregateEvents(ctx, id.String(), -1)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, map[string]interface{}{"trace": "trace-123", "geo": "EU"}, events[0].Metadata)
+}
+
+func TestTracing(t *testing.T) {
+	ctx := context.Background()
+	r := inmem.NewStore()
+	sr := new(oteltest.StandardSpanRecorder)
+	tracer := oteltest.NewTracerProvider(oteltest.WithSpanRecorder(sr)).Tracer("test")
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{}, eventsourcing.WithTracer(tracer))
+
+	id := uuid.New()
+	acc := test.CreateAccount("Paulo", id, 100)
+	acc.Deposit(10)
+	err := es.Save(ctx, acc)
+	require.NoError(t, err)
+
+	err = es.Exec(ctx, id.String(), func(a eventsourcing.Aggregater) (eventsourcing.Aggregater, error) {
+		return nil, errors.New("boom")
+	})
+	require.Error(t, err)
+
+	spans := map[string]*oteltest.Span{}
+	for _, s := range sr.Completed() {
+		spans[s.Name()] = s
+	}
+
+	save := spans["EventStore.Save"]
+	require.NotNil(t, save)
+	assert.Equal(t, label.StringValue(id.String()), save.Attributes()["aggregate.id"])
+	assert.Equal(t, label.StringValue("Account"), save.Attributes()["aggregate.type"])
+	assert.Equal(t, label.IntValue(2), save.Attributes()["event.count"])
+	assert.Equal(t, label.Int64Value(2), save.Attributes()["aggregate.version"])
+	saveEvent := spans["EsRepository.SaveEvent"]
+	require.NotNil(t, saveEvent)
+	assert.Equal(t, save.SpanContext().SpanID, saveEvent.ParentSpanID())
+
+	exec := spans["EventStore.Exec"]
+	require.NotNil(t, exec)
+	assert.Equal(t, codes.Error, exec.StatusCode())
+	getByID := spans["EventStore.GetByID"]
+	require.NotNil(t, getByID)
+	assert.Equal(t, exec.SpanContext().SpanID, getByID.ParentSpanID())
+	// the in memory repository loads the snapshot and the events together
+	load := spans["EsRepository.LoadAggregate"]
+	require.NotNil(t, load)
+	assert.Equal(t, getByID.SpanContext().SpanID, load.ParentSpanID())
+	assert.Equal(t, label.IntValue(2), load.Attributes()["event.count"])
+}
+
+type recorder struct {
+	saved     map[string]int
+	snapshots map[string]int
+	failed    map[string]int
+	conflicts map[string]int
+	bodySizes []int
+	loads     int
+	replayed  []int
+}
+
+func (r *recorder) EventsSaved(aggregateType string, count int) {
+	r.saved[aggregateType] += count
+}
+
+func (r *recorder) SnapshotSaved(aggregateType string) {
+	r.snapshots[aggregateType]++
+}
+
+func (r *recorder) SnapshotFailed(aggregateType string) {
+	r.failed[aggregateType]++
+}
+
+func (r *recorder) ConcurrencyConflict(aggregateType string) {
+	r.conflicts[aggregateType]++
+}
+
+func (r *recorder) EventBodySize(aggregateType string, size int) {
+	r.bodySizes = append(r.bodySizes, size)
+}
+
+func (r *recorder) AggregateLoaded(aggregateType string, latency time.Duration, replayedEvents int) {
+	r.loads++
+	r.replayed = append(r.replayed, replayedEvents)
+}
+
+func TestMetrics(t *testing.T) {
+	ctx := context.Background()
+	r := inmem.NewStore()
+	rec := &recorder{
+		saved:     map[string]int{},
+		snapshots: map[string]int{},
+		conflicts: map[string]int{},
+	}
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{},
+		eventsourcing.WithSnapshotThreshold(3),
+		eventsourcing.WithMetrics(rec),
+	)
+
+	id := uuid.New()
+	acc := test.CreateAccount("Paulo", id, 100)
+	acc.Deposit(10)
+	err := es.Save(ctx, acc)
+	require.NoError(t, err)
+	assert.Equal(t, 2, rec.saved["Account"])
+	assert.Equal(t, 0, rec.snapshots["Account"])
+
+	a1, err := es.GetByID(ctx, id.String())
+	require.NoError(t, err)
+	a2, err := es.GetByID(ctx, id.String())
+	require.NoError(t, err)
+	assert.Equal(t, 2, rec.loads)
+	assert.Equal(t, []int{2, 2}, rec.replayed)
+
+	a1.(*test.Account).Deposit(5)
+	err = es.Save(ctx, a1)
+	require.NoError(t, err)
+	assert.Equal(t, 3, rec.saved["Account"])
+	assert.Equal(t, 1, rec.snapshots["Account"])
+
+	a2.(*test.Account).Deposit(5)
+	err = es.Save(ctx, a2)
+	require.True(t, errors.Is(err, eventsourcing.ErrConcurrentModification))
+	assert.Equal(t, 1, rec.conflicts["Account"])
+	assert.Equal(t, 3, rec.saved["Account"])
+
+	// only the events after the snapshot are replayed
+	_, err = es.GetByID(ctx, id.String())
+	require.NoError(t, err)
+	assert.Equal(t, []int{2, 2, 0}, rec.replayed)
+}
+
+func TestAsyncSnapshotAfterClose(t *testing.T) {
+	ctx := context.Background()
+	r := inmem.NewStore()
+	rec := &recorder{
+		saved:     map[string]int{},
+		snapshots: map[string]int{},
+		failed:    map[string]int{},
+		conflicts: map[string]int{},
+	}
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{},
+		eventsourcing.WithSnapshotThreshold(3),
+		eventsourcing.WithAsyncSnapshots(1, 1),
+		eventsourcing.WithMetrics(rec),
+	)
+	err := es.Close(ctx)
+	require.NoError(t, err)
+
+	// the snapshot can't be queued, but the events are saved
+	id := uuid.New()
+	acc := test.CreateAccount("Paulo", id, 100)
+	acc.Deposit(10)
+	acc.Deposit(20)
+	err = es.Save(ctx, acc)
+	require.NoError(t, err)
+	assert.Empty(t, acc.GetEvents())
+	assert.Equal(t, 3, rec.saved["Account"])
+	assert.Equal(t, 0, rec.snapshots["Account"])
+	assert.Equal(t, 1, rec.failed["Account"])
+
+	snap, err := r.GetSnapshot(ctx, id.String())
+	require.NoError(t, err)
+	assert.Empty(t, snap.ID)
+	a, err := es.GetByID(ctx, id.String())
+	require.NoError(t, err)
+	assert.Equal(t, int64(130), a.(*test.Account).Balance)
+}
+
+func TestAsyncSnapshotMetrics(t *testing.T) {
+	ctx := context.Background()
+	newRecorder := func() *recorder {
+		return &recorder{
+			saved:     map[string]int{},
+			snapshots: map[string]int{},
+			failed:    map[string]int{},
+			conflicts: map[string]int{},
+		}
+	}
+
+	// the snapshots are only counted once written
+	rec := newRecorder()
+	es := eventsourcing.NewEventStore(inmem.NewStore(), test.AggregateFactory{},
+		eventsourcing.WithSnapshotThreshold(1),
+		eventsourcing.WithAsyncSnapshots(1, 10),
+		eventsourcing.WithMetrics(rec),
+	)
+	err := es.Save(ctx, test.CreateAccount("Paulo", uuid.New(), 100))
+	require.NoError(t, err)
+	err = es.Close(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, rec.snapshots["Account"])
+	assert.Equal(t, 0, rec.failed["Account"])
+
+	// a failed background write is reported as failed
+	rec = newRecorder()
+	es = eventsourcing.NewEventStore(inmem.NewStore(), test.AggregateFactory{},
+		eventsourcing.WithSnapshotThreshold(1),
+		eventsourcing.WithSnapshotStore(failingSnapshotStore{inmem.NewStore()}),
+		eventsourcing.WithAsyncSnapshots(1, 10),
+		eventsourcing.WithMetrics(rec),
+	)
+	err = es.Save(ctx, test.CreateAccount("Paulo", uuid.New(), 100))
+	require.NoError(t, err)
+	err = es.Close(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, rec.snapshots["Account"])
+	assert.Equal(t, 1, rec.failed["Account"])
+}
+
+func TestAsyncSnapshotPruningWithTenant(t *testing.T) {
+	ctx := eventsourcing.WithTenant(context.Background(), "A")
+	r := inmem.NewStore(inmem.WithMultiTenant())
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{},
+		eventsourcing.WithSnapshotThreshold(1),
+		eventsourcing.WithAsyncSnapshots(1, 10),
+		eventsourcing.WithSnapshotPruning(1),
+	)
+
+	id := uuid.New()
+	acc := test.CreateAccount("Paulo", id, 100)
+	for i := 0; i < 3; i++ {
+		acc.Deposit(10)
+		err := es.Save(ctx, acc)
+		require.NoError(t, err)
+		// avoids snapshots created in the same millisecond
+		time.Sleep(2 * time.Millisecond)
+	}
+	err := es.Close(context.Background())
+	require.NoError(t, err)
+
+	// the background writes pruned the snapshots of the tenant
+	deleted, err := es.PruneSnapshots(eventsourcing.WithAllTenants(context.Background()), 1)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), deleted)
+	snap, err := r.GetSnapshot(ctx, id.String())
+	require.NoError(t, err)
+	assert.Equal(t, uint32(4), snap.AggregateVersion)
+}
+
+func TestAsyncSnapshotsNegativeBuffer(t *testing.T) {
+	ctx := context.Background()
+	r := inmem.NewStore()
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{},
+		eventsourcing.WithSnapshotThreshold(1),
+		eventsourcing.WithAsyncSnapshots(1, -1),
+	)
+
+	id := uuid.New()
+	err := es.Save(ctx, test.CreateAccount("Paulo", id, 100))
+	require.NoError(t, err)
+	err = es.Close(ctx)
+	require.NoError(t, err)
+
+	snap, err := r.GetSnapshot(ctx, id.String())
+	require.NoError(t, err)
+	assert.Equal(t, uint32(1), snap.AggregateVersion)
+}
+
+func TestSnapshotPolicy(t *testing.T) {
+	ctx := context.Background()
+	r := inmem.NewStore()
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{},
+		eventsourcing.WithSnapshotPolicy(eventsourcing.SnapshotAgePolicy(time.Hour)),
+	)
+
+	// without a snapshot, the first save snapshots
+	id := uuid.New()
+	acc := test.CreateAccount("Paulo", id, 100)
+	err := es.Save(ctx, acc)
+	require.NoError(t, err)
+	snap, err := r.GetSnapshot(ctx, id.String())
+	require.NoError(t, err)
+	assert.Equal(t, uint32(1), snap.AggregateVersion)
+
+	// the snapshot time is surfaced when loading
+	a, err := es.GetByID(ctx, id.String())
+	require.NoError(t, err)
+	assert.Equal(t, snap.CreatedAt, a.(*test.Account).GetSnapshotAt())
+
+	// a recent snapshot is not replaced
+	a.(*test.Account).Deposit(10)
+	err = es.Save(ctx, a)
+	require.NoError(t, err)
+	snap, err = r.GetSnapshot(ctx, id.String())
+	require.NoError(t, err)
+	assert.Equal(t, uint32(1), snap.AggregateVersion)
+
+	// custom policy
+	var lastSnapshotAt time.Time
+	es = eventsourcing.NewEventStore(r, test.AggregateFactory{},
+		eventsourcing.WithSnapshotPolicy(eventsourcing.SnapshotPolicyFunc(func(agg eventsourcing.Aggregater, at time.Time) bool {
+			lastSnapshotAt = at
+			return agg.(*test.Account).Balance > 200
+		})),
+	)
+	err = es.Exec(ctx, id.String(), func(a eventsourcing.Aggregater) (eventsourcing.Aggregater, error) {
+		a.(*test.Account).Deposit(100)
+		return a, nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, snap.CreatedAt, lastSnapshotAt)
+	snap, err = r.GetSnapshot(ctx, id.String())
+	require.NoError(t, err)
+	assert.Equal(t, uint32(3), snap.AggregateVersion)
+}
+
+func TestMaxBodySize(t *testing.T) {
+	ctx := context.Background()
+	r := inmem.NewStore()
+	rec := &recorder{
+		saved:     map[string]int{},
+		snapshots: map[string]int{},
+		conflicts: map[string]int{},
+	}
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{},
+		eventsourcing.WithMaxBodySize(100),
+		eventsourcing.WithMetrics(rec),
+	)
+
+	id := uuid.New()
+	acc := test.CreateAccount("Paulo", id, 100)
+	err := es.Save(ctx, acc)
+	require.NoError(t, err)
+	require.Len(t, rec.bodySizes, 1)
+	assert.True(t, rec.bodySizes[0] > 0 && rec.bodySizes[0] <= 100)
+
+	acc.UpdateOwner(strings.Repeat("x", 100))
+	err = es.Save(ctx, acc)
+	require.True(t, errors.Is(err, eventsourcing.ErrEventTooLarge))
+	require.Len(t, rec.bodySizes, 2)
+	assert.True(t, rec.bodySizes[1] > 100)
+
+	_, err = es.GetByID(ctx, id.String())
+	require.NoError(t, err)
+	assert.Equal(t, 1, rec.saved["Account"])
+}
+
+func TestVersionGap(t *testing.T) {
+	ctx := context.Background()
+	r := inmem.NewStore()
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{})
+
+	id := uuid.New()
+	acc := test.CreateAccount("Paulo", id, 100)
+	err := es.Save(ctx, acc)
+	require.NoError(t, err)
+
+	acc.Deposit(10)
+	acc.SetVersion(5)
+	err = es.Save(ctx, acc)
+	require.True(t, errors.Is(err, eventsourcing.ErrVersionGap), err)
+
+	events, err := r.GetAggregateEvents(ctx, id.String(), -1)
+	require.NoError(t, err)
+	assert.Len(t, events, 1)
+}
+
+func TestGetByIDAt(t *testing.T) {
+	ctx := context.Background()
+	r := inmem.NewStore()
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{}, eventsourcing.WithSnapshotThreshold(2))
+
+	// snapshots at versions 2 and 4
+	id := uuid.New()
+	acc := test.CreateAccount("Paulo", id, 100)
+	acc.Deposit(10)
+	err := es.Save(ctx, acc)
+	require.NoError(t, err)
+	err = es.Exec(ctx, id.String(), func(a eventsourcing.Aggregater) (eventsourcing.Aggregater, error) {
+		a.(*test.Account).Deposit(20)
+		a.(*test.Account).Withdraw(5)
+		return a, nil
+	})
+	require.NoError(t, err)
+	snap, err := r.GetSnapshot(ctx, id.String())
+	require.NoError(t, err)
+	require.Equal(t, uint32(4), snap.AggregateVersion)
+
+	balances := map[uint32]int64{1: 100, 2: 110, 3: 130, 4: 125}
+	for version, balance := range balances {
+		a, err := es.GetByIDAt(ctx, id.String(), version)
+		require.NoError(t, err)
+		assert.Equal(t, version, a.GetVersion())
+		assert.Equal(t, balance, a.(*test.Account).Balance, "version %d", version)
+	}
+
+	_, err = es.GetByIDAt(ctx, id.String(), 5)
+	require.True(t, errors.Is(err, eventsourcing.ErrUnknownAggregateVersion))
+
+	_, err = es.GetByIDAt(ctx, uuid.New().String(), 1)
+	require.True(t, errors.Is(err, eventsourcing.ErrUnknownAggregateID))
+}
+
+func TestGetByIDAtTime(t *testing.T) {
+	ctx := context.Background()
+	r := inmem.NewStore()
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{}, eventsourcing.WithSnapshotThreshold(2))
+
+	before := time.Now()
+	time.Sleep(5 * time.Millisecond)
+
+	// snapshot at version 2
+	id := uuid.New()
+	acc := test.CreateAccount("Paulo", id, 100)
+	acc.Deposit(10)
+	err := es.Save(ctx, acc)
+	require.NoError(t, err)
+
+	time.Sleep(5 * time.Millisecond)
+	middle := time.Now()
+	time.Sleep(5 * time.Millisecond)
+
+	// snapshot at version 4, after the middle time
+	err = es.Exec(ctx, id.String(), func(a eventsourcing.Aggregater) (eventsourcing.Aggregater, error) {
+		a.(*test.Account).Deposit(20)
+		a.(*test.Account).Withdraw(5)
+		return a, nil
+	})
+	require.NoError(t, err)
+
+	a, err := es.GetByIDAtTime(ctx, id.String(), middle)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(2), a.GetVersion())
+	assert.Equal(t, int64(110), a.(*test.Account).Balance)
+
+	a, err = es.GetByIDAtTime(ctx, id.String(), time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, uint32(4), a.GetVersion())
+	assert.Equal(t, int64(125), a.(*test.Account).Balance)
+
+	_, err = es.GetByIDAtTime(ctx, id.String(), before)
+	require.True(t, errors.Is(err, eventsourcing.ErrUnknownAggregateID))
+}
+
+// countingCodec is a JSON codec, with its own content type, that counts its usage
+type countingCodec struct {
+	eventsourcing.JSONCodec
+	encoded int
+	decoded int
+}
+
+func (*countingCodec) ContentType() string {
+	return "application/x-counting"
+}
+
+func (c *countingCodec) Encode(v interface{}) ([]byte, error) {
+	c.encoded++
+	return c.JSONCodec.Encode(v)
+}
+
+func (c *countingCodec) Decode(data []byte, v interface{}) error {
+	c.decoded++
+	return c.JSONCodec.Decode(data, v)
+}
+
+func TestCodecFor(t *testing.T) {
+	ctx := context.Background()
+	r := inmem.NewStore()
+	codec := &countingCodec{}
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{},
+		eventsourcing.WithSnapshotThreshold(2),
+		eventsourcing.WithCodecFor("Account", codec),
+	)
+
+	id := uuid.New()
+	acc := test.CreateAccount("Paulo", id, 100)
+	acc.Deposit(10)
+	acc.Deposit(20)
+	err := es.Save(ctx, acc)
+	require.NoError(t, err)
+	// 3 events and 1 snapshot
+	assert.Equal(t, 4, codec.encoded)
+
+	events, err := r.GetAggregateEvents(ctx, id.String(), -1)
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+	for _, e := range events {
+		assert.Equal(t, "application/x-counting", e.ContentType)
+	}
+
+	a, err := es.GetByIDAt(ctx, id.String(), 2)
+	require.NoError(t, err)
+	assert.Equal(t, int64(110), a.(*test.Account).Balance)
+	assert.Equal(t, 2, codec.decoded)
+
+	// other aggregate types use the global codec
+	es = eventsourcing.NewEventStore(r, test.AggregateFactory{},
+		eventsourcing.WithCodecFor("Other", codec),
+		eventsourcing.WithDecoder("application/x-counting", codec),
+	)
+	acc = test.CreateAccount("Paulo", uuid.New(), 100)
+	err = es.Save(ctx, acc)
+	require.NoError(t, err)
+	assert.Equal(t, 4, codec.encoded)
+
+	// events written by another codec are read with the registered decoder
+	a, err = es.GetByID(ctx, id.String())
+	require.NoError(t, err)
+	assert.Equal(t, int64(130), a.(*test.Account).Balance)
+
+	// as are the events received by a projection
+	decoded := codec.decoded
+	e, err := es.RehydrateEventOf(ctx, events[1])
+	require.NoError(t, err)
+	assert.Equal(t, test.MoneyDeposited{Money: 10}, e)
+	assert.Equal(t, decoded+1, codec.decoded)
+}
+
+// countingRepository counts the reads of an in memory repository
+type countingRepository struct {
+	*inmem.EsRepository
+	snapshotGets int
+	loads        int
+}
+
+func (r *countingRepository) GetSnapshot(ctx context.Context, aggregateID string) (eventsourcing.Snapshot, error) {
+	r.snapshotGets++
+	return r.EsRepository.GetSnapshot(ctx, aggregateID)
+}
+
+func (r *countingRepository) LoadAggregate(ctx context.Context, aggregateID string) (eventsourcing.Snapshot, []eventsourcing.Event, error) {
+	r.loads++
+	return r.EsRepository.LoadAggregate(ctx, aggregateID)
+}
+
+func TestLoadAggregate(t *testing.T) {
+	ctx := context.Background()
+	r := &countingRepository{EsRepository: inmem.NewStore()}
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{}, eventsourcing.WithSnapshotThreshold(2))
+
+	id := uuid.New()
+	acc := test.CreateAccount("Paulo", id, 100)
+	acc.Deposit(10)
+	acc.Deposit(20)
+	err := es.Save(ctx, acc)
+	require.NoError(t, err)
+
+	a, err := es.GetByID(ctx, id.String())
+	require.NoError(t, err)
+	assert.Equal(t, uint32(3), a.GetVersion())
+	assert.Equal(t, int64(130), a.(*test.Account).Balance)
+	assert.Equal(t, 1, r.loads)
+	assert.Equal(t, 0, r.snapshotGets)
+
+	// with a separate snapshot store, the snapshot is read from there
+	snaps := inmem.NewStore()
+	es = eventsourcing.NewEventStore(r, test.AggregateFactory{}, eventsourcing.WithSnapshotStore(snaps))
+	a, err = es.GetByID(ctx, id.String())
+	require.NoError(t, err)
+	assert.Equal(t, int64(130), a.(*test.Account).Balance)
+	assert.Equal(t, 1, r.loads)
+}
+
+// streamingRepository streams the events of an in memory repository, counting the reads
+type streamingRepository struct {
+	countingRepository
+	streams int
+}
+
+func (r *streamingRepository) GetAggregateEventsStream(ctx context.Context, aggregateID string, snapVersion int) (<-chan eventsourcing.Event, <-chan error) {
+	r.streams++
+	events := make(chan eventsourcing.Event)
+	errCh := make(chan error, 1)
+	go func() {
+		defer close(events)
+		defer close(errCh)
+		evts, err := r.EsRepository.GetAggregateEvents(ctx, aggregateID, snapVersion)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		for _, e := range evts {
+			events <- e
+		}
+	}()
+	return events, errCh
+}
+
+func TestLoadAggregateStreaming(t *testing.T) {
+	ctx := context.Background()
+	r := &streamingRepository{countingRepository: countingRepository{EsRepository: inmem.NewStore()}}
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{}, eventsourcing.WithSnapshotThreshold(2))
+
+	id := uuid.New()
+	acc := test.CreateAccount("Paulo", id, 100)
+	acc.Deposit(10)
+	acc.Deposit(20)
+	err := es.Save(ctx, acc)
+	require.NoError(t, err)
+
+	// the events are streamed, even if the repository keeps the snapshots
+	a, err := es.GetByID(ctx, id.String())
+	require.NoError(t, err)
+	assert.Equal(t, uint32(3), a.GetVersion())
+	assert.Equal(t, int64(130), a.(*test.Account).Balance)
+	assert.Equal(t, 0, r.loads)
+	assert.Equal(t, 1, r.snapshotGets)
+	assert.Equal(t, 1, r.streams)
+}
+
+func TestReadTrailingLag(t *testing.T) {
+	ctx := context.Background()
+	r := inmem.NewStore()
+	lag := 50 * time.Millisecond
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{}, eventsourcing.WithReadTrailingLag(lag))
+
+	id := uuid.New()
+	acc := test.CreateAccount("Paulo", id, 100)
+	err := es.Save(ctx, acc)
+	require.NoError(t, err)
+
+	// too recent
+	a, err := es.GetByID(ctx, id.String())
+	require.NoError(t, err)
+	assert.Nil(t, a)
+
+	time.Sleep(lag)
+
+	// Exec is not affected by the lag
+	err = es.Exec(ctx, id.String(), func(a eventsourcing.Aggregater) (eventsourcing.Aggregater, error) {
+		a.(*test.Account).Deposit(10)
+		return a, nil
+	})
+	require.NoError(t, err)
+
+	a, err = es.GetByID(ctx, id.String())
+	require.NoError(t, err)
+	assert.Equal(t, uint32(1), a.GetVersion())
+	assert.Equal(t, int64(100), a.(*test.Account).Balance)
+}
+
+func TestNewStoreStats(t *testing.T) {
+	now := time.Now()
+	id1 := eventid.TimeOnly(now.Add(-time.Hour))
+	id2 := eventid.TimeOnly(now.Add(-time.Minute))
+	id3 := eventid.TimeOnly(now)
+
+	stats := eventsourcing.NewStoreStats(map[eventsourcing.AggregateType]eventsourcing.EventsStats{
+		"Account": {Events: 2, FirstEventID: id2, LastEventID: id2, Oldest: now.Add(-time.Minute), Newest: now.Add(-time.Minute)},
+		"Order":   {Events: 3, FirstEventID: id1, LastEventID: id3, Oldest: now.Add(-time.Hour), Newest: now},
+		"Empty":   {},
+	})
+	assert.Equal(t, int64(5), stats.Events)
+	assert.Equal(t, id1, stats.FirstEventID)
+	assert.Equal(t, id3, stats.LastEventID)
+	assert.Equal(t, now.Add(-time.Hour), stats.Oldest)
+	assert.Equal(t, now, stats.Newest)
+}
+
+func TestSnapshotPruning(t *testing.T) {
+	ctx := context.Background()
+	r := inmem.NewStore()
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{}, eventsourcing.WithSnapshotThreshold(1))
+
+	id := uuid.New()
+	acc := test.CreateAccount("Paulo", id, 100)
+	for i := 0; i < 3; i++ {
+		acc.Deposit(10)
+		err := es.Save(ctx, acc)
+		require.NoError(t, err)
+		// avoids snapshots created in the same millisecond
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	deleted, err := es.PruneSnapshots(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), deleted)
+	snap, err := r.GetSnapshot(ctx, id.String())
+	require.NoError(t, err)
+	assert.Equal(t, uint32(4), snap.AggregateVersion)
+
+	// pruning after every snapshot
+	es = eventsourcing.NewEventStore(r, test.AggregateFactory{},
+		eventsourcing.WithSnapshotThreshold(1),
+		eventsourcing.WithSnapshotPruning(2),
+	)
+	for i := 0; i < 3; i++ {
+		acc.Deposit(10)
+		err := es.Save(ctx, acc)
+		require.NoError(t, err)
+		// avoids snapshots created in the same millisecond
+		time.Sleep(2 * time.Millisecond)
+	}
+	deleted, err = es.PruneSnapshots(ctx, 2)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), deleted)
+	deleted, err = es.PruneSnapshots(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), deleted)
+
+	_, err = es.PruneSnapshots(ctx, 0)
+	require.Error(t, err)
+}
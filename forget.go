@@ -0,0 +1,290 @@
+package eventsourcing
+
+import (
+	"context"
+	"reflect"
+	"strings"
+
+	"github.com/quintans/faults"
+
+	"github.com/quintans/eventsourcing/common"
+)
+
+// EventFields are the fields to erase from the events of a kind
+type EventFields struct {
+	Kind EventKind
+	// Fields are dot separated paths of the JSON field names, eg: "address.street"
+	Fields []string
+}
+
+type ForgetFieldsRequest struct {
+	AggregateID   string
+	AggregateType AggregateType
+	Events        []EventFields
+	// AggregateFields are the paths of the fields to erase from the snapshots
+	AggregateFields []string
+}
+
+// ForgetFields erases the values of the fields of the events, of the listed kinds, and of the snapshots of an aggregate.
+// All the paths are validated against the types of the factory before anything is changed.
+// Each event kind is forgotten on its own, so the erasure is only all or nothing for each kind.
+func (es EventStore) ForgetFields(ctx context.Context, request ForgetFieldsRequest) error {
+	// the decoded values are told apart by their type
+	fields := map[reflect.Type][]string{}
+	add := func(kind string, paths []string) error {
+		if len(paths) == 0 {
+			return nil
+		}
+		e, err := es.factory.New(kind)
+		if err != nil {
+			return err
+		}
+		t := reflect.TypeOf(common.Dereference(e))
+		for _, p := range paths {
+			if err := checkPath(t, splitPath(p)); err != nil {
+				return faults.Errorf("Invalid path '%s' for '%s': %w", p, kind, err)
+			}
+		}
+		fields[t] = append(fields[t], paths...)
+		return nil
+	}
+
+	if len(request.AggregateFields) > 0 {
+		if request.AggregateType == "" {
+			return faults.New("the aggregate type is required to erase aggregate fields")
+		}
+		if err := add(request.AggregateType.String(), request.AggregateFields); err != nil {
+			return err
+		}
+	}
+	for _, ef := range request.Events {
+		if err := add(ef.Kind.String(), ef.Fields); err != nil {
+			return err
+		}
+	}
+
+	forget := func(i interface{}) interface{} {
+		paths := fields[reflect.TypeOf(i)]
+		if len(paths) == 0 {
+			return i
+		}
+		// the paths were already checked
+		i, _ = RedactFields(i, paths...)
+		return i
+	}
+
+	kinds := make([]EventKind, 0, len(request.Events))
+	for _, ef := range request.Events {
+		kinds = append(kinds, ef.Kind)
+	}
+	if len(kinds) == 0 {
+		// an empty kind matches no event, only the snapshots
+		kinds = append(kinds, "")
+	}
+	for _, kind := range kinds {
+		err := es.Forget(ctx, ForgetRequest{
+			AggregateID:   request.AggregateID,
+			EventKind:     kind,
+			AggregateType: request.AggregateType,
+		}, forget)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ForgetByKeyDeletion forgets an aggregate by deleting its data key from the key store set with WithKeyStore,
+// making all of its events and snapshots unreadable at once. Reading the aggregate afterwards fails with ErrForgotten.
+// With deleteSnapshots, the unreadable snapshots are also deleted, if the snapshot store implements SnapshotDeleter or SnapshotPruner.
+func (es EventStore) ForgetByKeyDeletion(ctx context.Context, aggregateID string, deleteSnapshots bool) error {
+	if es.keyStore == nil {
+		return faults.New("a key store is required to forget by key deletion")
+	}
+	err := es.keyStore.DeleteKey(ctx, aggregateID)
+	if err != nil {
+		return faults.Errorf("Unable to delete the key of aggregate '%s': %w", aggregateID, err)
+	}
+	if !deleteSnapshots {
+		return nil
+	}
+
+	if deleter, ok := es.snapshotStore.(SnapshotDeleter); ok {
+		err = deleter.DeleteSnapshot(ctx, aggregateID)
+	} else if pruner, ok := es.snapshotStore.(SnapshotPruner); ok {
+		err = pruner.DeleteSnapshots(ctx, aggregateID, 0)
+	} else {
+		err = faults.Errorf("%w: deleting snapshots", ErrNotSupported)
+	}
+	if err != nil {
+		return faults.Errorf("Unable to delete the snapshots of aggregate '%s': %w", aggregateID, err)
+	}
+	return nil
+}
+
+// RedactFields sets to the zero value the fields of v, identified by dot separated paths of JSON field names, eg: "address.street".
+// Paths going through slices, arrays or maps apply to all of their elements.
+// A value v is copied, but if v is a pointer, or has pointers in the path, the pointed values are changed in place.
+func RedactFields(v interface{}, paths ...string) (interface{}, error) {
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() {
+		return v, nil
+	}
+	for _, p := range paths {
+		if err := checkPath(rv.Type(), splitPath(p)); err != nil {
+			return nil, faults.Errorf("Invalid path '%s' for %s: %w", p, rv.Type(), err)
+		}
+	}
+
+	target := rv
+	if rv.Kind() != reflect.Ptr {
+		target = reflect.New(rv.Type()).Elem()
+		target.Set(rv)
+	}
+	for _, p := range paths {
+		redactPath(target, splitPath(p))
+	}
+	return target.Interface(), nil
+}
+
+func splitPath(path string) []string {
+	return strings.Split(path, ".")
+}
+
+// checkPath checks if the path exists in the type
+func checkPath(t reflect.Type, path []string) error {
+	for len(path) > 0 {
+		switch t.Kind() {
+		case reflect.Ptr, reflect.Slice, reflect.Array:
+			t = t.Elem()
+		case reflect.Map:
+			if t.Key().Kind() != reflect.String {
+				return faults.Errorf("map keys of %s are not strings", t)
+			}
+			t = t.Elem()
+			path = path[1:]
+		case reflect.Struct:
+			f, ok := jsonField(t, path[0])
+			if !ok {
+				return faults.Errorf("field '%s' not found in %s", path[0], t)
+			}
+			t = f.Type
+			path = path[1:]
+		case reflect.Interface:
+			// the dynamic type is only known at runtime
+			return nil
+		default:
+			return faults.Errorf("field '%s' not found in %s", path[0], t)
+		}
+	}
+	return nil
+}
+
+// redactPath sets to the zero value the field at the end of the path. The path must have been checked.
+func redactPath(v reflect.Value, path []string) {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return
+		}
+		e := v.Elem()
+		if v.Kind() == reflect.Interface {
+			// values held by interfaces are not addressable
+			c := reflect.New(e.Type()).Elem()
+			c.Set(e)
+			redactPath(c, path)
+			v.Set(c)
+			return
+		}
+		redactPath(e, path)
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			redactPath(v.Index(i), path)
+		}
+	case reflect.Map:
+		key := reflect.ValueOf(path[0]).Convert(v.Type().Key())
+		e := v.MapIndex(key)
+		if !e.IsValid() {
+			return
+		}
+		c := reflect.New(e.Type()).Elem()
+		if len(path) > 1 {
+			c.Set(e)
+			redactPath(c, path[1:])
+		}
+		v.SetMapIndex(key, c)
+	case reflect.Struct:
+		f, ok := jsonField(v.Type(), path[0])
+		if !ok {
+			return
+		}
+		fv, ok := fieldByIndex(v, f.Index)
+		if !ok {
+			return
+		}
+		if len(path) == 1 {
+			fv.Set(reflect.Zero(fv.Type()))
+			return
+		}
+		redactPath(fv, path[1:])
+	}
+}
+
+// fieldByIndex is like reflect.Value.FieldByIndex but it does not panic on nil embedded pointers
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+// jsonField finds the exported field, following the encoding/json naming rules, including the promoted fields of embedded structs.
+func jsonField(t reflect.Type, name string) (reflect.StructField, bool) {
+	var fold *reflect.StructField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		tagName := strings.Split(tag, ",")[0]
+		if f.Anonymous && tagName == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				if sf, ok := jsonField(ft, name); ok {
+					sf.Index = append([]int{i}, sf.Index...)
+					return sf, true
+				}
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			// unexported
+			continue
+		}
+		fieldName := tagName
+		if fieldName == "" {
+			fieldName = f.Name
+		}
+		if fieldName == name {
+			return f, true
+		}
+		if fold == nil && strings.EqualFold(fieldName, name) {
+			f := f
+			fold = &f
+		}
+	}
+	if fold != nil {
+		return *fold, true
+	}
+	return reflect.StructField{}, false
+}
@@ -0,0 +1,116 @@
+package eventsourcing_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/quintans/eventsourcing"
+	"github.com/quintans/eventsourcing/store/inmem"
+	"github.com/quintans/eventsourcing/test"
+)
+
+type address struct {
+	Street string `json:"street"`
+	City   string `json:"city"`
+}
+
+type person struct {
+	Name      string                 `json:"name"`
+	Address   address                `json:"address"`
+	Previous  []*address             `json:"previous"`
+	Extra     map[string]interface{} `json:"extra"`
+	Nickname  string
+	unchanged string
+}
+
+func TestRedactFields(t *testing.T) {
+	p := person{
+		Name:     "Paulo",
+		Address:  address{Street: "Main", City: "Lisbon"},
+		Previous: []*address{{Street: "Old", City: "Porto"}, nil},
+		Extra:    map[string]interface{}{"phone": "123", "age": 40},
+		Nickname: "PQ",
+	}
+	v, err := eventsourcing.RedactFields(p, "address.street", "previous.street", "extra.phone", "nickname")
+	require.NoError(t, err)
+	r := v.(person)
+	assert.Equal(t, "Paulo", r.Name)
+	assert.Equal(t, address{City: "Lisbon"}, r.Address)
+	assert.Equal(t, &address{City: "Porto"}, r.Previous[0])
+	assert.Nil(t, r.Previous[1])
+	assert.Equal(t, map[string]interface{}{"phone": nil, "age": 40}, r.Extra)
+	assert.Empty(t, r.Nickname)
+	// the original value is not changed
+	assert.Equal(t, "Main", p.Address.Street)
+
+	_, err = eventsourcing.RedactFields(p, "address.zip")
+	require.Error(t, err)
+	_, err = eventsourcing.RedactFields(p, "name.first")
+	require.Error(t, err)
+	_, err = eventsourcing.RedactFields(p, "unchanged")
+	require.Error(t, err)
+}
+
+func TestForgetFields(t *testing.T) {
+	ctx := context.Background()
+	r := inmem.NewStore()
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{}, eventsourcing.WithSnapshotThreshold(3))
+
+	id := uuid.New()
+	acc := test.CreateAccount("Paulo", id, 100)
+	acc.UpdateOwner("Paulo Quintans")
+	acc.Deposit(10)
+	err := es.Save(ctx, acc)
+	require.NoError(t, err)
+
+	request := eventsourcing.ForgetFieldsRequest{
+		AggregateID:   id.String(),
+		AggregateType: "Account",
+		Events: []eventsourcing.EventFields{
+			{Kind: "AccountCreated", Fields: []string{"owner"}},
+			{Kind: "OwnerUpdated", Fields: []string{"owner"}},
+		},
+		AggregateFields: []string{"owner"},
+	}
+
+	// an unknown field aborts before anything is changed
+	invalid := request
+	invalid.Events = append(invalid.Events, eventsourcing.EventFields{Kind: "MoneyDeposited", Fields: []string{"owner"}})
+	err = es.ForgetFields(ctx, invalid)
+	require.Error(t, err)
+	events, err := r.GetAggregateEvents(ctx, id.String(), -1)
+	require.NoError(t, err)
+	for _, e := range events {
+		assert.False(t, e.IsForgotten())
+	}
+
+	err = es.ForgetFields(ctx, request)
+	require.NoError(t, err)
+
+	events, err = r.GetAggregateEvents(ctx, id.String(), -1)
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+	ac := test.AccountCreated{}
+	err = json.Unmarshal(events[0].Body, &ac)
+	require.NoError(t, err)
+	assert.Empty(t, ac.Owner)
+	assert.Equal(t, int64(100), ac.Money)
+	ou := test.OwnerUpdated{}
+	err = json.Unmarshal(events[1].Body, &ou)
+	require.NoError(t, err)
+	assert.Empty(t, ou.Owner)
+	assert.False(t, events[2].IsForgotten())
+
+	snap, err := r.GetSnapshot(ctx, id.String())
+	require.NoError(t, err)
+	a := test.NewAccount()
+	err = json.Unmarshal(snap.Body, a)
+	require.NoError(t, err)
+	assert.Empty(t, a.Owner)
+	assert.Equal(t, int64(110), a.Balance)
+}
@@ -3,6 +3,12 @@ module github.com/quintans/eventsourcing
 go 1.15
 
 require (
+	github.com/Shopify/sarama v1.27.2
+	github.com/alicebob/miniredis/v2 v2.14.3
+	github.com/aws/aws-sdk-go-v2 v1.16.16
+	github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue v1.10.0
+	github.com/aws/aws-sdk-go-v2/service/dynamodb v1.17.1
+	github.com/aws/aws-sdk-go-v2/service/dynamodbstreams v1.13.20
 	github.com/cenkalti/backoff/v4 v4.1.0
 	github.com/docker/go-connections v0.4.0
 	github.com/elastic/go-elasticsearch/v7 v7.10.0
@@ -10,7 +16,7 @@ require (
 	github.com/go-redis/redis/v8 v8.4.0
 	github.com/go-sql-driver/mysql v1.5.0
 	github.com/golang-migrate/migrate/v4 v4.11.0
-	github.com/golang/protobuf v1.4.2
+	github.com/golang/protobuf v1.4.3
 	github.com/google/uuid v1.1.2
 	github.com/hashicorp/consul/api v1.8.0
 	github.com/jackc/fake v0.0.0-20150926172116-812a484cc733 // indirect
@@ -22,17 +28,23 @@ require (
 	github.com/jmoiron/sqlx v1.3.3
 	github.com/kyleconroy/pgoutput v0.1.0
 	github.com/lib/pq v1.7.0
+	github.com/linkedin/goavro/v2 v2.9.8
+	github.com/mattn/go-sqlite3 v1.14.12
 	github.com/nats-io/nats-server/v2 v2.1.8 // indirect
 	github.com/nats-io/nats-streaming-server v0.18.0 // indirect
-	github.com/nats-io/nats.go v1.10.0
+	github.com/nats-io/nats.go v1.11.0
 	github.com/nats-io/stan.go v0.7.0
 	github.com/oklog/ulid/v2 v2.0.2
 	github.com/pingcap/check v0.0.0-20200212061837-5e12011dc712 // indirect
+	github.com/prometheus/client_golang v1.9.0
 	github.com/quintans/faults v1.4.0
-	github.com/sirupsen/logrus v1.4.2
+	github.com/sirupsen/logrus v1.6.0
 	github.com/stretchr/testify v1.6.1
 	github.com/testcontainers/testcontainers-go v0.9.0
+	github.com/vmihailenco/msgpack/v5 v5.3.5
 	go.mongodb.org/mongo-driver v1.1.0
+	go.opentelemetry.io/otel v0.14.0
+	golang.org/x/time v0.0.0-20191024005414-555d28b269f0
 	google.golang.org/grpc v1.27.1
 	google.golang.org/protobuf v1.25.0
 	gotest.tools v0.0.0-20181223230014-1083505acf35
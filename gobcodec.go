@@ -0,0 +1,169 @@
+package eventsourcing
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/gob"
+	"reflect"
+	"sync"
+
+	"github.com/quintans/faults"
+)
+
+// GobContentType is the content type of the events encoded with GobCodec
+const GobContentType = "application/x-gob"
+
+// GobCodec encodes and decodes events and aggregate snapshots with gob, for events only read by Go services.
+// It needs no struct tags, but only the exported fields are encoded and, since every body carries the description of its types,
+// it is slower than JSONCodec for single values (see BenchmarkCodecs).
+// Only the types registered through the factory can be encoded.
+type GobCodec struct {
+	types map[reflect.Type]bool
+}
+
+// NewGobCodec registers in gob, under their kind, the types of the events and aggregates instantiated by the factory for the kinds,
+// so that they can also be encoded when held by interfaces.
+func NewGobCodec(factory Factory, kinds ...string) (_ GobCodec, err error) {
+	c := GobCodec{
+		types: map[reflect.Type]bool{},
+	}
+	defer func() {
+		// gob panics on conflicting registrations
+		if r := recover(); r != nil {
+			err = faults.Errorf("Unable to register in gob: %v", r)
+		}
+	}()
+	for _, kind := range kinds {
+		v, err := factory.New(kind)
+		if err != nil {
+			return GobCodec{}, err
+		}
+		gob.RegisterName(kind, v)
+		t := reflect.TypeOf(v)
+		c.types[t] = true
+		if t.Kind() == reflect.Ptr {
+			c.types[t.Elem()] = true
+		}
+	}
+	return c, nil
+}
+
+func (GobCodec) ContentType() string {
+	return GobContentType
+}
+
+func (c GobCodec) Encode(v interface{}) ([]byte, error) {
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() || !c.types[rv.Type()] {
+		return nil, faults.Errorf("unable to encode %T: the type was not registered in the gob codec", v)
+	}
+	rv = reflect.Indirect(rv)
+	if view := gobViewOf(rv.Type()); view != nil {
+		rv = view.from(rv)
+	}
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).EncodeValue(rv)
+	if err != nil {
+		return nil, faults.Errorf("unable to encode %T: %w", v, err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (c GobCodec) Decode(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() || rv.Kind() != reflect.Ptr || !c.types[rv.Type()] {
+		return faults.Errorf("unable to decode into %T: the type was not registered in the gob codec", v)
+	}
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	view := gobViewOf(rv.Type().Elem())
+	if view == nil {
+		return faults.Wrap(dec.DecodeValue(rv))
+	}
+	vv := reflect.New(view.typ)
+	if err := dec.DecodeValue(vv); err != nil {
+		return faults.Wrap(err)
+	}
+	view.to(vv.Elem(), rv.Elem())
+	return nil
+}
+
+// gobView is a struct type without the embedded structs that gob can't encode, like RootAggregate,
+// since gob fails with fields of struct types without exported fields.
+type gobView struct {
+	typ    reflect.Type
+	fields []int
+}
+
+var gobViews sync.Map
+
+// gobViewOf returns the view of the struct type, or nil if gob can encode the type as it is
+func gobViewOf(t reflect.Type) *gobView {
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	if v, ok := gobViews.Load(t); ok {
+		return v.(*gobView)
+	}
+
+	var view *gobView
+	fields := []reflect.StructField{}
+	indexes := []int{}
+	skipped := false
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			// unexported fields are not encoded
+			continue
+		}
+		if f.Anonymous && !gobEncodable(f.Type) {
+			skipped = true
+			continue
+		}
+		fields = append(fields, reflect.StructField{Name: f.Name, Type: f.Type})
+		indexes = append(indexes, i)
+	}
+	if skipped {
+		view = &gobView{
+			typ:    reflect.StructOf(fields),
+			fields: indexes,
+		}
+	}
+	gobViews.Store(t, view)
+	return view
+}
+
+func (g *gobView) from(v reflect.Value) reflect.Value {
+	view := reflect.New(g.typ).Elem()
+	for k, i := range g.fields {
+		view.Field(k).Set(v.Field(i))
+	}
+	return view
+}
+
+func (g *gobView) to(view, v reflect.Value) {
+	for k, i := range g.fields {
+		v.Field(i).Set(view.Field(k))
+	}
+}
+
+var (
+	gobEncoderType    = reflect.TypeOf((*gob.GobEncoder)(nil)).Elem()
+	binaryMarshalType = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+)
+
+// gobEncodable tells if gob can encode the struct type, by having exported fields or by encoding itself, like time.Time
+func gobEncodable(t reflect.Type) bool {
+	if t.Kind() != reflect.Struct {
+		return true
+	}
+	p := reflect.PtrTo(t)
+	if p.Implements(gobEncoderType) || p.Implements(binaryMarshalType) {
+		return true
+	}
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).PkgPath == "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,182 @@
+package lock
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// PgLockPool creates locks based on PostgreSQL session advisory locks
+type PgLockPool struct {
+	db *sql.DB
+}
+
+func NewPgLockPool(db *sql.DB) PgLockPool {
+	return PgLockPool{
+		db: db,
+	}
+}
+
+// NewLock creates a lock keyed by the lock name, eg: the projection name.
+// Since advisory locks are held by the database session, the lock keeps a connection of the pool while acquired,
+// checking it at every heartbeat. If the connection is lost, so is the lock, and the done channel is closed.
+func (p PgLockPool) NewLock(lockName string, heartbeat time.Duration) *PgLock {
+	return &PgLock{
+		db:        p.db,
+		lockName:  lockName,
+		key:       lockKey(lockName),
+		heartbeat: heartbeat,
+	}
+}
+
+// lockKey derives the advisory lock key from the lock name
+func lockKey(lockName string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(lockName))
+	return int64(h.Sum64())
+}
+
+type PgLock struct {
+	db        *sql.DB
+	lockName  string
+	key       int64
+	heartbeat time.Duration
+	conn      *sql.Conn
+	done      chan struct{}
+	mu        sync.Mutex
+}
+
+// Lock tries to acquire the lock, returning a nil channel if it is held by someone else
+func (l *PgLock) Lock(ctx context.Context) (chan struct{}, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.done != nil {
+		return nil, fmt.Errorf("this lock '%s' is already acquired. Unlock it first", l.lockName)
+	}
+
+	conn, err := l.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var acquired bool
+	err = conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", l.key).Scan(&acquired)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !acquired {
+		conn.Close()
+		return nil, nil
+	}
+
+	l.conn = conn
+	l.done = make(chan struct{})
+	go l.keepAlive(conn, l.done)
+
+	return l.done, nil
+}
+
+// keepAlive releases the lock if the session holding it is lost
+func (l *PgLock) keepAlive(conn *sql.Conn, done chan struct{}) {
+	ticker := time.NewTicker(l.heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			// we use a new context because the one of Lock may no longer be usable
+			ctx, cancel := context.WithTimeout(context.Background(), l.heartbeat)
+			err := conn.PingContext(ctx)
+			cancel()
+			if err != nil {
+				l.release(done)
+				return
+			}
+		}
+	}
+}
+
+// release closes the done channel and the connection, if done is still the current one
+func (l *PgLock) release(done chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.done != done {
+		return
+	}
+	close(l.done)
+	l.done = nil
+	// the session may still be alive, holding the lock
+	discard(l.conn)
+	l.conn = nil
+}
+
+// Unlock releases the lock. The unlock runs with a context of its own, bounded by the heartbeat,
+// since the one of the caller may already be done, eg: when stopping.
+func (l *PgLock) Unlock(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.done == nil {
+		return nil
+	}
+
+	close(l.done)
+	l.done = nil
+	ctx, cancel := context.WithTimeout(context.Background(), l.heartbeat)
+	defer cancel()
+	// closing the connection would also release the lock, but it may only be returned to the pool
+	_, err := l.conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", l.key)
+	if err != nil {
+		// the session still holding the lock must not go back to the pool
+		discard(l.conn)
+	} else {
+		l.conn.Close()
+	}
+	l.conn = nil
+
+	return err
+}
+
+// discard closes the database session of the connection, instead of returning it to the pool,
+// releasing any advisory lock that it holds
+func discard(conn *sql.Conn) {
+	// a bad connection is closed by the pool
+	_ = conn.Raw(func(interface{}) error {
+		return driver.ErrBadConn
+	})
+	conn.Close()
+}
+
+// WaitForUnlock waits until no session holds the lock
+func (l *PgLock) WaitForUnlock(ctx context.Context) error {
+	ticker := time.NewTicker(l.heartbeat)
+	defer ticker.Stop()
+	for {
+		// a bigint advisory lock key is split between classid (high bits) and objid (low bits)
+		var locked bool
+		err := l.db.QueryRowContext(ctx,
+			"SELECT EXISTS(SELECT 1 FROM pg_locks WHERE locktype = 'advisory' AND classid = $1 AND objid = $2 AND objsubid = 1)",
+			int64(uint64(l.key)>>32), int64(uint32(l.key)),
+		).Scan(&locked)
+		if err != nil {
+			return err
+		}
+		if !locked {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -4,6 +4,22 @@ import "github.com/sirupsen/logrus"
 
 type Tags map[string]interface{}
 
+// Tags shared by the feeds, the poller and the projections, so that the progress of a feed can be correlated across components
+const (
+	TagProjection   = "projection"
+	TagPartitionLow = "partitionLow"
+	TagPartitionHi  = "partitionHi"
+	TagLastEventID  = "lastEventID"
+)
+
+// PartitionTags are the tags of the partition range [low, hi] of a feed. Zero means no partitioning.
+func PartitionTags(low, hi uint32) Tags {
+	return Tags{
+		TagPartitionLow: low,
+		TagPartitionHi:  hi,
+	}
+}
+
 type Logger interface {
 	Debug(args ...interface{})
 	Debugf(format string, args ...interface{})
@@ -30,7 +46,7 @@ func NewLogrus(logger *logrus.Logger) LogrusWrap {
 }
 
 func (l LogrusWrap) Debug(args ...interface{}) {
-	logrus.Debug(args...)
+	l.logger.Debug(args...)
 }
 
 func (l LogrusWrap) Debugf(format string, args ...interface{}) {
@@ -78,3 +94,21 @@ func (l LogrusWrap) WithTags(vals Tags) Logger {
 		logger: l.logger.WithFields(logrus.Fields(vals)),
 	}
 }
+
+// NopLogger is a logger that discards everything
+type NopLogger struct{}
+
+var _ Logger = NopLogger{}
+
+func (NopLogger) Debug(args ...interface{})                 {}
+func (NopLogger) Debugf(format string, args ...interface{}) {}
+func (NopLogger) Info(args ...interface{})                  {}
+func (NopLogger) Infof(format string, args ...interface{})  {}
+func (NopLogger) Warn(args ...interface{})                  {}
+func (NopLogger) Warnf(format string, args ...interface{})  {}
+func (NopLogger) Error(args ...interface{})                 {}
+func (NopLogger) Errorf(format string, args ...interface{}) {}
+func (NopLogger) Fatal(args ...interface{})                 {}
+func (NopLogger) Fatalf(format string, args ...interface{}) {}
+func (l NopLogger) WithTags(tags Tags) Logger               { return l }
+func (l NopLogger) WithError(err error) Logger              { return l }
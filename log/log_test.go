@@ -0,0 +1,30 @@
+package log_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/quintans/eventsourcing/log"
+)
+
+func TestLogrusTags(t *testing.T) {
+	var buf bytes.Buffer
+	l := logrus.New()
+	l.SetOutput(&buf)
+	l.SetLevel(logrus.DebugLevel)
+	l.SetFormatter(&logrus.TextFormatter{DisableTimestamp: true})
+
+	logger := log.NewLogrus(l).
+		WithTags(log.PartitionTags(1, 4)).
+		WithTags(log.Tags{log.TagProjection: "balances"})
+	logger.Debug("Polled events")
+
+	out := buf.String()
+	assert.Contains(t, out, "Polled events")
+	assert.Contains(t, out, "partitionLow=1")
+	assert.Contains(t, out, "partitionHi=4")
+	assert.Contains(t, out, "projection=balances")
+}
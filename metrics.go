@@ -0,0 +1,41 @@
+package eventsourcing
+
+import (
+	"time"
+)
+
+// Recorder receives the measurements of the event store operations, to be exported as metrics
+type Recorder interface {
+	// EventsSaved is called after the events of an aggregate are saved
+	EventsSaved(aggregateType string, count int)
+	// SnapshotSaved is called after a snapshot is saved, by the background workers with asynchronous snapshots
+	SnapshotSaved(aggregateType string)
+	// ConcurrencyConflict is called when a save fails due to a concurrent modification
+	ConcurrencyConflict(aggregateType string)
+	// EventBodySize is called with the size, in bytes, of each encoded event body, before it is saved
+	EventBodySize(aggregateType string, size int)
+	// AggregateLoaded is called after GetByID, with how long it took and the number of events replayed over the snapshot
+	AggregateLoaded(aggregateType string, latency time.Duration, replayedEvents int)
+}
+
+// SnapshotFailureRecorder is an optional interface of the Recorder, called when the snapshot taken by Save can't be saved,
+// or, with asynchronous snapshots, queued. Save doesn't fail in that case, since the events are already saved.
+type SnapshotFailureRecorder interface {
+	SnapshotFailed(aggregateType string)
+}
+
+// WithMetrics sets the recorder that receives the measurements of the event store operations
+func WithMetrics(recorder Recorder) EsOptions {
+	return func(r *EventStore) {
+		r.recorder = recorder
+	}
+}
+
+// nopRecorder is the recorder used when no recorder is configured
+type nopRecorder struct{}
+
+func (nopRecorder) EventsSaved(string, int)                    {}
+func (nopRecorder) SnapshotSaved(string)                       {}
+func (nopRecorder) ConcurrencyConflict(string)                 {}
+func (nopRecorder) EventBodySize(string, int)                  {}
+func (nopRecorder) AggregateLoaded(string, time.Duration, int) {}
@@ -0,0 +1,128 @@
+package prometheus
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/quintans/faults"
+
+	"github.com/quintans/eventsourcing"
+	"github.com/quintans/eventsourcing/worker"
+)
+
+const (
+	labelAggregateType = "aggregate_type"
+	labelWorker        = "worker"
+)
+
+var (
+	_ eventsourcing.Recorder                = (*Recorder)(nil)
+	_ eventsourcing.SnapshotFailureRecorder = (*Recorder)(nil)
+	_ worker.Recorder                       = (*Recorder)(nil)
+)
+
+// Recorder exports the event store measurements as Prometheus metrics, labeled by aggregate type,
+// and the start failures of the balanced workers, labeled by worker
+type Recorder struct {
+	eventsSaved         *prometheus.CounterVec
+	snapshotsSaved      *prometheus.CounterVec
+	snapshotsFailed     *prometheus.CounterVec
+	conflicts           *prometheus.CounterVec
+	bodySize            *prometheus.HistogramVec
+	loadLatency         *prometheus.HistogramVec
+	replayedEvents      *prometheus.HistogramVec
+	workerStartFailures *prometheus.CounterVec
+}
+
+// NewRecorder creates the metrics, under the namespace, and registers them in the registerer.
+// If the registerer is nil, the default Prometheus registerer is used.
+func NewRecorder(namespace string, registerer prometheus.Registerer) (_ *Recorder, err error) {
+	defer faults.Catch(&err, "prometheus.NewRecorder(namespace=%s)", namespace)
+
+	if registerer == nil {
+		registerer = prometheus.DefaultRegisterer
+	}
+
+	r := &Recorder{
+		eventsSaved: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "events_saved_total",
+			Help:      "Number of events saved.",
+		}, []string{labelAggregateType}),
+		snapshotsSaved: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "snapshots_saved_total",
+			Help:      "Number of snapshots saved.",
+		}, []string{labelAggregateType}),
+		snapshotsFailed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "snapshots_failed_total",
+			Help:      "Number of snapshots that could not be saved or queued.",
+		}, []string{labelAggregateType}),
+		conflicts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "concurrency_conflicts_total",
+			Help:      "Number of saves that failed due to a concurrent modification.",
+		}, []string{labelAggregateType}),
+		bodySize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "event_body_size_bytes",
+			Help:      "Size of the encoded event bodies.",
+			Buckets:   prometheus.ExponentialBuckets(64, 4, 8),
+		}, []string{labelAggregateType}),
+		loadLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "aggregate_load_duration_seconds",
+			Help:      "Time taken to load an aggregate.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{labelAggregateType}),
+		replayedEvents: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "aggregate_load_replayed_events",
+			Help:      "Number of events replayed to load an aggregate.",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 10),
+		}, []string{labelAggregateType}),
+		workerStartFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "worker_start_failures_total",
+			Help:      "Number of times a balanced worker failed to start.",
+		}, []string{labelWorker}),
+	}
+
+	for _, c := range []prometheus.Collector{r.eventsSaved, r.snapshotsSaved, r.snapshotsFailed, r.conflicts, r.bodySize, r.loadLatency, r.replayedEvents, r.workerStartFailures} {
+		if err := registerer.Register(c); err != nil {
+			return nil, faults.Wrap(err)
+		}
+	}
+
+	return r, nil
+}
+
+func (r *Recorder) EventsSaved(aggregateType string, count int) {
+	r.eventsSaved.WithLabelValues(aggregateType).Add(float64(count))
+}
+
+func (r *Recorder) SnapshotSaved(aggregateType string) {
+	r.snapshotsSaved.WithLabelValues(aggregateType).Inc()
+}
+
+func (r *Recorder) SnapshotFailed(aggregateType string) {
+	r.snapshotsFailed.WithLabelValues(aggregateType).Inc()
+}
+
+func (r *Recorder) ConcurrencyConflict(aggregateType string) {
+	r.conflicts.WithLabelValues(aggregateType).Inc()
+}
+
+func (r *Recorder) EventBodySize(aggregateType string, size int) {
+	r.bodySize.WithLabelValues(aggregateType).Observe(float64(size))
+}
+
+func (r *Recorder) AggregateLoaded(aggregateType string, latency time.Duration, replayedEvents int) {
+	r.loadLatency.WithLabelValues(aggregateType).Observe(latency.Seconds())
+	r.replayedEvents.WithLabelValues(aggregateType).Observe(float64(replayedEvents))
+}
+
+func (r *Recorder) WorkerStartFailed(worker string) {
+	r.workerStartFailures.WithLabelValues(worker).Inc()
+}
@@ -0,0 +1,61 @@
+package prometheus_test
+
+import (
+	"testing"
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/quintans/eventsourcing/metrics/prometheus"
+)
+
+func TestRecorder(t *testing.T) {
+	reg := prom.NewRegistry()
+	r, err := prometheus.NewRecorder("es", reg)
+	require.NoError(t, err)
+
+	r.EventsSaved("Account", 2)
+	r.EventsSaved("Account", 1)
+	r.SnapshotSaved("Account")
+	r.SnapshotFailed("Account")
+	r.ConcurrencyConflict("Account")
+	r.EventBodySize("Account", 100)
+	r.AggregateLoaded("Account", 10*time.Millisecond, 3)
+	r.WorkerStartFailed("worker-1")
+	r.WorkerStartFailed("worker-1")
+
+	mfs, err := reg.Gather()
+	require.NoError(t, err)
+	metrics := map[string]float64{}
+	for _, mf := range mfs {
+		m := mf.GetMetric()[0]
+		if mf.GetName() == "es_worker_start_failures_total" {
+			assert.Equal(t, "worker", m.GetLabel()[0].GetName())
+			assert.Equal(t, "worker-1", m.GetLabel()[0].GetValue())
+		} else {
+			assert.Equal(t, "aggregate_type", m.GetLabel()[0].GetName())
+			assert.Equal(t, "Account", m.GetLabel()[0].GetValue())
+		}
+		if h := m.GetHistogram(); h != nil {
+			metrics[mf.GetName()] = h.GetSampleSum()
+		} else {
+			metrics[mf.GetName()] = m.GetCounter().GetValue()
+		}
+	}
+	assert.Equal(t, map[string]float64{
+		"es_events_saved_total":              3,
+		"es_snapshots_saved_total":           1,
+		"es_snapshots_failed_total":          1,
+		"es_concurrency_conflicts_total":     1,
+		"es_event_body_size_bytes":           100,
+		"es_aggregate_load_duration_seconds": 0.01,
+		"es_aggregate_load_replayed_events":  3,
+		"es_worker_start_failures_total":     2,
+	}, metrics)
+
+	// metrics can only be registered once
+	_, err = prometheus.NewRecorder("es", reg)
+	require.Error(t, err)
+}
@@ -0,0 +1,36 @@
+package msgpack
+
+import (
+	"bytes"
+
+	"github.com/quintans/faults"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// MsgpackCodec encodes and decodes events and aggregate snapshots with MessagePack, a compact binary alternative to JSON.
+// The field names follow the json tags, so the same structs can be used with JSONCodec.
+type MsgpackCodec struct{}
+
+// ContentType is the content type of the events encoded with MsgpackCodec
+const ContentType = "application/x-msgpack"
+
+func (MsgpackCodec) ContentType() string {
+	return ContentType
+}
+
+func (MsgpackCodec) Encode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	if err := enc.Encode(v); err != nil {
+		return nil, faults.Wrap(err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (MsgpackCodec) Decode(data []byte, v interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	err := dec.Decode(v)
+	return faults.Wrap(err)
+}
@@ -0,0 +1,59 @@
+package msgpack_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/quintans/eventsourcing"
+	"github.com/quintans/eventsourcing/msgpack"
+	"github.com/quintans/eventsourcing/store/inmem"
+	"github.com/quintans/eventsourcing/test"
+)
+
+func TestRoundTrip(t *testing.T) {
+	codec := msgpack.MsgpackCodec{}
+
+	b, err := codec.Encode(test.OwnerUpdated{Owner: "Paulo"})
+	require.NoError(t, err)
+
+	e, err := eventsourcing.RehydrateEvent(test.AggregateFactory{}, codec, nil, "OwnerUpdated", b)
+	require.NoError(t, err)
+	assert.Equal(t, test.OwnerUpdated{Owner: "Paulo"}, e)
+}
+
+func TestEventStore(t *testing.T) {
+	ctx := context.Background()
+	r := inmem.NewStore()
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{},
+		eventsourcing.WithCodec(msgpack.MsgpackCodec{}),
+		eventsourcing.WithSnapshotThreshold(3),
+	)
+
+	id := uuid.New()
+	acc := test.CreateAccount("Paulo", id, 100)
+	acc.Deposit(10)
+	acc.Deposit(20)
+	err := es.Save(ctx, acc)
+	require.NoError(t, err)
+	acc.Withdraw(15)
+	err = es.Save(ctx, acc)
+	require.NoError(t, err)
+
+	events, err := r.GetAggregateEvents(ctx, id.String(), -1)
+	require.NoError(t, err)
+	require.Len(t, events, 4)
+	assert.Equal(t, msgpack.ContentType, events[0].ContentType)
+
+	// from the snapshot and the last event
+	a, err := es.GetByID(ctx, id.String())
+	require.NoError(t, err)
+	acc2 := a.(*test.Account)
+	assert.Equal(t, id, acc2.ID)
+	assert.Equal(t, "Paulo", acc2.Owner)
+	assert.Equal(t, int64(115), acc2.Balance)
+	assert.Equal(t, uint32(4), acc2.GetVersion())
+}
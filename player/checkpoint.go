@@ -0,0 +1,51 @@
+package player
+
+import (
+	"context"
+
+	"github.com/quintans/faults"
+
+	"github.com/quintans/eventsourcing/eventid"
+)
+
+// Checkpointer persists the position of a named replay, so that a long running replay can be resumed after a restart.
+type Checkpointer interface {
+	// GetCheckpoint returns the last processed event ID of the replay, or eventid.Zero if there is none
+	GetCheckpoint(ctx context.Context, name string) (eventid.EventID, error)
+	SetCheckpoint(ctx context.Context, name string, eventID eventid.EventID) error
+}
+
+// TokenStore is a key value store of tokens, like the projection stream resumers
+type TokenStore interface {
+	GetStreamResumeToken(ctx context.Context, key string) (string, error)
+	SetStreamResumeToken(ctx context.Context, key string, token string) error
+}
+
+var _ Checkpointer = TokenCheckpointer{}
+
+// TokenCheckpointer keeps the replay checkpoints in a TokenStore, under the replay name
+type TokenCheckpointer struct {
+	store TokenStore
+}
+
+func NewTokenCheckpointer(store TokenStore) TokenCheckpointer {
+	return TokenCheckpointer{
+		store: store,
+	}
+}
+
+func (c TokenCheckpointer) GetCheckpoint(ctx context.Context, name string) (eventid.EventID, error) {
+	token, err := c.store.GetStreamResumeToken(ctx, name)
+	if err != nil {
+		return eventid.Zero, err
+	}
+	id, err := eventid.Parse(token)
+	if err != nil {
+		return eventid.Zero, faults.Errorf("Invalid checkpoint for replay '%s': %w", name, err)
+	}
+	return id, nil
+}
+
+func (c TokenCheckpointer) SetCheckpoint(ctx context.Context, name string, eventID eventid.EventID) error {
+	return c.store.SetStreamResumeToken(ctx, name, eventID.String())
+}
@@ -0,0 +1,94 @@
+package player
+
+import (
+	"context"
+
+	"github.com/quintans/eventsourcing"
+	"github.com/quintans/eventsourcing/eventid"
+	"github.com/quintans/eventsourcing/store"
+)
+
+// EventIterator iterates over the events of a repository, fetching them in batches as needed.
+//
+//	it := p.Iterator(ctx, eventid.Zero)
+//	for it.Next() {
+//		e := it.Event()
+//		...
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type EventIterator struct {
+	ctx          context.Context
+	player       Player
+	filter       store.Filter
+	afterEventID eventid.EventID
+	batch        []eventsourcing.Event
+	event        eventsourcing.Event
+	err          error
+	done         bool
+}
+
+// Iterator returns an iterator over the events after afterEventID, using the batch size, trailing lag and custom filter of the player.
+// The checkpointer of the player is not used. The iteration stops when there are no more events or the context is cancelled.
+func (p Player) Iterator(ctx context.Context, afterEventID eventid.EventID, filters ...store.FilterOption) *EventIterator {
+	filter := store.Filter{}
+	for _, f := range filters {
+		f(&filter)
+	}
+	return &EventIterator{
+		ctx:          ctx,
+		player:       p,
+		filter:       filter,
+		afterEventID: afterEventID,
+	}
+}
+
+// Next moves to the next event, returning false when there are no more events or if an error occurred.
+func (it *EventIterator) Next() bool {
+	for !it.done {
+		if err := it.ctx.Err(); err != nil {
+			it.err = err
+			it.done = true
+			return false
+		}
+
+		if len(it.batch) == 0 {
+			events, err := it.player.store.GetEvents(it.ctx, it.afterEventID, it.player.batchSize, it.player.trailingLag, it.filter)
+			if err != nil {
+				it.err = err
+				it.done = true
+				return false
+			}
+			if len(events) == 0 {
+				it.done = true
+				return false
+			}
+			it.batch = events
+		}
+
+		e := it.batch[0]
+		it.batch = it.batch[1:]
+		it.afterEventID = e.ID
+		if it.player.customFilter == nil || it.player.customFilter(e) {
+			it.event = e
+			return true
+		}
+	}
+	return false
+}
+
+// Event returns the current event
+func (it *EventIterator) Event() eventsourcing.Event {
+	return it.event
+}
+
+// Err returns the error that stopped the iteration, if any, including the context error if it was cancelled
+func (it *EventIterator) Err() error {
+	return it.err
+}
+
+// LastEventID returns the ID of the last event read, to resume the iteration later
+func (it *EventIterator) LastEventID() eventid.EventID {
+	return it.afterEventID
+}
@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/quintans/faults"
+	"golang.org/x/time/rate"
 
 	"github.com/quintans/eventsourcing"
 	"github.com/quintans/eventsourcing/eventid"
@@ -30,10 +31,17 @@ const (
 	END Start = iota
 	BEGINNING
 	SEQUENCE
+	PARTITIONS
 )
 
 type EventHandlerFunc func(ctx context.Context, e eventsourcing.Event) error
 
+// ProgressFunc receives the number of events processed by a replay, and the ID and creation time of the last one
+type ProgressFunc func(processed int64, lastEventID eventid.EventID, lastCreatedAt time.Time)
+
+// DefaultProgressEvery is how many events are processed between progress reports, unless set with WithProgressEvery
+const DefaultProgressEvery = 1000
+
 type Cancel func()
 
 type Option func(*Player)
@@ -42,8 +50,14 @@ type Player struct {
 	store     Repository
 	batchSize int
 	// lag to account for on same millisecond concurrent inserts and clock skews
-	trailingLag  time.Duration
-	customFilter func(eventsourcing.Event) bool
+	trailingLag    time.Duration
+	customFilter   func(eventsourcing.Event) bool
+	checkpointer   Checkpointer
+	checkpointName string
+	eachEvent      bool
+	limiter        *rate.Limiter
+	progress       ProgressFunc
+	progressEvery  int64
 }
 
 func WithBatchSize(batchSize int) Option {
@@ -66,14 +80,63 @@ func WithCustomFilter(fn func(events eventsourcing.Event) bool) Option {
 	}
 }
 
+// WithCheckpointer persists, under the name, the last replayed event ID after every batch,
+// so that a replay resumes from there after a restart instead of from the supplied event ID.
+// This is intended for one-off bulk replays, like migrations, and not for projections, that have their own resume tokens.
+// Every distinct replay must have its own name.
+func WithCheckpointer(checkpointer Checkpointer, name string) Option {
+	return func(p *Player) {
+		p.checkpointer = checkpointer
+		p.checkpointName = name
+	}
+}
+
+// WithCheckpointEachEvent persists the checkpoint after every handled event, instead of after every batch,
+// so that a replay interrupted by a crash only handles again the event that was being handled.
+// It has no effect without WithCheckpointer.
+func WithCheckpointEachEvent() Option {
+	return func(p *Player) {
+		p.eachEvent = true
+	}
+}
+
+// WithRateLimit limits the events handed to the handler to eventsPerSecond, with a token bucket, eg: to not overwhelm downstream systems during a rebuild.
+// The events are still fetched in batches, but their handling is evenly spaced. Waiting for a token stops when the context is cancelled.
+func WithRateLimit(eventsPerSecond int) Option {
+	return func(p *Player) {
+		if eventsPerSecond > 0 {
+			p.limiter = rate.NewLimiter(rate.Limit(eventsPerSecond), 1)
+		}
+	}
+}
+
+// WithProgress reports the progress of the replays, eg: to log it or to estimate when a rebuild will finish.
+// The progress is reported every time a number of events, set with WithProgressEvery, is processed, and once more when the replay completes.
+// The processed events include the ones discarded by the custom filter.
+func WithProgress(fn ProgressFunc) Option {
+	return func(p *Player) {
+		p.progress = fn
+	}
+}
+
+// WithProgressEvery sets how many events are processed between progress reports. It defaults to DefaultProgressEvery.
+func WithProgressEvery(events int) Option {
+	return func(p *Player) {
+		if events > 0 {
+			p.progressEvery = int64(events)
+		}
+	}
+}
+
 // New instantiates a new Player.
 //
 // trailingLag: lag to account for on same millisecond concurrent inserts and clock skews. A good lag is 200ms.
 func New(repository Repository, options ...Option) Player {
 	p := Player{
-		store:       repository,
-		batchSize:   20,
-		trailingLag: TrailingLag,
+		store:         repository,
+		batchSize:     20,
+		trailingLag:   TrailingLag,
+		progressEvery: DefaultProgressEvery,
 	}
 
 	for _, f := range options {
@@ -84,8 +147,9 @@ func New(repository Repository, options ...Option) Player {
 }
 
 type StartOption struct {
-	startFrom  Start
-	afterMsgID eventid.EventID
+	startFrom       Start
+	afterMsgID      eventid.EventID
+	partitionTokens map[uint32]eventid.EventID
 }
 
 func (so StartOption) StartFrom() Start {
@@ -96,6 +160,11 @@ func (so StartOption) AfterMsgID() eventid.EventID {
 	return so.afterMsgID
 }
 
+// PartitionTokens returns the last event ID consumed by each partition
+func (so StartOption) PartitionTokens() map[uint32]eventid.EventID {
+	return so.partitionTokens
+}
+
 func StartEnd() StartOption {
 	return StartOption{
 		startFrom: END,
@@ -115,6 +184,15 @@ func StartAt(after eventid.EventID) StartOption {
 	}
 }
 
+// StartAtPartitions resumes each partition independently, after the last event ID consumed by that partition.
+// Partitions without a token start from the beginning.
+func StartAtPartitions(tokens map[uint32]eventid.EventID) StartOption {
+	return StartOption{
+		startFrom:       PARTITIONS,
+		partitionTokens: tokens,
+	}
+}
+
 func (p Player) ReplayUntil(ctx context.Context, handler EventHandlerFunc, untilEventID eventid.EventID, filters ...store.FilterOption) (eventid.EventID, error) {
 	return p.ReplayFromUntil(ctx, handler, eventid.Zero, untilEventID, filters...)
 }
@@ -123,31 +201,150 @@ func (p Player) Replay(ctx context.Context, handler EventHandlerFunc, afterEvent
 	return p.ReplayFromUntil(ctx, handler, afterEventID, eventid.Zero, filters...)
 }
 
+// ReplayFromUntil replays the events after afterEventID until, and including, untilEventID.
+// A zero untilEventID replays until the last event.
+// With a checkpointer, the replay resumes from the checkpoint, if it is after afterEventID.
 func (p Player) ReplayFromUntil(ctx context.Context, handler EventHandlerFunc, afterEventID, untilEventID eventid.EventID, filters ...store.FilterOption) (eventid.EventID, error) {
+	if p.checkpointer == nil {
+		return p.replay(ctx, handler, afterEventID, untilEventID, nil, filters...)
+	}
+
+	checkpoint, err := p.checkpointer.GetCheckpoint(ctx, p.checkpointName)
+	if err != nil {
+		return eventid.Zero, faults.Errorf("Unable to get checkpoint of replay '%s': %w", p.checkpointName, err)
+	}
+	if checkpoint.Compare(afterEventID) > 0 {
+		afterEventID = checkpoint
+	}
+	return p.replay(ctx, handler, afterEventID, untilEventID, func(ctx context.Context, eventID eventid.EventID) error {
+		err := p.checkpointer.SetCheckpoint(ctx, p.checkpointName, eventID)
+		if err != nil {
+			return faults.Errorf("Unable to set checkpoint of replay '%s' to %s: %w", p.checkpointName, eventID, err)
+		}
+		return nil
+	}, filters...)
+}
+
+// replay replays the events, calling checkpoint, if not nil, with the last event ID of every batch, or of every handled event
+func (p Player) replay(
+	ctx context.Context,
+	handler EventHandlerFunc,
+	afterEventID, untilEventID eventid.EventID,
+	checkpoint func(ctx context.Context, eventID eventid.EventID) error,
+	filters ...store.FilterOption,
+) (eventid.EventID, error) {
 	filter := store.Filter{}
 	for _, f := range filters {
 		f(&filter)
 	}
+	checkpointed := afterEventID
+	var processed int64
+	var lastCreatedAt time.Time
 	loop := true
 	for loop {
 		events, err := p.store.GetEvents(ctx, afterEventID, p.batchSize, p.trailingLag, filter)
 		if err != nil {
 			return eventid.Zero, err
 		}
+		done := false
 		for _, evt := range events {
 			if p.customFilter == nil || p.customFilter(evt) {
+				if p.limiter != nil {
+					if err := p.limiter.Wait(ctx); err != nil {
+						return eventid.Zero, faults.Wrap(err)
+					}
+				}
 				err := handler(ctx, evt)
 				if err != nil {
 					return eventid.Zero, faults.Wrap(err)
 				}
+				if checkpoint != nil && p.eachEvent {
+					if err := checkpoint(ctx, evt.ID); err != nil {
+						return eventid.Zero, err
+					}
+					checkpointed = evt.ID
+				}
 			}
 			afterEventID = evt.ID
+			lastCreatedAt = evt.CreatedAt
+			processed++
+			if p.progress != nil && processed%p.progressEvery == 0 {
+				p.progress(processed, afterEventID, lastCreatedAt)
+			}
 
 			if !untilEventID.IsZero() && evt.ID.Compare(untilEventID) >= 0 {
-				return evt.ID, nil
+				done = true
+				break
 			}
 		}
-		loop = len(events) != 0
+		if checkpoint != nil && afterEventID != checkpointed {
+			if err := checkpoint(ctx, afterEventID); err != nil {
+				return eventid.Zero, err
+			}
+			checkpointed = afterEventID
+		}
+		loop = !done && len(events) != 0
+	}
+	if p.progress != nil {
+		// the replay completed
+		p.progress(processed, afterEventID, lastCreatedAt)
 	}
 	return afterEventID, nil
 }
+
+type BucketHandlerFunc func(ctx context.Context, bucket time.Time, events []eventsourcing.Event) error
+
+// ReplayTimeBuckets replays the events created in the interval [from, to[, grouped by their creation time truncated to bucket (eg: time.Hour).
+// The handler is called once for every non empty bucket, in chronological order.
+// Since created_at is in UTC, buckets are also aligned in UTC.
+func (p Player) ReplayTimeBuckets(ctx context.Context, handler BucketHandlerFunc, bucket time.Duration, from, to time.Time, filters ...store.FilterOption) error {
+	if bucket <= 0 {
+		return faults.Errorf("bucket duration must be positive, got %s", bucket)
+	}
+	if !to.After(from) {
+		return faults.Errorf("the end of the interval (%s) must be after the start (%s)", to, from)
+	}
+
+	var current time.Time
+	var events []eventsourcing.Event
+	// event IDs are time based, so we can use them to delimit the interval.
+	// Buckets are not checkpointed, since a resumed replay would split a bucket.
+	_, err := p.replay(ctx, func(ctx context.Context, e eventsourcing.Event) error {
+		if e.CreatedAt.Before(from) || !e.CreatedAt.Before(to) {
+			return nil
+		}
+		b := e.CreatedAt.Truncate(bucket)
+		if len(events) > 0 && !b.Equal(current) {
+			err := handler(ctx, current, events)
+			if err != nil {
+				return err
+			}
+			events = nil
+		}
+		current = b
+		events = append(events, e)
+		return nil
+	}, eventid.TimeOnly(from), eventid.TimeOnly(to), nil, filters...)
+	if err != nil {
+		return err
+	}
+
+	if len(events) > 0 {
+		return handler(ctx, current, events)
+	}
+	return nil
+}
+
+// GetEventsByTimeBucket returns the events created in the interval [from, to[, grouped by their creation time truncated to bucket.
+// For large intervals prefer ReplayTimeBuckets, since it does not hold all the events in memory.
+func (p Player) GetEventsByTimeBucket(ctx context.Context, bucket time.Duration, from, to time.Time, filters ...store.FilterOption) (map[time.Time][]eventsourcing.Event, error) {
+	buckets := map[time.Time][]eventsourcing.Event{}
+	err := p.ReplayTimeBuckets(ctx, func(ctx context.Context, bucket time.Time, events []eventsourcing.Event) error {
+		buckets[bucket] = events
+		return nil
+	}, bucket, from, to, filters...)
+	if err != nil {
+		return nil, err
+	}
+	return buckets, nil
+}
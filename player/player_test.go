@@ -0,0 +1,262 @@
+package player_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/quintans/eventsourcing"
+	"github.com/quintans/eventsourcing/eventid"
+	"github.com/quintans/eventsourcing/player"
+	"github.com/quintans/eventsourcing/store"
+)
+
+type sliceRepository struct {
+	events []eventsourcing.Event
+}
+
+func (r sliceRepository) GetLastEventID(ctx context.Context, trailingLag time.Duration, filter store.Filter) (eventid.EventID, error) {
+	if len(r.events) == 0 {
+		return eventid.Zero, nil
+	}
+	return r.events[len(r.events)-1].ID, nil
+}
+
+func (r sliceRepository) GetEvents(ctx context.Context, afterEventID eventid.EventID, limit int, trailingLag time.Duration, filter store.Filter) ([]eventsourcing.Event, error) {
+	events := []eventsourcing.Event{}
+	for _, e := range r.events {
+		if e.ID.Compare(afterEventID) > 0 {
+			events = append(events, e)
+		}
+		if limit > 0 && len(events) == limit {
+			break
+		}
+	}
+	return events, nil
+}
+
+func newEvents(t *testing.T, times ...time.Time) []eventsourcing.Event {
+	events := make([]eventsourcing.Event, len(times))
+	for k, v := range times {
+		id, err := eventid.New(v, eventid.EntropyFactory(v))
+		require.NoError(t, err)
+		events[k] = eventsourcing.Event{
+			ID:          id,
+			AggregateID: "123",
+			CreatedAt:   v,
+		}
+	}
+	return events
+}
+
+func TestReplayWithRateLimit(t *testing.T) {
+	now := time.Now()
+	repo := sliceRepository{events: newEvents(t, now.Add(-4*time.Second), now.Add(-3*time.Second), now.Add(-2*time.Second), now.Add(-time.Second))}
+	p := player.New(repo, player.WithBatchSize(2), player.WithTrailingLag(0), player.WithRateLimit(20))
+
+	handled := 0
+	start := time.Now()
+	_, err := p.Replay(context.Background(), func(ctx context.Context, e eventsourcing.Event) error {
+		handled++
+		return nil
+	}, eventid.Zero)
+	require.NoError(t, err)
+	require.Equal(t, 4, handled)
+	// the first token is available right away
+	require.True(t, time.Since(start) >= 140*time.Millisecond, time.Since(start))
+
+	// waiting for a token stops on cancellation
+	p = player.New(repo, player.WithTrailingLag(0), player.WithRateLimit(1))
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	handled = 0
+	start = time.Now()
+	_, err = p.Replay(ctx, func(ctx context.Context, e eventsourcing.Event) error {
+		handled++
+		return nil
+	}, eventid.Zero)
+	require.Error(t, err)
+	require.Equal(t, 1, handled)
+	require.True(t, time.Since(start) < time.Second, time.Since(start))
+}
+
+func TestReplayWithProgress(t *testing.T) {
+	now := time.Now().UTC()
+	repo := sliceRepository{events: newEvents(t, now.Add(-5*time.Second), now.Add(-4*time.Second), now.Add(-3*time.Second), now.Add(-2*time.Second), now.Add(-time.Second))}
+
+	type report struct {
+		processed     int64
+		lastEventID   eventid.EventID
+		lastCreatedAt time.Time
+	}
+	var reports []report
+	p := player.New(repo,
+		player.WithBatchSize(2),
+		player.WithTrailingLag(0),
+		player.WithProgressEvery(2),
+		player.WithProgress(func(processed int64, lastEventID eventid.EventID, lastCreatedAt time.Time) {
+			reports = append(reports, report{processed, lastEventID, lastCreatedAt})
+		}),
+	)
+	_, err := p.Replay(context.Background(), func(ctx context.Context, e eventsourcing.Event) error {
+		return nil
+	}, eventid.Zero)
+	require.NoError(t, err)
+
+	events := repo.events
+	// every two events and once more at the end
+	require.Equal(t, []report{
+		{2, events[1].ID, events[1].CreatedAt},
+		{4, events[3].ID, events[3].CreatedAt},
+		{5, events[4].ID, events[4].CreatedAt},
+	}, reports)
+}
+
+func TestGetEventsByTimeBucket(t *testing.T) {
+	base := time.Date(2021, 5, 1, 10, 0, 0, 0, time.UTC)
+	repo := sliceRepository{
+		events: newEvents(t,
+			base.Add(-time.Minute),
+			base,
+			base.Add(10*time.Minute),
+			base.Add(time.Hour+time.Minute),
+			base.Add(3*time.Hour),
+			base.Add(4*time.Hour),
+		),
+	}
+	p := player.New(repo, player.WithBatchSize(2))
+
+	buckets, err := p.GetEventsByTimeBucket(context.Background(), time.Hour, base, base.Add(4*time.Hour))
+	require.NoError(t, err)
+	require.Len(t, buckets, 3)
+	require.Len(t, buckets[base], 2)
+	require.Len(t, buckets[base.Add(time.Hour)], 1)
+	require.Len(t, buckets[base.Add(3*time.Hour)], 1)
+
+	_, err = p.GetEventsByTimeBucket(context.Background(), time.Hour, base, base)
+	require.Error(t, err)
+}
+
+type mapCheckpointer map[string]eventid.EventID
+
+func (c mapCheckpointer) GetCheckpoint(ctx context.Context, name string) (eventid.EventID, error) {
+	return c[name], nil
+}
+
+func (c mapCheckpointer) SetCheckpoint(ctx context.Context, name string, eventID eventid.EventID) error {
+	c[name] = eventID
+	return nil
+}
+
+func TestReplayWithCheckpointer(t *testing.T) {
+	base := time.Date(2021, 5, 1, 10, 0, 0, 0, time.UTC)
+	times := make([]time.Time, 6)
+	for k := range times {
+		times[k] = base.Add(time.Duration(k) * time.Minute)
+	}
+	repo := sliceRepository{
+		events: newEvents(t, times...),
+	}
+	checkpointer := mapCheckpointer{}
+	p := player.New(repo, player.WithBatchSize(2), player.WithCheckpointer(checkpointer, "migration"))
+
+	// fails in the middle of the second batch
+	replayed := []eventid.EventID{}
+	_, err := p.Replay(context.Background(), func(ctx context.Context, e eventsourcing.Event) error {
+		if e.ID == repo.events[3].ID {
+			return errors.New("boom")
+		}
+		replayed = append(replayed, e.ID)
+		return nil
+	}, eventid.Zero)
+	require.Error(t, err)
+	require.Len(t, replayed, 3)
+	require.Equal(t, repo.events[1].ID, checkpointer["migration"])
+
+	// resumes after the last checkpointed batch
+	replayed = []eventid.EventID{}
+	last, err := p.Replay(context.Background(), func(ctx context.Context, e eventsourcing.Event) error {
+		replayed = append(replayed, e.ID)
+		return nil
+	}, eventid.Zero)
+	require.NoError(t, err)
+	require.Equal(t, []eventid.EventID{repo.events[2].ID, repo.events[3].ID, repo.events[4].ID, repo.events[5].ID}, replayed)
+	require.Equal(t, repo.events[5].ID, last)
+	require.Equal(t, repo.events[5].ID, checkpointer["migration"])
+}
+
+func TestReplayWithCheckpointEachEvent(t *testing.T) {
+	base := time.Date(2021, 5, 1, 10, 0, 0, 0, time.UTC)
+	times := make([]time.Time, 6)
+	for k := range times {
+		times[k] = base.Add(time.Duration(k) * time.Minute)
+	}
+	repo := sliceRepository{
+		events: newEvents(t, times...),
+	}
+	checkpointer := mapCheckpointer{}
+	p := player.New(repo,
+		player.WithBatchSize(2),
+		player.WithCheckpointer(checkpointer, "projection"),
+		player.WithCheckpointEachEvent(),
+	)
+
+	// fails in the middle of the second batch
+	_, err := p.Replay(context.Background(), func(ctx context.Context, e eventsourcing.Event) error {
+		if e.ID == repo.events[3].ID {
+			return errors.New("boom")
+		}
+		return nil
+	}, eventid.Zero)
+	require.Error(t, err)
+	require.Equal(t, repo.events[2].ID, checkpointer["projection"])
+
+	// resumes right after the last handled event
+	replayed := []eventid.EventID{}
+	_, err = p.Replay(context.Background(), func(ctx context.Context, e eventsourcing.Event) error {
+		replayed = append(replayed, e.ID)
+		return nil
+	}, eventid.Zero)
+	require.NoError(t, err)
+	require.Equal(t, []eventid.EventID{repo.events[3].ID, repo.events[4].ID, repo.events[5].ID}, replayed)
+	require.Equal(t, repo.events[5].ID, checkpointer["projection"])
+}
+
+func TestEventIterator(t *testing.T) {
+	base := time.Date(2021, 5, 1, 10, 0, 0, 0, time.UTC)
+	repo := sliceRepository{
+		events: newEvents(t,
+			base,
+			base.Add(time.Minute),
+			base.Add(2*time.Minute),
+			base.Add(3*time.Minute),
+			base.Add(4*time.Minute),
+		),
+	}
+	p := player.New(repo, player.WithBatchSize(2))
+
+	it := p.Iterator(context.Background(), repo.events[0].ID)
+	var ids []eventid.EventID
+	for it.Next() {
+		ids = append(ids, it.Event().ID)
+	}
+	require.NoError(t, it.Err())
+	require.Len(t, ids, 4)
+	for k, id := range ids {
+		require.Equal(t, repo.events[k+1].ID, id)
+	}
+	require.Equal(t, repo.events[4].ID, it.LastEventID())
+	require.False(t, it.Next())
+
+	// cancellation
+	ctx, cancel := context.WithCancel(context.Background())
+	it = p.Iterator(ctx, eventid.Zero)
+	require.True(t, it.Next())
+	cancel()
+	require.False(t, it.Next())
+	require.True(t, errors.Is(it.Err(), context.Canceled))
+	require.Equal(t, repo.events[0].ID, it.LastEventID())
+}
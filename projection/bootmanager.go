@@ -2,6 +2,7 @@ package projection
 
 import (
 	"context"
+	"errors"
 	"sync"
 
 	"github.com/quintans/faults"
@@ -11,6 +12,10 @@ import (
 	"github.com/quintans/eventsourcing/log"
 )
 
+// ErrDraining is returned to the subscriber for the events received after the projection started draining,
+// so that they are not acknowledged
+var ErrDraining = errors.New("projection is draining")
+
 // Canceller is the interface for cancelling a running projection
 type Canceller interface {
 	Name() string
@@ -65,9 +70,15 @@ type ProjectionPartition struct {
 	filter      func(e eventsourcing.Event) bool
 	subscriber  Subscriber
 
-	cancel context.CancelFunc
-	done   chan struct{}
-	mu     sync.RWMutex
+	cancel   context.CancelFunc
+	done     chan struct{}
+	unfrozen chan struct{}
+	mu       sync.RWMutex
+
+	// drainMu is apart from mu, since Cancel holds mu while waiting for the subscriber, that may be waiting for a handler
+	drainMu  sync.RWMutex
+	draining bool
+	inflight sync.WaitGroup
 }
 
 // NewProjectionPartition creates an instance that manages the lifecycle of a projection that has the capability of being stopped and restarted on demand.
@@ -101,29 +112,40 @@ func (m *ProjectionPartition) Name() string {
 // Run action to be executed on boot
 func (m *ProjectionPartition) Run(ctx context.Context) error {
 	logger := m.logger.WithTags(log.Tags{
-		"projection": m.resume.Stream,
+		log.TagProjection: m.resume.Stream,
 	})
-	for {
+	if fn, ok := m.notifier.(FreezeNotifier); ok {
+		err := fn.ListenFreezeProjection(ctx, m)
+		if err != nil {
+			return err
+		}
+	}
+	for !m.isDraining() {
 		logger.Info("Waiting for Unlock")
 		m.restartLock.WaitForUnlock(ctx)
+		m.waitForUnfreeze(ctx)
+		if m.isDraining() {
+			return nil
+		}
 		ctx2, cancel := context.WithCancel(ctx)
 
+		m.mu.Lock()
+		m.cancel = cancel
+		m.mu.Unlock()
+
 		err := m.bootAndListen(ctx2)
 		if err != nil {
 			cancel()
 			return err
 		}
 
-		m.mu.Lock()
-		m.cancel = cancel
-		m.mu.Unlock()
-
 		select {
 		case <-ctx.Done():
 			return nil
 		default:
 		}
 	}
+	return nil
 }
 
 func (m *ProjectionPartition) bootAndListen(ctx context.Context) error {
@@ -151,7 +173,7 @@ func (m *ProjectionPartition) boot(ctx context.Context) error {
 	done, err := m.subscriber.StartConsumer(
 		ctx,
 		m.resume,
-		m.handler,
+		m.handle,
 		options...,
 	)
 	if err != nil {
@@ -165,13 +187,105 @@ func (m *ProjectionPartition) boot(ctx context.Context) error {
 	return nil
 }
 
+// handle calls the handler, keeping track of the call, unless the projection is draining
+func (m *ProjectionPartition) handle(ctx context.Context, e eventsourcing.Event) error {
+	m.drainMu.RLock()
+	if m.draining {
+		m.drainMu.RUnlock()
+		return ErrDraining
+	}
+	m.inflight.Add(1)
+	m.drainMu.RUnlock()
+	defer m.inflight.Done()
+
+	return m.handler(ctx, e)
+}
+
+func (m *ProjectionPartition) isDraining() bool {
+	m.drainMu.RLock()
+	defer m.drainMu.RUnlock()
+	return m.draining
+}
+
+// Drain stops consuming events for good, waiting for the handler call in progress, if any, to complete.
+// It is meant for graceful shutdowns, eg: when rolling a deploy, so that the current event is neither lost nor handled twice.
+// If the context expires before that, it returns an error.
+func (m *ProjectionPartition) Drain(ctx context.Context) error {
+	m.drainMu.Lock()
+	m.draining = true
+	m.drainMu.Unlock()
+
+	m.mu.Lock()
+	if m.cancel != nil {
+		m.cancel()
+	}
+	done := m.done
+	m.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		m.inflight.Wait()
+		if done != nil {
+			<-done
+		}
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return faults.Errorf("Unable to drain projection %s: %w", m.resume.Stream, ctx.Err())
+	}
+}
+
 func (m *ProjectionPartition) Cancel() {
 	m.mu.Lock()
 	if m.cancel != nil {
 		m.cancel()
 	}
 	// wait for the closing subscriber
-	<-m.done
+	if m.done != nil {
+		<-m.done
+	}
+
+	m.mu.Unlock()
+}
 
+// Freeze cancels the running projection and keeps it from restarting until Unfreeze is called
+func (m *ProjectionPartition) Freeze() {
+	m.mu.Lock()
+	if m.unfrozen == nil {
+		m.unfrozen = make(chan struct{})
+	}
 	m.mu.Unlock()
+
+	m.Cancel()
+}
+
+// Unfreeze allows a frozen projection to restart
+func (m *ProjectionPartition) Unfreeze() {
+	m.mu.Lock()
+	if m.unfrozen != nil {
+		close(m.unfrozen)
+		m.unfrozen = nil
+	}
+	m.mu.Unlock()
+}
+
+func (m *ProjectionPartition) waitForUnfreeze(ctx context.Context) {
+	m.mu.RLock()
+	unfrozen := m.unfrozen
+	m.mu.RUnlock()
+	if unfrozen == nil {
+		return
+	}
+
+	m.logger.WithTags(log.Tags{
+		log.TagProjection: m.resume.Stream,
+	}).Info("Waiting for Unfreeze")
+	select {
+	case <-unfrozen:
+	case <-ctx.Done():
+	}
 }
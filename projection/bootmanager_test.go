@@ -0,0 +1,76 @@
+package projection_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/quintans/eventsourcing"
+	"github.com/quintans/eventsourcing/estest"
+	"github.com/quintans/eventsourcing/log"
+	"github.com/quintans/eventsourcing/projection"
+)
+
+type nopLocker struct{}
+
+func (nopLocker) Lock(context.Context) (chan struct{}, error) { return make(chan struct{}), nil }
+func (nopLocker) Unlock(context.Context) error                { return nil }
+func (nopLocker) WaitForUnlock(context.Context) error         { return nil }
+
+type nopNotifier struct{}
+
+func (nopNotifier) ListenCancelProjection(ctx context.Context, restarter projection.Canceller) error {
+	return nil
+}
+
+func (nopNotifier) CancelProjection(ctx context.Context, projectionName string, partitions int) error {
+	return nil
+}
+
+func TestDrain(t *testing.T) {
+	ctx := context.Background()
+	s := estest.NewSubscriber()
+	handling := make(chan struct{})
+	release := make(chan struct{})
+	handled := 0
+	p := projection.NewProjectionPartition(log.NopLogger{}, nopLocker{}, nopNotifier{}, s,
+		projection.StreamResume{Topic: "accounts", Stream: "balance"}, nil,
+		func(ctx context.Context, e eventsourcing.Event) error {
+			close(handling)
+			<-release
+			handled++
+			return nil
+		},
+	)
+
+	stopped := make(chan error)
+	go func() {
+		stopped <- p.Run(ctx)
+	}()
+	require.Eventually(t, func() bool {
+		return len(s.Consumers()) == 1
+	}, time.Second, time.Millisecond)
+
+	published := make(chan error)
+	go func() {
+		published <- s.Publish(ctx, "accounts", eventsourcing.Event{Kind: "MoneyDeposited"})
+	}()
+	<-handling
+
+	// the handler is still running
+	drainCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	require.Error(t, p.Drain(drainCtx))
+
+	close(release)
+	require.NoError(t, p.Drain(ctx))
+	assert.Equal(t, 1, handled)
+	require.NoError(t, <-published)
+
+	// the projection does not restart
+	require.NoError(t, <-stopped)
+	assert.Empty(t, s.Consumers())
+}
@@ -0,0 +1,78 @@
+package projection
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/quintans/faults"
+
+	"github.com/quintans/eventsourcing/log"
+)
+
+var ErrFreezeNotAcknowledged = errors.New("freeze not acknowledged by all members")
+
+// Freezer is the interface for a projection that can be stopped and later resumed on demand
+type Freezer interface {
+	Name() string
+	Freeze()
+	Unfreeze()
+}
+
+// FreezeNotifier represents the interface that a message queue needs to implement to freeze distributed projections execution
+type FreezeNotifier interface {
+	ListenFreezeProjection(ctx context.Context, freezer Freezer) error
+	// FreezeProjection broadcasts the freeze and returns the number of members that acknowledged it,
+	// waiting until all the members acknowledge or the context is done.
+	FreezeProjection(ctx context.Context, projectionName string, members int) (int, error)
+	UnfreezeProjection(ctx context.Context, projectionName string) error
+}
+
+// FreezeController coordinates a cluster wide freeze of a projection, for example, to do a schema migration.
+type FreezeController struct {
+	logger   log.Logger
+	notifier FreezeNotifier
+	members  int
+	timeout  time.Duration
+}
+
+// NewFreezeController creates a controller that expects acknowledgements from the members,
+// usually the number of partitions of the projection, within the timeout.
+func NewFreezeController(logger log.Logger, notifier FreezeNotifier, members int, timeout time.Duration) *FreezeController {
+	return &FreezeController{
+		logger:   logger,
+		notifier: notifier,
+		members:  members,
+		timeout:  timeout,
+	}
+}
+
+// Freeze freezes the projection in all members and only then calls fn.
+// After fn returns, or if not all members acknowledged the freeze, the projection is unfrozen.
+func (c *FreezeController) Freeze(ctx context.Context, projection string, fn func(ctx context.Context) error) (err error) {
+	logger := c.logger.WithTags(log.Tags{
+		"method":     "FreezeController.Freeze",
+		"projection": projection,
+	})
+
+	defer func() {
+		logger.Info("Signalling to UNFREEZE projection")
+		er := c.notifier.UnfreezeProjection(ctx, projection)
+		if er != nil && err == nil {
+			err = faults.Errorf("Failed to unfreeze projection %s: %w", projection, er)
+		}
+	}()
+
+	logger.Info("Signalling to FREEZE projection")
+	ctx2, cancel := context.WithTimeout(ctx, c.timeout)
+	acks, err := c.notifier.FreezeProjection(ctx2, projection, c.members)
+	cancel()
+	if err != nil {
+		return faults.Errorf("Failed to freeze projection %s: %w", projection, err)
+	}
+	if acks < c.members {
+		return faults.Errorf("%w: projection %s was frozen by %d of %d members", ErrFreezeNotAcknowledged, projection, acks, c.members)
+	}
+
+	return fn(ctx)
+}
@@ -0,0 +1,118 @@
+package projection_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/quintans/eventsourcing/log"
+	"github.com/quintans/eventsourcing/projection"
+)
+
+type freezer struct {
+	name string
+
+	mu     sync.Mutex
+	frozen bool
+}
+
+func (f *freezer) Name() string {
+	return f.name
+}
+
+func (f *freezer) Freeze() {
+	f.mu.Lock()
+	f.frozen = true
+	f.mu.Unlock()
+}
+
+func (f *freezer) Unfreeze() {
+	f.mu.Lock()
+	f.frozen = false
+	f.mu.Unlock()
+}
+
+func (f *freezer) isFrozen() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.frozen
+}
+
+// notifier delivers the notifications to the listening freezers, in process
+type notifier struct {
+	mu       sync.Mutex
+	freezers []projection.Freezer
+}
+
+func (n *notifier) ListenFreezeProjection(ctx context.Context, freezer projection.Freezer) error {
+	n.mu.Lock()
+	n.freezers = append(n.freezers, freezer)
+	n.mu.Unlock()
+	return nil
+}
+
+func (n *notifier) FreezeProjection(ctx context.Context, projectionName string, members int) (int, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	count := 0
+	for _, f := range n.freezers {
+		if f.Name() == projectionName {
+			f.Freeze()
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (n *notifier) UnfreezeProjection(ctx context.Context, projectionName string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, f := range n.freezers {
+		if f.Name() == projectionName {
+			f.Unfreeze()
+		}
+	}
+	return nil
+}
+
+func TestFreezeController(t *testing.T) {
+	ctx := context.Background()
+	n := &notifier{}
+	freezers := []*freezer{{name: "balance"}, {name: "balance"}, {name: "other"}}
+	for _, f := range freezers {
+		require.NoError(t, n.ListenFreezeProjection(ctx, f))
+	}
+
+	c := projection.NewFreezeController(log.NopLogger{}, n, 2, time.Second)
+	called := false
+	err := c.Freeze(ctx, "balance", func(ctx context.Context) error {
+		called = true
+		assert.True(t, freezers[0].isFrozen())
+		assert.True(t, freezers[1].isFrozen())
+		assert.False(t, freezers[2].isFrozen())
+		return nil
+	})
+	require.NoError(t, err)
+	assert.True(t, called)
+	for _, f := range freezers {
+		assert.False(t, f.isFrozen())
+	}
+
+	// a missing member aborts the freeze
+	c = projection.NewFreezeController(log.NopLogger{}, n, 3, time.Second)
+	called = false
+	err = c.Freeze(ctx, "balance", func(ctx context.Context) error {
+		called = true
+		return nil
+	})
+	require.True(t, errors.Is(err, projection.ErrFreezeNotAcknowledged))
+	assert.False(t, called)
+	for _, f := range freezers {
+		assert.False(t, f.isFrozen())
+	}
+}
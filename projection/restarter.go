@@ -14,6 +14,8 @@ type Action int
 
 const (
 	Release Action = iota + 1
+	Freeze
+	Unfreeze
 )
 
 type Notification struct {
@@ -0,0 +1,57 @@
+package protobuf
+
+import (
+	"reflect"
+
+	"github.com/quintans/faults"
+	"google.golang.org/protobuf/proto"
+)
+
+// ProtoCodec encodes and decodes events and aggregate snapshots with protobuf.
+// The values must implement proto.Message, which is usually the case for pointers to generated types.
+// Non pointer values are also accepted for encoding, as long as their pointer implements proto.Message.
+type ProtoCodec struct{}
+
+// ContentType is the content type of the events encoded with ProtoCodec
+const ContentType = "application/x-protobuf"
+
+func (ProtoCodec) ContentType() string {
+	return ContentType
+}
+
+func (ProtoCodec) Encode(v interface{}) ([]byte, error) {
+	m, err := toMessage(v)
+	if err != nil {
+		return nil, err
+	}
+	b, err := proto.Marshal(m)
+	return b, faults.Wrap(err)
+}
+
+func (ProtoCodec) Decode(data []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return faults.Errorf("unable to decode into %T: it does not implement proto.Message", v)
+	}
+	err := proto.Unmarshal(data, m)
+	return faults.Wrap(err)
+}
+
+func toMessage(v interface{}) (proto.Message, error) {
+	if m, ok := v.(proto.Message); ok {
+		return m, nil
+	}
+
+	if v != nil {
+		val := reflect.ValueOf(v)
+		if val.Kind() != reflect.Ptr {
+			ptr := reflect.New(val.Type())
+			ptr.Elem().Set(val)
+			if m, ok := ptr.Interface().(proto.Message); ok {
+				return m, nil
+			}
+		}
+	}
+
+	return nil, faults.Errorf("unable to encode %T: it does not implement proto.Message", v)
+}
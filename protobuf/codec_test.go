@@ -0,0 +1,54 @@
+package protobuf_test
+
+import (
+	"testing"
+
+	"github.com/quintans/faults"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/quintans/eventsourcing"
+	"github.com/quintans/eventsourcing/protobuf"
+)
+
+// OwnerUpdated is an event whose body is a protobuf message
+type OwnerUpdated struct {
+	*wrapperspb.StringValue
+}
+
+func (OwnerUpdated) GetType() string {
+	return "OwnerUpdated"
+}
+
+type factory struct{}
+
+func (factory) New(kind string) (eventsourcing.Typer, error) {
+	switch kind {
+	case "OwnerUpdated":
+		return &OwnerUpdated{StringValue: &wrapperspb.StringValue{}}, nil
+	}
+	return nil, faults.Errorf("unknown type '%s'", kind)
+}
+
+func TestRoundTrip(t *testing.T) {
+	codec := protobuf.ProtoCodec{}
+
+	b, err := codec.Encode(OwnerUpdated{StringValue: wrapperspb.String("Paulo")})
+	require.NoError(t, err)
+
+	e, err := eventsourcing.RehydrateEvent(factory{}, codec, nil, "OwnerUpdated", b)
+	require.NoError(t, err)
+	evt, ok := e.(OwnerUpdated)
+	require.True(t, ok)
+	require.Equal(t, "Paulo", evt.GetValue())
+}
+
+func TestNotProtoMessage(t *testing.T) {
+	codec := protobuf.ProtoCodec{}
+
+	_, err := codec.Encode(struct{ Name string }{Name: "Paulo"})
+	require.Error(t, err)
+
+	err = codec.Decode([]byte{}, &struct{ Name string }{})
+	require.Error(t, err)
+}
@@ -36,11 +36,13 @@ func NewRootAggregate(aggregate EventHandler) RootAggregate {
 }
 
 type RootAggregate struct {
-	version       uint32
-	eventsCounter uint32
-	events        []Eventer
-	eventHandler  EventHandler
-	updatedAt     time.Time
+	version        uint32
+	changesVersion uint32
+	eventsCounter  uint32
+	events         []Eventer
+	eventHandler   EventHandler
+	updatedAt      time.Time
+	snapshotAt     time.Time
 }
 
 func (a RootAggregate) GetVersion() uint32 {
@@ -70,11 +72,18 @@ func (a *RootAggregate) ApplyChangeFromHistory(event Eventer) {
 }
 
 func (a *RootAggregate) ApplyChange(event Eventer) {
+	if len(a.events) == 0 {
+		a.changesVersion = a.version
+	}
 	a.ApplyChangeFromHistory(event)
 
 	a.events = append(a.events, event)
 }
 
+func (a RootAggregate) GetChangesVersion() uint32 {
+	return a.changesVersion
+}
+
 func (a *RootAggregate) SetUpdatedAt(t time.Time) {
 	a.updatedAt = t
 }
@@ -82,3 +91,11 @@ func (a *RootAggregate) SetUpdatedAt(t time.Time) {
 func (a RootAggregate) GetUpdatedAt() time.Time {
 	return a.updatedAt
 }
+
+func (a *RootAggregate) SetSnapshotAt(t time.Time) {
+	a.snapshotAt = t
+}
+
+func (a RootAggregate) GetSnapshotAt() time.Time {
+	return a.snapshotAt
+}
@@ -0,0 +1,143 @@
+package sink
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/quintans/faults"
+
+	"github.com/quintans/eventsourcing"
+)
+
+// BatchSinker is implemented by the sinks that can write several events at once
+type BatchSinker interface {
+	SinkBatch(ctx context.Context, events []eventsourcing.Event) error
+}
+
+var _ Sinker = (*BatchedSink)(nil)
+
+// BatchedSink accumulates the events, writing them to the inner sink when the batch is full or the flush interval elapses.
+// The events are written in the order they were received, so the ordering per aggregate is preserved.
+// If the inner sink implements BatchSinker, the whole batch is written in one call.
+type BatchedSink struct {
+	inner    Sinker
+	maxBatch int
+
+	mu     sync.Mutex
+	events []eventsourcing.Event
+	// err is the error of the last background flush, to be returned by the next call to Sink
+	err error
+
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// Batched wraps the inner sink with a batching layer.
+// A flush interval of zero disables the flushing on time.
+func Batched(inner Sinker, maxBatch int, flushInterval time.Duration) *BatchedSink {
+	if maxBatch < 1 {
+		maxBatch = 1
+	}
+	s := &BatchedSink{
+		inner:    inner,
+		maxBatch: maxBatch,
+		events:   make([]eventsourcing.Event, 0, maxBatch),
+		done:     make(chan struct{}),
+	}
+	if flushInterval > 0 {
+		s.wg.Add(1)
+		go s.flushPeriodically(flushInterval)
+	}
+	return s
+}
+
+func (s *BatchedSink) flushPeriodically(interval time.Duration) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			if err := s.flush(context.Background()); err != nil {
+				s.err = err
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// Sink adds the event to the batch, flushing it if it is full.
+// It also returns the error of a previous background flush, if any.
+// On a failed flush the unwritten events are kept, so LastMessage, that flushes first, stays consistent with what was received.
+func (s *BatchedSink) Sink(ctx context.Context, e eventsourcing.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		err := s.err
+		s.err = nil
+		return err
+	}
+
+	s.events = append(s.events, e)
+	if len(s.events) < s.maxBatch {
+		return nil
+	}
+	return s.flush(ctx)
+}
+
+// Flush writes the pending events to the inner sink
+func (s *BatchedSink) Flush(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.flush(ctx)
+}
+
+// flush writes the pending events. The events that were not written are kept, to be retried on the next flush.
+func (s *BatchedSink) flush(ctx context.Context) error {
+	if len(s.events) == 0 {
+		return nil
+	}
+
+	if bs, ok := s.inner.(BatchSinker); ok {
+		if err := bs.SinkBatch(ctx, s.events); err != nil {
+			return faults.Wrap(err)
+		}
+		s.events = s.events[:0]
+		return nil
+	}
+
+	for k, e := range s.events {
+		if err := s.inner.Sink(ctx, e); err != nil {
+			s.events = append(s.events[:0], s.events[k:]...)
+			return faults.Wrap(err)
+		}
+	}
+	s.events = s.events[:0]
+	return nil
+}
+
+// LastMessage flushes the pending events and gets the last message from the inner sink
+func (s *BatchedSink) LastMessage(ctx context.Context, partition uint32) (*eventsourcing.Event, error) {
+	if err := s.Flush(ctx); err != nil {
+		return nil, err
+	}
+	return s.inner.LastMessage(ctx, partition)
+}
+
+// Close stops the background flushing, flushes the pending events and closes the inner sink.
+// Use Flush before Close to handle flushing errors.
+func (s *BatchedSink) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.wg.Wait()
+		_ = s.Flush(context.Background())
+		s.inner.Close()
+	})
+}
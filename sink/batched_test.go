@@ -0,0 +1,111 @@
+package sink_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/quintans/eventsourcing"
+	"github.com/quintans/eventsourcing/sink"
+)
+
+type recordingSink struct {
+	mu     sync.Mutex
+	events []eventsourcing.Event
+	failAt int
+	closed bool
+}
+
+func (s *recordingSink) Sink(ctx context.Context, e eventsourcing.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failAt > 0 && len(s.events) == s.failAt {
+		s.failAt = 0
+		return errors.New("boom")
+	}
+	s.events = append(s.events, e)
+	return nil
+}
+
+func (s *recordingSink) LastMessage(ctx context.Context, partition uint32) (*eventsourcing.Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.events) == 0 {
+		return nil, nil
+	}
+	return &s.events[len(s.events)-1], nil
+}
+
+func (s *recordingSink) Close() {
+	s.closed = true
+}
+
+func (s *recordingSink) versions() []uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	versions := make([]uint32, len(s.events))
+	for k, e := range s.events {
+		versions[k] = e.AggregateVersion
+	}
+	return versions
+}
+
+func event(version uint32) eventsourcing.Event {
+	return eventsourcing.Event{AggregateID: "123", AggregateVersion: version}
+}
+
+func TestBatchedFlushesOnSize(t *testing.T) {
+	ctx := context.Background()
+	inner := &recordingSink{}
+	s := sink.Batched(inner, 3, 0)
+
+	require.NoError(t, s.Sink(ctx, event(1)))
+	require.NoError(t, s.Sink(ctx, event(2)))
+	assert.Empty(t, inner.versions())
+
+	require.NoError(t, s.Sink(ctx, event(3)))
+	assert.Equal(t, []uint32{1, 2, 3}, inner.versions())
+
+	require.NoError(t, s.Sink(ctx, event(4)))
+	last, err := s.LastMessage(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(4), last.AggregateVersion)
+
+	s.Close()
+	assert.True(t, inner.closed)
+}
+
+func TestBatchedFlushesOnTime(t *testing.T) {
+	ctx := context.Background()
+	inner := &recordingSink{}
+	s := sink.Batched(inner, 100, 10*time.Millisecond)
+	defer s.Close()
+
+	require.NoError(t, s.Sink(ctx, event(1)))
+	require.NoError(t, s.Sink(ctx, event(2)))
+	require.Eventually(t, func() bool {
+		return len(inner.versions()) == 2
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, []uint32{1, 2}, inner.versions())
+}
+
+func TestBatchedKeepsOrderOnFailure(t *testing.T) {
+	ctx := context.Background()
+	inner := &recordingSink{failAt: 1}
+	s := sink.Batched(inner, 3, 0)
+
+	require.NoError(t, s.Sink(ctx, event(1)))
+	require.NoError(t, s.Sink(ctx, event(2)))
+	require.Error(t, s.Sink(ctx, event(3)))
+	assert.Equal(t, []uint32{1}, inner.versions())
+
+	// the events that failed are retried before the new ones
+	require.NoError(t, s.Sink(ctx, event(4)))
+	require.NoError(t, s.Flush(ctx))
+	assert.Equal(t, []uint32{1, 2, 3, 4}, inner.versions())
+}
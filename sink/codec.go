@@ -33,9 +33,11 @@ type Event struct {
 	AggregateType    eventsourcing.AggregateType `json:"aggregate_type,omitempty"`
 	Kind             eventsourcing.EventKind     `json:"kind,omitempty"`
 	Body             encoding.Base64             `json:"body,omitempty"`
+	ContentType      string                      `json:"content_type,omitempty"`
 	IdempotencyKey   string                      `json:"idempotency_key,omitempty"`
 	Metadata         map[string]interface{}      `json:"metadata,omitempty"`
 	CreatedAt        time.Time                   `json:"created_at,omitempty"`
+	EventVersion     uint16                      `json:"event_version,omitempty"`
 }
 
 type JsonCodec struct{}
@@ -50,9 +52,11 @@ func (JsonCodec) Encode(e eventsourcing.Event) ([]byte, error) {
 		AggregateType:    e.AggregateType,
 		Kind:             e.Kind,
 		Body:             e.Body,
+		ContentType:      e.ContentType,
 		IdempotencyKey:   e.IdempotencyKey,
 		Metadata:         e.Metadata,
 		CreatedAt:        e.CreatedAt,
+		EventVersion:     e.EventVersion,
 	}
 	b, err := json.Marshal(event)
 	if err != nil {
@@ -76,9 +80,11 @@ func (JsonCodec) Decode(data []byte) (eventsourcing.Event, error) {
 		AggregateType:    e.AggregateType,
 		Kind:             e.Kind,
 		Body:             []byte(e.Body),
+		ContentType:      e.ContentType,
 		IdempotencyKey:   e.IdempotencyKey,
 		Metadata:         e.Metadata,
 		CreatedAt:        e.CreatedAt,
+		EventVersion:     e.EventVersion,
 	}
 	return event, nil
 }
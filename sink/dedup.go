@@ -0,0 +1,135 @@
+package sink
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/quintans/eventsourcing"
+	"github.com/quintans/eventsourcing/eventid"
+)
+
+// DefaultDeduperCapacity is the default number of event IDs remembered by the Deduper
+const DefaultDeduperCapacity = 10000
+
+// DuplicateHandler is called when an event is dropped for being a duplicate
+type DuplicateHandler func(e eventsourcing.Event)
+
+type DeduperOption func(*Deduper)
+
+// WithDeduperCapacity sets how many event IDs are remembered. The least recently seen are forgotten first.
+func WithDeduperCapacity(capacity int) DeduperOption {
+	return func(d *Deduper) {
+		if capacity > 0 {
+			d.capacity = capacity
+		}
+	}
+}
+
+// WithDeduperTTL sets for how long an event ID is remembered. Zero, the default, means until it is evicted by the capacity.
+func WithDeduperTTL(ttl time.Duration) DeduperOption {
+	return func(d *Deduper) {
+		d.ttl = ttl
+	}
+}
+
+// WithDuplicateHandler sets a handler, eg: to increment a metric, called on every dropped event
+func WithDuplicateHandler(handler DuplicateHandler) DeduperOption {
+	return func(d *Deduper) {
+		d.handler = handler
+	}
+}
+
+var _ Sinker = (*Deduper)(nil)
+
+// Deduper drops the events already sinked, as the feeds may deliver some events again after resuming.
+// The event IDs are remembered in a bounded LRU, optionally expiring after a TTL, so duplicates are only dropped within that window.
+// An event is only remembered after the inner sink succeeds, so that a failed event can be retried.
+type Deduper struct {
+	inner    Sinker
+	handler  DuplicateHandler
+	capacity int
+	ttl      time.Duration
+
+	mu   sync.Mutex
+	seen map[eventid.EventID]*list.Element
+	lru  *list.List
+}
+
+type seenEvent struct {
+	id     eventid.EventID
+	seenAt time.Time
+}
+
+// NewDeduper wraps the inner sink, dropping the duplicate events
+func NewDeduper(inner Sinker, options ...DeduperOption) *Deduper {
+	d := &Deduper{
+		inner:    inner,
+		capacity: DefaultDeduperCapacity,
+		seen:     map[eventid.EventID]*list.Element{},
+		lru:      list.New(),
+	}
+	for _, o := range options {
+		o(d)
+	}
+	return d
+}
+
+func (d *Deduper) Sink(ctx context.Context, e eventsourcing.Event) error {
+	if d.isDuplicate(e.ID) {
+		if d.handler != nil {
+			d.handler(e)
+		}
+		return nil
+	}
+	err := d.inner.Sink(ctx, e)
+	if err != nil {
+		return err
+	}
+	d.remember(e.ID)
+	return nil
+}
+
+func (d *Deduper) isDuplicate(id eventid.EventID) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	elem, ok := d.seen[id]
+	if !ok {
+		return false
+	}
+	if d.ttl > 0 && time.Since(elem.Value.(*seenEvent).seenAt) > d.ttl {
+		d.lru.Remove(elem)
+		delete(d.seen, id)
+		return false
+	}
+	d.lru.MoveToFront(elem)
+	return true
+}
+
+func (d *Deduper) remember(id eventid.EventID) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	if elem, ok := d.seen[id]; ok {
+		elem.Value.(*seenEvent).seenAt = now
+		d.lru.MoveToFront(elem)
+		return
+	}
+	d.seen[id] = d.lru.PushFront(&seenEvent{id: id, seenAt: now})
+	if d.lru.Len() > d.capacity {
+		oldest := d.lru.Back()
+		d.lru.Remove(oldest)
+		delete(d.seen, oldest.Value.(*seenEvent).id)
+	}
+}
+
+func (d *Deduper) LastMessage(ctx context.Context, partition uint32) (*eventsourcing.Event, error) {
+	return d.inner.LastMessage(ctx, partition)
+}
+
+func (d *Deduper) Close() {
+	d.inner.Close()
+}
@@ -0,0 +1,63 @@
+package sink_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/quintans/eventsourcing"
+	"github.com/quintans/eventsourcing/eventid"
+	"github.com/quintans/eventsourcing/sink"
+)
+
+func TestDeduper(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	id1 := eventid.TimeOnly(now)
+	id2 := eventid.TimeOnly(now.Add(time.Second))
+	id3 := eventid.TimeOnly(now.Add(2 * time.Second))
+
+	inner := &recordingSink{failAt: 2}
+	dropped := 0
+	d := sink.NewDeduper(inner,
+		sink.WithDeduperCapacity(2),
+		sink.WithDuplicateHandler(func(e eventsourcing.Event) {
+			dropped++
+		}),
+	)
+
+	require.NoError(t, d.Sink(ctx, eventsourcing.Event{ID: id1}))
+	require.NoError(t, d.Sink(ctx, eventsourcing.Event{ID: id2}))
+	require.NoError(t, d.Sink(ctx, eventsourcing.Event{ID: id1}))
+	// a failed event is not remembered
+	require.Error(t, d.Sink(ctx, eventsourcing.Event{ID: id3}))
+	require.NoError(t, d.Sink(ctx, eventsourcing.Event{ID: id3}))
+	// id2 is forgotten when id3 arrives, since id1 was seen after id2
+	require.NoError(t, d.Sink(ctx, eventsourcing.Event{ID: id2}))
+	require.NoError(t, d.Sink(ctx, eventsourcing.Event{ID: id3}))
+
+	assert.Equal(t, 2, dropped)
+	ids := []eventid.EventID{}
+	for _, e := range inner.events {
+		ids = append(ids, e.ID)
+	}
+	assert.Equal(t, []eventid.EventID{id1, id2, id3, id2}, ids)
+}
+
+func TestDeduperTTL(t *testing.T) {
+	ctx := context.Background()
+	inner := &recordingSink{}
+	d := sink.NewDeduper(inner, sink.WithDeduperTTL(20*time.Millisecond))
+
+	e := eventsourcing.Event{ID: eventid.TimeOnly(time.Now())}
+	require.NoError(t, d.Sink(ctx, e))
+	require.NoError(t, d.Sink(ctx, e))
+	assert.Len(t, inner.events, 1)
+
+	time.Sleep(30 * time.Millisecond)
+	require.NoError(t, d.Sink(ctx, e))
+	assert.Len(t, inner.events, 2)
+}
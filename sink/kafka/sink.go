@@ -0,0 +1,180 @@
+package kafka
+
+import (
+	"context"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/quintans/faults"
+
+	"github.com/quintans/eventsourcing"
+	"github.com/quintans/eventsourcing/common"
+	"github.com/quintans/eventsourcing/log"
+	"github.com/quintans/eventsourcing/sink"
+)
+
+var (
+	_ sink.Sinker      = (*Sink)(nil)
+	_ sink.BatchSinker = (*Sink)(nil)
+)
+
+// Sink publishes events to a kafka topic.
+// The events are keyed by the aggregate ID and sent to the kafka partition matching the event partition,
+// so that the ordering per aggregate is preserved and feeds can resume from the last message of each partition.
+type Sink struct {
+	logger     log.Logger
+	topic      string
+	partitions uint32
+	client     sarama.Client
+	producer   sarama.SyncProducer
+	codec      sink.Codec
+}
+
+// NewSink instantiates a kafka sink. The topic must have, at least, as many partitions as the ones supplied.
+// The producer partitioner of the config is always replaced by a manual partitioner.
+func NewSink(logger log.Logger, topic string, partitions uint32, brokers []string, config *sarama.Config) (_ *Sink, err error) {
+	defer faults.Catch(&err, "kafka.NewSink(topic=%s, partitions=%d)", topic, partitions)
+
+	if config == nil {
+		config = sarama.NewConfig()
+	}
+	config.Producer.Return.Successes = true
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Partitioner = sarama.NewManualPartitioner
+	// a single in-flight request keeps the ordering of batched messages on retries
+	config.Net.MaxOpenRequests = 1
+
+	client, err := sarama.NewClient(brokers, config)
+	if err != nil {
+		return nil, faults.Errorf("Could not instantiate kafka client: %w", err)
+	}
+	producer, err := sarama.NewSyncProducerFromClient(client)
+	if err != nil {
+		client.Close()
+		return nil, faults.Errorf("Could not instantiate kafka producer: %w", err)
+	}
+
+	return &Sink{
+		logger:     logger,
+		topic:      topic,
+		partitions: partitions,
+		client:     client,
+		producer:   producer,
+		codec:      sink.JsonCodec{},
+	}, nil
+}
+
+func (s *Sink) SetCodec(codec sink.Codec) {
+	s.codec = codec
+}
+
+// Close releases resources
+func (s *Sink) Close() {
+	if s.producer != nil {
+		s.producer.Close()
+	}
+	if s.client != nil {
+		s.client.Close()
+	}
+}
+
+// Sink sends the event to kafka
+func (s *Sink) Sink(ctx context.Context, e eventsourcing.Event) error {
+	msg, err := s.message(e)
+	if err != nil {
+		return err
+	}
+
+	_, _, err = s.producer.SendMessage(msg)
+	if err != nil {
+		return faults.Errorf("Failed to send message: %w", err)
+	}
+	return nil
+}
+
+// SinkBatch sends the events to kafka in a single request
+func (s *Sink) SinkBatch(ctx context.Context, events []eventsourcing.Event) error {
+	msgs := make([]*sarama.ProducerMessage, len(events))
+	for k, e := range events {
+		msg, err := s.message(e)
+		if err != nil {
+			return err
+		}
+		msgs[k] = msg
+	}
+
+	err := s.producer.SendMessages(msgs)
+	if err != nil {
+		return faults.Errorf("Failed to send %d messages: %w", len(msgs), err)
+	}
+	return nil
+}
+
+func (s *Sink) message(e eventsourcing.Event) (*sarama.ProducerMessage, error) {
+	b, err := s.codec.Encode(e)
+	if err != nil {
+		return nil, err
+	}
+
+	partition := kafkaPartition(common.WhichPartition(e.AggregateIDHash, s.partitions))
+	s.logger.WithTags(log.Tags{
+		"topic":     s.topic,
+		"partition": partition,
+	}).Debugf("publishing '%+v'", e)
+
+	return &sarama.ProducerMessage{
+		Topic:     s.topic,
+		Key:       sarama.StringEncoder(e.AggregateID),
+		Value:     sarama.ByteEncoder(b),
+		Partition: partition,
+	}, nil
+}
+
+// LastMessage gets the last message sent to the kafka partition matching the event partition
+func (s *Sink) LastMessage(ctx context.Context, partition uint32) (*eventsourcing.Event, error) {
+	kp := kafkaPartition(partition)
+	newest, err := s.client.GetOffset(s.topic, kp, sarama.OffsetNewest)
+	if err != nil {
+		return nil, faults.Errorf("Unable to get the newest offset of topic %s and partition %d: %w", s.topic, kp, err)
+	}
+	if newest <= 0 {
+		// no messages
+		return nil, nil
+	}
+
+	consumer, err := sarama.NewConsumerFromClient(s.client)
+	if err != nil {
+		return nil, faults.Wrap(err)
+	}
+	defer consumer.Close()
+
+	pc, err := consumer.ConsumePartition(s.topic, kp, newest-1)
+	if err != nil {
+		return nil, faults.Errorf("Unable to consume topic %s and partition %d: %w", s.topic, kp, err)
+	}
+	defer pc.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	select {
+	case msg := <-pc.Messages():
+		event, err := s.codec.Decode(msg.Value)
+		if err != nil {
+			return nil, err
+		}
+		return &event, nil
+	case err := <-pc.Errors():
+		return nil, faults.Wrap(err)
+	case <-ctx.Done():
+		return nil, faults.Errorf("Timeout getting the last message of topic %s and partition %d: %w", s.topic, kp, ctx.Err())
+	}
+}
+
+// kafkaPartition converts the event partition, that starts at 1 (0 means no partitioning), into the zero based kafka partition
+func kafkaPartition(partition uint32) int32 {
+	if partition == 0 {
+		return 0
+	}
+	return int32(partition - 1)
+}
@@ -0,0 +1,85 @@
+package kafka_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/quintans/eventsourcing"
+	"github.com/quintans/eventsourcing/common"
+	"github.com/quintans/eventsourcing/eventid"
+	"github.com/quintans/eventsourcing/log"
+	"github.com/quintans/eventsourcing/sink"
+	"github.com/quintans/eventsourcing/sink/kafka"
+)
+
+const topic = "accounts"
+
+func TestSinkAndLastMessage(t *testing.T) {
+	now := time.Now()
+	id, err := eventid.New(now, eventid.EntropyFactory(now))
+	require.NoError(t, err)
+	event := eventsourcing.Event{
+		ID:               id,
+		ResumeToken:      []byte("token"),
+		AggregateID:      "123",
+		AggregateIDHash:  common.Hash("123"),
+		AggregateVersion: 1,
+		AggregateType:    "Account",
+		Kind:             "AccountCreated",
+		Body:             []byte(`{"owner":"Paulo"}`),
+	}
+	partition := int32(common.WhichPartition(event.AggregateIDHash, 2) - 1)
+	data, err := sink.JsonCodec{}.Encode(event)
+	require.NoError(t, err)
+
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader(topic, 0, broker.BrokerID()).
+			SetLeader(topic, 1, broker.BrokerID()),
+		"ProduceRequest": sarama.NewMockProduceResponse(t),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset(topic, partition, sarama.OffsetNewest, 1).
+			SetOffset(topic, partition, sarama.OffsetOldest, 0).
+			SetOffset(topic, 1-partition, sarama.OffsetNewest, 0),
+		"FetchRequest": sarama.NewMockFetchResponse(t, 1).
+			SetMessage(topic, partition, 0, sarama.ByteEncoder(data)).
+			SetHighWaterMark(topic, partition, 1),
+	})
+
+	// the mock responses use the oldest protocol versions
+	config := sarama.NewConfig()
+	config.Version = sarama.V0_8_2_0
+	s, err := kafka.NewSink(log.NopLogger{}, topic, 2, []string{broker.Addr()}, config)
+	require.NoError(t, err)
+	defer s.Close()
+
+	err = s.Sink(context.Background(), event)
+	require.NoError(t, err)
+
+	var produced *sarama.ProduceRequest
+	for _, rr := range broker.History() {
+		if r, ok := rr.Request.(*sarama.ProduceRequest); ok {
+			produced = r
+		}
+	}
+	require.NotNil(t, produced)
+
+	last, err := s.LastMessage(context.Background(), uint32(partition)+1)
+	require.NoError(t, err)
+	require.NotNil(t, last)
+	assert.Equal(t, event.ID, last.ID)
+	assert.Equal(t, event.ResumeToken, last.ResumeToken)
+
+	// the other partition is empty
+	last, err = s.LastMessage(context.Background(), uint32(1-partition)+1)
+	require.NoError(t, err)
+	require.Nil(t, last)
+}
@@ -0,0 +1,152 @@
+package nats
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/quintans/faults"
+
+	"github.com/quintans/eventsourcing"
+	"github.com/quintans/eventsourcing/common"
+	"github.com/quintans/eventsourcing/log"
+	"github.com/quintans/eventsourcing/sink"
+)
+
+// DefaultDuplicatesWindow is how long JetStream tracks the event IDs, to discard republished events
+const DefaultDuplicatesWindow = 2 * time.Minute
+
+var _ sink.Sinker = (*Sink)(nil)
+
+type Option func(*Sink)
+
+// WithDuplicatesWindow sets the dedup window of the stream, when the stream is created by the sink
+func WithDuplicatesWindow(window time.Duration) Option {
+	return func(s *Sink) {
+		s.duplicatesWindow = window
+	}
+}
+
+// Sink publishes events to a NATS JetStream stream.
+// The events are published to the subject <topic>.<partition>.<aggregate type>
+// (<topic>.<aggregate type> when there is no partitioning), using the event ID as the message ID,
+// so that republishing an event, inside the duplicates window, is ignored by JetStream.
+type Sink struct {
+	logger           log.Logger
+	topic            string
+	partitions       uint32
+	duplicatesWindow time.Duration
+	codec            sink.Codec
+	nc               *nats.Conn
+	js               nats.JetStreamContext
+}
+
+// NewSink instantiates a JetStream sink, creating the stream, named after the topic, if it does not exist.
+func NewSink(logger log.Logger, topic string, partitions uint32, url string, options ...Option) (_ *Sink, err error) {
+	defer faults.Catch(&err, "nats.NewSink(topic=%s, partitions=%d)", topic, partitions)
+
+	s := &Sink{
+		logger:           logger,
+		topic:            topic,
+		partitions:       partitions,
+		duplicatesWindow: DefaultDuplicatesWindow,
+		codec:            sink.JsonCodec{},
+	}
+	for _, o := range options {
+		o(s)
+	}
+
+	nc, err := nats.Connect(url)
+	if err != nil {
+		return nil, faults.Errorf("Could not instantiate NATS connection: %w", err)
+	}
+	js, err := nc.JetStream()
+	if err != nil {
+		nc.Close()
+		return nil, faults.Errorf("Could not instantiate JetStream context: %w", err)
+	}
+	s.nc = nc
+	s.js = js
+
+	stream := streamName(topic)
+	if _, err := js.StreamInfo(stream); err != nil {
+		_, err = js.AddStream(&nats.StreamConfig{
+			Name:       stream,
+			Subjects:   []string{topic + ".>"},
+			Duplicates: s.duplicatesWindow,
+		})
+		if err != nil {
+			nc.Close()
+			return nil, faults.Errorf("Could not create stream %s: %w", stream, err)
+		}
+	}
+
+	return s, nil
+}
+
+// streamName derives the stream name from the topic, since stream names cannot have dots
+func streamName(topic string) string {
+	return strings.ReplaceAll(topic, ".", "_")
+}
+
+func (s *Sink) SetCodec(codec sink.Codec) {
+	s.codec = codec
+}
+
+// Close releases resources
+func (s *Sink) Close() {
+	if s.nc != nil {
+		s.nc.Close()
+	}
+}
+
+// Sink publishes the event to JetStream
+func (s *Sink) Sink(ctx context.Context, e eventsourcing.Event) error {
+	b, err := s.codec.Encode(e)
+	if err != nil {
+		return err
+	}
+
+	subject := common.PartitionTopic(s.topic, e.AggregateIDHash, s.partitions) + "." + e.AggregateType.String()
+	s.logger.WithTags(log.Tags{
+		"subject": subject,
+	}).Debugf("publishing '%+v'", e)
+
+	_, err = s.js.Publish(subject, b, nats.MsgId(e.ID.String()), nats.Context(ctx))
+	if err != nil {
+		return faults.Errorf("Failed to publish message: %w", err)
+	}
+	return nil
+}
+
+// LastMessage gets the last message published to the partition, for any aggregate type
+func (s *Sink) LastMessage(ctx context.Context, partition uint32) (*eventsourcing.Event, error) {
+	sub, err := s.js.SubscribeSync(common.TopicWithPartition(s.topic, partition)+".*", nats.DeliverLast(), nats.AckNone())
+	if err != nil {
+		return nil, faults.Wrap(err)
+	}
+	defer sub.Unsubscribe()
+
+	info, err := sub.ConsumerInfo()
+	if err != nil {
+		return nil, faults.Wrap(err)
+	}
+	if info.NumPending == 0 && info.Delivered.Stream == 0 {
+		// no last message
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	msg, err := sub.NextMsgWithContext(ctx)
+	if err != nil {
+		return nil, faults.Errorf("Unable to get the last message of partition %d: %w", partition, err)
+	}
+
+	event, err := s.codec.Decode(msg.Data)
+	if err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
@@ -0,0 +1,116 @@
+package sink
+
+import (
+	"container/list"
+	"context"
+	"sync"
+
+	"github.com/quintans/eventsourcing"
+	"github.com/quintans/eventsourcing/log"
+)
+
+// DefaultOrderVerifierCapacity is the default number of aggregates tracked by the OrderVerifier
+const DefaultOrderVerifierCapacity = 10000
+
+// OutOfOrderHandler is called when an event arrives with a version lower than the last one seen for its aggregate
+type OutOfOrderHandler func(e eventsourcing.Event, lastVersion uint32)
+
+type OrderVerifierOption func(*OrderVerifier)
+
+// WithOutOfOrderHandler sets a handler, eg: to increment a metric, called on every out of order event
+func WithOutOfOrderHandler(handler OutOfOrderHandler) OrderVerifierOption {
+	return func(v *OrderVerifier) {
+		v.handler = handler
+	}
+}
+
+// WithOrderVerifierCapacity sets how many aggregates are tracked. The least recently seen are forgotten first.
+func WithOrderVerifierCapacity(capacity int) OrderVerifierOption {
+	return func(v *OrderVerifier) {
+		if capacity > 0 {
+			v.capacity = capacity
+		}
+	}
+}
+
+var _ Sinker = (*OrderVerifier)(nil)
+
+// OrderVerifier is a canary for the ordering that projections depend on.
+// It tracks the last version seen per aggregate and reports the events that arrive with a lower version, before passing them to the inner sink.
+// Events with the same version are not reported, since redeliveries happen and some repositories (eg: mongodb) use one version for all the events of a save.
+type OrderVerifier struct {
+	inner    Sinker
+	logger   log.Logger
+	handler  OutOfOrderHandler
+	capacity int
+
+	mu       sync.Mutex
+	versions map[string]*list.Element
+	lru      *list.List
+}
+
+type aggregateVersion struct {
+	aggregateID string
+	version     uint32
+}
+
+// NewOrderVerifier wraps the inner sink, verifying the order of the events per aggregate
+func NewOrderVerifier(logger log.Logger, inner Sinker, options ...OrderVerifierOption) *OrderVerifier {
+	v := &OrderVerifier{
+		inner:    inner,
+		logger:   logger,
+		capacity: DefaultOrderVerifierCapacity,
+		versions: map[string]*list.Element{},
+		lru:      list.New(),
+	}
+	for _, o := range options {
+		o(v)
+	}
+	return v
+}
+
+func (v *OrderVerifier) Sink(ctx context.Context, e eventsourcing.Event) error {
+	v.verify(e)
+	return v.inner.Sink(ctx, e)
+}
+
+func (v *OrderVerifier) verify(e eventsourcing.Event) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	elem, ok := v.versions[e.AggregateID]
+	if !ok {
+		v.versions[e.AggregateID] = v.lru.PushFront(&aggregateVersion{aggregateID: e.AggregateID, version: e.AggregateVersion})
+		if v.lru.Len() > v.capacity {
+			oldest := v.lru.Back()
+			v.lru.Remove(oldest)
+			delete(v.versions, oldest.Value.(*aggregateVersion).aggregateID)
+		}
+		return
+	}
+
+	v.lru.MoveToFront(elem)
+	last := elem.Value.(*aggregateVersion)
+	if e.AggregateVersion < last.version {
+		v.logger.WithTags(log.Tags{
+			"aggregateID":   e.AggregateID,
+			"aggregateType": e.AggregateType,
+			"eventID":       e.ID,
+			"version":       e.AggregateVersion,
+			"lastVersion":   last.version,
+		}).Error("Event arrived out of order")
+		if v.handler != nil {
+			v.handler(e, last.version)
+		}
+		return
+	}
+	last.version = e.AggregateVersion
+}
+
+func (v *OrderVerifier) LastMessage(ctx context.Context, partition uint32) (*eventsourcing.Event, error) {
+	return v.inner.LastMessage(ctx, partition)
+}
+
+func (v *OrderVerifier) Close() {
+	v.inner.Close()
+}
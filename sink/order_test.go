@@ -0,0 +1,50 @@
+package sink_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/quintans/eventsourcing"
+	"github.com/quintans/eventsourcing/log"
+	"github.com/quintans/eventsourcing/sink"
+)
+
+func TestOrderVerifier(t *testing.T) {
+	ctx := context.Background()
+	inner := &recordingSink{}
+	type outOfOrder struct {
+		aggregateID string
+		version     uint32
+		lastVersion uint32
+	}
+	var reported []outOfOrder
+	v := sink.NewOrderVerifier(log.NopLogger{}, inner,
+		sink.WithOrderVerifierCapacity(2),
+		sink.WithOutOfOrderHandler(func(e eventsourcing.Event, lastVersion uint32) {
+			reported = append(reported, outOfOrder{e.AggregateID, e.AggregateVersion, lastVersion})
+		}),
+	)
+
+	events := []eventsourcing.Event{
+		{AggregateID: "a", AggregateVersion: 1},
+		{AggregateID: "a", AggregateVersion: 2},
+		// same version is not reported
+		{AggregateID: "a", AggregateVersion: 2},
+		{AggregateID: "b", AggregateVersion: 5},
+		{AggregateID: "a", AggregateVersion: 1},
+		// "b" is forgotten when "c" arrives, since "a" was seen after "b"
+		{AggregateID: "c", AggregateVersion: 1},
+		{AggregateID: "b", AggregateVersion: 4},
+		{AggregateID: "a", AggregateVersion: 3},
+	}
+	for _, e := range events {
+		require.NoError(t, v.Sink(ctx, e))
+	}
+
+	assert.Equal(t, []outOfOrder{{"a", 1, 2}}, reported)
+	// out of order events are still sinked
+	assert.Len(t, inner.events, len(events))
+}
@@ -0,0 +1,60 @@
+package eventsourcing
+
+import (
+	"time"
+)
+
+// SnapshotPolicy decides if a snapshot should be written after saving the aggregate events.
+// lastSnapshotAt is the time of the last snapshot of the aggregate, or the zero time if unknown.
+type SnapshotPolicy interface {
+	ShouldSnapshot(agg Aggregater, lastSnapshotAt time.Time) bool
+}
+
+// SnapshotPolicyFunc is an adapter to allow the use of ordinary functions as snapshot policies
+type SnapshotPolicyFunc func(agg Aggregater, lastSnapshotAt time.Time) bool
+
+func (f SnapshotPolicyFunc) ShouldSnapshot(agg Aggregater, lastSnapshotAt time.Time) bool {
+	return f(agg, lastSnapshotAt)
+}
+
+// EventsThresholdPolicy snapshots when the number of events applied to the aggregate, since it was loaded, reaches the threshold.
+// This is the default policy.
+type EventsThresholdPolicy uint32
+
+func (p EventsThresholdPolicy) ShouldSnapshot(agg Aggregater, _ time.Time) bool {
+	return agg.GetEventsCounter() >= uint32(p)
+}
+
+// SnapshotAgePolicy snapshots when the last snapshot is older than the max age, or when there is no snapshot
+type SnapshotAgePolicy time.Duration
+
+func (p SnapshotAgePolicy) ShouldSnapshot(_ Aggregater, lastSnapshotAt time.Time) bool {
+	return time.Since(lastSnapshotAt) >= time.Duration(p)
+}
+
+// SnapshotTimer is implemented by the aggregates that keep the time of their last snapshot, like the ones embedding RootAggregate.
+// It is what surfaces the last snapshot time to the snapshot policy.
+type SnapshotTimer interface {
+	SetSnapshotAt(time.Time)
+	GetSnapshotAt() time.Time
+}
+
+// WithSnapshotPolicy replaces the default policy of snapshotting when the events counter reaches the snapshot threshold
+func WithSnapshotPolicy(policy SnapshotPolicy) EsOptions {
+	return func(r *EventStore) {
+		r.snapshotPolicy = policy
+	}
+}
+
+func lastSnapshotAt(agg Aggregater) time.Time {
+	if st, ok := agg.(SnapshotTimer); ok {
+		return st.GetSnapshotAt()
+	}
+	return time.Time{}
+}
+
+func setSnapshotAt(agg Aggregater, t time.Time) {
+	if st, ok := agg.(SnapshotTimer); ok {
+		st.SetSnapshotAt(t)
+	}
+}
@@ -0,0 +1,100 @@
+package eventsourcing
+
+import (
+	"context"
+	"sync"
+
+	"github.com/quintans/faults"
+
+	"github.com/quintans/eventsourcing/log"
+)
+
+// asyncSnapshotter writes snapshots in the background, using a pool of workers fed by a bounded queue.
+// The written snapshots, and the ones that failed, are reported to the recorder.
+type asyncSnapshotter struct {
+	logger   log.Logger
+	recorder Recorder
+	save     func(ctx context.Context, snap Snapshot) error
+	jobs   chan Snapshot
+	wg     sync.WaitGroup
+	mu     sync.RWMutex
+	closed bool
+}
+
+func newAsyncSnapshotter(logger log.Logger, recorder Recorder, save func(ctx context.Context, snap Snapshot) error, workers, buffer int) *asyncSnapshotter {
+	s := &asyncSnapshotter{
+		logger:   logger,
+		recorder: recorder,
+		save:     save,
+		jobs:     make(chan Snapshot, buffer),
+	}
+	s.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go s.work()
+	}
+	return s
+}
+
+func (s *asyncSnapshotter) work() {
+	defer s.wg.Done()
+	for snap := range s.jobs {
+		// the snapshot is written under its tenant, so that multi tenant stores accept it
+		ctx := context.Background()
+		if snap.TenantID != "" {
+			ctx = WithTenant(ctx, snap.TenantID)
+		}
+		err := s.save(ctx, snap)
+		if err != nil {
+			s.logger.WithTags(log.Tags{
+				"aggregateID": snap.AggregateID,
+				"version":     snap.AggregateVersion,
+			}).WithError(err).Error("Failed to save snapshot")
+			if r, ok := s.recorder.(SnapshotFailureRecorder); ok {
+				r.SnapshotFailed(snap.AggregateType.String())
+			}
+			continue
+		}
+		s.recorder.SnapshotSaved(snap.AggregateType.String())
+	}
+}
+
+// submit queues the snapshot, blocking if the queue is full.
+// It fails if the snapshotter is closed or the context is done before there is room.
+func (s *asyncSnapshotter) submit(ctx context.Context, snap Snapshot) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return faults.New("snapshotter is closed")
+	}
+
+	select {
+	case s.jobs <- snap:
+		return nil
+	case <-ctx.Done():
+		return faults.Wrap(ctx.Err())
+	}
+}
+
+// close stops accepting snapshots and waits for the queued ones to be written
+func (s *asyncSnapshotter) close(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.jobs)
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return faults.Errorf("Unable to flush all snapshots: %w", ctx.Err())
+	}
+}
@@ -0,0 +1,488 @@
+package dynamodb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodbstreams"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodbstreams/types"
+	"github.com/cenkalti/backoff/v4"
+	"github.com/quintans/faults"
+
+	"github.com/quintans/eventsourcing"
+	"github.com/quintans/eventsourcing/common"
+	"github.com/quintans/eventsourcing/log"
+	"github.com/quintans/eventsourcing/sink"
+	"github.com/quintans/eventsourcing/store"
+)
+
+// StreamsClient is the part of the DynamoDB Streams client used by the feed, implemented by *dynamodbstreams.Client
+type StreamsClient interface {
+	DescribeStream(ctx context.Context, params *dynamodbstreams.DescribeStreamInput, optFns ...func(*dynamodbstreams.Options)) (*dynamodbstreams.DescribeStreamOutput, error)
+	GetShardIterator(ctx context.Context, params *dynamodbstreams.GetShardIteratorInput, optFns ...func(*dynamodbstreams.Options)) (*dynamodbstreams.GetShardIteratorOutput, error)
+	GetRecords(ctx context.Context, params *dynamodbstreams.GetRecordsInput, optFns ...func(*dynamodbstreams.Options)) (*dynamodbstreams.GetRecordsOutput, error)
+}
+
+var _ StreamsClient = (*dynamodbstreams.Client)(nil)
+
+type Feed struct {
+	logger           log.Logger
+	client           StreamsClient
+	streamARN        string
+	partitions       uint32
+	partitionsLow    uint32
+	partitionsHi     uint32
+	filter           store.Filter
+	coldStart        store.ColdStart
+	pollInterval     time.Duration
+	reconnectInitial time.Duration
+	reconnectMax     time.Duration
+}
+
+type FeedOption func(*Feed)
+
+func WithPartitions(partitions, partitionsLow, partitionsHi uint32) FeedOption {
+	return func(p *Feed) {
+		if partitions <= 1 {
+			return
+		}
+		p.partitions = partitions
+		p.partitionsLow = partitionsLow
+		p.partitionsHi = partitionsHi
+	}
+}
+
+// WithColdStart sets from where to start when the sink has no messages for the partitions of the feed.
+// It defaults to store.StartFromBeginning, that is limited to the records still in the stream, kept for 24 hours.
+func WithColdStart(start store.ColdStart) FeedOption {
+	return func(p *Feed) {
+		p.coldStart = start
+	}
+}
+
+// WithPollInterval sets how long to wait before reading the shards again, when they had no new records. It defaults to one second.
+func WithPollInterval(interval time.Duration) FeedOption {
+	return func(p *Feed) {
+		if interval > 0 {
+			p.pollInterval = interval
+		}
+	}
+}
+
+// WithReconnectBackoff sets the interval to wait before reading the stream again, when it fails with a recoverable error,
+// and the maximum interval that it grows to, exponentially and with jitter, while the reads fail.
+func WithReconnectBackoff(initial, max time.Duration) FeedOption {
+	return func(p *Feed) {
+		p.reconnectInitial = initial
+		p.reconnectMax = max
+	}
+}
+
+// WithFeedFilter only feeds the events passing the filter, applied in memory to the records of the stream.
+// Raw conditions are not supported.
+func WithFeedFilter(filters ...store.FilterOption) FeedOption {
+	return func(p *Feed) {
+		for _, f := range filters {
+			f(&p.filter)
+		}
+	}
+}
+
+// NewFeed creates a feed over the DynamoDB stream of the events table, that must have the NEW_IMAGE, or NEW_AND_OLD_IMAGES, view type.
+func NewFeed(logger log.Logger, client StreamsClient, streamARN string, opts ...FeedOption) Feed {
+	f := Feed{
+		logger:           logger,
+		client:           client,
+		streamARN:        streamARN,
+		pollInterval:     time.Second,
+		reconnectInitial: backoff.DefaultInitialInterval,
+		reconnectMax:     backoff.DefaultMaxInterval,
+	}
+
+	for _, o := range opts {
+		o(&f)
+	}
+	return f
+}
+
+// Feed feeds the sinker with the inserted events, from the stream.
+// A child shard is only read after its parent, so that the events of an aggregate are sinked in order.
+// The resume token of the events has the position of the feed in all the shards, so that it resumes after the last fully sinked item.
+// On recoverable errors, eg: throttling, the stream is read again with an exponential backoff, with jitter.
+// It only returns on fatal errors, eg: if the records to resume from were already trimmed from the stream, or when the context is cancelled.
+func (f Feed) Feed(ctx context.Context, sinker sink.Sinker) error {
+	if f.filter.RawCondition != "" {
+		return faults.Wrap(store.ErrRawConditionNotSupported)
+	}
+
+	pos := newPosition()
+	resumed := false
+	err := store.ForEachResumeTokenInSinkPartitions(ctx, sinker, f.partitionsLow, f.partitionsHi, func(message *eventsourcing.Event) error {
+		if len(message.ResumeToken) == 0 {
+			return nil
+		}
+		p, err := decodePosition(message.ResumeToken)
+		if err != nil {
+			return err
+		}
+		pos.merge(p)
+		resumed = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	logger := f.logger.WithTags(log.PartitionTags(f.partitionsLow, f.partitionsHi))
+	r := &streamReader{
+		feed:      f,
+		sinker:    sinker,
+		pos:       pos,
+		iterators: map[string]string{},
+		latest:    map[string]bool{},
+		fromNow:   !resumed && f.coldStart == store.StartFromNow,
+	}
+	switch {
+	case resumed:
+		logger.Info("Starting to feed")
+	case r.fromNow:
+		logger.Info("Starting to feed from now")
+	default:
+		logger.Info("Starting to feed from the beginning")
+	}
+
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = f.reconnectInitial
+	b.MaxInterval = f.reconnectMax
+	// never gives up
+	b.MaxElapsedTime = 0
+
+	err = backoff.RetryNotify(func() error {
+		return r.read(ctx, b)
+	}, backoff.WithContext(b, ctx), func(err error, d time.Duration) {
+		logger.WithError(err).
+			WithTags(log.Tags{"backoff": d}).
+			Warn("Failure reading the DynamoDB stream. Reading again.")
+	})
+	if ctx.Err() != nil {
+		// the in-flight item was completely sinked, so the feed can be resumed from the sink
+		return ctx.Err()
+	}
+	return err
+}
+
+// streamReader reads the shards of the stream, keeping where it is in each one
+type streamReader struct {
+	feed      Feed
+	sinker    sink.Sinker
+	pos       position
+	iterators map[string]string
+	// latest has the shards to read from their end, until a record is read from them
+	latest map[string]bool
+	// fromNow tells to read the shards open at the start from their end, and to skip the closed ones
+	fromNow bool
+}
+
+// read reads the shards of the stream, in rounds, until it fails or the context is cancelled
+func (r *streamReader) read(ctx context.Context, b backoff.BackOff) error {
+	for {
+		shards, err := r.describe(ctx)
+		if err != nil {
+			return streamError(err)
+		}
+		r.pos.prune(shards)
+		if r.fromNow {
+			for _, shard := range shards {
+				id := aws.ToString(shard.ShardId)
+				if shard.SequenceNumberRange != nil && shard.SequenceNumberRange.EndingSequenceNumber != nil {
+					r.pos.done(id)
+				} else {
+					r.latest[id] = true
+				}
+			}
+			r.fromNow = false
+		}
+
+		read := 0
+		for _, shard := range shards {
+			id := aws.ToString(shard.ShardId)
+			if r.pos.Done[id] {
+				continue
+			}
+			// the events of an aggregate in the child shard come after the ones in the parent shard
+			if parent := aws.ToString(shard.ParentShardId); parent != "" && !r.pos.Done[parent] && hasShard(shards, parent) {
+				continue
+			}
+			n, err := r.readShard(ctx, id)
+			if err != nil {
+				return err
+			}
+			if n > 0 {
+				read += n
+				b.Reset()
+			}
+		}
+
+		if read == 0 {
+			select {
+			case <-ctx.Done():
+				return backoff.Permanent(ctx.Err())
+			case <-time.After(r.feed.pollInterval):
+			}
+		}
+	}
+}
+
+// describe lists all the shards of the stream
+func (r *streamReader) describe(ctx context.Context) ([]types.Shard, error) {
+	var shards []types.Shard
+	var start *string
+	for {
+		out, err := r.feed.client.DescribeStream(ctx, &dynamodbstreams.DescribeStreamInput{
+			StreamArn:             aws.String(r.feed.streamARN),
+			ExclusiveStartShardId: start,
+		})
+		if err != nil {
+			return nil, faults.Errorf("Unable to describe the stream '%s': %w", r.feed.streamARN, err)
+		}
+		if out.StreamDescription == nil {
+			return shards, nil
+		}
+		shards = append(shards, out.StreamDescription.Shards...)
+		start = out.StreamDescription.LastEvaluatedShardId
+		if start == nil {
+			return shards, nil
+		}
+	}
+}
+
+func hasShard(shards []types.Shard, shardID string) bool {
+	for _, s := range shards {
+		if aws.ToString(s.ShardId) == shardID {
+			return true
+		}
+	}
+	return false
+}
+
+// readShard reads and sinks the next records of the shard, returning how many were read
+func (r *streamReader) readShard(ctx context.Context, shardID string) (int, error) {
+	iterator, ok := r.iterators[shardID]
+	if !ok {
+		var err error
+		iterator, err = r.shardIterator(ctx, shardID)
+		if err != nil {
+			return 0, streamError(err)
+		}
+	}
+
+	out, err := r.feed.client.GetRecords(ctx, &dynamodbstreams.GetRecordsInput{
+		ShardIterator: aws.String(iterator),
+	})
+	if err != nil {
+		var expired *types.ExpiredIteratorException
+		if errors.As(err, &expired) {
+			// a new iterator is taken from the position in the shard, on the next round
+			delete(r.iterators, shardID)
+			return 0, nil
+		}
+		return 0, streamError(faults.Errorf("Unable to get the records of shard '%s': %w", shardID, err))
+	}
+
+	for _, rec := range out.Records {
+		if err := r.sinkRecord(shardID, rec); err != nil {
+			return 0, backoff.Permanent(err)
+		}
+	}
+
+	if out.NextShardIterator == nil {
+		// the shard was closed and all of its records were read
+		r.pos.done(shardID)
+		delete(r.iterators, shardID)
+		delete(r.latest, shardID)
+	} else {
+		r.iterators[shardID] = aws.ToString(out.NextShardIterator)
+	}
+	return len(out.Records), nil
+}
+
+// shardIterator gets an iterator after the last record read from the shard, or else from its start,
+// or from its end if the feed started from now
+func (r *streamReader) shardIterator(ctx context.Context, shardID string) (string, error) {
+	input := &dynamodbstreams.GetShardIteratorInput{
+		StreamArn:         aws.String(r.feed.streamARN),
+		ShardId:           aws.String(shardID),
+		ShardIteratorType: types.ShardIteratorTypeTrimHorizon,
+	}
+	if seq, ok := r.pos.Sequences[shardID]; ok {
+		input.ShardIteratorType = types.ShardIteratorTypeAfterSequenceNumber
+		input.SequenceNumber = aws.String(seq)
+	} else if r.latest[shardID] {
+		input.ShardIteratorType = types.ShardIteratorTypeLatest
+	}
+	out, err := r.feed.client.GetShardIterator(ctx, input)
+	if err != nil {
+		return "", faults.Errorf("Unable to get an iterator for shard '%s': %w", shardID, err)
+	}
+	return aws.ToString(out.ShardIterator), nil
+}
+
+// sinkRecord sinks the events of the inserted item of the record, that are in the partitions of the feed and pass the filter.
+// The events are sinked even if the feed context is cancelled midway, so that the sink is left in a consistent position,
+// since only the last event carries the resume token of the item.
+func (r *streamReader) sinkRecord(shardID string, rec types.Record) error {
+	if rec.Dynamodb == nil {
+		return nil
+	}
+	r.pos.advance(shardID, aws.ToString(rec.Dynamodb.SequenceNumber))
+	delete(r.latest, shardID)
+	if rec.EventName != types.OperationTypeInsert {
+		return nil
+	}
+
+	image, err := attributevalue.FromDynamoDBStreamsMap(rec.Dynamodb.NewImage)
+	if err != nil {
+		return faults.Wrap(err)
+	}
+	item := Event{}
+	if err := attributevalue.UnmarshalMap(image, &item); err != nil {
+		return faults.Errorf("Unable to unmarshal the item of record '%s': %w", aws.ToString(rec.Dynamodb.SequenceNumber), err)
+	}
+	if r.feed.partitions > 1 {
+		partition := common.WhichPartition(item.AggregateIDHash, r.feed.partitions)
+		if partition < r.feed.partitionsLow || partition > r.feed.partitionsHi {
+			return nil
+		}
+	}
+	events, err := toEvents(item, nil)
+	if err != nil {
+		return err
+	}
+	var matched []eventsourcing.Event
+	for _, e := range events {
+		if r.feed.filter.Matches(e) {
+			matched = append(matched, e)
+		}
+	}
+	if len(matched) == 0 {
+		return nil
+	}
+
+	token, err := r.pos.encode()
+	if err != nil {
+		return err
+	}
+	// the resume token should be from the last fully completed sinked item, because it may fail midway.
+	matched[len(matched)-1].ResumeToken = token
+	for _, e := range matched {
+		if err := r.sinker.Sink(context.Background(), e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// streamError makes permanent the errors that won't go away by reading the stream again,
+// eg: when the records to resume from were already trimmed from the stream
+func streamError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var trimmed *types.TrimmedDataAccessException
+	var notFound *types.ResourceNotFoundException
+	if errors.As(err, &trimmed) || errors.As(err, &notFound) {
+		return backoff.Permanent(faults.Wrap(err))
+	}
+	return faults.Wrap(err)
+}
+
+// position is where the feed is in the shards of the stream: the sequence number of the last record read from each shard,
+// and the shards that were read to their end. It is the resume token of the sinked events.
+type position struct {
+	Sequences map[string]string `json:"seq,omitempty"`
+	Done      map[string]bool   `json:"done,omitempty"`
+}
+
+func newPosition() position {
+	return position{
+		Sequences: map[string]string{},
+		Done:      map[string]bool{},
+	}
+}
+
+func decodePosition(token []byte) (position, error) {
+	p := newPosition()
+	if err := json.Unmarshal(token, &p); err != nil {
+		return position{}, faults.Errorf("Unable to decode the resume token '%s': %w", string(token), err)
+	}
+	if p.Sequences == nil {
+		p.Sequences = map[string]string{}
+	}
+	if p.Done == nil {
+		p.Done = map[string]bool{}
+	}
+	return p, nil
+}
+
+func (p position) encode() ([]byte, error) {
+	b, err := json.Marshal(p)
+	return b, faults.Wrap(err)
+}
+
+func (p position) advance(shardID, seq string) {
+	p.Sequences[shardID] = seq
+}
+
+func (p position) done(shardID string) {
+	delete(p.Sequences, shardID)
+	p.Done[shardID] = true
+}
+
+// merge moves the position forward to the other position.
+// Since the positions of a feed only move forward, the merge of the positions of the last messages of the partitions is the most recent one.
+func (p position) merge(other position) {
+	for shardID := range other.Done {
+		p.done(shardID)
+	}
+	for shardID, seq := range other.Sequences {
+		if p.Done[shardID] {
+			continue
+		}
+		if current, ok := p.Sequences[shardID]; !ok || compareSequences(seq, current) > 0 {
+			p.Sequences[shardID] = seq
+		}
+	}
+}
+
+// prune forgets the shards that are no longer in the stream, trimmed after 24 hours
+func (p position) prune(shards []types.Shard) {
+	for shardID := range p.Sequences {
+		if !hasShard(shards, shardID) {
+			delete(p.Sequences, shardID)
+		}
+	}
+	for shardID := range p.Done {
+		if !hasShard(shards, shardID) {
+			delete(p.Done, shardID)
+		}
+	}
+}
+
+// compareSequences compares two sequence numbers, that are numeric strings of variable length
+func compareSequences(a, b string) int {
+	switch {
+	case len(a) < len(b):
+		return -1
+	case len(a) > len(b):
+		return 1
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
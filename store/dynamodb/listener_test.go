@@ -0,0 +1,227 @@
+package dynamodb
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	ddbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodbstreams"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodbstreams/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/quintans/eventsourcing"
+	"github.com/quintans/eventsourcing/eventid"
+	"github.com/quintans/eventsourcing/log"
+	"github.com/quintans/eventsourcing/test"
+)
+
+type fakeShard struct {
+	id      string
+	parent  string
+	closed  bool
+	records []types.Record
+}
+
+// fakeStreams serves the records of the shards, with iterators of the form <shard>:<index of the next record>
+type fakeStreams struct {
+	mu     sync.Mutex
+	shards []*fakeShard
+}
+
+func (c *fakeStreams) shard(id string) *fakeShard {
+	for _, s := range c.shards {
+		if s.id == id {
+			return s
+		}
+	}
+	return nil
+}
+
+func (c *fakeStreams) DescribeStream(ctx context.Context, params *dynamodbstreams.DescribeStreamInput, optFns ...func(*dynamodbstreams.Options)) (*dynamodbstreams.DescribeStreamOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	shards := []types.Shard{}
+	for _, s := range c.shards {
+		shard := types.Shard{
+			ShardId:             aws.String(s.id),
+			SequenceNumberRange: &types.SequenceNumberRange{},
+		}
+		if s.parent != "" {
+			shard.ParentShardId = aws.String(s.parent)
+		}
+		if s.closed {
+			shard.SequenceNumberRange.EndingSequenceNumber = aws.String("999")
+		}
+		shards = append(shards, shard)
+	}
+	return &dynamodbstreams.DescribeStreamOutput{StreamDescription: &types.StreamDescription{Shards: shards}}, nil
+}
+
+func (c *fakeStreams) GetShardIterator(ctx context.Context, params *dynamodbstreams.GetShardIteratorInput, optFns ...func(*dynamodbstreams.Options)) (*dynamodbstreams.GetShardIteratorOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.shard(aws.ToString(params.ShardId))
+	index := 0
+	switch params.ShardIteratorType {
+	case types.ShardIteratorTypeLatest:
+		index = len(s.records)
+	case types.ShardIteratorTypeAfterSequenceNumber:
+		for k, r := range s.records {
+			if aws.ToString(r.Dynamodb.SequenceNumber) == aws.ToString(params.SequenceNumber) {
+				index = k + 1
+			}
+		}
+	}
+	return &dynamodbstreams.GetShardIteratorOutput{ShardIterator: aws.String(fmt.Sprintf("%s:%d", s.id, index))}, nil
+}
+
+func (c *fakeStreams) GetRecords(ctx context.Context, params *dynamodbstreams.GetRecordsInput, optFns ...func(*dynamodbstreams.Options)) (*dynamodbstreams.GetRecordsOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	parts := strings.Split(aws.ToString(params.ShardIterator), ":")
+	s := c.shard(parts[0])
+	index, _ := strconv.Atoi(parts[1])
+	out := &dynamodbstreams.GetRecordsOutput{Records: s.records[index:]}
+	if !s.closed {
+		out.NextShardIterator = aws.String(fmt.Sprintf("%s:%d", s.id, len(s.records)))
+	}
+	return out, nil
+}
+
+func (c *fakeStreams) add(shardID string, rec types.Record) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.shard(shardID)
+	s.records = append(s.records, rec)
+}
+
+func record(t *testing.T, seq, aggregateID string, version uint32, kinds ...string) types.Record {
+	now := time.Now()
+	id, err := eventid.New(now, eventid.EntropyFactory(now))
+	require.NoError(t, err)
+	item := Event{
+		ID:               id.String(),
+		AggregateID:      aggregateID,
+		AggregateVersion: version,
+		AggregateType:    "Account",
+		CreatedAt:        now,
+	}
+	for _, k := range kinds {
+		item.Details = append(item.Details, EventDetail{Kind: eventsourcing.EventKind(k), Body: []byte("{}")})
+	}
+	av, err := attributevalue.MarshalMap(item)
+	require.NoError(t, err)
+	return types.Record{
+		EventName: types.OperationTypeInsert,
+		Dynamodb: &types.StreamRecord{
+			SequenceNumber: aws.String(seq),
+			NewImage:       toStreamsMap(av),
+		},
+	}
+}
+
+// toStreamsMap converts the attribute values of an item to the ones of a stream record
+func toStreamsMap(from map[string]ddbtypes.AttributeValue) map[string]types.AttributeValue {
+	to := map[string]types.AttributeValue{}
+	for k, v := range from {
+		to[k] = toStreams(v)
+	}
+	return to
+}
+
+func toStreams(from ddbtypes.AttributeValue) types.AttributeValue {
+	switch v := from.(type) {
+	case *ddbtypes.AttributeValueMemberS:
+		return &types.AttributeValueMemberS{Value: v.Value}
+	case *ddbtypes.AttributeValueMemberN:
+		return &types.AttributeValueMemberN{Value: v.Value}
+	case *ddbtypes.AttributeValueMemberB:
+		return &types.AttributeValueMemberB{Value: v.Value}
+	case *ddbtypes.AttributeValueMemberBOOL:
+		return &types.AttributeValueMemberBOOL{Value: v.Value}
+	case *ddbtypes.AttributeValueMemberNULL:
+		return &types.AttributeValueMemberNULL{Value: v.Value}
+	case *ddbtypes.AttributeValueMemberM:
+		return &types.AttributeValueMemberM{Value: toStreamsMap(v.Value)}
+	case *ddbtypes.AttributeValueMemberL:
+		l := make([]types.AttributeValue, len(v.Value))
+		for k, e := range v.Value {
+			l[k] = toStreams(e)
+		}
+		return &types.AttributeValueMemberL{Value: l}
+	}
+	panic(fmt.Sprintf("unexpected attribute value %T", from))
+}
+
+// feed runs the feed until the sink has the number of events
+func feed(t *testing.T, client StreamsClient, sinker *test.MockSink, count int) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- NewFeed(log.NopLogger{}, client, "arn", WithPollInterval(time.Millisecond)).Feed(ctx, sinker)
+	}()
+
+	require.Eventually(t, func() bool {
+		return len(sinker.GetEvents()) >= count
+	}, time.Second, time.Millisecond)
+	cancel()
+	require.Equal(t, context.Canceled, <-done)
+}
+
+func TestFeedReadsParentShardFirstAndResumes(t *testing.T) {
+	client := &fakeStreams{
+		shards: []*fakeShard{
+			{id: "child", parent: "parent"},
+			{id: "parent", closed: true},
+			{id: "other"},
+		},
+	}
+	client.add("child", record(t, "300", "A", 3, "MoneyWithdrawn"))
+	client.add("parent", record(t, "100", "A", 1, "AccountCreated"))
+	client.add("parent", record(t, "200", "A", 2, "MoneyDeposited", "MoneyDeposited"))
+	client.add("other", record(t, "150", "B", 1, "AccountCreated"))
+
+	sinker := test.NewMockSink(1)
+	feed(t, client, sinker, 5)
+
+	events := sinker.GetEvents()
+	require.Len(t, events, 5)
+	var versions []uint32
+	for _, e := range events {
+		if e.AggregateID == "A" {
+			versions = append(versions, e.AggregateVersion)
+		}
+	}
+	assert.Equal(t, []uint32{1, 2, 2, 3}, versions)
+
+	// only the records after the position in the sink are fed after a restart
+	client.add("child", record(t, "400", "A", 4, "MoneyDeposited"))
+	client.add("other", record(t, "250", "B", 2, "MoneyDeposited"))
+	feed(t, client, sinker, 7)
+
+	events = sinker.GetEvents()
+	require.Len(t, events, 7)
+	assert.ElementsMatch(t, []string{"A/4", "B/2"}, []string{
+		fmt.Sprintf("%s/%d", events[5].AggregateID, events[5].AggregateVersion),
+		fmt.Sprintf("%s/%d", events[6].AggregateID, events[6].AggregateVersion),
+	})
+}
+
+func TestMergePositions(t *testing.T) {
+	p := newPosition()
+	p.merge(position{Sequences: map[string]string{"a": "99", "b": "300"}, Done: map[string]bool{}})
+	p.merge(position{Sequences: map[string]string{"a": "100", "b": "200"}, Done: map[string]bool{"c": true}})
+	p.merge(position{Sequences: map[string]string{"c": "500"}, Done: map[string]bool{}})
+
+	assert.Equal(t, map[string]string{"a": "100", "b": "300"}, p.Sequences)
+	assert.Equal(t, map[string]bool{"c": true}, p.Done)
+}
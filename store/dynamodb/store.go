@@ -0,0 +1,503 @@
+package dynamodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/quintans/faults"
+
+	"github.com/quintans/eventsourcing"
+	"github.com/quintans/eventsourcing/eventid"
+)
+
+const (
+	defaultEventsTable      = "events"
+	defaultSnapshotsTable   = "snapshots"
+	defaultIdempotencyIndex = "idempotency_key_idx"
+)
+
+// Event is the item with the events of a save, keyed by aggregate ID and aggregate version.
+// Like in the MongoDB repository, the version is incremented once per save, and the events of the item share its ID, told apart by their count.
+type Event struct {
+	ID               string                      `dynamodbav:"id"`
+	AggregateID      string                      `dynamodbav:"aggregate_id"`
+	AggregateVersion uint32                      `dynamodbav:"aggregate_version"`
+	AggregateIDHash  uint32                      `dynamodbav:"aggregate_id_hash"`
+	AggregateType    eventsourcing.AggregateType `dynamodbav:"aggregate_type"`
+	Details          []EventDetail               `dynamodbav:"details"`
+	ContentType      string                      `dynamodbav:"content_type,omitempty"`
+	IdempotencyKey   string                      `dynamodbav:"idempotency_key,omitempty"`
+	Metadata         map[string]interface{}      `dynamodbav:"metadata,omitempty"`
+	TenantID         string                      `dynamodbav:"tenant_id,omitempty"`
+	CreatedAt        time.Time                   `dynamodbav:"created_at"`
+}
+
+type EventDetail struct {
+	Kind         eventsourcing.EventKind `dynamodbav:"kind"`
+	Body         []byte                  `dynamodbav:"body"`
+	EventVersion uint16                  `dynamodbav:"event_version,omitempty"`
+	ForgottenAt  *time.Time              `dynamodbav:"forgotten_at,omitempty"`
+}
+
+// Snapshot is the item of a snapshot, keyed by aggregate ID and aggregate version, in the snapshots table
+type Snapshot struct {
+	ID               string                      `dynamodbav:"id"`
+	AggregateID      string                      `dynamodbav:"aggregate_id"`
+	AggregateVersion uint32                      `dynamodbav:"aggregate_version"`
+	AggregateType    eventsourcing.AggregateType `dynamodbav:"aggregate_type"`
+	Body             []byte                      `dynamodbav:"body"`
+	TenantID         string                      `dynamodbav:"tenant_id,omitempty"`
+	CreatedAt        time.Time                   `dynamodbav:"created_at"`
+}
+
+// Client is the part of the DynamoDB client used by the repository, implemented by *dynamodb.Client
+type Client interface {
+	PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+	Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error)
+	UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error)
+}
+
+var _ Client = (*dynamodb.Client)(nil)
+
+var _ eventsourcing.EsRepository = (*EsRepository)(nil)
+
+type StoreOption func(*EsRepository)
+
+func WithEventsTable(eventsTable string) StoreOption {
+	return func(r *EsRepository) {
+		r.eventsTable = eventsTable
+	}
+}
+
+func WithSnapshotsTable(snapshotsTable string) StoreOption {
+	return func(r *EsRepository) {
+		r.snapshotsTable = snapshotsTable
+	}
+}
+
+// WithIdempotencyIndex sets the name of the global secondary index of the events table on the idempotency_key attribute.
+// It defaults to idempotency_key_idx.
+func WithIdempotencyIndex(index string) StoreOption {
+	return func(r *EsRepository) {
+		r.idempotencyIndex = index
+	}
+}
+
+// WithEventIDGenerator sets how the IDs of the events are generated, replacing eventid.Generate.
+// The IDs must have the creation time of the events, since the feeds rely on the IDs being ordered by creation time.
+func WithEventIDGenerator(generator eventid.Generator) StoreOption {
+	return func(r *EsRepository) {
+		r.idGenerator = generator
+	}
+}
+
+// WithHashFunc sets the function that computes the aggregate ID hash, used to partition the events, replacing eventsourcing.HashAggregateID.
+// eg: eventsourcing.HashLabel("tenant") partitions the events by tenant.
+func WithHashFunc(fn eventsourcing.HashFunc) StoreOption {
+	return func(r *EsRepository) {
+		r.hashFunc = fn
+	}
+}
+
+type EsRepository struct {
+	client           Client
+	eventsTable      string
+	snapshotsTable   string
+	idempotencyIndex string
+	idGenerator      eventid.Generator
+	hashFunc         eventsourcing.HashFunc
+}
+
+// NewStore creates a repository over the events and snapshots tables.
+// Both tables have the partition key aggregate_id (string) and the sort key aggregate_version (number),
+// and the events table has a global secondary index on idempotency_key (string), see WithIdempotencyIndex.
+// The repository is not multi tenant: the tenant of the events and of the snapshots is kept,
+// in Event.TenantID and Snapshot.TenantID, but the reads are not constrained to the tenant of the context.
+func NewStore(client Client, opts ...StoreOption) *EsRepository {
+	r := &EsRepository{
+		client:           client,
+		eventsTable:      defaultEventsTable,
+		snapshotsTable:   defaultSnapshotsTable,
+		idempotencyIndex: defaultIdempotencyIndex,
+		idGenerator:      eventid.Generate,
+		hashFunc:         eventsourcing.HashAggregateID,
+	}
+
+	for _, o := range opts {
+		o(r)
+	}
+
+	return r
+}
+
+var _ eventsourcing.EventIDsSaver = (*EsRepository)(nil)
+
+// SaveEventIDs saves the events of the record, in a single item, returning the IDs of all of them.
+// The events of an item share the item ID, told apart by their count.
+func (r *EsRepository) SaveEventIDs(ctx context.Context, eRec eventsourcing.EventRecord) ([]eventid.EventID, uint32, error) {
+	id, version, err := r.SaveEvent(ctx, eRec)
+	if err != nil {
+		return nil, 0, err
+	}
+	ids := make([]eventid.EventID, len(eRec.Details))
+	for k := range ids {
+		ids[k] = id.SetCount(uint8(k))
+	}
+	return ids, version, nil
+}
+
+var _ eventsourcing.AggregateHasher = (*EsRepository)(nil)
+
+// AggregateIDHash returns the hash that partitions the events of the aggregate
+func (r *EsRepository) AggregateIDHash(aggregateID string, labels map[string]interface{}) uint32 {
+	return r.hashFunc(aggregateID, labels)
+}
+
+// SaveEvent puts the item with the events of the record, on the condition that there is no item with its version,
+// failing with eventsourcing.ErrConcurrentModification otherwise.
+// Since a secondary index doesn't enforce uniqueness, the idempotency key is checked before the put,
+// through the eventually consistent index, failing with eventsourcing.ErrDuplicateIdempotencyKey if it was already used.
+func (r *EsRepository) SaveEvent(ctx context.Context, eRec eventsourcing.EventRecord) (eventid.EventID, uint32, error) {
+	if len(eRec.Details) == 0 {
+		return eventid.Zero, 0, faults.New("No events to be saved")
+	}
+	if eRec.IdempotencyKey != "" {
+		var dup bool
+		var err error
+		if eRec.IdempotencyScope == eventsourcing.IdempotencyScopeAggregate {
+			dup, err = r.HasAggregateIdempotencyKey(ctx, eRec.AggregateID, eRec.IdempotencyKey)
+		} else {
+			dup, err = r.HasIdempotencyKey(ctx, eRec.IdempotencyKey)
+		}
+		if err != nil {
+			return eventid.Zero, 0, err
+		}
+		if dup {
+			return eventid.Zero, 0, faults.Errorf("%w: '%s'", eventsourcing.ErrDuplicateIdempotencyKey, eRec.IdempotencyKey)
+		}
+	}
+
+	details := make([]EventDetail, 0, len(eRec.Details))
+	for _, e := range eRec.Details {
+		details = append(details, EventDetail{
+			Kind:         e.Kind,
+			Body:         e.Body,
+			EventVersion: e.EventVersion,
+		})
+	}
+
+	id, err := r.idGenerator.New(eventid.NewEntropy(), eRec.CreatedAt, eRec.AggregateID, eRec.Version+1)
+	if err != nil {
+		return eventid.Zero, 0, faults.Wrap(err)
+	}
+
+	version := eRec.Version + 1
+	item, err := attributevalue.MarshalMap(Event{
+		ID:               id.String(),
+		AggregateID:      eRec.AggregateID,
+		AggregateVersion: version,
+		AggregateIDHash:  r.hashFunc(eRec.AggregateID, eRec.Labels),
+		AggregateType:    eRec.AggregateType,
+		Details:          details,
+		ContentType:      eRec.ContentType,
+		IdempotencyKey:   eRec.IdempotencyKey,
+		Metadata:         eRec.Labels,
+		TenantID:         eRec.TenantID,
+		CreatedAt:        eRec.CreatedAt,
+	})
+	if err != nil {
+		return eventid.Zero, 0, faults.Errorf("Unable to marshal the events of aggregate '%s': %w", eRec.AggregateID, err)
+	}
+
+	_, err = r.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(r.eventsTable),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(aggregate_id)"),
+	})
+	if err != nil {
+		var condErr *types.ConditionalCheckFailedException
+		if errors.As(err, &condErr) {
+			return eventid.Zero, 0, eventsourcing.WrapCause(eventsourcing.ErrConcurrentModification, err)
+		}
+		return eventid.Zero, 0, faults.Errorf("Unable to put the events of aggregate '%s': %w", eRec.AggregateID, err)
+	}
+
+	return id, version, nil
+}
+
+func (r *EsRepository) GetSnapshot(ctx context.Context, aggregateID string) (eventsourcing.Snapshot, error) {
+	out, err := r.client.Query(ctx, &dynamodb.QueryInput{
+		TableName:                 aws.String(r.snapshotsTable),
+		KeyConditionExpression:    aws.String("aggregate_id = :id"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{":id": &types.AttributeValueMemberS{Value: aggregateID}},
+		ScanIndexForward:          aws.Bool(false),
+		Limit:                     aws.Int32(1),
+		ConsistentRead:            aws.Bool(true),
+	})
+	if err != nil {
+		return eventsourcing.Snapshot{}, faults.Errorf("Unable to get snapshot for aggregate '%s': %w", aggregateID, err)
+	}
+	if len(out.Items) == 0 {
+		return eventsourcing.Snapshot{}, nil
+	}
+	snap := Snapshot{}
+	if err := attributevalue.UnmarshalMap(out.Items[0], &snap); err != nil {
+		return eventsourcing.Snapshot{}, faults.Errorf("Unable to unmarshal snapshot for aggregate '%s': %w", aggregateID, err)
+	}
+	id, err := eventid.Parse(snap.ID)
+	if err != nil {
+		return eventsourcing.Snapshot{}, faults.Errorf("unable to parse snapshot ID '%s': %w", snap.ID, err)
+	}
+	return eventsourcing.Snapshot{
+		ID:               id,
+		AggregateID:      aggregateID,
+		AggregateVersion: snap.AggregateVersion,
+		AggregateType:    snap.AggregateType,
+		Body:             snap.Body,
+		TenantID:         snap.TenantID,
+		CreatedAt:        snap.CreatedAt,
+	}, nil
+}
+
+func (r *EsRepository) SaveSnapshot(ctx context.Context, snapshot eventsourcing.Snapshot) error {
+	item, err := attributevalue.MarshalMap(Snapshot{
+		ID:               snapshot.ID.String(),
+		AggregateID:      snapshot.AggregateID,
+		AggregateVersion: snapshot.AggregateVersion,
+		AggregateType:    snapshot.AggregateType,
+		Body:             snapshot.Body,
+		TenantID:         snapshot.TenantID,
+		CreatedAt:        snapshot.CreatedAt,
+	})
+	if err != nil {
+		return faults.Wrap(err)
+	}
+	_, err = r.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(r.snapshotsTable),
+		Item:      item,
+	})
+	return faults.Wrap(err)
+}
+
+func (r *EsRepository) GetAggregateEvents(ctx context.Context, aggregateID string, snapVersion int) ([]eventsourcing.Event, error) {
+	items, err := r.aggregateItems(ctx, aggregateID, snapVersion)
+	if err != nil {
+		return nil, faults.Errorf("Unable to get events for Aggregate '%s': %w", aggregateID, err)
+	}
+
+	events := []eventsourcing.Event{}
+	for _, item := range items {
+		evts, err := toEvents(item, nil)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, evts...)
+	}
+	return events, nil
+}
+
+// aggregateItems queries the items of the aggregate after the snapshot version, in version order
+func (r *EsRepository) aggregateItems(ctx context.Context, aggregateID string, snapVersion int) ([]Event, error) {
+	input := &dynamodb.QueryInput{
+		TableName:                 aws.String(r.eventsTable),
+		KeyConditionExpression:    aws.String("aggregate_id = :id"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{":id": &types.AttributeValueMemberS{Value: aggregateID}},
+		ConsistentRead:            aws.Bool(true),
+	}
+	if snapVersion > -1 {
+		input.KeyConditionExpression = aws.String("aggregate_id = :id AND aggregate_version > :version")
+		input.ExpressionAttributeValues[":version"] = &types.AttributeValueMemberN{Value: strconv.Itoa(snapVersion)}
+	}
+
+	items := []Event{}
+	paginator := dynamodb.NewQueryPaginator(r.client, input)
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, faults.Wrap(err)
+		}
+		page := []Event{}
+		if err := attributevalue.UnmarshalListOfMaps(out.Items, &page); err != nil {
+			return nil, faults.Wrap(err)
+		}
+		items = append(items, page...)
+	}
+	return items, nil
+}
+
+// toEvents converts the item to its events, of the kinds, if any
+func toEvents(item Event, kinds []eventsourcing.EventKind) ([]eventsourcing.Event, error) {
+	id, err := eventid.Parse(item.ID)
+	if err != nil {
+		return nil, faults.Errorf("unable to parse event ID '%s': %w", item.ID, err)
+	}
+	events := make([]eventsourcing.Event, 0, len(item.Details))
+	for k, d := range item.Details {
+		if !hasKind(kinds, d.Kind) {
+			continue
+		}
+		e := eventsourcing.Event{
+			ID:               id.SetCount(uint8(k)),
+			AggregateID:      item.AggregateID,
+			AggregateIDHash:  item.AggregateIDHash,
+			AggregateVersion: item.AggregateVersion,
+			AggregateType:    item.AggregateType,
+			Kind:             d.Kind,
+			Body:             d.Body,
+			ContentType:      item.ContentType,
+			IdempotencyKey:   item.IdempotencyKey,
+			Metadata:         item.Metadata,
+			TenantID:         item.TenantID,
+			EventVersion:     d.EventVersion,
+			CreatedAt:        item.CreatedAt,
+		}
+		if d.ForgottenAt != nil {
+			e.ForgottenAt = *d.ForgottenAt
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+// hasKind checks if the kind is one of the kinds. No kinds means any kind.
+func hasKind(kinds []eventsourcing.EventKind, kind eventsourcing.EventKind) bool {
+	if len(kinds) == 0 {
+		return true
+	}
+	for _, k := range kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// HasIdempotencyKey checks if the idempotency key was used, through the secondary index.
+// Since the secondary indexes are eventually consistent, a key used moments ago may not be found yet.
+func (r *EsRepository) HasIdempotencyKey(ctx context.Context, idempotencyKey string) (bool, error) {
+	out, err := r.client.Query(ctx, &dynamodb.QueryInput{
+		TableName:                 aws.String(r.eventsTable),
+		IndexName:                 aws.String(r.idempotencyIndex),
+		KeyConditionExpression:    aws.String("idempotency_key = :key"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{":key": &types.AttributeValueMemberS{Value: idempotencyKey}},
+		Select:                    types.SelectCount,
+		Limit:                     aws.Int32(1),
+	})
+	if err != nil {
+		return false, faults.Errorf("Unable to verify the existence of the idempotency key: %w", err)
+	}
+	return out.Count > 0, nil
+}
+
+var _ eventsourcing.AggregateIdempotencyKeyChecker = (*EsRepository)(nil)
+
+// HasAggregateIdempotencyKey checks if the idempotency key was used by the aggregate
+func (r *EsRepository) HasAggregateIdempotencyKey(ctx context.Context, aggregateID, idempotencyKey string) (bool, error) {
+	paginator := dynamodb.NewQueryPaginator(r.client, &dynamodb.QueryInput{
+		TableName:              aws.String(r.eventsTable),
+		KeyConditionExpression: aws.String("aggregate_id = :id"),
+		FilterExpression:       aws.String("idempotency_key = :key"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":id":  &types.AttributeValueMemberS{Value: aggregateID},
+			":key": &types.AttributeValueMemberS{Value: idempotencyKey},
+		},
+		Select:         types.SelectCount,
+		ConsistentRead: aws.Bool(true),
+	})
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			return false, faults.Errorf("Unable to verify the existence of the idempotency key for aggregate '%s': %w", aggregateID, err)
+		}
+		if out.Count > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Forget erases the bodies of the events of the kind, and of the snapshots, of the aggregate.
+// Since the items are updated one by one, if it fails it can be called again.
+func (r *EsRepository) Forget(ctx context.Context, request eventsourcing.ForgetRequest, forget func(kind string, body []byte) ([]byte, error)) error {
+	items, err := r.aggregateItems(ctx, request.AggregateID, -1)
+	if err != nil {
+		return faults.Errorf("Unable to get events for Aggregate '%s' and event kind '%s': %w", request.AggregateID, request.EventKind, err)
+	}
+	forgottenAt, err := attributevalue.Marshal(time.Now().UTC())
+	if err != nil {
+		return faults.Wrap(err)
+	}
+	for _, item := range items {
+		var set []string
+		values := map[string]types.AttributeValue{":forgottenAt": forgottenAt}
+		for k, d := range item.Details {
+			if d.Kind != request.EventKind {
+				continue
+			}
+			body, err := forget(d.Kind.String(), d.Body)
+			if err != nil {
+				return err
+			}
+			values[fmt.Sprintf(":body%d", k)] = &types.AttributeValueMemberB{Value: body}
+			set = append(set, fmt.Sprintf("details[%d].body = :body%d, details[%d].forgotten_at = :forgottenAt", k, k, k))
+		}
+		if len(set) == 0 {
+			continue
+		}
+		err = r.updateItem(ctx, r.eventsTable, item.AggregateID, item.AggregateVersion, "SET "+strings.Join(set, ", "), values)
+		if err != nil {
+			return faults.Errorf("Unable to forget event ID %s: %w", item.ID, err)
+		}
+	}
+
+	paginator := dynamodb.NewQueryPaginator(r.client, &dynamodb.QueryInput{
+		TableName:                 aws.String(r.snapshotsTable),
+		KeyConditionExpression:    aws.String("aggregate_id = :id"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{":id": &types.AttributeValueMemberS{Value: request.AggregateID}},
+		ConsistentRead:            aws.Bool(true),
+	})
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			return faults.Errorf("Unable to get snapshot for aggregate '%s': %w", request.AggregateID, err)
+		}
+		snaps := []Snapshot{}
+		if err := attributevalue.UnmarshalListOfMaps(out.Items, &snaps); err != nil {
+			return faults.Errorf("Unable to get snapshot for aggregate '%s': %w", request.AggregateID, err)
+		}
+		for _, s := range snaps {
+			body, err := forget(s.AggregateType.String(), s.Body)
+			if err != nil {
+				return err
+			}
+			err = r.updateItem(ctx, r.snapshotsTable, s.AggregateID, s.AggregateVersion, "SET body = :body",
+				map[string]types.AttributeValue{":body": &types.AttributeValueMemberB{Value: body}})
+			if err != nil {
+				return faults.Errorf("Unable to forget snapshot with ID %s: %w", s.ID, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (r *EsRepository) updateItem(ctx context.Context, table, aggregateID string, version uint32, update string, values map[string]types.AttributeValue) error {
+	_, err := r.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(table),
+		Key: map[string]types.AttributeValue{
+			"aggregate_id":      &types.AttributeValueMemberS{Value: aggregateID},
+			"aggregate_version": &types.AttributeValueMemberN{Value: strconv.FormatUint(uint64(version), 10)},
+		},
+		UpdateExpression:          aws.String(update),
+		ExpressionAttributeValues: values,
+	})
+	return faults.Wrap(err)
+}
@@ -0,0 +1,92 @@
+package dynamodb
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/quintans/eventsourcing"
+)
+
+type fakeClient struct {
+	putErr error
+	count  int32
+	puts   []*dynamodb.PutItemInput
+}
+
+func (c *fakeClient) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	c.puts = append(c.puts, params)
+	return &dynamodb.PutItemOutput{}, c.putErr
+}
+
+func (c *fakeClient) Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+	return &dynamodb.QueryOutput{Count: c.count}, nil
+}
+
+func (c *fakeClient) UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func eventRecord() eventsourcing.EventRecord {
+	return eventsourcing.EventRecord{
+		AggregateID:   "123",
+		Version:       2,
+		AggregateType: "Account",
+		Details:       []eventsourcing.EventRecordDetail{{Kind: "MoneyDeposited", Body: []byte("{}")}},
+		CreatedAt:     time.Now(),
+	}
+}
+
+func TestSaveEventConditionalWrite(t *testing.T) {
+	client := &fakeClient{}
+	r := NewStore(client)
+
+	_, version, err := r.SaveEvent(context.Background(), eventRecord())
+	require.NoError(t, err)
+	assert.Equal(t, uint32(3), version)
+	require.Len(t, client.puts, 1)
+	assert.Equal(t, "attribute_not_exists(aggregate_id)", *client.puts[0].ConditionExpression)
+
+	client.putErr = &types.ConditionalCheckFailedException{}
+	_, _, err = r.SaveEvent(context.Background(), eventRecord())
+	require.True(t, errors.Is(err, eventsourcing.ErrConcurrentModification))
+}
+
+func TestSaveEventDuplicateIdempotencyKey(t *testing.T) {
+	client := &fakeClient{count: 1}
+	r := NewStore(client)
+
+	rec := eventRecord()
+	rec.IdempotencyKey = "key"
+	_, _, err := r.SaveEvent(context.Background(), rec)
+	require.True(t, errors.Is(err, eventsourcing.ErrDuplicateIdempotencyKey))
+	assert.Empty(t, client.puts)
+}
+
+func TestSaveEventKeepsTenantAndEventVersion(t *testing.T) {
+	client := &fakeClient{}
+	r := NewStore(client)
+
+	rec := eventRecord()
+	rec.TenantID = "A"
+	rec.Details[0].EventVersion = 2
+	_, _, err := r.SaveEvent(context.Background(), rec)
+	require.NoError(t, err)
+	require.Len(t, client.puts, 1)
+
+	item := Event{}
+	err = attributevalue.UnmarshalMap(client.puts[0].Item, &item)
+	require.NoError(t, err)
+	events, err := toEvents(item, nil)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, "A", events[0].TenantID)
+	assert.Equal(t, uint16(2), events[0].EventVersion)
+}
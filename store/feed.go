@@ -2,10 +2,13 @@ package store
 
 import (
 	"context"
+	"sort"
+	"sync"
 
 	"github.com/quintans/faults"
 
 	"github.com/quintans/eventsourcing"
+	"github.com/quintans/eventsourcing/eventid"
 	"github.com/quintans/eventsourcing/log"
 	"github.com/quintans/eventsourcing/sink"
 )
@@ -31,7 +34,7 @@ func NewForwarder(logger log.Logger, name string, feeder Feeder, sinker sink.Sin
 }
 
 func (f *Forwarder) Run(ctx context.Context) error {
-	f.logger.Infof("Starting Feed '%s'", f.name)
+	f.logger.WithTags(log.Tags{log.TagProjection: f.name}).Info("Starting feed")
 	err := f.feeder.Feed(ctx, f.sinker)
 	if err != nil {
 		return faults.Errorf("Error feeding '%s' on boot: %w", f.name, err)
@@ -41,6 +44,50 @@ func (f *Forwarder) Run(ctx context.Context) error {
 
 func (f *Forwarder) Cancel() {}
 
+// ColdStart tells from where a feed starts when the sink has no messages for its partitions, eg: for a brand new consumer
+type ColdStart int
+
+const (
+	// StartFromBeginning feeds all the events in the store, backfilling the history
+	StartFromBeginning ColdStart = iota
+	// StartFromNow only feeds the events saved after the feed started
+	StartFromNow
+)
+
+// SinkPosition is the last message of a partition in the sink
+type SinkPosition struct {
+	Partition   uint32
+	EventID     eventid.EventID
+	ResumeToken []byte
+}
+
+// IsZero tells if the partition has no messages in the sink
+func (p SinkPosition) IsZero() bool {
+	return p.EventID.IsZero() && p.ResumeToken == nil
+}
+
+// SinkPositions returns the last message of each partition, in the range [partitionLow, partitionHi], or of the partition 0 if partitionLow is 0.
+// The partitions without messages have a zero EventID and a nil ResumeToken.
+func SinkPositions(ctx context.Context, sinker sink.Sinker, partitionLow, partitionHi uint32) ([]SinkPosition, error) {
+	if partitionLow == 0 {
+		partitionHi = 0
+	}
+	positions := make([]SinkPosition, 0, partitionHi-partitionLow+1)
+	for i := partitionLow; i <= partitionHi; i++ {
+		message, err := sinker.LastMessage(ctx, i)
+		if err != nil {
+			return nil, faults.Errorf("Unable to get the last event ID in sink from partition %d: %w", i, err)
+		}
+		pos := SinkPosition{Partition: i}
+		if message != nil {
+			pos.EventID = message.ID
+			pos.ResumeToken = message.ResumeToken
+		}
+		positions = append(positions, pos)
+	}
+	return positions, nil
+}
+
 // ForEachResumeTokenInSinkPartitions retrieves the last message for all the partitions
 func ForEachResumeTokenInSinkPartitions(ctx context.Context, sinker sink.Sinker, partitionLow, partitionHi uint32, forEach func(*eventsourcing.Event) error) error {
 	if partitionLow == 0 {
@@ -64,3 +111,215 @@ func ForEachResumeTokenInSinkPartitions(ctx context.Context, sinker sink.Sinker,
 
 	return nil
 }
+
+// LastEventIDInSink returns the highest event ID of the last messages of all the partitions, to resume a feed from.
+// Since a feed sinks the events of its partitions in order, the partitions without messages don't hold it back.
+// The resume token of the messages is expected to be the event ID, falling back to the ID of the message if it has no token.
+// If the sink has no messages in any of the partitions, it returns a zero event ID, and the feed decides where to start from with ColdStart.
+func LastEventIDInSink(ctx context.Context, sinker sink.Sinker, partitionLow, partitionHi uint32) (eventid.EventID, error) {
+	var lastID eventid.EventID
+	err := ForEachResumeTokenInSinkPartitions(ctx, sinker, partitionLow, partitionHi, func(message *eventsourcing.Event) error {
+		eID, err := resumeEventID(message.ID, message.ResumeToken)
+		if err != nil {
+			return err
+		}
+		if eID.Compare(lastID) > 0 {
+			lastID = eID
+		}
+		return nil
+	})
+	if err != nil {
+		return eventid.Zero, err
+	}
+	return lastID, nil
+}
+
+// LastEventIDsInSink returns the event ID of the last message of each partition, so that each partition is resumed from its own position,
+// without rewinding the others. The partitions are numbered as in common.WhichPartition and the ones without messages are left out.
+// The resume token of the messages is expected to be the event ID, falling back to the ID of the message if it has no token.
+func LastEventIDsInSink(ctx context.Context, sinker sink.Sinker, partitionLow, partitionHi uint32) (map[uint32]eventid.EventID, error) {
+	positions, err := SinkPositions(ctx, sinker, partitionLow, partitionHi)
+	if err != nil {
+		return nil, err
+	}
+	ids := map[uint32]eventid.EventID{}
+	for _, pos := range positions {
+		if pos.IsZero() {
+			continue
+		}
+		eID, err := resumeEventID(pos.EventID, pos.ResumeToken)
+		if err != nil {
+			return nil, err
+		}
+		ids[pos.Partition] = eID
+	}
+	return ids, nil
+}
+
+func resumeEventID(id eventid.EventID, resumeToken []byte) (eventid.EventID, error) {
+	if len(resumeToken) == 0 {
+		return id, nil
+	}
+	eID, err := eventid.Parse(string(resumeToken))
+	if err != nil {
+		return eventid.Zero, faults.Errorf("Unable to parse the resume token '%s' as an event ID: %w", string(resumeToken), err)
+	}
+	return eID, nil
+}
+
+// FeederFactory creates a feeder for the partitions in the range [partitionLow, partitionHi]
+type FeederFactory func(partitionLow, partitionHi uint32) (Feeder, error)
+
+// ConcurrentFeed splits its partition range into sub ranges, feeding each one in its own go routine.
+// Since an aggregate always falls in the same partition, the ordering per aggregate is preserved.
+// Each feeder resumes from the last message of its own partitions, so the sinker must be safe for concurrent use.
+type ConcurrentFeed struct {
+	logger       log.Logger
+	partitionLow uint32
+	partitionHi  uint32
+	concurrency  int
+	factory      FeederFactory
+}
+
+var _ Feeder = ConcurrentFeed{}
+
+func NewConcurrentFeed(logger log.Logger, partitionLow, partitionHi uint32, concurrency int, factory FeederFactory) ConcurrentFeed {
+	return ConcurrentFeed{
+		logger:       logger,
+		partitionLow: partitionLow,
+		partitionHi:  partitionHi,
+		concurrency:  concurrency,
+		factory:      factory,
+	}
+}
+
+// Feed runs all the sub feeds until one fails or the context is cancelled.
+// The first failure stops the remaining feeds.
+func (c ConcurrentFeed) Feed(ctx context.Context, sinker sink.Sinker) error {
+	ranges := SplitPartitions(c.partitionLow, c.partitionHi, c.concurrency)
+	feeders := make([]Feeder, len(ranges))
+	for k, r := range ranges {
+		feeder, err := c.factory(r[0], r[1])
+		if err != nil {
+			return faults.Errorf("Unable to create feeder for partitions [%d, %d]: %w", r[0], r[1], err)
+		}
+		feeders[k] = feeder
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	for k, feeder := range feeders {
+		wg.Add(1)
+		go func(r [2]uint32, feeder Feeder) {
+			defer wg.Done()
+			c.logger.WithTags(log.PartitionTags(r[0], r[1])).Info("Starting feed")
+			err := feeder.Feed(ctx, sinker)
+			if err != nil {
+				once.Do(func() {
+					firstErr = faults.Errorf("Error feeding partitions [%d, %d]: %w", r[0], r[1], err)
+					cancel()
+				})
+			}
+		}(ranges[k], feeder)
+	}
+	wg.Wait()
+
+	return firstErr
+}
+
+// SplitPartitions splits the partition range [low, hi] in, at most, n contiguous sub ranges of similar size.
+// A low partition of zero means no partitioning, resulting in a single range.
+func SplitPartitions(low, hi uint32, n int) [][2]uint32 {
+	if low == 0 || hi < low || n <= 1 {
+		return [][2]uint32{{low, hi}}
+	}
+
+	size := hi - low + 1
+	if uint32(n) > size {
+		n = int(size)
+	}
+	step := size / uint32(n)
+	remainder := size % uint32(n)
+
+	ranges := make([][2]uint32, 0, n)
+	start := low
+	for i := 0; i < n; i++ {
+		end := start + step - 1
+		if uint32(i) < remainder {
+			end++
+		}
+		ranges = append(ranges, [2]uint32{start, end})
+		start = end + 1
+	}
+	return ranges
+}
+
+// ValidatePartitionRange checks that 1 <= low <= hi <= partitions.
+// Without partitioning (partitions <= 1) the range is ignored, like in WithPartitions.
+func ValidatePartitionRange(partitions, low, hi uint32) error {
+	if partitions <= 1 {
+		return nil
+	}
+	if low < 1 || low > hi || hi > partitions {
+		return faults.Errorf("%w: range [%d, %d] is not within [1, %d]", ErrInvalidPartitions, low, hi, partitions)
+	}
+	return nil
+}
+
+// ValidatePartitionCoverage checks that the ranges, eg: of all the running feeds, cover every partition in [1, partitions] exactly once,
+// since a partition without a feed has its events silently dropped, and a partition with two feeds has its events sinked twice.
+func ValidatePartitionCoverage(partitions uint32, ranges [][2]uint32) error {
+	if partitions <= 1 {
+		return nil
+	}
+	sorted := make([][2]uint32, len(ranges))
+	copy(sorted, ranges)
+	for _, r := range sorted {
+		if err := ValidatePartitionRange(partitions, r[0], r[1]); err != nil {
+			return err
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i][0] < sorted[j][0]
+	})
+
+	next := uint32(1)
+	for _, r := range sorted {
+		if r[0] > next {
+			return faults.Errorf("%w: partitions [%d, %d] are not covered", ErrInvalidPartitions, next, r[0]-1)
+		}
+		if r[0] < next {
+			return faults.Errorf("%w: range [%d, %d] overlaps partition %d", ErrInvalidPartitions, r[0], r[1], r[0])
+		}
+		next = r[1] + 1
+	}
+	if next <= partitions {
+		return faults.Errorf("%w: partitions [%d, %d] are not covered", ErrInvalidPartitions, next, partitions)
+	}
+	return nil
+}
+
+// PartitionFilters splits the partitions [1, partitions] among the workers, returning the filter of each worker, by worker index.
+// Deriving every filter from the same partition count guarantees that each partition is handled by exactly one worker.
+// If there are more workers than partitions, only the first workers get a filter.
+// Without partitioning (partitions <= 1) a single empty filter is returned.
+func PartitionFilters(partitions uint32, workers int) []Filter {
+	if partitions <= 1 {
+		return []Filter{{}}
+	}
+
+	ranges := SplitPartitions(1, partitions, workers)
+	filters := make([]Filter, len(ranges))
+	for k, r := range ranges {
+		filters[k] = Filter{
+			Partitions:   partitions,
+			PartitionLow: r[0],
+			PartitionHi:  r[1],
+		}
+	}
+	return filters
+}
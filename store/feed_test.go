@@ -0,0 +1,169 @@
+package store_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/quintans/eventsourcing"
+	"github.com/quintans/eventsourcing/eventid"
+	"github.com/quintans/eventsourcing/log"
+	"github.com/quintans/eventsourcing/sink"
+	"github.com/quintans/eventsourcing/store"
+	"github.com/quintans/eventsourcing/test"
+)
+
+func TestSplitPartitions(t *testing.T) {
+	require.Equal(t, [][2]uint32{{0, 0}}, store.SplitPartitions(0, 0, 4))
+	require.Equal(t, [][2]uint32{{1, 10}}, store.SplitPartitions(1, 10, 1))
+	require.Equal(t, [][2]uint32{{1, 4}, {5, 7}, {8, 10}}, store.SplitPartitions(1, 10, 3))
+	require.Equal(t, [][2]uint32{{3, 3}, {4, 4}}, store.SplitPartitions(3, 4, 5))
+}
+
+func TestPartitionFilters(t *testing.T) {
+	require.Equal(t, []store.Filter{{}}, store.PartitionFilters(0, 3))
+	require.Equal(t, []store.Filter{{}}, store.PartitionFilters(1, 3))
+	require.Equal(t, []store.Filter{
+		{Partitions: 5, PartitionLow: 1, PartitionHi: 2},
+		{Partitions: 5, PartitionLow: 3, PartitionHi: 4},
+		{Partitions: 5, PartitionLow: 5, PartitionHi: 5},
+	}, store.PartitionFilters(5, 3))
+	require.Equal(t, []store.Filter{
+		{Partitions: 2, PartitionLow: 1, PartitionHi: 1},
+		{Partitions: 2, PartitionLow: 2, PartitionHi: 2},
+	}, store.PartitionFilters(2, 4))
+}
+
+func TestValidatePartitionRange(t *testing.T) {
+	require.NoError(t, store.ValidatePartitionRange(0, 0, 0))
+	require.NoError(t, store.ValidatePartitionRange(1, 0, 0))
+	require.NoError(t, store.ValidatePartitionRange(12, 1, 6))
+	require.NoError(t, store.ValidatePartitionRange(12, 12, 12))
+	for _, r := range [][2]uint32{{0, 6}, {7, 6}, {7, 13}} {
+		err := store.ValidatePartitionRange(12, r[0], r[1])
+		require.True(t, errors.Is(err, store.ErrInvalidPartitions), r)
+	}
+}
+
+func TestValidatePartitionCoverage(t *testing.T) {
+	require.NoError(t, store.ValidatePartitionCoverage(1, nil))
+	require.NoError(t, store.ValidatePartitionCoverage(12, [][2]uint32{{7, 12}, {1, 6}}))
+	for _, ranges := range [][][2]uint32{
+		// gap
+		{{1, 5}, {7, 12}},
+		// overlap
+		{{1, 6}, {6, 12}},
+		// missing tail
+		{{1, 6}, {7, 11}},
+		// out of range
+		{{1, 6}, {7, 13}},
+		{},
+	} {
+		err := store.ValidatePartitionCoverage(12, ranges)
+		require.True(t, errors.Is(err, store.ErrInvalidPartitions), ranges)
+	}
+}
+
+type feederFunc func(ctx context.Context, sinker sink.Sinker) error
+
+func (f feederFunc) Feed(ctx context.Context, sinker sink.Sinker) error {
+	return f(ctx, sinker)
+}
+
+func TestConcurrentFeed(t *testing.T) {
+	var mu sync.Mutex
+	ranges := [][2]uint32{}
+	feed := store.NewConcurrentFeed(log.NopLogger{}, 1, 4, 2, func(low, hi uint32) (store.Feeder, error) {
+		mu.Lock()
+		ranges = append(ranges, [2]uint32{low, hi})
+		mu.Unlock()
+		return feederFunc(func(ctx context.Context, sinker sink.Sinker) error {
+			if low == 1 {
+				return errors.New("boom")
+			}
+			// the other feeder runs until cancelled
+			<-ctx.Done()
+			return nil
+		}), nil
+	})
+
+	err := feed.Feed(context.Background(), nil)
+	require.Error(t, err)
+	require.ElementsMatch(t, [][2]uint32{{1, 2}, {3, 4}}, ranges)
+}
+
+func TestSinkPositions(t *testing.T) {
+	ctx := context.Background()
+	id1 := eventid.TimeOnly(time.Now())
+
+	sinker := test.NewMockSink(3)
+	sinker.SetLastMessages(map[uint32]eventsourcing.Event{
+		2: {ID: id1, ResumeToken: []byte("token")},
+	})
+	positions, err := store.SinkPositions(ctx, sinker, 1, 3)
+	require.NoError(t, err)
+	require.Equal(t, []store.SinkPosition{
+		{Partition: 1},
+		{Partition: 2, EventID: id1, ResumeToken: []byte("token")},
+		{Partition: 3},
+	}, positions)
+	require.True(t, positions[0].IsZero())
+	require.False(t, positions[1].IsZero())
+}
+
+func TestLastEventIDsInSink(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	id1 := eventid.TimeOnly(now.Add(-time.Minute))
+	id2 := eventid.TimeOnly(now)
+
+	sinker := test.NewMockSink(3)
+	ids, err := store.LastEventIDsInSink(ctx, sinker, 1, 3)
+	require.NoError(t, err)
+	require.Empty(t, ids)
+
+	sinker.SetLastMessages(map[uint32]eventsourcing.Event{
+		1: {ID: id1, ResumeToken: []byte(id1.String())},
+		// messages without a resume token fall back to their ID
+		3: {ID: id2},
+	})
+	ids, err = store.LastEventIDsInSink(ctx, sinker, 1, 3)
+	require.NoError(t, err)
+	require.Equal(t, map[uint32]eventid.EventID{1: id1, 3: id2}, ids)
+}
+
+func TestLastEventIDInSink(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	id1 := eventid.TimeOnly(now.Add(-time.Minute))
+	id2 := eventid.TimeOnly(now)
+	id3 := eventid.TimeOnly(now.Add(time.Minute))
+
+	sinker := test.NewMockSink(3)
+	lastID, err := store.LastEventIDInSink(ctx, sinker, 1, 3)
+	require.NoError(t, err)
+	require.True(t, lastID.IsZero())
+
+	sinker.SetLastMessages(map[uint32]eventsourcing.Event{
+		1: {ID: id1, ResumeToken: []byte(id1.String())},
+		2: {ID: id2, ResumeToken: []byte(id2.String())},
+		// messages without a resume token fall back to their ID
+		3: {ID: id3},
+	})
+	lastID, err = store.LastEventIDInSink(ctx, sinker, 1, 2)
+	require.NoError(t, err)
+	require.Equal(t, id2, lastID)
+	lastID, err = store.LastEventIDInSink(ctx, sinker, 1, 3)
+	require.NoError(t, err)
+	require.Equal(t, id3, lastID)
+
+	sinker.SetLastMessages(map[uint32]eventsourcing.Event{
+		1: {ID: id1, ResumeToken: []byte("not an event ID")},
+	})
+	_, err = store.LastEventIDInSink(ctx, sinker, 1, 1)
+	require.Error(t, err)
+}
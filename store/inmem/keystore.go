@@ -0,0 +1,48 @@
+package inmem
+
+import (
+	"context"
+	"sync"
+
+	"github.com/quintans/eventsourcing"
+)
+
+var _ eventsourcing.KeyStore = (*KeyStore)(nil)
+
+// KeyStore is an in memory key store, intended to be used in tests.
+type KeyStore struct {
+	mu   sync.RWMutex
+	keys map[string][]byte
+}
+
+func NewKeyStore() *KeyStore {
+	return &KeyStore{
+		keys: map[string][]byte{},
+	}
+}
+
+func (k *KeyStore) GetKey(ctx context.Context, aggregateID string) ([]byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.keys[aggregateID], nil
+}
+
+func (k *KeyStore) CreateKey(ctx context.Context, aggregateID string, key []byte) ([]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if existing, ok := k.keys[aggregateID]; ok {
+		return existing, nil
+	}
+	k.keys[aggregateID] = key
+	return key, nil
+}
+
+func (k *KeyStore) DeleteKey(ctx context.Context, aggregateID string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	delete(k.keys, aggregateID)
+	return nil
+}
@@ -0,0 +1,647 @@
+package inmem
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/quintans/faults"
+
+	"github.com/quintans/eventsourcing"
+	"github.com/quintans/eventsourcing/eventid"
+	"github.com/quintans/eventsourcing/player"
+	"github.com/quintans/eventsourcing/store"
+)
+
+var (
+	_ eventsourcing.EsRepository = (*EsRepository)(nil)
+	_ eventsourcing.BatchSaver   = (*EsRepository)(nil)
+	_ player.Repository          = (*EsRepository)(nil)
+)
+
+type StoreOption func(*EsRepository)
+
+// WithEventIDGenerator sets how the IDs of the events are generated, replacing eventid.Generate.
+// The IDs must have the creation time of the events, since the feeds rely on the IDs being ordered by creation time.
+func WithEventIDGenerator(generator eventid.Generator) StoreOption {
+	return func(r *EsRepository) {
+		r.idGenerator = generator
+	}
+}
+
+// WithHashFunc sets the function that computes the aggregate ID hash, used to partition the events, replacing eventsourcing.HashAggregateID.
+// eg: eventsourcing.HashLabel("tenant") partitions the events by tenant.
+func WithHashFunc(fn eventsourcing.HashFunc) StoreOption {
+	return func(r *EsRepository) {
+		r.hashFunc = fn
+	}
+}
+
+// WithMultiTenant requires a tenant to save the events and the snapshots, and constrains the reads of the events
+// and of the snapshots to the tenant of the context.
+// See eventsourcing.WithTenant and eventsourcing.WithAllTenants.
+func WithMultiTenant() StoreOption {
+	return func(r *EsRepository) {
+		r.multiTenant = true
+	}
+}
+
+// EsRepository is an in memory event store repository, intended to be used in tests.
+type EsRepository struct {
+	mu              sync.RWMutex
+	events          []eventsourcing.Event
+	versions        map[string]uint32
+	idempotencyKeys map[string]struct{}
+	snapshots       map[string][]eventsourcing.Snapshot
+	idGenerator     eventid.Generator
+	hashFunc        eventsourcing.HashFunc
+	multiTenant     bool
+}
+
+func NewStore(options ...StoreOption) *EsRepository {
+	r := &EsRepository{
+		versions:        map[string]uint32{},
+		idempotencyKeys: map[string]struct{}{},
+		snapshots:       map[string][]eventsourcing.Snapshot{},
+		idGenerator:     eventid.Generate,
+		hashFunc:        eventsourcing.HashAggregateID,
+	}
+	for _, o := range options {
+		o(r)
+	}
+	return r
+}
+
+// tx collects the changes of a save, so that they are only applied if all the records are valid
+type tx struct {
+	events          []eventsourcing.Event
+	versions        map[string]uint32
+	idempotencyKeys map[string]struct{}
+}
+
+var _ eventsourcing.AggregateHasher = (*EsRepository)(nil)
+
+// AggregateIDHash returns the hash that partitions the events of the aggregate
+func (r *EsRepository) AggregateIDHash(aggregateID string, labels map[string]interface{}) uint32 {
+	return r.hashFunc(aggregateID, labels)
+}
+
+func (r *EsRepository) SaveEvent(ctx context.Context, eRec eventsourcing.EventRecord) (eventid.EventID, uint32, error) {
+	ids, version, err := r.SaveEventIDs(ctx, eRec)
+	if err != nil {
+		return eventid.Zero, 0, err
+	}
+	return ids[len(ids)-1], version, nil
+}
+
+var _ eventsourcing.EventIDsSaver = (*EsRepository)(nil)
+
+// SaveEventIDs saves the events of the record, returning the IDs of all of them
+func (r *EsRepository) SaveEventIDs(ctx context.Context, eRec eventsourcing.EventRecord) ([]eventid.EventID, uint32, error) {
+	var ids []eventid.EventID
+	var version uint32
+	err := r.save(func(t *tx) error {
+		var err error
+		ids, version, err = r.saveEvent(t, eRec)
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return ids, version, nil
+}
+
+// SaveEvents saves the events of several aggregates atomically.
+func (r *EsRepository) SaveEvents(ctx context.Context, eRecs []eventsourcing.EventRecord) ([]eventsourcing.EventRecordResult, error) {
+	results := make([]eventsourcing.EventRecordResult, len(eRecs))
+	err := r.save(func(t *tx) error {
+		for k, eRec := range eRecs {
+			ids, version, err := r.saveEvent(t, eRec)
+			if err != nil {
+				return err
+			}
+			results[k] = eventsourcing.EventRecordResult{
+				ID:      ids[len(ids)-1],
+				Version: version,
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// save applies the changes collected by fn, unless it fails
+func (r *EsRepository) save(fn func(t *tx) error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t := &tx{
+		versions:        map[string]uint32{},
+		idempotencyKeys: map[string]struct{}{},
+	}
+	if err := fn(t); err != nil {
+		return err
+	}
+
+	// commit
+	for k, v := range t.versions {
+		r.versions[k] = v
+	}
+	for k := range t.idempotencyKeys {
+		r.idempotencyKeys[k] = struct{}{}
+	}
+	r.events = append(r.events, t.events...)
+	sort.SliceStable(r.events, func(i, j int) bool {
+		return r.events[i].ID.Compare(r.events[j].ID) < 0
+	})
+
+	return nil
+}
+
+func (r *EsRepository) saveEvent(t *tx, eRec eventsourcing.EventRecord) ([]eventid.EventID, uint32, error) {
+	if r.multiTenant && eRec.TenantID == "" {
+		return nil, 0, faults.Errorf("%w: saving events of aggregate '%s'", eventsourcing.ErrMissingTenant, eRec.AggregateID)
+	}
+	current, ok := t.versions[eRec.AggregateID]
+	if !ok {
+		current = r.versions[eRec.AggregateID]
+	}
+	if eRec.Version != current {
+		return nil, 0, eventsourcing.ErrConcurrentModification
+	}
+
+	if eRec.IdempotencyKey != eventsourcing.EmptyIdempotencyKey {
+		var dup bool
+		if eRec.IdempotencyScope == eventsourcing.IdempotencyScopeAggregate {
+			dup = hasAggregateIdempotencyKey(r.events, "", eRec.AggregateID, eRec.IdempotencyKey) ||
+				hasAggregateIdempotencyKey(t.events, "", eRec.AggregateID, eRec.IdempotencyKey)
+		} else {
+			_, dupRepo := r.idempotencyKeys[eRec.IdempotencyKey]
+			_, dupTx := t.idempotencyKeys[eRec.IdempotencyKey]
+			dup = dupRepo || dupTx
+		}
+		if dup {
+			return nil, 0, eventsourcing.ErrDuplicateIdempotencyKey
+		}
+		t.idempotencyKeys[eRec.IdempotencyKey] = struct{}{}
+	}
+
+	version := eRec.Version
+	ids := make([]eventid.EventID, 0, len(eRec.Details))
+	hash := r.hashFunc(eRec.AggregateID, eRec.Labels)
+	entropy := eventid.NewEntropy()
+	for _, e := range eRec.Details {
+		id, err := r.idGenerator.New(entropy, eRec.CreatedAt, eRec.AggregateID, version+1)
+		if err != nil {
+			return nil, 0, faults.Wrap(err)
+		}
+		version++
+		ids = append(ids, id)
+		t.events = append(t.events, eventsourcing.Event{
+			ID:               id,
+			AggregateID:      eRec.AggregateID,
+			AggregateIDHash:  hash,
+			AggregateVersion: version,
+			AggregateType:    eRec.AggregateType,
+			Kind:             e.Kind,
+			Body:             copyBytes(e.Body),
+			ContentType:      eRec.ContentType,
+			IdempotencyKey:   eRec.IdempotencyKey,
+			Metadata:         eRec.Labels,
+			CreatedAt:        eRec.CreatedAt,
+			TenantID:         eRec.TenantID,
+			EventVersion:     e.EventVersion,
+		})
+	}
+	t.versions[eRec.AggregateID] = version
+
+	return ids, version, nil
+}
+
+func copyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	c := make([]byte, len(b))
+	copy(c, b)
+	return c
+}
+
+func (r *EsRepository) GetSnapshot(ctx context.Context, aggregateID string) (eventsourcing.Snapshot, error) {
+	tenantID, err := r.tenant(ctx)
+	if err != nil {
+		return eventsourcing.Snapshot{}, err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	snaps := r.snapshotsLocked(tenantID, aggregateID)
+	if len(snaps) == 0 {
+		return eventsourcing.Snapshot{}, nil
+	}
+	return snaps[len(snaps)-1], nil
+}
+
+var _ eventsourcing.BoundedSnapshotGetter = (*EsRepository)(nil)
+
+// GetSnapshotUpTo gets the newest snapshot not exceeding the version
+func (r *EsRepository) GetSnapshotUpTo(ctx context.Context, aggregateID string, maxVersion uint32) (eventsourcing.Snapshot, error) {
+	tenantID, err := r.tenant(ctx)
+	if err != nil {
+		return eventsourcing.Snapshot{}, err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	snaps := r.snapshotsLocked(tenantID, aggregateID)
+	for i := len(snaps) - 1; i >= 0; i-- {
+		if snaps[i].AggregateVersion <= maxVersion {
+			return snaps[i], nil
+		}
+	}
+	return eventsourcing.Snapshot{}, nil
+}
+
+var _ eventsourcing.TimeBoundedSnapshotGetter = (*EsRepository)(nil)
+
+// GetSnapshotUntil gets the newest snapshot created until the time
+func (r *EsRepository) GetSnapshotUntil(ctx context.Context, aggregateID string, at time.Time) (eventsourcing.Snapshot, error) {
+	tenantID, err := r.tenant(ctx)
+	if err != nil {
+		return eventsourcing.Snapshot{}, err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	snaps := r.snapshotsLocked(tenantID, aggregateID)
+	for i := len(snaps) - 1; i >= 0; i-- {
+		if !snaps[i].CreatedAt.After(at) {
+			return snaps[i], nil
+		}
+	}
+	return eventsourcing.Snapshot{}, nil
+}
+
+// snapshotsLocked returns the snapshots of the aggregate of the tenant, sorted from the oldest.
+// An empty tenant accepts the snapshots of all the tenants.
+func (r *EsRepository) snapshotsLocked(tenantID, aggregateID string) []eventsourcing.Snapshot {
+	snaps := r.snapshots[aggregateID]
+	if tenantID == "" {
+		return snaps
+	}
+	var tenantSnaps []eventsourcing.Snapshot
+	for _, s := range snaps {
+		if s.TenantID == tenantID {
+			tenantSnaps = append(tenantSnaps, s)
+		}
+	}
+	return tenantSnaps
+}
+
+func (r *EsRepository) SaveSnapshot(ctx context.Context, snapshot eventsourcing.Snapshot) error {
+	if r.multiTenant && snapshot.TenantID == "" {
+		return faults.Errorf("%w: saving snapshot of aggregate '%s'", eventsourcing.ErrMissingTenant, snapshot.AggregateID)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	snapshot.Body = copyBytes(snapshot.Body)
+	snaps := append(r.snapshots[snapshot.AggregateID], snapshot)
+	sort.SliceStable(snaps, func(i, j int) bool {
+		return snaps[i].ID.Compare(snaps[j].ID) < 0
+	})
+	r.snapshots[snapshot.AggregateID] = snaps
+	return nil
+}
+
+var _ eventsourcing.SnapshotPruner = (*EsRepository)(nil)
+
+func (r *EsRepository) DeleteSnapshots(ctx context.Context, aggregateID string, keepLast int) error {
+	tenantID, err := r.tenant(ctx)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.deleteSnapshots(tenantID, aggregateID, keepLast)
+	return nil
+}
+
+func (r *EsRepository) PruneSnapshots(ctx context.Context, keepLast int) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var deleted int64
+	for aggregateID := range r.snapshots {
+		deleted += int64(r.deleteSnapshots("", aggregateID, keepLast))
+	}
+	return deleted, nil
+}
+
+// deleteSnapshots deletes all but the latest keepLast snapshots of the aggregate of the tenant, returning how many were deleted.
+// An empty tenant deletes the snapshots of all the tenants.
+func (r *EsRepository) deleteSnapshots(tenantID, aggregateID string, keepLast int) int {
+	// the snapshots are sorted from the oldest
+	snaps := r.snapshotsLocked(tenantID, aggregateID)
+	if keepLast < 0 {
+		keepLast = 0
+	}
+	if len(snaps) <= keepLast {
+		return 0
+	}
+	deleted := len(snaps) - keepLast
+	drop := make(map[eventid.EventID]struct{}, deleted)
+	for _, s := range snaps[:deleted] {
+		drop[s.ID] = struct{}{}
+	}
+	kept := []eventsourcing.Snapshot{}
+	for _, s := range r.snapshots[aggregateID] {
+		if _, ok := drop[s.ID]; !ok {
+			kept = append(kept, s)
+		}
+	}
+	r.snapshots[aggregateID] = kept
+	return deleted
+}
+
+func (r *EsRepository) GetAggregateEvents(ctx context.Context, aggregateID string, snapVersion int) ([]eventsourcing.Event, error) {
+	return r.aggregateEvents(ctx, aggregateID, snapVersion, func(eventsourcing.Event) bool {
+		return true
+	})
+}
+
+var _ eventsourcing.BoundedEventsGetter = (*EsRepository)(nil)
+
+// GetAggregateEventsUpTo gets the events of the aggregate after the snapshot version, up to and including the max version
+func (r *EsRepository) GetAggregateEventsUpTo(ctx context.Context, aggregateID string, snapVersion int, maxVersion uint32) ([]eventsourcing.Event, error) {
+	return r.aggregateEvents(ctx, aggregateID, snapVersion, func(e eventsourcing.Event) bool {
+		return e.AggregateVersion <= maxVersion
+	})
+}
+
+var _ eventsourcing.AggregateLoader = (*EsRepository)(nil)
+
+// LoadAggregate gets the latest snapshot and the events after it
+func (r *EsRepository) LoadAggregate(ctx context.Context, aggregateID string) (eventsourcing.Snapshot, []eventsourcing.Event, error) {
+	tenantID, err := r.tenant(ctx)
+	if err != nil {
+		return eventsourcing.Snapshot{}, nil, err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var snap eventsourcing.Snapshot
+	snapVersion := -1
+	if snaps := r.snapshotsLocked(tenantID, aggregateID); len(snaps) > 0 {
+		snap = snaps[len(snaps)-1]
+		snapVersion = int(snap.AggregateVersion)
+	}
+	return snap, r.aggregateEventsLocked(tenantID, aggregateID, snapVersion, nil), nil
+}
+
+var _ eventsourcing.TimeBoundedEventsGetter = (*EsRepository)(nil)
+
+// GetAggregateEventsUntil gets the events of the aggregate after the snapshot version, created until, and including, the time
+func (r *EsRepository) GetAggregateEventsUntil(ctx context.Context, aggregateID string, snapVersion int, at time.Time) ([]eventsourcing.Event, error) {
+	return r.aggregateEvents(ctx, aggregateID, snapVersion, func(e eventsourcing.Event) bool {
+		return !e.CreatedAt.After(at)
+	})
+}
+
+func (r *EsRepository) aggregateEvents(ctx context.Context, aggregateID string, snapVersion int, accept func(eventsourcing.Event) bool) ([]eventsourcing.Event, error) {
+	tenantID, err := r.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.aggregateEventsLocked(tenantID, aggregateID, snapVersion, accept), nil
+}
+
+// aggregateEventsLocked is like aggregateEvents, for callers already holding the lock. A nil accept accepts all the events.
+// An empty tenant accepts the events of all the tenants.
+func (r *EsRepository) aggregateEventsLocked(tenantID, aggregateID string, snapVersion int, accept func(eventsourcing.Event) bool) []eventsourcing.Event {
+	events := []eventsourcing.Event{}
+	for _, e := range r.events {
+		if e.AggregateID == aggregateID && int(e.AggregateVersion) > snapVersion && ofTenant(e, tenantID) && (accept == nil || accept(e)) {
+			events = append(events, e)
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].AggregateVersion < events[j].AggregateVersion
+	})
+	return events
+}
+
+// tenant returns the tenant constraining the reads, or empty if they are not constrained
+func (r *EsRepository) tenant(ctx context.Context) (string, error) {
+	if !r.multiTenant {
+		return "", nil
+	}
+	return eventsourcing.TenantScope(ctx)
+}
+
+func ofTenant(e eventsourcing.Event, tenantID string) bool {
+	return tenantID == "" || e.TenantID == tenantID
+}
+
+func (r *EsRepository) HasIdempotencyKey(ctx context.Context, idempotencyKey string) (bool, error) {
+	tenantID, err := r.tenant(ctx)
+	if err != nil {
+		return false, err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if tenantID == "" {
+		_, ok := r.idempotencyKeys[idempotencyKey]
+		return ok, nil
+	}
+	for _, e := range r.events {
+		if e.IdempotencyKey == idempotencyKey && ofTenant(e, tenantID) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+var _ eventsourcing.AggregateIdempotencyKeyChecker = (*EsRepository)(nil)
+
+// HasAggregateIdempotencyKey checks if the idempotency key was used by the aggregate
+func (r *EsRepository) HasAggregateIdempotencyKey(ctx context.Context, aggregateID, idempotencyKey string) (bool, error) {
+	tenantID, err := r.tenant(ctx)
+	if err != nil {
+		return false, err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return hasAggregateIdempotencyKey(r.events, tenantID, aggregateID, idempotencyKey), nil
+}
+
+var _ eventsourcing.StatsGetter = (*EsRepository)(nil)
+
+func (r *EsRepository) Stats(ctx context.Context) (eventsourcing.StoreStats, error) {
+	tenantID, err := r.tenant(ctx)
+	if err != nil {
+		return eventsourcing.StoreStats{}, err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	byType := map[eventsourcing.AggregateType]eventsourcing.EventsStats{}
+	for _, e := range r.events {
+		if !ofTenant(e, tenantID) {
+			continue
+		}
+		s, ok := byType[e.AggregateType]
+		if !ok {
+			s.FirstEventID = e.ID
+			s.Oldest = e.CreatedAt
+			s.Newest = e.CreatedAt
+		}
+		s.Events++
+		// the IDs of different saves in the same millisecond are not ordered
+		if e.ID.Compare(s.FirstEventID) < 0 {
+			s.FirstEventID = e.ID
+		}
+		if e.ID.Compare(s.LastEventID) > 0 {
+			s.LastEventID = e.ID
+		}
+		if e.CreatedAt.Before(s.Oldest) {
+			s.Oldest = e.CreatedAt
+		}
+		if e.CreatedAt.After(s.Newest) {
+			s.Newest = e.CreatedAt
+		}
+		byType[e.AggregateType] = s
+	}
+	return eventsourcing.NewStoreStats(byType), nil
+}
+
+func hasAggregateIdempotencyKey(events []eventsourcing.Event, tenantID, aggregateID, idempotencyKey string) bool {
+	for _, e := range events {
+		if e.AggregateID == aggregateID && e.IdempotencyKey == idempotencyKey && ofTenant(e, tenantID) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *EsRepository) Forget(ctx context.Context, request eventsourcing.ForgetRequest, forget func(kind string, body []byte) ([]byte, error)) error {
+	tenantID, err := r.tenant(ctx)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	forgottenAt := time.Now().UTC()
+	for k, e := range r.events {
+		if e.AggregateID != request.AggregateID || e.Kind != request.EventKind || !ofTenant(e, tenantID) {
+			continue
+		}
+		body, err := forget(e.Kind.String(), e.Body)
+		if err != nil {
+			return err
+		}
+		r.events[k].Body = body
+		r.events[k].ForgottenAt = forgottenAt
+	}
+
+	snaps := r.snapshots[request.AggregateID]
+	for k, s := range snaps {
+		if tenantID != "" && s.TenantID != tenantID {
+			continue
+		}
+		body, err := forget(s.AggregateType.String(), s.Body)
+		if err != nil {
+			return err
+		}
+		snaps[k].Body = body
+	}
+
+	return nil
+}
+
+var _ eventsourcing.ForgetPreviewer = (*EsRepository)(nil)
+
+func (r *EsRepository) PreviewForget(ctx context.Context, request eventsourcing.ForgetRequest) (eventsourcing.ForgetPreview, error) {
+	tenantID, err := r.tenant(ctx)
+	if err != nil {
+		return eventsourcing.ForgetPreview{}, err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	preview := eventsourcing.ForgetPreview{
+		EventIDs:    []eventid.EventID{},
+		SnapshotIDs: []eventid.EventID{},
+	}
+	for _, e := range r.events {
+		if e.AggregateID == request.AggregateID && e.Kind == request.EventKind && ofTenant(e, tenantID) {
+			preview.EventIDs = append(preview.EventIDs, e.ID)
+		}
+	}
+	for _, s := range r.snapshotsLocked(tenantID, request.AggregateID) {
+		preview.SnapshotIDs = append(preview.SnapshotIDs, s.ID)
+	}
+	return preview, nil
+}
+
+func (r *EsRepository) GetLastEventID(ctx context.Context, trailingLag time.Duration, filter store.Filter) (eventid.EventID, error) {
+	if filter.RawCondition != "" {
+		return eventid.Zero, faults.Wrap(store.ErrRawConditionNotSupported)
+	}
+	tenantID, err := r.tenant(ctx)
+	if err != nil {
+		return eventid.Zero, err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	safetyMargin := safetyMargin(trailingLag)
+	for i := len(r.events) - 1; i >= 0; i-- {
+		e := r.events[i]
+		if e.CreatedAt.After(safetyMargin) || !ofTenant(e, tenantID) || !filter.Matches(e) {
+			continue
+		}
+		return e.ID, nil
+	}
+	return eventid.Zero, nil
+}
+
+func (r *EsRepository) GetEvents(ctx context.Context, afterEventID eventid.EventID, batchSize int, trailingLag time.Duration, filter store.Filter) ([]eventsourcing.Event, error) {
+	if filter.RawCondition != "" {
+		return nil, faults.Wrap(store.ErrRawConditionNotSupported)
+	}
+	tenantID, err := r.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	safetyMargin := safetyMargin(trailingLag)
+	events := []eventsourcing.Event{}
+	for _, e := range r.events {
+		if e.ID.Compare(afterEventID) <= 0 || e.CreatedAt.After(safetyMargin) || !ofTenant(e, tenantID) || !filter.Matches(e) {
+			continue
+		}
+		events = append(events, e)
+		if batchSize > 0 && len(events) == batchSize {
+			break
+		}
+	}
+	return events, nil
+}
+
+func safetyMargin(trailingLag time.Duration) time.Time {
+	return time.Now().UTC().Add(-trailingLag)
+}
@@ -0,0 +1,591 @@
+package inmem_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/quintans/eventsourcing"
+	"github.com/quintans/eventsourcing/eventid"
+	"github.com/quintans/eventsourcing/player"
+	"github.com/quintans/eventsourcing/store"
+	"github.com/quintans/eventsourcing/store/inmem"
+	"github.com/quintans/eventsourcing/test"
+)
+
+func TestSaveAndGet(t *testing.T) {
+	ctx := context.Background()
+	r := inmem.NewStore()
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{}, eventsourcing.WithSnapshotThreshold(3))
+
+	id := uuid.New()
+	acc := test.CreateAccount("Paulo", id, 100)
+	acc.Deposit(10)
+	acc.Deposit(20)
+	err := es.Save(ctx, acc)
+	require.NoError(t, err)
+	acc.Deposit(5)
+	err = es.Save(ctx, acc, eventsourcing.WithIdempotencyKey("idempotency-key"))
+	require.NoError(t, err)
+
+	snap, err := r.GetSnapshot(ctx, id.String())
+	require.NoError(t, err)
+	assert.Equal(t, uint32(3), snap.AggregateVersion)
+
+	a, err := es.GetByID(ctx, id.String())
+	require.NoError(t, err)
+	acc2 := a.(*test.Account)
+	assert.Equal(t, id, acc2.ID)
+	assert.Equal(t, uint32(4), acc2.GetVersion())
+	assert.Equal(t, int64(135), acc2.Balance)
+	assert.Equal(t, test.OPEN, acc2.Status)
+
+	found, err := es.HasIdempotencyKey(ctx, "idempotency-key")
+	require.NoError(t, err)
+	require.True(t, found)
+
+	acc.Deposit(5)
+	err = es.Save(ctx, acc, eventsourcing.WithIdempotencyKey("idempotency-key"))
+	require.True(t, errors.Is(err, eventsourcing.ErrDuplicateIdempotencyKey))
+
+	// stale version
+	acc2.Deposit(5)
+	acc2.SetVersion(2)
+	err = es.Save(ctx, acc2)
+	require.True(t, errors.Is(err, eventsourcing.ErrConcurrentModification))
+}
+
+func TestEventIDGenerator(t *testing.T) {
+	ctx := context.Background()
+	generated := 0
+	r := inmem.NewStore(inmem.WithEventIDGenerator(func(_ io.Reader, createdAt time.Time, aggregateID string, version uint32) (eventid.EventID, error) {
+		generated++
+		return eventid.TimeOnly(createdAt).SetCount(uint8(version)), nil
+	}))
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{})
+
+	id := uuid.New()
+	acc := test.CreateAccount("Paulo", id, 100)
+	acc.Deposit(10)
+	err := es.Save(ctx, acc)
+	require.NoError(t, err)
+	assert.Equal(t, 2, generated)
+
+	events, err := r.GetAggregateEvents(ctx, id.String(), -1)
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	assert.Equal(t, uint8(1), events[0].ID.Count())
+	assert.Equal(t, uint8(2), events[1].ID.Count())
+}
+
+func TestConcurrentSavesKeepIDsOrdered(t *testing.T) {
+	ctx := context.Background()
+	r := inmem.NewStore()
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{})
+
+	ids := make([]uuid.UUID, 20)
+	var wg sync.WaitGroup
+	for k := range ids {
+		ids[k] = uuid.New()
+		wg.Add(1)
+		go func(id uuid.UUID) {
+			defer wg.Done()
+			acc := test.CreateAccount("Paulo", id, 100)
+			for i := 0; i < 10; i++ {
+				acc.Deposit(1)
+			}
+			assert.NoError(t, es.Save(ctx, acc))
+		}(ids[k])
+	}
+	wg.Wait()
+
+	for _, id := range ids {
+		events, err := r.GetAggregateEvents(ctx, id.String(), -1)
+		require.NoError(t, err)
+		require.Len(t, events, 11)
+		for k := 1; k < len(events); k++ {
+			require.Equal(t, 1, events[k].ID.Compare(events[k-1].ID), "event %d of %s", k, id)
+		}
+	}
+}
+
+func TestHashFunc(t *testing.T) {
+	ctx := context.Background()
+	r := inmem.NewStore(inmem.WithHashFunc(eventsourcing.HashLabel("tenant")))
+	var saved []eventsourcing.Event
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{},
+		eventsourcing.WithAfterSave(func(ctx context.Context, aggregate eventsourcing.Aggregater, events []eventsourcing.Event) error {
+			saved = append(saved, events...)
+			return nil
+		}),
+	)
+
+	tenant := eventsourcing.WithMetadata(map[string]interface{}{"tenant": "acme"})
+	acc1 := test.CreateAccount("Paulo", uuid.New(), 100)
+	err := es.Save(ctx, acc1, tenant)
+	require.NoError(t, err)
+	acc2 := test.CreateAccount("Pereira", uuid.New(), 100)
+	err = es.Save(ctx, acc2, tenant)
+	require.NoError(t, err)
+	// without the label, the aggregate ID is hashed
+	acc3 := test.CreateAccount("Pedro", uuid.New(), 100)
+	err = es.Save(ctx, acc3)
+	require.NoError(t, err)
+
+	events, err := r.GetEvents(ctx, eventid.Zero, 0, 0, store.Filter{})
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+	// the saves in the same millisecond are not ordered
+	hashes := map[string]uint32{}
+	for _, e := range events {
+		hashes[e.AggregateID] = e.AggregateIDHash
+	}
+	tenantHash := eventsourcing.HashLabel("tenant")("", map[string]interface{}{"tenant": "acme"})
+	assert.Equal(t, tenantHash, hashes[acc1.GetID()])
+	assert.Equal(t, tenantHash, hashes[acc2.GetID()])
+	assert.Equal(t, eventsourcing.HashAggregateID(acc3.GetID(), nil), hashes[acc3.GetID()])
+
+	// the hooks get the same hash
+	require.Len(t, saved, 3)
+	for _, e := range saved {
+		assert.Equal(t, hashes[e.AggregateID], e.AggregateIDHash)
+	}
+}
+
+func TestIdempotencyScope(t *testing.T) {
+	ctx := context.Background()
+	r := inmem.NewStore()
+	global := eventsourcing.NewEventStore(r, test.AggregateFactory{})
+	scoped := eventsourcing.NewEventStore(r, test.AggregateFactory{}, eventsourcing.WithIdempotencyScope(eventsourcing.IdempotencyScopeAggregate))
+
+	acc1 := test.CreateAccount("Paulo", uuid.New(), 100)
+	err := scoped.Save(ctx, acc1, eventsourcing.WithIdempotencyKey("key"))
+	require.NoError(t, err)
+
+	acc2 := test.CreateAccount("Pereira", uuid.New(), 100)
+	err = global.Save(ctx, acc2, eventsourcing.WithIdempotencyKey("key"))
+	require.True(t, errors.Is(err, eventsourcing.ErrDuplicateIdempotencyKey))
+	err = scoped.Save(ctx, acc2, eventsourcing.WithIdempotencyKey("key"))
+	require.NoError(t, err)
+
+	acc1.Deposit(10)
+	err = scoped.Save(ctx, acc1, eventsourcing.WithIdempotencyKey("key"))
+	require.True(t, errors.Is(err, eventsourcing.ErrDuplicateIdempotencyKey))
+
+	found, err := scoped.HasAggregateIdempotencyKey(ctx, acc2.GetID(), "key")
+	require.NoError(t, err)
+	assert.True(t, found)
+	found, err = scoped.HasIdempotencyKey(ctx, "key")
+	require.NoError(t, err)
+	assert.True(t, found)
+}
+
+func TestSaveEventsBatch(t *testing.T) {
+	ctx := context.Background()
+	r := inmem.NewStore()
+
+	newRecord := func(id string, version uint32) eventsourcing.EventRecord {
+		return eventsourcing.EventRecord{
+			AggregateID:   id,
+			Version:       version,
+			AggregateType: "Account",
+			CreatedAt:     time.Now().UTC(),
+			Details: []eventsourcing.EventRecordDetail{
+				{Kind: "MoneyDeposited", Body: []byte(`{"money":10}`)},
+			},
+		}
+	}
+
+	results, err := r.SaveEvents(ctx, []eventsourcing.EventRecord{newRecord("1", 0), newRecord("2", 0)})
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+
+	// the second record clashes, so nothing is saved
+	_, err = r.SaveEvents(ctx, []eventsourcing.EventRecord{newRecord("1", 1), newRecord("2", 0)})
+	require.True(t, errors.Is(err, eventsourcing.ErrConcurrentModification))
+
+	events, err := r.GetEvents(ctx, eventid.Zero, 0, 0, store.Filter{})
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+}
+
+func TestForget(t *testing.T) {
+	ctx := context.Background()
+	r := inmem.NewStore()
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{}, eventsourcing.WithSnapshotThreshold(3))
+
+	id := uuid.New()
+	acc := test.CreateAccount("Paulo", id, 100)
+	acc.UpdateOwner("Paulo Quintans")
+	acc.Deposit(10)
+	err := es.Save(ctx, acc)
+	require.NoError(t, err)
+
+	request := eventsourcing.ForgetRequest{
+		AggregateID: id.String(),
+		EventKind:   "OwnerUpdated",
+	}
+	preview, err := es.PreviewForget(ctx, request)
+	require.NoError(t, err)
+	events, err := r.GetAggregateEvents(ctx, id.String(), -1)
+	require.NoError(t, err)
+	snap, err := r.GetSnapshot(ctx, id.String())
+	require.NoError(t, err)
+	assert.Equal(t, []eventid.EventID{events[1].ID}, preview.EventIDs)
+	assert.Equal(t, []eventid.EventID{snap.ID}, preview.SnapshotIDs)
+	assert.False(t, preview.DeletesSnapshots)
+	// nothing was changed
+	assert.False(t, events[1].IsForgotten())
+	assert.Contains(t, string(events[1].Body), "Paulo Quintans")
+
+	err = es.Forget(ctx, request,
+		func(i interface{}) interface{} {
+			switch t := i.(type) {
+			case test.OwnerUpdated:
+				t.Owner = ""
+				return t
+			case test.Account:
+				t.Owner = ""
+				return t
+			}
+			return i
+		},
+	)
+	require.NoError(t, err)
+
+	events, err = r.GetAggregateEvents(ctx, id.String(), -1)
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+	ou := test.OwnerUpdated{}
+	err = json.Unmarshal(events[1].Body, &ou)
+	require.NoError(t, err)
+	assert.Empty(t, ou.Owner)
+	assert.True(t, events[1].IsForgotten())
+	assert.False(t, events[0].IsForgotten())
+	assert.False(t, events[2].IsForgotten())
+
+	snap, err = r.GetSnapshot(ctx, id.String())
+	require.NoError(t, err)
+	a := test.NewAccount()
+	err = json.Unmarshal(snap.Body, a)
+	require.NoError(t, err)
+	assert.Empty(t, a.Owner)
+	assert.NotEmpty(t, a.ID)
+}
+
+func TestReplay(t *testing.T) {
+	ctx := context.Background()
+	r := inmem.NewStore()
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{})
+
+	acc1 := test.CreateAccount("Paulo", uuid.New(), 100)
+	acc1.Deposit(10)
+	err := es.Save(ctx, acc1, eventsourcing.WithMetadata(map[string]interface{}{"geo": "EU"}))
+	require.NoError(t, err)
+	acc2 := test.CreateAccount("Pereira", uuid.New(), 100)
+	err = es.Save(ctx, acc2, eventsourcing.WithMetadata(map[string]interface{}{"geo": "US"}))
+	require.NoError(t, err)
+
+	events := []eventsourcing.Event{}
+	p := player.New(r, player.WithBatchSize(1), player.WithTrailingLag(0))
+	_, err = p.Replay(ctx, func(ctx context.Context, e eventsourcing.Event) error {
+		events = append(events, e)
+		return nil
+	}, eventid.Zero, store.WithMetadataKV("geo", "EU"))
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	assert.Equal(t, acc1.GetID(), events[0].AggregateID)
+
+	all, err := r.GetEvents(ctx, eventid.Zero, 0, 0, store.Filter{})
+	require.NoError(t, err)
+	require.Len(t, all, 3)
+	lastID, err := r.GetLastEventID(ctx, 0, store.Filter{})
+	require.NoError(t, err)
+	assert.Equal(t, all[2].ID, lastID)
+}
+
+func TestReplayWithMetadataExists(t *testing.T) {
+	ctx := context.Background()
+	r := inmem.NewStore()
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{})
+
+	acc1 := test.CreateAccount("Paulo", uuid.New(), 100)
+	err := es.Save(ctx, acc1, eventsourcing.WithMetadata(map[string]interface{}{"geo": "EU"}))
+	require.NoError(t, err)
+	acc2 := test.CreateAccount("Pereira", uuid.New(), 100)
+	err = es.Save(ctx, acc2)
+	require.NoError(t, err)
+
+	events := []eventsourcing.Event{}
+	p := player.New(r, player.WithTrailingLag(0))
+	_, err = p.Replay(ctx, func(ctx context.Context, e eventsourcing.Event) error {
+		events = append(events, e)
+		return nil
+	}, eventid.Zero, store.WithMetadataExists("geo"))
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, acc1.GetID(), events[0].AggregateID)
+}
+
+func TestReplayWithExclusions(t *testing.T) {
+	ctx := context.Background()
+	r := inmem.NewStore()
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{})
+
+	acc1 := test.CreateAccount("Paulo", uuid.New(), 100)
+	err := es.Save(ctx, acc1, eventsourcing.WithMetadata(map[string]interface{}{"geo": "EU"}))
+	require.NoError(t, err)
+	acc2 := test.CreateAccount("Pereira", uuid.New(), 100)
+	err = es.Save(ctx, acc2)
+	require.NoError(t, err)
+
+	events := []eventsourcing.Event{}
+	p := player.New(r, player.WithTrailingLag(0))
+	handler := func(ctx context.Context, e eventsourcing.Event) error {
+		events = append(events, e)
+		return nil
+	}
+	_, err = p.Replay(ctx, handler, eventid.Zero, store.WithExcludeMetadataKV("geo", "EU"))
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, acc2.GetID(), events[0].AggregateID)
+
+	events = nil
+	_, err = p.Replay(ctx, handler, eventid.Zero, store.WithExcludeAggregateTypes("Account"))
+	require.NoError(t, err)
+	require.Len(t, events, 0)
+}
+
+func TestStats(t *testing.T) {
+	ctx := context.Background()
+	r := inmem.NewStore()
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{})
+
+	stats, err := es.Stats(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), stats.Events)
+	assert.True(t, stats.LastEventID.IsZero())
+	assert.Empty(t, stats.ByAggregateType)
+
+	acc1 := test.CreateAccount("Paulo", uuid.New(), 100)
+	acc1.Deposit(10)
+	err = es.Save(ctx, acc1)
+	require.NoError(t, err)
+	acc2 := test.CreateAccount("Pereira", uuid.New(), 100)
+	err = es.Save(ctx, acc2)
+	require.NoError(t, err)
+
+	events, err := r.GetEvents(ctx, eventid.Zero, 10, 0, store.Filter{})
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+
+	first, last := events[0].ID, events[0].ID
+	oldest, newest := events[0].CreatedAt, events[0].CreatedAt
+	for _, e := range events[1:] {
+		if e.ID.Compare(first) < 0 {
+			first = e.ID
+		}
+		if e.ID.Compare(last) > 0 {
+			last = e.ID
+		}
+		if e.CreatedAt.Before(oldest) {
+			oldest = e.CreatedAt
+		}
+		if e.CreatedAt.After(newest) {
+			newest = e.CreatedAt
+		}
+	}
+
+	stats, err = es.Stats(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), stats.Events)
+	assert.Equal(t, first, stats.FirstEventID)
+	assert.Equal(t, last, stats.LastEventID)
+	assert.True(t, oldest.Equal(stats.Oldest))
+	assert.True(t, newest.Equal(stats.Newest))
+	require.Len(t, stats.ByAggregateType, 1)
+	assert.Equal(t, stats.EventsStats, stats.ByAggregateType["Account"])
+}
+
+func TestReplayWithAggregateIDs(t *testing.T) {
+	ctx := context.Background()
+	r := inmem.NewStore()
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{})
+
+	accs := []*test.Account{
+		test.CreateAccount("Paulo", uuid.New(), 100),
+		test.CreateAccount("Pereira", uuid.New(), 100),
+		test.CreateAccount("Quintans", uuid.New(), 100),
+	}
+	for _, acc := range accs {
+		err := es.Save(ctx, acc)
+		require.NoError(t, err)
+	}
+
+	events := []eventsourcing.Event{}
+	p := player.New(r, player.WithTrailingLag(0))
+	handler := func(ctx context.Context, e eventsourcing.Event) error {
+		events = append(events, e)
+		return nil
+	}
+	// no IDs do not filter
+	_, err := p.Replay(ctx, handler, eventid.Zero, store.WithAggregateIDs())
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+
+	events = nil
+	_, err = p.Replay(ctx, handler, eventid.Zero, store.WithAggregateIDs(accs[1].GetID()))
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, accs[1].GetID(), events[0].AggregateID)
+
+	events = nil
+	_, err = p.Replay(ctx, handler, eventid.Zero, store.WithAggregateIDs(accs[0].GetID(), accs[2].GetID()))
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	assert.ElementsMatch(t, []string{accs[0].GetID(), accs[2].GetID()}, aggregateIDs(events))
+}
+
+func TestReplayWithEventKinds(t *testing.T) {
+	ctx := context.Background()
+	r := inmem.NewStore()
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{})
+
+	acc := test.CreateAccount("Paulo", uuid.New(), 100)
+	acc.Deposit(10)
+	acc.Withdraw(5)
+	err := es.Save(ctx, acc)
+	require.NoError(t, err)
+
+	events := []eventsourcing.Event{}
+	p := player.New(r, player.WithTrailingLag(0))
+	_, err = p.Replay(ctx, func(ctx context.Context, e eventsourcing.Event) error {
+		events = append(events, e)
+		return nil
+	}, eventid.Zero, store.WithEventKinds("MoneyWithdrawn"))
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, eventsourcing.EventKind("MoneyWithdrawn"), events[0].Kind)
+}
+
+func TestMultiTenant(t *testing.T) {
+	r := inmem.NewStore(inmem.WithMultiTenant())
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{})
+
+	id := uuid.New()
+	err := es.Save(context.Background(), test.CreateAccount("Paulo", id, 100))
+	require.True(t, errors.Is(err, eventsourcing.ErrMissingTenant), err)
+
+	ctxA := eventsourcing.WithTenant(context.Background(), "A")
+	ctxB := eventsourcing.WithTenant(context.Background(), "B")
+	err = es.Save(ctxA, test.CreateAccount("Paulo", id, 100))
+	require.NoError(t, err)
+	err = es.Save(ctxB, test.CreateAccount("Pedro", uuid.New(), 50))
+	require.NoError(t, err)
+
+	a, err := es.GetByID(ctxA, id.String())
+	require.NoError(t, err)
+	assert.Equal(t, int64(100), a.(*test.Account).Balance)
+	// the aggregate is not found by the other tenants
+	a, err = es.GetByID(ctxB, id.String())
+	require.NoError(t, err)
+	require.Nil(t, a)
+	_, err = es.GetByID(context.Background(), id.String())
+	require.True(t, errors.Is(err, eventsourcing.ErrMissingTenant), err)
+
+	events, err := r.GetEvents(ctxA, eventid.Zero, 10, 0, store.Filter{})
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, "A", events[0].TenantID)
+	events, err = r.GetEvents(eventsourcing.WithAllTenants(context.Background()), eventid.Zero, 10, 0, store.Filter{})
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	_, err = r.GetEvents(context.Background(), eventid.Zero, 10, 0, store.Filter{})
+	require.True(t, errors.Is(err, eventsourcing.ErrMissingTenant), err)
+
+	stats, err := r.Stats(ctxA)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), stats.Events)
+	stats, err = r.Stats(eventsourcing.WithAllTenants(context.Background()))
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), stats.Events)
+	_, err = r.Stats(context.Background())
+	require.True(t, errors.Is(err, eventsourcing.ErrMissingTenant), err)
+	// events can't be saved for all the tenants
+	err = es.Save(eventsourcing.WithAllTenants(context.Background()), test.CreateAccount("Maria", uuid.New(), 10))
+	require.True(t, errors.Is(err, eventsourcing.ErrMissingTenant), err)
+}
+
+func TestMultiTenantSnapshotsAndForget(t *testing.T) {
+	r := inmem.NewStore(inmem.WithMultiTenant())
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{}, eventsourcing.WithSnapshotThreshold(3))
+
+	ctxA := eventsourcing.WithTenant(context.Background(), "A")
+	ctxB := eventsourcing.WithTenant(context.Background(), "B")
+	id := uuid.New()
+	acc := test.CreateAccount("Paulo", id, 100)
+	acc.UpdateOwner("Paulo Quintans")
+	acc.Deposit(10)
+	err := es.Save(ctxA, acc, eventsourcing.WithIdempotencyKey("key"))
+	require.NoError(t, err)
+
+	snap, err := r.GetSnapshot(ctxA, id.String())
+	require.NoError(t, err)
+	assert.Equal(t, "A", snap.TenantID)
+	// the snapshot is not found by the other tenants
+	snap, err = r.GetSnapshot(ctxB, id.String())
+	require.NoError(t, err)
+	assert.Empty(t, snap.ID)
+	snap, _, err = r.LoadAggregate(ctxB, id.String())
+	require.NoError(t, err)
+	assert.Empty(t, snap.ID)
+	_, err = r.GetSnapshot(context.Background(), id.String())
+	require.True(t, errors.Is(err, eventsourcing.ErrMissingTenant), err)
+
+	found, err := es.HasIdempotencyKey(ctxA, "key")
+	require.NoError(t, err)
+	assert.True(t, found)
+	found, err = es.HasIdempotencyKey(ctxB, "key")
+	require.NoError(t, err)
+	assert.False(t, found)
+	found, err = r.HasAggregateIdempotencyKey(ctxB, id.String(), "key")
+	require.NoError(t, err)
+	assert.False(t, found)
+
+	request := eventsourcing.ForgetRequest{
+		AggregateID: id.String(),
+		EventKind:   "OwnerUpdated",
+	}
+	preview, err := es.PreviewForget(ctxB, request)
+	require.NoError(t, err)
+	assert.Empty(t, preview.EventIDs)
+	assert.Empty(t, preview.SnapshotIDs)
+
+	// forgetting by another tenant changes nothing
+	err = es.Forget(ctxB, request, func(i interface{}) interface{} {
+		t.Fatalf("forgetting %T of another tenant", i)
+		return i
+	})
+	require.NoError(t, err)
+	events, err := r.GetAggregateEvents(ctxA, id.String(), -1)
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+	assert.False(t, events[1].IsForgotten())
+	assert.Contains(t, string(events[1].Body), "Paulo Quintans")
+}
+
+func aggregateIDs(events []eventsourcing.Event) []string {
+	ids := make([]string, 0, len(events))
+	for _, e := range events {
+		ids = append(ids, e.AggregateID)
+	}
+	return ids
+}
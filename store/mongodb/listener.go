@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/cenkalti/backoff/v4"
@@ -28,6 +29,10 @@ type Feed struct {
 	partitions       uint32
 	partitionsLow    uint32
 	partitionsHi     uint32
+	filter           store.Filter
+	coldStart        store.ColdStart
+	reconnectInitial time.Duration
+	reconnectMax     time.Duration
 }
 
 type FeedOption func(*Feed)
@@ -49,12 +54,41 @@ func WithFeedEventsCollection(eventsCollection string) FeedOption {
 	}
 }
 
+// WithColdStart sets from where to start when the sink has no messages for the partitions of the feed.
+// It defaults to store.StartFromBeginning.
+func WithColdStart(start store.ColdStart) FeedOption {
+	return func(p *Feed) {
+		p.coldStart = start
+	}
+}
+
+// WithReconnectBackoff sets the interval to wait before reopening the change stream, when it fails with a recoverable error,
+// and the maximum interval that it grows to, exponentially and with jitter, while the reopening fails.
+func WithReconnectBackoff(initial, max time.Duration) FeedOption {
+	return func(p *Feed) {
+		p.reconnectInitial = initial
+		p.reconnectMax = max
+	}
+}
+
+// WithFeedFilter only feeds the events passing the filter, applied in the change stream pipeline.
+// Raw conditions are not supported.
+func WithFeedFilter(filters ...store.FilterOption) FeedOption {
+	return func(p *Feed) {
+		for _, f := range filters {
+			f(&p.filter)
+		}
+	}
+}
+
 func NewFeed(logger log.Logger, connString, database string, opts ...FeedOption) Feed {
 	m := Feed{
 		logger:           logger,
 		dbName:           database,
 		connString:       connString,
 		eventsCollection: "events",
+		reconnectInitial: backoff.DefaultInitialInterval,
+		reconnectMax:     backoff.DefaultMaxInterval,
 	}
 
 	for _, o := range opts {
@@ -67,6 +101,10 @@ type ChangeEvent struct {
 	FullDocument Event `bson:"fullDocument,omitempty"`
 }
 
+// Feed feeds the sinker with the inserted events, from the change stream.
+// On recoverable errors, eg: on a replica set election, the change stream is reopened with an exponential backoff, with jitter,
+// resuming after the last fully sinked document. It only returns on fatal errors, eg: if the resume token is no longer in the oplog,
+// or when the context is cancelled.
 func (m Feed) Feed(ctx context.Context, sinker sink.Sinker) error {
 	var lastResumeToken []byte
 	err := store.ForEachResumeTokenInSinkPartitions(ctx, sinker, m.partitionsLow, m.partitionsHi, func(message *eventsourcing.Event) error {
@@ -79,6 +117,10 @@ func (m Feed) Feed(ctx context.Context, sinker sink.Sinker) error {
 		return err
 	}
 
+	if m.filter.RawCondition != "" {
+		return faults.Wrap(store.ErrRawConditionNotSupported)
+	}
+
 	ctx2, cancel := context.WithTimeout(ctx, 10*time.Second)
 	client, err := mongo.Connect(ctx2, options.Client().ApplyURI(m.connString))
 	cancel()
@@ -95,76 +137,156 @@ func (m Feed) Feed(ctx context.Context, sinker sink.Sinker) error {
 	if m.partitions > 1 {
 		match = append(match, partitionFilter("fullDocument.aggregate_id_hash", m.partitions, m.partitionsLow, m.partitionsHi))
 	}
+	match = buildFilter("fullDocument.", m.filter, match)
 
 	matchPipeline := bson.D{{Key: "$match", Value: match}}
 	pipeline := mongo.Pipeline{matchPipeline}
 
 	eventsCollection := client.Database(m.dbName).Collection(m.eventsCollection)
-	var eventsStream *mongo.ChangeStream
-	if len(lastResumeToken) != 0 {
-		m.logger.Infof("Starting feeding (partitions: [%d-%d]) from '%X'", m.partitionsLow, m.partitionsHi, lastResumeToken)
-		eventsStream, err = eventsCollection.Watch(ctx, pipeline, options.ChangeStream().SetResumeAfter(bson.Raw(lastResumeToken)))
-		if err != nil {
-			return faults.Wrap(err)
+	logger := m.logger.WithTags(log.PartitionTags(m.partitionsLow, m.partitionsHi))
+
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = m.reconnectInitial
+	b.MaxInterval = m.reconnectMax
+	// never gives up
+	b.MaxElapsedTime = 0
+
+	err = backoff.RetryNotify(func() error {
+		var err error
+		lastResumeToken, err = m.watch(ctx, logger, eventsCollection, pipeline, lastResumeToken, sinker, b)
+		return err
+	}, backoff.WithContext(b, ctx), func(err error, d time.Duration) {
+		logger.WithError(err).
+			WithTags(log.Tags{"backoff": d}).
+			Warn("Failure watching the MongoDB change stream. Reopening.")
+	})
+	if ctx.Err() != nil {
+		// the in-flight document was completely sinked, so the feed can be resumed from the sink
+		return ctx.Err()
+	}
+	return err
+}
+
+// watch opens the change stream after the resume token, or from the beginning if there is none, and sinks its documents.
+// It returns the resume token of the last fully sinked document, from where the change stream can be reopened.
+// Errors that don't allow to reopen the change stream are permanent.
+func (m Feed) watch(
+	ctx context.Context,
+	logger log.Logger,
+	eventsCollection *mongo.Collection,
+	pipeline mongo.Pipeline,
+	resumeToken []byte,
+	sinker sink.Sinker,
+	b backoff.BackOff,
+) ([]byte, error) {
+	opts := options.ChangeStream()
+	switch {
+	case len(resumeToken) != 0:
+		logger.WithTags(log.Tags{"resumeToken": fmt.Sprintf("%X", resumeToken)}).Info("Starting to feed")
+		opts.SetResumeAfter(bson.Raw(resumeToken))
+	case m.coldStart == store.StartFromNow:
+		logger.Info("Starting to feed from now")
+	default:
+		logger.Info("Starting to feed from the beginning")
+		opts.SetStartAtOperationTime(&primitive.Timestamp{})
+	}
+	eventsStream, err := eventsCollection.Watch(ctx, pipeline, opts)
+	if err != nil {
+		return resumeToken, streamError(err)
+	}
+	defer eventsStream.Close(context.Background())
+	if len(resumeToken) == 0 && m.coldStart == store.StartFromNow {
+		// reopening the change stream must not skip the events saved in the meantime
+		resumeToken = []byte(eventsStream.ResumeToken())
+	}
+
+	for eventsStream.Next(ctx) {
+		var data ChangeEvent
+		if err := eventsStream.Decode(&data); err != nil {
+			return resumeToken, backoff.Permanent(faults.Wrap(err))
 		}
-	} else {
-		m.logger.Infof("Starting feeding (partitions: [%d-%d]) from the beginning", m.partitionsLow, m.partitionsHi)
-		eventsStream, err = eventsCollection.Watch(ctx, pipeline, options.ChangeStream().SetStartAtOperationTime(&primitive.Timestamp{}))
+		token := []byte(eventsStream.ResumeToken())
+		err := sinkDocument(sinker, data.FullDocument, token, m.filter.EventKinds)
 		if err != nil {
-			return faults.Wrap(err)
+			return resumeToken, backoff.Permanent(err)
 		}
+		resumeToken = token
+
+		b.Reset()
 	}
-	defer eventsStream.Close(ctx)
+	if ctx.Err() != nil {
+		return resumeToken, backoff.Permanent(ctx.Err())
+	}
+	return resumeToken, streamError(eventsStream.Err())
+}
 
-	// TODO should be configured
-	b := backoff.NewExponentialBackOff()
-	b.MaxElapsedTime = 10 * time.Second
-
-	return backoff.Retry(func() error {
-		for eventsStream.Next(ctx) {
-			var data ChangeEvent
-			if err := eventsStream.Decode(&data); err != nil {
-				return faults.Wrap(backoff.Permanent(err))
-			}
-			eventDoc := data.FullDocument
-
-			lastIdx := len(eventDoc.Details) - 1
-			for k, d := range eventDoc.Details {
-				if k == lastIdx {
-					// we update the resume token on the last event of the transaction
-					lastResumeToken = []byte(eventsStream.ResumeToken())
-				}
-				id, err := eventid.Parse(eventDoc.ID)
-				if err != nil {
-					return faults.Wrap(backoff.Permanent(err))
-				}
-				event := eventsourcing.Event{
-					ID: id.SetCount(uint8(k)),
-					// the resume token should be from the last fully completed sinked doc, because it may fail midway.
-					// We should use the last eventID to filter out the ones that were successfully sent.
-					ResumeToken:      lastResumeToken,
-					AggregateID:      eventDoc.AggregateID,
-					AggregateIDHash:  eventDoc.AggregateIDHash,
-					AggregateVersion: eventDoc.AggregateVersion,
-					AggregateType:    eventDoc.AggregateType,
-					Kind:             d.Kind,
-					Body:             d.Body,
-					IdempotencyKey:   eventDoc.IdempotencyKey,
-					Metadata:         eventDoc.Metadata,
-					CreatedAt:        eventDoc.CreatedAt,
-				}
-				err = sinker.Sink(ctx, event)
-				if err != nil {
-					return backoff.Permanent(err)
-				}
-			}
-
-			b.Reset()
+// mongo server error codes of change streams that can't be resumed
+const (
+	codeChangeStreamFatalError  = 280
+	codeChangeStreamHistoryLost = 286
+)
+
+// streamError makes permanent the change stream errors that won't go away by reopening the change stream,
+// eg: when the resume token is no longer in the oplog
+func streamError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) &&
+		(cmdErr.Code == codeChangeStreamFatalError ||
+			cmdErr.Code == codeChangeStreamHistoryLost ||
+			cmdErr.HasErrorLabel("NonResumableChangeStreamError")) {
+		return backoff.Permanent(faults.Wrap(err))
+	}
+	return faults.Wrap(err)
+}
+
+// sinkDocument sinks all the events of a document, of the kinds, if any.
+// The events are sinked even if the feed context is cancelled midway, so that the sink is left in a consistent position,
+// since only the last event carries the resume token of the document.
+func sinkDocument(sinker sink.Sinker, eventDoc Event, resumeToken []byte, kinds []eventsourcing.EventKind) error {
+	ctx := context.Background()
+	id, err := eventid.Parse(eventDoc.ID)
+	if err != nil {
+		return faults.Wrap(err)
+	}
+
+	var lastResumeToken []byte
+	lastIdx := -1
+	for k, d := range eventDoc.Details {
+		if hasKind(kinds, d.Kind) {
+			lastIdx = k
+		}
+	}
+	for k, d := range eventDoc.Details {
+		if !hasKind(kinds, d.Kind) {
+			continue
 		}
-		err := eventsStream.Err()
-		if errors.Is(err, context.Canceled) {
-			return backoff.Permanent(err)
+		if k == lastIdx {
+			// we update the resume token on the last event of the transaction
+			lastResumeToken = resumeToken
 		}
-		return err
-	}, b)
+		event := eventsourcing.Event{
+			ID: id.SetCount(uint8(k)),
+			// the resume token should be from the last fully completed sinked doc, because it may fail midway.
+			// We should use the last eventID to filter out the ones that were successfully sent.
+			ResumeToken:      lastResumeToken,
+			AggregateID:      eventDoc.AggregateID,
+			AggregateIDHash:  eventDoc.AggregateIDHash,
+			AggregateVersion: eventDoc.AggregateVersion,
+			AggregateType:    eventDoc.AggregateType,
+			Kind:             d.Kind,
+			Body:             d.Body,
+			ContentType:      eventDoc.ContentType,
+			IdempotencyKey:   eventDoc.IdempotencyKey,
+			Metadata:         eventDoc.Metadata,
+			CreatedAt:        eventDoc.CreatedAt,
+		}
+		err = sinker.Sink(ctx, event)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,125 @@
+package mongodb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/quintans/eventsourcing"
+	"github.com/quintans/eventsourcing/eventid"
+	"github.com/quintans/eventsourcing/store"
+)
+
+type cancelingSink struct {
+	cancel context.CancelFunc
+	events []eventsourcing.Event
+}
+
+func (s *cancelingSink) Sink(ctx context.Context, e eventsourcing.Event) error {
+	// cancel the feed while the document is being sinked
+	s.cancel()
+	s.events = append(s.events, e)
+	return nil
+}
+
+func (s *cancelingSink) LastMessage(ctx context.Context, partition uint32) (*eventsourcing.Event, error) {
+	if len(s.events) == 0 {
+		return nil, nil
+	}
+	return &s.events[len(s.events)-1], nil
+}
+
+func (s *cancelingSink) Close() {}
+
+func TestSinkDocumentDrainsOnCancel(t *testing.T) {
+	now := time.Now()
+	id, err := eventid.New(now, eventid.EntropyFactory(now))
+	require.NoError(t, err)
+
+	_, cancel := context.WithCancel(context.Background())
+	s := &cancelingSink{cancel: cancel}
+	doc := Event{
+		ID:            id.String(),
+		AggregateID:   "123",
+		AggregateType: "Account",
+		Details: []EventDetail{
+			{Kind: "AccountCreated"},
+			{Kind: "MoneyDeposited"},
+			{Kind: "MoneyWithdrawn"},
+		},
+		CreatedAt: now,
+	}
+
+	err = sinkDocument(s, doc, []byte("token"), nil)
+	require.NoError(t, err)
+
+	require.Len(t, s.events, 3)
+	for k, e := range s.events[:2] {
+		assert.Equal(t, id.SetCount(uint8(k)), e.ID)
+		assert.Empty(t, e.ResumeToken)
+	}
+	last, err := s.LastMessage(context.Background(), 1)
+	require.NoError(t, err)
+	assert.Equal(t, id.SetCount(2), last.ID)
+	assert.Equal(t, []byte("token"), []byte(last.ResumeToken))
+}
+
+func TestFeedFilterWithAggregateIDs(t *testing.T) {
+	match := bson.D{{Key: "operationType", Value: "insert"}}
+	assert.Equal(t, match, buildFilter("fullDocument.", store.Filter{}, match))
+
+	f := Feed{}
+	WithFeedFilter(store.WithAggregateIDs("a", "b"))(&f)
+	assert.Equal(t, bson.D{
+		{Key: "operationType", Value: "insert"},
+		{Key: "fullDocument.aggregate_id", Value: bson.D{{Key: "$in", Value: []string{"a", "b"}}}},
+	}, buildFilter("fullDocument.", f.filter, match))
+}
+
+func TestFeedFilterWithLabels(t *testing.T) {
+	f := Feed{}
+	WithFeedFilter(store.WithExcludeMetadataKV("geo", "US"), store.WithMetadataExists("tenant"))(&f)
+	assert.Equal(t, bson.D{
+		{Key: "fullDocument.metadata.geo", Value: bson.D{{Key: "$nin", Value: []string{"US"}}}},
+		{Key: "fullDocument.metadata.tenant", Value: bson.D{{Key: "$exists", Value: true}}},
+	}, buildFilter("fullDocument.", f.filter, bson.D{}))
+}
+
+func TestSinkDocumentWithEventKinds(t *testing.T) {
+	now := time.Now()
+	id, err := eventid.New(now, eventid.EntropyFactory(now))
+	require.NoError(t, err)
+
+	s := &cancelingSink{cancel: func() {}}
+	doc := Event{
+		ID:            id.String(),
+		AggregateID:   "123",
+		AggregateType: "Account",
+		Details: []EventDetail{
+			{Kind: "AccountCreated"},
+			{Kind: "MoneyDeposited"},
+			{Kind: "MoneyWithdrawn"},
+		},
+		CreatedAt: now,
+	}
+
+	err = sinkDocument(s, doc, []byte("token"), []eventsourcing.EventKind{"AccountCreated", "MoneyDeposited"})
+	require.NoError(t, err)
+
+	require.Len(t, s.events, 2)
+	assert.Equal(t, id, s.events[0].ID)
+	assert.Empty(t, s.events[0].ResumeToken)
+	// the last event of the kinds carries the resume token of the document
+	assert.Equal(t, id.SetCount(1), s.events[1].ID)
+	assert.Equal(t, []byte("token"), []byte(s.events[1].ResumeToken))
+
+	f := Feed{}
+	WithFeedFilter(store.WithEventKinds("AccountCreated"))(&f)
+	assert.Equal(t, bson.D{
+		{Key: "fullDocument.details.kind", Value: bson.D{{Key: "$in", Value: []eventsourcing.EventKind{"AccountCreated"}}}},
+	}, buildFilter("fullDocument.", f.filter, bson.D{}))
+}
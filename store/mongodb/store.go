@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/quintans/faults"
@@ -12,7 +13,6 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 
 	"github.com/quintans/eventsourcing"
-	"github.com/quintans/eventsourcing/common"
 	"github.com/quintans/eventsourcing/eventid"
 	"github.com/quintans/eventsourcing/store"
 )
@@ -31,14 +31,16 @@ type Event struct {
 	AggregateVersion uint32                      `bson:"aggregate_version,omitempty"`
 	AggregateType    eventsourcing.AggregateType `bson:"aggregate_type,omitempty"`
 	Details          []EventDetail               `bson:"details,omitempty"`
+	ContentType      string                      `bson:"content_type,omitempty"`
 	IdempotencyKey   string                      `bson:"idempotency_key,omitempty"`
 	Metadata         bson.M                      `bson:"metadata,omitempty"`
 	CreatedAt        time.Time                   `bson:"created_at,omitempty"`
 }
 
 type EventDetail struct {
-	Kind eventsourcing.EventKind `bson:"kind,omitempty"`
-	Body []byte                  `bson:"body,omitempty"`
+	Kind        eventsourcing.EventKind `bson:"kind,omitempty"`
+	Body        []byte                  `bson:"body,omitempty"`
+	ForgottenAt time.Time               `bson:"forgotten_at,omitempty"`
 }
 
 type Snapshot struct {
@@ -74,12 +76,30 @@ func WithSnapshotsCollection(snapshotsCollection string) StoreOption {
 	}
 }
 
+// WithEventIDGenerator sets how the IDs of the events are generated, replacing eventid.Generate.
+// The IDs must have the creation time of the events, since the feeds rely on the IDs being ordered by creation time.
+func WithEventIDGenerator(generator eventid.Generator) StoreOption {
+	return func(r *EsRepository) {
+		r.idGenerator = generator
+	}
+}
+
+// WithHashFunc sets the function that computes the aggregate ID hash, used to partition the events, replacing eventsourcing.HashAggregateID.
+// eg: eventsourcing.HashLabel("tenant") partitions the events by tenant.
+func WithHashFunc(fn eventsourcing.HashFunc) StoreOption {
+	return func(r *EsRepository) {
+		r.hashFunc = fn
+	}
+}
+
 type EsRepository struct {
 	dbName                  string
 	client                  *mongo.Client
 	projectorFactory        ProjectorFactory
 	eventsCollectionName    string
 	snapshotsCollectionName string
+	idGenerator             eventid.Generator
+	hashFunc                eventsourcing.HashFunc
 }
 
 // NewStore creates a new instance of MongoEsRepository
@@ -97,6 +117,8 @@ func NewStore(connString, database string, opts ...StoreOption) (*EsRepository,
 		client:                  client,
 		eventsCollectionName:    defaultEventsCollection,
 		snapshotsCollectionName: defaultSnapshotsCollection,
+		idGenerator:             eventid.Generate,
+		hashFunc:                eventsourcing.HashAggregateID,
 	}
 
 	for _, o := range opts {
@@ -122,6 +144,29 @@ func (r *EsRepository) snapshotCollection() *mongo.Collection {
 	return r.collection(r.snapshotsCollectionName)
 }
 
+var _ eventsourcing.EventIDsSaver = (*EsRepository)(nil)
+
+// SaveEventIDs saves the events of the record, in a single document, returning the IDs of all of them.
+// The events of a document share the document ID, told apart by their count.
+func (r *EsRepository) SaveEventIDs(ctx context.Context, eRec eventsourcing.EventRecord) ([]eventid.EventID, uint32, error) {
+	id, version, err := r.SaveEvent(ctx, eRec)
+	if err != nil {
+		return nil, 0, err
+	}
+	ids := make([]eventid.EventID, len(eRec.Details))
+	for k := range ids {
+		ids[k] = id.SetCount(uint8(k))
+	}
+	return ids, version, nil
+}
+
+var _ eventsourcing.AggregateHasher = (*EsRepository)(nil)
+
+// AggregateIDHash returns the hash that partitions the events of the aggregate
+func (r *EsRepository) AggregateIDHash(aggregateID string, labels map[string]interface{}) uint32 {
+	return r.hashFunc(aggregateID, labels)
+}
+
 func (r *EsRepository) SaveEvent(ctx context.Context, eRec eventsourcing.EventRecord) (eventid.EventID, uint32, error) {
 	if len(eRec.Details) == 0 {
 		return eventid.Zero, 0, faults.New("No events to be saved")
@@ -134,8 +179,7 @@ func (r *EsRepository) SaveEvent(ctx context.Context, eRec eventsourcing.EventRe
 		})
 	}
 
-	entropy := eventid.EntropyFactory(eRec.CreatedAt)
-	id, err := eventid.New(eRec.CreatedAt, entropy)
+	id, err := r.idGenerator.New(eventid.NewEntropy(), eRec.CreatedAt, eRec.AggregateID, eRec.Version+1)
 	if err != nil {
 		return eventid.Zero, 0, faults.Wrap(err)
 	}
@@ -146,15 +190,16 @@ func (r *EsRepository) SaveEvent(ctx context.Context, eRec eventsourcing.EventRe
 		AggregateID:      eRec.AggregateID,
 		AggregateType:    eRec.AggregateType,
 		Details:          details,
+		ContentType:      eRec.ContentType,
 		AggregateVersion: version,
 		IdempotencyKey:   eRec.IdempotencyKey,
 		Metadata:         eRec.Labels,
 		CreatedAt:        eRec.CreatedAt,
-		AggregateIDHash:  common.Hash(eRec.AggregateID),
+		AggregateIDHash:  r.hashFunc(eRec.AggregateID, eRec.Labels),
 	}
 
 	if r.projectorFactory != nil {
-		r.withTx(ctx, func(mCtx mongo.SessionContext) (interface{}, error) {
+		err = r.withTx(ctx, func(mCtx mongo.SessionContext) (interface{}, error) {
 			res, err := r.eventsCollection().InsertOne(mCtx, doc)
 			if err != nil {
 				return nil, faults.Wrap(err)
@@ -171,11 +216,15 @@ func (r *EsRepository) SaveEvent(ctx context.Context, eRec eventsourcing.EventRe
 					IdempotencyKey:   doc.IdempotencyKey,
 					Kind:             d.Kind,
 					Body:             d.Body,
+					ContentType:      doc.ContentType,
 					Metadata:         doc.Metadata,
 					CreatedAt:        doc.CreatedAt,
 				}
 				projector.Project(evt)
 			}
+			if err := store.Flush(projector); err != nil {
+				return nil, err
+			}
 
 			return res, nil
 		})
@@ -183,8 +232,8 @@ func (r *EsRepository) SaveEvent(ctx context.Context, eRec eventsourcing.EventRe
 		_, err = r.eventsCollection().InsertOne(ctx, doc)
 	}
 	if err != nil {
-		if isMongoDup(err) {
-			return eventid.Zero, 0, eventsourcing.ErrConcurrentModification
+		if e := mongoDupError(err); e != nil {
+			return eventid.Zero, 0, e
 		}
 		return eventid.Zero, 0, faults.Errorf("Unable to insert event: %w", err)
 	}
@@ -192,16 +241,22 @@ func (r *EsRepository) SaveEvent(ctx context.Context, eRec eventsourcing.EventRe
 	return id, version, nil
 }
 
-func isMongoDup(err error) bool {
+// mongoDupError converts a unique violation into ErrDuplicateIdempotencyKey, if the name of the violated index mentions idempotency,
+// or ErrConcurrentModification otherwise, keeping the database error as the cause. Other errors return nil.
+func mongoDupError(err error) error {
 	var e mongo.WriteException
 	if errors.As(err, &e) {
 		for _, we := range e.WriteErrors {
 			if we.Code == mongoUniqueViolation {
-				return true
+				// eg: E11000 duplicate key error collection: eventsourcing.events index: idx_idempotency dup key: ...
+				if strings.Contains(we.Message, "idempot") {
+					return eventsourcing.WrapCause(eventsourcing.ErrDuplicateIdempotencyKey, e)
+				}
+				return eventsourcing.WrapCause(eventsourcing.ErrConcurrentModification, e)
 			}
 		}
 	}
-	return false
+	return nil
 }
 
 func (r *EsRepository) withTx(ctx context.Context, callback func(mongo.SessionContext) (interface{}, error)) (err error) {
@@ -257,6 +312,77 @@ func (r *EsRepository) SaveSnapshot(ctx context.Context, snapshot eventsourcing.
 	return faults.Wrap(err)
 }
 
+var _ eventsourcing.SnapshotPruner = (*EsRepository)(nil)
+
+func (r *EsRepository) DeleteSnapshots(ctx context.Context, aggregateID string, keepLast int) error {
+	if keepLast < 0 {
+		keepLast = 0
+	}
+	opts := options.Find().
+		SetSort(bson.D{{"aggregate_version", -1}}).
+		SetSkip(int64(keepLast)).
+		SetProjection(bson.D{{"_id", 1}})
+	cursor, err := r.snapshotCollection().Find(ctx, bson.D{{"aggregate_id", aggregateID}}, opts)
+	if err != nil {
+		return faults.Errorf("Unable to get the snapshots of aggregate '%s': %w", aggregateID, err)
+	}
+	snaps := []Snapshot{}
+	if err = cursor.All(ctx, &snaps); err != nil {
+		return faults.Errorf("Unable to get the snapshots of aggregate '%s': %w", aggregateID, err)
+	}
+	if len(snaps) == 0 {
+		return nil
+	}
+	ids := make([]string, 0, len(snaps))
+	for _, s := range snaps {
+		ids = append(ids, s.ID)
+	}
+	_, err = r.snapshotCollection().DeleteMany(ctx, bson.D{{"_id", bson.D{{"$in", ids}}}})
+	if err != nil {
+		return faults.Errorf("Unable to delete the snapshots of aggregate '%s': %w", aggregateID, err)
+	}
+	return nil
+}
+
+func (r *EsRepository) PruneSnapshots(ctx context.Context, keepLast int) (int64, error) {
+	if keepLast < 0 {
+		keepLast = 0
+	}
+	// only the aggregates with more snapshots than the ones to keep are returned, with their snapshot IDs from the newest
+	pipeline := mongo.Pipeline{
+		{{"$sort", bson.D{{"aggregate_id", 1}, {"aggregate_version", -1}}}},
+		{{"$group", bson.D{
+			{"_id", "$aggregate_id"},
+			{"ids", bson.D{{"$push", "$_id"}}},
+		}}},
+		{{"$match", bson.D{{fmt.Sprintf("ids.%d", keepLast), bson.D{{"$exists", true}}}}}},
+	}
+	cursor, err := r.snapshotCollection().Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return 0, faults.Errorf("Unable to prune the snapshots: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var deleted int64
+	for cursor.Next(ctx) {
+		doc := struct {
+			IDs []string `bson:"ids"`
+		}{}
+		if err := cursor.Decode(&doc); err != nil {
+			return deleted, faults.Errorf("Unable to prune the snapshots: %w", err)
+		}
+		res, err := r.snapshotCollection().DeleteMany(ctx, bson.D{{"_id", bson.D{{"$in", doc.IDs[keepLast:]}}}})
+		if err != nil {
+			return deleted, faults.Errorf("Unable to prune the snapshots: %w", err)
+		}
+		deleted += res.DeletedCount
+	}
+	if err := cursor.Err(); err != nil {
+		return deleted, faults.Errorf("Unable to prune the snapshots: %w", err)
+	}
+	return deleted, nil
+}
+
 func (r *EsRepository) GetAggregateEvents(ctx context.Context, aggregateID string, snapVersion int) ([]eventsourcing.Event, error) {
 	filter := bson.D{
 		{"aggregate_id", bson.D{{"$eq", aggregateID}}},
@@ -268,7 +394,7 @@ func (r *EsRepository) GetAggregateEvents(ctx context.Context, aggregateID strin
 	opts := options.Find()
 	opts.SetSort(bson.D{{"aggregate_version", 1}})
 
-	events, _, err := r.queryEvents(ctx, filter, opts, eventid.Zero)
+	events, _, err := r.queryEvents(ctx, filter, opts, eventid.Zero, nil)
 	if err != nil {
 		return nil, faults.Errorf("Unable to get events for Aggregate '%s': %w", aggregateID, err)
 	}
@@ -290,6 +416,85 @@ func (r *EsRepository) HasIdempotencyKey(ctx context.Context, idempotencyKey str
 	return true, nil
 }
 
+var _ eventsourcing.AggregateIdempotencyKeyChecker = (*EsRepository)(nil)
+
+// HasAggregateIdempotencyKey checks if the idempotency key was used by the aggregate
+func (r *EsRepository) HasAggregateIdempotencyKey(ctx context.Context, aggregateID, idempotencyKey string) (bool, error) {
+	filter := bson.D{
+		{"aggregate_id", aggregateID},
+		{"idempotency_key", idempotencyKey},
+	}
+	opts := options.FindOne().SetProjection(bson.D{{"_id", 1}})
+	evt := Event{}
+	if err := r.eventsCollection().FindOne(ctx, filter, opts).Decode(&evt); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return false, nil
+		}
+		return false, faults.Errorf("Unable to verify the existence of the idempotency key for aggregate '%s': %w", aggregateID, err)
+	}
+
+	return true, nil
+}
+
+var _ eventsourcing.StatsGetter = (*EsRepository)(nil)
+
+type statsDoc struct {
+	AggregateType string    `bson:"_id"`
+	Events        int64     `bson:"events"`
+	FirstID       string    `bson:"first_id"`
+	LastID        string    `bson:"last_id"`
+	LastCount     int       `bson:"last_count"`
+	Oldest        time.Time `bson:"oldest"`
+	Newest        time.Time `bson:"newest"`
+}
+
+func (r *EsRepository) Stats(ctx context.Context) (eventsourcing.StoreStats, error) {
+	// a document holds all the events of a save, identified by the document ID and the position in the details
+	pipeline := mongo.Pipeline{
+		{{"$sort", bson.D{{"_id", 1}}}},
+		{{"$group", bson.D{
+			{"_id", "$aggregate_type"},
+			{"events", bson.D{{"$sum", bson.D{{"$size", "$details"}}}}},
+			{"first_id", bson.D{{"$first", "$_id"}}},
+			{"last_id", bson.D{{"$last", "$_id"}}},
+			{"last_count", bson.D{{"$last", bson.D{{"$size", "$details"}}}}},
+			{"oldest", bson.D{{"$min", "$created_at"}}},
+			{"newest", bson.D{{"$max", "$created_at"}}},
+		}}},
+	}
+	cursor, err := r.eventsCollection().Aggregate(ctx, pipeline)
+	if err != nil {
+		return eventsourcing.StoreStats{}, faults.Errorf("Unable to compute the events statistics: %w", err)
+	}
+	docs := []statsDoc{}
+	if err = cursor.All(ctx, &docs); err != nil {
+		return eventsourcing.StoreStats{}, faults.Errorf("Unable to compute the events statistics: %w", err)
+	}
+
+	byType := make(map[eventsourcing.AggregateType]eventsourcing.EventsStats, len(docs))
+	for _, doc := range docs {
+		firstID, err := eventid.Parse(doc.FirstID)
+		if err != nil {
+			return eventsourcing.StoreStats{}, faults.Errorf("unable to parse message ID '%s': %w", doc.FirstID, err)
+		}
+		lastID, err := eventid.Parse(doc.LastID)
+		if err != nil {
+			return eventsourcing.StoreStats{}, faults.Errorf("unable to parse message ID '%s': %w", doc.LastID, err)
+		}
+		if doc.LastCount > 0 {
+			lastID = lastID.SetCount(uint8(doc.LastCount - 1))
+		}
+		byType[eventsourcing.AggregateType(doc.AggregateType)] = eventsourcing.EventsStats{
+			Events:       doc.Events,
+			FirstEventID: firstID,
+			LastEventID:  lastID,
+			Oldest:       doc.Oldest,
+			Newest:       doc.Newest,
+		}
+	}
+	return eventsourcing.NewStoreStats(byType), nil
+}
+
 func (r *EsRepository) Forget(ctx context.Context, request eventsourcing.ForgetRequest, forget func(kind string, body []byte) ([]byte, error)) error {
 	// When Forget() is called, the aggregate is no longer used, therefore if it fails, it can be called again.
 
@@ -306,6 +511,7 @@ func (r *EsRepository) Forget(ctx context.Context, request eventsourcing.ForgetR
 	if err = cursor.All(ctx, &events); err != nil {
 		return faults.Errorf("Unable to get events for Aggregate '%s' and event kind '%s': %w", request.AggregateID, request.EventKind, err)
 	}
+	forgottenAt := time.Now().UTC()
 	for _, evt := range events {
 		for k, d := range evt.Details {
 			body, err := forget(d.Kind.String(), d.Body)
@@ -317,7 +523,10 @@ func (r *EsRepository) Forget(ctx context.Context, request eventsourcing.ForgetR
 				{"_id", evt.ID},
 			}
 			update := bson.D{
-				{"$set", bson.E{fmt.Sprintf("details.%d.body", k), body}},
+				{"$set", bson.D{
+					{fmt.Sprintf("details.%d.body", k), body},
+					{fmt.Sprintf("details.%d.forgotten_at", k), forgottenAt},
+				}},
 			}
 			_, err = r.eventsCollection().UpdateOne(ctx, filter, update)
 			if err != nil {
@@ -360,14 +569,70 @@ func (r *EsRepository) Forget(ctx context.Context, request eventsourcing.ForgetR
 	return nil
 }
 
+var _ eventsourcing.ForgetPreviewer = (*EsRepository)(nil)
+
+func (r *EsRepository) PreviewForget(ctx context.Context, request eventsourcing.ForgetRequest) (eventsourcing.ForgetPreview, error) {
+	preview := eventsourcing.ForgetPreview{
+		EventIDs:    []eventid.EventID{},
+		SnapshotIDs: []eventid.EventID{},
+	}
+
+	// Forget() changes all the events saved together with an event of the kind
+	filter := bson.D{
+		{"aggregate_id", bson.D{{"$eq", request.AggregateID}}},
+		{"details.kind", bson.D{{"$eq", request.EventKind}}},
+	}
+	opts := options.Find().SetSort(bson.D{{"_id", 1}})
+	cursor, err := r.eventsCollection().Find(ctx, filter, opts)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return eventsourcing.ForgetPreview{}, faults.Wrap(err)
+	}
+	events := []Event{}
+	if err = cursor.All(ctx, &events); err != nil {
+		return eventsourcing.ForgetPreview{}, faults.Errorf("Unable to get events for Aggregate '%s' and event kind '%s': %w", request.AggregateID, request.EventKind, err)
+	}
+	for _, evt := range events {
+		id, err := eventid.Parse(evt.ID)
+		if err != nil {
+			return eventsourcing.ForgetPreview{}, faults.Errorf("unable to parse event ID '%s': %w", evt.ID, err)
+		}
+		for k := range evt.Details {
+			preview.EventIDs = append(preview.EventIDs, id.SetCount(uint8(k)))
+		}
+	}
+
+	filter = bson.D{
+		{"aggregate_id", bson.D{{"$eq", request.AggregateID}}},
+	}
+	cursor, err = r.snapshotCollection().Find(ctx, filter, opts)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return eventsourcing.ForgetPreview{}, faults.Wrap(err)
+	}
+	snaps := []Snapshot{}
+	if err = cursor.All(ctx, &snaps); err != nil {
+		return eventsourcing.ForgetPreview{}, faults.Errorf("Unable to get snapshot for aggregate '%s': %w", request.AggregateID, err)
+	}
+	for _, s := range snaps {
+		id, err := eventid.Parse(s.ID)
+		if err != nil {
+			return eventsourcing.ForgetPreview{}, faults.Errorf("unable to parse snapshot ID '%s': %w", s.ID, err)
+		}
+		preview.SnapshotIDs = append(preview.SnapshotIDs, id)
+	}
+	return preview, nil
+}
+
 func (r *EsRepository) GetLastEventID(ctx context.Context, trailingLag time.Duration, filter store.Filter) (eventid.EventID, error) {
+	if filter.RawCondition != "" {
+		return eventid.Zero, faults.Wrap(store.ErrRawConditionNotSupported)
+	}
 	flt := bson.D{}
 
 	if trailingLag != time.Duration(0) {
 		safetyMargin := time.Now().UTC().Add(-trailingLag)
 		flt = append(flt, bson.E{"created_at", bson.D{{"$lte", safetyMargin}}})
 	}
-	flt = buildFilter(filter, flt)
+	flt = buildFilter("", filter, flt)
 
 	opts := options.FindOne().
 		SetSort(bson.D{{"_id", -1}}).
@@ -389,6 +654,9 @@ func (r *EsRepository) GetLastEventID(ctx context.Context, trailingLag time.Dura
 }
 
 func (r *EsRepository) GetEvents(ctx context.Context, afterEventID eventid.EventID, batchSize int, trailingLag time.Duration, filter store.Filter) ([]eventsourcing.Event, error) {
+	if filter.RawCondition != "" {
+		return nil, faults.Wrap(store.ErrRawConditionNotSupported)
+	}
 	lastMessageID := afterEventID
 	var records []eventsourcing.Event
 	for len(records) < batchSize {
@@ -401,7 +669,7 @@ func (r *EsRepository) GetEvents(ctx context.Context, afterEventID eventid.Event
 			safetyMargin := time.Now().UTC().Add(-trailingLag)
 			flt = append(flt, bson.E{"created_at", bson.D{{"$lte", safetyMargin}}})
 		}
-		flt = buildFilter(filter, flt)
+		flt = buildFilter("", filter, flt)
 
 		opts := options.Find().SetSort(bson.D{{"_id", 1}})
 		if batchSize > 0 {
@@ -410,7 +678,7 @@ func (r *EsRepository) GetEvents(ctx context.Context, afterEventID eventid.Event
 			opts.SetBatchSize(-1)
 		}
 
-		rows, eID, err := r.queryEvents(ctx, flt, opts, lastMessageID)
+		rows, eID, err := r.queryEvents(ctx, flt, opts, lastMessageID, filter.EventKinds)
 		if err != nil {
 			return nil, faults.Errorf("Unable to get events after '%s' for filter %+v: %w", lastMessageID, filter, err)
 		}
@@ -425,23 +693,68 @@ func (r *EsRepository) GetEvents(ctx context.Context, afterEventID eventid.Event
 	return records, nil
 }
 
-func buildFilter(filter store.Filter, flt bson.D) bson.D {
+// buildFilter adds the conditions of the filter to flt. The prefix is prepended to the fields, eg: "fullDocument." for change streams
+func buildFilter(prefix string, filter store.Filter, flt bson.D) bson.D {
+	// inclusions and exclusions of the same field go in the same condition
+	types := bson.D{}
 	if len(filter.AggregateTypes) > 0 {
-		flt = append(flt, bson.E{"aggregate_type", bson.D{{"$in", filter.AggregateTypes}}})
+		types = append(types, bson.E{"$in", filter.AggregateTypes})
+	}
+	if len(filter.ExcludeAggregateTypes) > 0 {
+		types = append(types, bson.E{"$nin", filter.ExcludeAggregateTypes})
+	}
+	if len(types) > 0 {
+		flt = append(flt, bson.E{prefix + "aggregate_type", types})
+	}
+
+	if len(filter.AggregateIDs) > 0 {
+		flt = append(flt, bson.E{prefix + "aggregate_id", bson.D{{"$in", filter.AggregateIDs}}})
+	}
+
+	// a document holds all the events of a save, so the events of other kinds are discarded after reading it
+	if len(filter.EventKinds) > 0 {
+		flt = append(flt, bson.E{prefix + "details.kind", bson.D{{"$in", filter.EventKinds}}})
 	}
 
 	if filter.Partitions > 1 {
-		flt = append(flt, partitionFilter("aggregate_id_hash", filter.Partitions, filter.PartitionLow, filter.PartitionHi))
+		flt = append(flt, partitionFilter(prefix+"aggregate_id_hash", filter.Partitions, filter.PartitionLow, filter.PartitionHi))
 	}
 
 	if len(filter.Metadata) > 0 {
 		for k, v := range filter.Metadata {
-			flt = append(flt, bson.E{"metadata." + k, bson.D{{"$in", v}}})
+			cond := bson.D{{"$in", v}}
+			if excl, ok := filter.ExcludeMetadata[k]; ok {
+				cond = append(cond, bson.E{"$nin", excl})
+			}
+			flt = append(flt, bson.E{prefix + "metadata." + k, cond})
+		}
+	}
+	// $nin also matches the documents without the field
+	for k, v := range filter.ExcludeMetadata {
+		if _, ok := filter.Metadata[k]; ok {
+			continue
 		}
+		flt = append(flt, bson.E{prefix + "metadata." + k, bson.D{{"$nin", v}}})
+	}
+	for _, k := range filter.MetadataExists {
+		flt = append(flt, bson.E{prefix + "metadata." + k, bson.D{{"$exists", true}}})
 	}
 	return flt
 }
 
+// hasKind checks if the kind is one of the kinds. No kinds means any kind.
+func hasKind(kinds []eventsourcing.EventKind, kind eventsourcing.EventKind) bool {
+	if len(kinds) == 0 {
+		return true
+	}
+	for _, k := range kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
 func partitionFilter(field string, partitions, partitionsLow, partitionsHi uint32) bson.E {
 	field = "$" + field
 	// aggregate: { $expr: {"$eq": [{"$mod" : [$field, m.partitions]}],  m.partitionsLow - 1]} }
@@ -485,7 +798,8 @@ func partitionFilter(field string, partitions, partitionsLow, partitionsHi uint3
 	}
 }
 
-func (r *EsRepository) queryEvents(ctx context.Context, filter bson.D, opts *options.FindOptions, afterEventID eventid.EventID) ([]eventsourcing.Event, eventid.EventID, error) {
+// queryEvents reads the events of the documents after afterEventID, keeping only the events of the kinds, if any
+func (r *EsRepository) queryEvents(ctx context.Context, filter bson.D, opts *options.FindOptions, afterEventID eventid.EventID, kinds []eventsourcing.EventKind) ([]eventsourcing.Event, eventid.EventID, error) {
 	cursor, err := r.eventsCollection().Find(ctx, filter, opts)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
@@ -506,7 +820,7 @@ func (r *EsRepository) queryEvents(ctx context.Context, filter bson.D, opts *opt
 	for _, v := range evts {
 		for k, d := range v.Details {
 			// only collect events that are greater than afterEventID-afterCount
-			if v.ID > afterEventIDStr || k > after {
+			if (v.ID > afterEventIDStr || k > after) && hasKind(kinds, d.Kind) {
 				eventID, err := eventid.Parse(v.ID)
 				if err != nil {
 					return nil, eventid.Zero, faults.Errorf("unable to parse message ID '%s': %w", v.ID, err)
@@ -520,9 +834,11 @@ func (r *EsRepository) queryEvents(ctx context.Context, filter bson.D, opts *opt
 					AggregateType:    v.AggregateType,
 					Kind:             d.Kind,
 					Body:             d.Body,
+					ContentType:      v.ContentType,
 					IdempotencyKey:   v.IdempotencyKey,
 					Metadata:         v.Metadata,
 					CreatedAt:        v.CreatedAt,
+					ForgottenAt:      d.ForgottenAt,
 				})
 			}
 		}
@@ -146,10 +146,12 @@ func (f Feed) Feed(ctx context.Context, sinker sink.Sinker) error {
 	return backoff.Retry(func() error {
 		var err error
 		if lastResumePosition.Name == "" {
-			f.logger.Infof("Starting feeding (partitions: [%d-%d]) from the beginning", f.partitionsLow, f.partitionsHi)
+			f.logger.WithTags(log.PartitionTags(f.partitionsLow, f.partitionsHi)).Info("Starting to feed from the beginning")
 			err = c.Run()
 		} else {
-			f.logger.Infof("Starting feeding (partitions: [%d-%d]) from '%s'", f.partitionsLow, f.partitionsHi, lastResumePosition)
+			f.logger.WithTags(log.PartitionTags(f.partitionsLow, f.partitionsHi)).
+				WithTags(log.Tags{"resumePosition": lastResumePosition.String()}).
+				Info("Starting to feed")
 			err = c.RunFrom(lastResumePosition)
 		}
 		if err != nil {
@@ -265,6 +267,7 @@ func (h *binlogHandler) OnRow(e *canal.RowsEvent) error {
 			AggregateType:    eventsourcing.AggregateType(r.getAsString("aggregate_type")),
 			Kind:             eventsourcing.EventKind(r.getAsString("kind")),
 			Body:             r.getAsBytes("body"),
+			ContentType:      r.getAsString("content_type"),
 			IdempotencyKey:   r.getAsString("idempotency_key"),
 			Metadata:         r.getAsMap("metadata"),
 			CreatedAt:        r.getAsTimeDate("created_at"),
@@ -15,7 +15,6 @@ import (
 	"github.com/quintans/faults"
 
 	"github.com/quintans/eventsourcing"
-	"github.com/quintans/eventsourcing/common"
 	"github.com/quintans/eventsourcing/eventid"
 	"github.com/quintans/eventsourcing/store"
 )
@@ -34,9 +33,11 @@ type Event struct {
 	AggregateType    eventsourcing.AggregateType `db:"aggregate_type"`
 	Kind             eventsourcing.EventKind     `db:"kind"`
 	Body             []byte                      `db:"body"`
+	ContentType      NilString                   `db:"content_type"`
 	IdempotencyKey   NilString                   `db:"idempotency_key"`
 	Metadata         []byte                      `db:"metadata"`
 	CreatedAt        time.Time                   `db:"created_at"`
+	ForgottenAt      sql.NullTime                `db:"forgotten_at"`
 }
 
 // NilString converts nil to empty string
@@ -79,9 +80,49 @@ func ProjectorFactoryOption(fn ProjectorFactory) StoreOption {
 	}
 }
 
+// MaxOpenConnsOption sets the maximum number of open connections to the database.
+// The default, zero, is unlimited, which under load may exhaust the connections accepted by the database.
+func MaxOpenConnsOption(n int) StoreOption {
+	return func(r *EsRepository) {
+		r.db.SetMaxOpenConns(n)
+	}
+}
+
+// MaxIdleConnsOption sets the maximum number of idle connections kept in the pool. The default is 2.
+func MaxIdleConnsOption(n int) StoreOption {
+	return func(r *EsRepository) {
+		r.db.SetMaxIdleConns(n)
+	}
+}
+
+// ConnMaxLifetimeOption sets for how long a connection can be reused. The default, zero, is forever.
+func ConnMaxLifetimeOption(d time.Duration) StoreOption {
+	return func(r *EsRepository) {
+		r.db.SetConnMaxLifetime(d)
+	}
+}
+
+// EventIDGeneratorOption sets how the IDs of the events are generated, replacing eventid.Generate.
+// The IDs must have the creation time of the events, since the feeds rely on the IDs being ordered by creation time.
+func EventIDGeneratorOption(generator eventid.Generator) StoreOption {
+	return func(r *EsRepository) {
+		r.idGenerator = generator
+	}
+}
+
+// HashFuncOption sets the function that computes the aggregate ID hash, used to partition the events, replacing eventsourcing.HashAggregateID.
+// eg: eventsourcing.HashLabel("tenant") partitions the events by tenant.
+func HashFuncOption(fn eventsourcing.HashFunc) StoreOption {
+	return func(r *EsRepository) {
+		r.hashFunc = fn
+	}
+}
+
 type EsRepository struct {
 	db               *sqlx.DB
 	projectorFactory ProjectorFactory
+	idGenerator      eventid.Generator
+	hashFunc         eventsourcing.HashFunc
 }
 
 func NewStore(connString string, options ...StoreOption) (*EsRepository, error) {
@@ -92,7 +133,9 @@ func NewStore(connString string, options ...StoreOption) (*EsRepository, error)
 
 	dbx := sqlx.NewDb(db, driverName)
 	r := &EsRepository{
-		db: dbx,
+		db:          dbx,
+		idGenerator: eventid.Generate,
+		hashFunc:    eventsourcing.HashAggregateID,
 	}
 
 	for _, o := range options {
@@ -102,10 +145,28 @@ func NewStore(connString string, options ...StoreOption) (*EsRepository, error)
 	return r, nil
 }
 
+var _ eventsourcing.AggregateHasher = (*EsRepository)(nil)
+
+// AggregateIDHash returns the hash that partitions the events of the aggregate
+func (r *EsRepository) AggregateIDHash(aggregateID string, labels map[string]interface{}) uint32 {
+	return r.hashFunc(aggregateID, labels)
+}
+
 func (r *EsRepository) SaveEvent(ctx context.Context, eRec eventsourcing.EventRecord) (eventid.EventID, uint32, error) {
+	ids, version, err := r.SaveEventIDs(ctx, eRec)
+	if err != nil {
+		return eventid.Zero, 0, err
+	}
+	return ids[len(ids)-1], version, nil
+}
+
+var _ eventsourcing.EventIDsSaver = (*EsRepository)(nil)
+
+// SaveEventIDs saves the events of the record, returning the IDs of all of them
+func (r *EsRepository) SaveEventIDs(ctx context.Context, eRec eventsourcing.EventRecord) ([]eventid.EventID, uint32, error) {
 	metadata, err := json.Marshal(eRec.Labels)
 	if err != nil {
-		return eventid.Zero, 0, faults.Wrap(err)
+		return nil, 0, faults.Wrap(err)
 	}
 
 	var idempotencyKey *string
@@ -114,31 +175,32 @@ func (r *EsRepository) SaveEvent(ctx context.Context, eRec eventsourcing.EventRe
 	}
 
 	version := eRec.Version
-	var id eventid.EventID
+	ids := make([]eventid.EventID, 0, len(eRec.Details))
 	err = r.withTx(ctx, func(c context.Context, tx *sql.Tx) error {
 		var projector store.Projector
 		if r.projectorFactory != nil {
 			projector = r.projectorFactory(tx)
 		}
-		entropy := eventid.EntropyFactory(eRec.CreatedAt)
+		entropy := eventid.NewEntropy()
 		for _, e := range eRec.Details {
-			id, err = eventid.New(eRec.CreatedAt, entropy)
+			id, err := r.idGenerator.New(entropy, eRec.CreatedAt, eRec.AggregateID, version+1)
 			if err != nil {
 				return faults.Wrap(err)
 			}
 			version++
-			hash := common.Hash(eRec.AggregateID)
+			hash := r.hashFunc(eRec.AggregateID, eRec.Labels)
 			_, err = tx.ExecContext(ctx,
-				`INSERT INTO events (id, aggregate_id, aggregate_version, aggregate_type, kind, body, idempotency_key, metadata, created_at, aggregate_id_hash)
-			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-				id.String(), eRec.AggregateID, version, eRec.AggregateType, e.Kind, e.Body, idempotencyKey, metadata, eRec.CreatedAt, int32ring(hash))
+				`INSERT INTO events (id, aggregate_id, aggregate_version, aggregate_type, kind, body, content_type, idempotency_key, metadata, created_at, aggregate_id_hash)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				id.String(), eRec.AggregateID, version, eRec.AggregateType, e.Kind, e.Body, eRec.ContentType, idempotencyKey, metadata, eRec.CreatedAt, int32ring(hash))
 
 			if err != nil {
-				if isDup(err) {
-					return eventsourcing.ErrConcurrentModification
+				if e := dupError(err); e != nil {
+					return e
 				}
 				return faults.Errorf("Unable to insert event: %w", err)
 			}
+			ids = append(ids, id)
 
 			if projector != nil {
 				evt := eventsourcing.Event{
@@ -149,6 +211,7 @@ func (r *EsRepository) SaveEvent(ctx context.Context, eRec eventsourcing.EventRe
 					AggregateType:    eRec.AggregateType,
 					Kind:             e.Kind,
 					Body:             e.Body,
+					ContentType:      eRec.ContentType,
 					Metadata:         eRec.Labels,
 					CreatedAt:        eRec.CreatedAt,
 				}
@@ -156,13 +219,13 @@ func (r *EsRepository) SaveEvent(ctx context.Context, eRec eventsourcing.EventRe
 			}
 		}
 
-		return nil
+		return store.Flush(projector)
 	})
 	if err != nil {
-		return eventid.Zero, 0, err
+		return nil, 0, err
 	}
 
-	return id, version, nil
+	return ids, version, nil
 }
 
 func int32ring(x uint32) int32 {
@@ -176,9 +239,17 @@ func int32ring(x uint32) int32 {
 	return h
 }
 
-func isDup(err error) bool {
+// dupError converts a unique violation into ErrDuplicateIdempotencyKey, if the name of the violated index mentions idempotency,
+// or ErrConcurrentModification otherwise, keeping the database error as the cause. Other errors return nil.
+func dupError(err error) error {
 	me, ok := err.(*mysql.MySQLError)
-	return ok && me.Number == uniqueViolation
+	if !ok || me.Number != uniqueViolation {
+		return nil
+	}
+	if strings.Contains(me.Message, "idempot") {
+		return eventsourcing.WrapCause(eventsourcing.ErrDuplicateIdempotencyKey, me)
+	}
+	return eventsourcing.WrapCause(eventsourcing.ErrConcurrentModification, me)
 }
 
 func (r *EsRepository) GetSnapshot(ctx context.Context, aggregateID string) (eventsourcing.Snapshot, error) {
@@ -219,6 +290,38 @@ func (r *EsRepository) SaveSnapshot(ctx context.Context, snapshot eventsourcing.
 	return faults.Wrap(err)
 }
 
+var _ eventsourcing.SnapshotPruner = (*EsRepository)(nil)
+
+func (r *EsRepository) DeleteSnapshots(ctx context.Context, aggregateID string, keepLast int) error {
+	_, err := r.db.ExecContext(ctx,
+		`DELETE FROM snapshots WHERE id IN (
+			SELECT id FROM (
+				SELECT id, ROW_NUMBER() OVER (ORDER BY aggregate_version DESC) AS pos FROM snapshots WHERE aggregate_id = ?
+			) AS s WHERE pos > ?
+		)`, aggregateID, keepLast)
+	if err != nil {
+		return faults.Errorf("Unable to delete the snapshots of aggregate '%s': %w", aggregateID, err)
+	}
+	return nil
+}
+
+func (r *EsRepository) PruneSnapshots(ctx context.Context, keepLast int) (int64, error) {
+	res, err := r.db.ExecContext(ctx,
+		`DELETE FROM snapshots WHERE id IN (
+			SELECT id FROM (
+				SELECT id, ROW_NUMBER() OVER (PARTITION BY aggregate_id ORDER BY aggregate_version DESC) AS pos FROM snapshots
+			) AS s WHERE pos > ?
+		)`, keepLast)
+	if err != nil {
+		return 0, faults.Errorf("Unable to prune the snapshots: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, faults.Wrap(err)
+	}
+	return n, nil
+}
+
 func (r *EsRepository) GetAggregateEvents(ctx context.Context, aggregateID string, snapVersion int) ([]eventsourcing.Event, error) {
 	var query bytes.Buffer
 	query.WriteString("SELECT * FROM events e WHERE e.aggregate_id = ?")
@@ -267,6 +370,50 @@ func (r *EsRepository) HasIdempotencyKey(ctx context.Context, idempotencyKey str
 	return exists, nil
 }
 
+var _ eventsourcing.AggregateIdempotencyKeyChecker = (*EsRepository)(nil)
+
+// HasAggregateIdempotencyKey checks if the idempotency key was used by the aggregate
+func (r *EsRepository) HasAggregateIdempotencyKey(ctx context.Context, aggregateID, idempotencyKey string) (bool, error) {
+	var exists bool
+	err := r.db.GetContext(ctx, &exists, `SELECT EXISTS(SELECT 1 FROM events WHERE aggregate_id=? AND idempotency_key=?) AS "EXISTS"`, aggregateID, idempotencyKey)
+	if err != nil {
+		return false, faults.Errorf("Unable to verify the existence of the idempotency key for aggregate '%s': %w", aggregateID, err)
+	}
+	return exists, nil
+}
+
+var _ eventsourcing.StatsGetter = (*EsRepository)(nil)
+
+type statsRow struct {
+	AggregateType string          `db:"aggregate_type"`
+	Events        int64           `db:"events"`
+	FirstEventID  eventid.EventID `db:"first_id"`
+	LastEventID   eventid.EventID `db:"last_id"`
+	Oldest        time.Time       `db:"oldest"`
+	Newest        time.Time       `db:"newest"`
+}
+
+func (r *EsRepository) Stats(ctx context.Context) (eventsourcing.StoreStats, error) {
+	rows := []statsRow{}
+	err := r.db.SelectContext(ctx, &rows,
+		`SELECT aggregate_type, COUNT(*) AS events, MIN(id) AS first_id, MAX(id) AS last_id, MIN(created_at) AS oldest, MAX(created_at) AS newest
+		FROM events GROUP BY aggregate_type`)
+	if err != nil {
+		return eventsourcing.StoreStats{}, faults.Errorf("Unable to compute the events statistics: %w", err)
+	}
+	byType := make(map[eventsourcing.AggregateType]eventsourcing.EventsStats, len(rows))
+	for _, row := range rows {
+		byType[eventsourcing.AggregateType(row.AggregateType)] = eventsourcing.EventsStats{
+			Events:       row.Events,
+			FirstEventID: row.FirstEventID,
+			LastEventID:  row.LastEventID,
+			Oldest:       row.Oldest,
+			Newest:       row.Newest,
+		}
+	}
+	return eventsourcing.NewStoreStats(byType), nil
+}
+
 func (r *EsRepository) Forget(ctx context.Context, req eventsourcing.ForgetRequest, forget func(kind string, body []byte) ([]byte, error)) error {
 	// When Forget() is called, the aggregate is no longer used, therefore if it fails, it can be called again.
 
@@ -276,12 +423,13 @@ func (r *EsRepository) Forget(ctx context.Context, req eventsourcing.ForgetReque
 		return faults.Errorf("Unable to get events for Aggregate '%s' and event kind '%s': %w", req.AggregateID, req.EventKind, err)
 	}
 
+	forgottenAt := time.Now().UTC()
 	for _, evt := range events {
 		body, err := forget(evt.Kind.String(), evt.Body)
 		if err != nil {
 			return err
 		}
-		_, err = r.db.ExecContext(ctx, "UPDATE events SET body = ? WHERE ID = ?", body, evt.ID.String())
+		_, err = r.db.ExecContext(ctx, "UPDATE events SET body = ?, forgotten_at = ? WHERE ID = ?", body, forgottenAt, evt.ID.String())
 		if err != nil {
 			return faults.Errorf("Unable to forget event ID %s: %w", evt.ID, err)
 		}
@@ -310,6 +458,24 @@ func (r *EsRepository) Forget(ctx context.Context, req eventsourcing.ForgetReque
 	return nil
 }
 
+var _ eventsourcing.ForgetPreviewer = (*EsRepository)(nil)
+
+func (r *EsRepository) PreviewForget(ctx context.Context, req eventsourcing.ForgetRequest) (eventsourcing.ForgetPreview, error) {
+	preview := eventsourcing.ForgetPreview{
+		EventIDs:    []eventid.EventID{},
+		SnapshotIDs: []eventid.EventID{},
+	}
+	err := r.db.SelectContext(ctx, &preview.EventIDs, "SELECT id FROM events WHERE aggregate_id = ? AND kind = ? ORDER BY id ASC", req.AggregateID, req.EventKind)
+	if err != nil {
+		return eventsourcing.ForgetPreview{}, faults.Errorf("Unable to get events for Aggregate '%s' and event kind '%s': %w", req.AggregateID, req.EventKind, err)
+	}
+	err = r.db.SelectContext(ctx, &preview.SnapshotIDs, "SELECT id FROM snapshots WHERE aggregate_id = ? ORDER BY id ASC", req.AggregateID)
+	if err != nil {
+		return eventsourcing.ForgetPreview{}, faults.Errorf("Unable to get snapshots for aggregate '%s': %w", req.AggregateID, err)
+	}
+	return preview, nil
+}
+
 func (r *EsRepository) GetLastEventID(ctx context.Context, trailingLag time.Duration, filter store.Filter) (eventid.EventID, error) {
 	var query bytes.Buffer
 	query.WriteString("SELECT * FROM events ")
@@ -378,6 +544,41 @@ func buildFilter(filter store.Filter, query *bytes.Buffer, args []interface{}) [
 		}
 		query.WriteString(")")
 	}
+	if len(filter.ExcludeAggregateTypes) > 0 {
+		query.WriteString(" AND aggregate_type NOT IN (")
+		for k, v := range filter.ExcludeAggregateTypes {
+			if k > 0 {
+				query.WriteString(", ")
+			}
+			args = append(args, v)
+			query.WriteString("?")
+		}
+		query.WriteString(")")
+	}
+
+	if len(filter.AggregateIDs) > 0 {
+		query.WriteString(" AND aggregate_id IN (")
+		for k, v := range filter.AggregateIDs {
+			if k > 0 {
+				query.WriteString(", ")
+			}
+			args = append(args, v)
+			query.WriteString("?")
+		}
+		query.WriteString(")")
+	}
+
+	if len(filter.EventKinds) > 0 {
+		query.WriteString(" AND kind IN (")
+		for k, v := range filter.EventKinds {
+			if k > 0 {
+				query.WriteString(", ")
+			}
+			args = append(args, v)
+			query.WriteString("?")
+		}
+		query.WriteString(")")
+	}
 
 	if filter.Partitions > 1 {
 		if filter.PartitionLow == filter.PartitionHi {
@@ -399,9 +600,30 @@ func buildFilter(filter store.Filter, query *bytes.Buffer, args []interface{}) [
 				}
 				v = escape(v)
 				query.WriteString(fmt.Sprintf(`JSON_EXTRACT(metadata, '$.%s') = '%s'`, k, v))
-				query.WriteString(")")
 			}
+			query.WriteString(")")
+		}
+	}
+	// a missing key makes the comparison NULL, so it is turned into false to keep the event
+	for k, values := range filter.ExcludeMetadata {
+		k = escape(k)
+		query.WriteString(" AND NOT COALESCE(")
+		for idx, v := range values {
+			if idx > 0 {
+				query.WriteString(" OR ")
+			}
+			query.WriteString(fmt.Sprintf(`JSON_EXTRACT(metadata, '$.%s') = '%s'`, k, escape(v)))
 		}
+		query.WriteString(", FALSE)")
+	}
+	for _, k := range filter.MetadataExists {
+		query.WriteString(fmt.Sprintf(` AND JSON_CONTAINS_PATH(metadata, 'one', '$.%s')`, escape(k)))
+	}
+	if filter.RawCondition != "" {
+		query.WriteString(" AND (")
+		query.WriteString(filter.RawCondition)
+		query.WriteString(")")
+		args = append(args, filter.RawArgs...)
 	}
 	return args
 }
@@ -443,8 +665,10 @@ func (r *EsRepository) queryEvents(ctx context.Context, query string, args ...in
 			AggregateType:    event.AggregateType,
 			Kind:             event.Kind,
 			Body:             event.Body,
+			ContentType:      string(event.ContentType),
 			Metadata:         metadata,
 			CreatedAt:        event.CreatedAt,
+			ForgottenAt:      event.ForgottenAt.Time,
 		})
 	}
 	return events, nil
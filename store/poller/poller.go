@@ -1,11 +1,11 @@
 package poller
 
 import (
-	"bytes"
 	"context"
 	"time"
 
 	"github.com/quintans/eventsourcing"
+	"github.com/quintans/eventsourcing/common"
 	"github.com/quintans/eventsourcing/eventid"
 	"github.com/quintans/eventsourcing/log"
 	"github.com/quintans/eventsourcing/player"
@@ -26,12 +26,19 @@ type Poller struct {
 	// lag to account for on same millisecond concurrent inserts and clock skews
 	trailingLag    time.Duration
 	aggregateTypes []eventsourcing.AggregateType
+	eventKinds     []eventsourcing.EventKind
 	metadata       store.Metadata
+	metadataExists []string
 	partitions     uint32
 	partitionsLow  uint32
 	partitionsHi   uint32
+	coldStart      store.ColdStart
+	onPosition     PositionCallback
 }
 
+// PositionCallback receives the ID of the last handled event and when it was reached
+type PositionCallback func(lastEventID eventid.EventID, at time.Time)
+
 type Option func(*Poller)
 
 func WithTrailingLag(trailingLag time.Duration) Option {
@@ -40,20 +47,32 @@ func WithTrailingLag(trailingLag time.Duration) Option {
 	}
 }
 
-func WithPollInterval(pollInterval time.Duration) Option {
+// WithInterval sets how long to wait between polls, when the previous poll got to the last event
+func WithInterval(interval time.Duration) Option {
 	return func(p *Poller) {
-		p.pollInterval = pollInterval
+		p.pollInterval = interval
 	}
 }
 
-func WithLimit(limit int) Option {
+// Deprecated: use WithInterval
+func WithPollInterval(pollInterval time.Duration) Option {
+	return WithInterval(pollInterval)
+}
+
+// WithBatchSize sets the maximum number of events read by each query
+func WithBatchSize(size int) Option {
 	return func(p *Poller) {
-		if limit > 0 {
-			p.limit = limit
+		if size > 0 {
+			p.limit = size
 		}
 	}
 }
 
+// Deprecated: use WithBatchSize
+func WithLimit(limit int) Option {
+	return WithBatchSize(limit)
+}
+
 func WithPartitions(partitions, partitionsLow, partitionsHi uint32) Option {
 	return func(p *Poller) {
 		p.partitions = partitions
@@ -68,6 +87,13 @@ func WithAggregateTypes(at ...eventsourcing.AggregateType) Option {
 	}
 }
 
+// WithEventKinds polls only the events of the kinds
+func WithEventKinds(kinds ...eventsourcing.EventKind) Option {
+	return func(f *Poller) {
+		f.eventKinds = kinds
+	}
+}
+
 func WithMetadataKV(key, value string) Option {
 	return func(f *Poller) {
 		if f.metadata == nil {
@@ -89,6 +115,31 @@ func WithMetadata(metadata store.Metadata) Option {
 	}
 }
 
+// WithMetadataExists polls only the events that have the metadata key, whatever the value
+func WithMetadataExists(key string) Option {
+	return func(f *Poller) {
+		f.metadataExists = append(f.metadataExists, key)
+	}
+}
+
+// WithColdStart sets from where Feed starts when the sink has no messages for the partitions of the poller.
+// It defaults to store.StartFromBeginning.
+func WithColdStart(start store.ColdStart) Option {
+	return func(p *Poller) {
+		p.coldStart = start
+	}
+}
+
+// WithPositionCallback reports the position of the poller after every successful poll, even if no events were found,
+// meaning that the poller is caught up, eg: to monitor how far behind the poller is.
+// The callback runs in its own go routine, so that it does not hold back the polling,
+// but it should be quick, since positions reported while it is still running are replaced by the latest one.
+func WithPositionCallback(callback PositionCallback) Option {
+	return func(p *Poller) {
+		p.onPosition = callback
+	}
+}
+
 func New(logger log.Logger, repository player.Repository, options ...Option) Poller {
 	p := Poller{
 		logger:       logger,
@@ -119,30 +170,83 @@ func (p Poller) Poll(ctx context.Context, startOption player.StartOption, handle
 	case player.BEGINNING:
 	case player.SEQUENCE:
 		afterMsgID = startOption.AfterMsgID()
+	case player.PARTITIONS:
+		afterMsgID, handler = p.resumePartitions(startOption.PartitionTokens(), handler)
 	}
 	return p.forward(ctx, afterMsgID, handler)
 }
 
+// resumePartitions returns from where to start polling, the lowest token of the partitions of the poller,
+// and a handler that skips the events already consumed by their partition
+func (p Poller) resumePartitions(tokens map[uint32]eventid.EventID, handler player.EventHandlerFunc) (eventid.EventID, player.EventHandlerFunc) {
+	low, hi := p.partitionsLow, p.partitionsHi
+	if p.partitions <= 1 {
+		low, hi = 0, 0
+	}
+	var after eventid.EventID
+	for i := low; i <= hi; i++ {
+		token, ok := tokens[i]
+		if !ok {
+			// this partition starts from the beginning
+			after = eventid.Zero
+			break
+		}
+		if i == low || token.Compare(after) < 0 {
+			after = token
+		}
+	}
+
+	return after, func(ctx context.Context, e eventsourcing.Event) error {
+		token, ok := tokens[common.WhichPartition(e.AggregateIDHash, p.partitions)]
+		if ok && e.ID.Compare(token) <= 0 {
+			return nil
+		}
+		return handler(ctx, e)
+	}
+}
+
 func (p Poller) forward(ctx context.Context, after eventid.EventID, handler player.EventHandlerFunc) error {
+	logger := p.logger.WithTags(log.PartitionTags(p.partitionsLow, p.partitionsHi))
 	wait := p.pollInterval
 	filters := []store.FilterOption{
 		store.WithAggregateTypes(p.aggregateTypes...),
+		store.WithEventKinds(p.eventKinds...),
 		store.WithMetadata(p.metadata),
 		store.WithPartitions(p.partitions, p.partitionsLow, p.partitionsHi),
 	}
+	for _, k := range p.metadataExists {
+		filters = append(filters, store.WithMetadataExists(k))
+	}
+	// the cursor only advances over the events that were handled, so that a failing event is retried,
+	// and not skipped, and a slow handler holds back the polling
+	handled := after
+	track := func(ctx context.Context, e eventsourcing.Event) error {
+		err := handler(ctx, e)
+		if err != nil {
+			return err
+		}
+		handled = e.ID
+		return nil
+	}
+	report := p.positionReporter(ctx)
 	for {
-		eid, err := p.play.Replay(ctx, handler, after, filters...)
+		eid, err := p.play.Replay(ctx, track, after, filters...)
 		if err != nil {
+			after = handled
 			wait += 2 * wait
 			if wait > maxWait {
 				wait = maxWait
 			}
-			p.logger.WithTags(log.Tags{"backoff": wait}).
+			logger.WithTags(log.Tags{"backoff": wait, log.TagLastEventID: after}).
 				WithError(err).
-				Error("Failure retrieving events. Backing off.")
+				Error("Failure retrieving or handling events. Backing off.")
 		} else {
+			if eid != after {
+				logger.WithTags(log.Tags{log.TagLastEventID: eid}).Debug("Polled events")
+			}
 			after = eid
 			wait = p.pollInterval
+			report(after)
 		}
 
 		t := time.NewTimer(wait)
@@ -155,28 +259,71 @@ func (p Poller) forward(ctx context.Context, after eventid.EventID, handler play
 	}
 }
 
+type position struct {
+	eventID eventid.EventID
+	at      time.Time
+}
+
+// positionReporter returns a function that hands the position to the position callback without blocking.
+// Only the latest position is kept while the callback is busy.
+func (p Poller) positionReporter(ctx context.Context) func(eventid.EventID) {
+	if p.onPosition == nil {
+		return func(eventid.EventID) {}
+	}
+
+	positions := make(chan position, 1)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case pos := <-positions:
+				p.onPosition(pos.eventID, pos.at)
+			}
+		}
+	}()
+
+	return func(eventID eventid.EventID) {
+		pos := position{eventID: eventID, at: time.Now()}
+		// discard the position that was not yet reported
+		select {
+		case <-positions:
+		default:
+		}
+		// this is the only sender, so there is always room after the discard
+		positions <- pos
+	}
+}
+
 // Feed forwars the handling to a sink.
 // eg: a message queue
 func (p Poller) Feed(ctx context.Context, sinker sink.Sinker) error {
-	var afterEventID []byte
+	// each partition resumes from its own last message
+	tokens := map[uint32]eventid.EventID{}
 	err := store.ForEachResumeTokenInSinkPartitions(ctx, sinker, p.partitionsLow, p.partitionsHi, func(message *eventsourcing.Event) error {
-		if bytes.Compare(message.ResumeToken, afterEventID) > 0 {
-			afterEventID = message.ResumeToken
+		eID, err := eventid.Parse(string(message.ResumeToken))
+		if err != nil {
+			return err
 		}
+		tokens[common.WhichPartition(message.AggregateIDHash, p.partitions)] = eID
 		return nil
 	})
 	if err != nil {
 		return err
 	}
 
-	eID, err := eventid.Parse(string(afterEventID))
-	if err != nil {
-		return err
-	}
-
-	p.logger.Info("Starting to feed from event ID: ", afterEventID)
-	return p.forward(ctx, eID, func(ctx context.Context, e eventsourcing.Event) error {
+	afterEventID, handler := p.resumePartitions(tokens, func(ctx context.Context, e eventsourcing.Event) error {
 		e.ResumeToken = []byte(e.ID.String())
 		return sinker.Sink(ctx, e)
 	})
+	if len(tokens) == 0 && p.coldStart == store.StartFromNow {
+		afterEventID, err = p.store.GetLastEventID(ctx, 0, store.Filter{})
+		if err != nil {
+			return err
+		}
+	}
+	p.logger.WithTags(log.PartitionTags(p.partitionsLow, p.partitionsHi)).
+		WithTags(log.Tags{log.TagLastEventID: afterEventID}).
+		Info("Starting to feed")
+	return p.forward(ctx, afterEventID, handler)
 }
@@ -0,0 +1,190 @@
+package poller_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/quintans/eventsourcing"
+	"github.com/quintans/eventsourcing/common"
+	"github.com/quintans/eventsourcing/eventid"
+	"github.com/quintans/eventsourcing/log"
+	"github.com/quintans/eventsourcing/player"
+	"github.com/quintans/eventsourcing/store"
+	"github.com/quintans/eventsourcing/store/inmem"
+	"github.com/quintans/eventsourcing/store/poller"
+	"github.com/quintans/eventsourcing/test"
+)
+
+func TestPollRetriesFailedEvent(t *testing.T) {
+	ctx := context.Background()
+	r := inmem.NewStore()
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{})
+
+	acc := test.CreateAccount("Paulo", uuid.New(), 100)
+	acc.Deposit(10)
+	acc.Withdraw(20)
+	err := es.Save(ctx, acc)
+	require.NoError(t, err)
+
+	p := poller.New(log.NopLogger{}, r,
+		poller.WithBatchSize(2),
+		poller.WithInterval(time.Millisecond),
+		poller.WithTrailingLag(0),
+	)
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	var mu sync.Mutex
+	var kinds []string
+	failed := false
+	err = p.Poll(ctx, player.StartBeginning(), func(ctx context.Context, e eventsourcing.Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if e.Kind == "MoneyDeposited" && !failed {
+			failed = true
+			return errors.New("handler failure")
+		}
+		kinds = append(kinds, e.Kind.String())
+		if len(kinds) == 3 {
+			cancel()
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"AccountCreated", "MoneyDeposited", "MoneyWithdrawn"}, kinds)
+}
+
+func TestPollFromPartitionTokens(t *testing.T) {
+	ctx := context.Background()
+	r := inmem.NewStore()
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{})
+
+	// accounts until both partitions have two of them
+	byPartition := map[uint32][]string{}
+	for len(byPartition[1]) < 2 || len(byPartition[2]) < 2 {
+		id := uuid.New()
+		err := es.Save(ctx, test.CreateAccount("Paulo", id, 100))
+		require.NoError(t, err)
+		part := common.WhichPartition(common.Hash(id.String()), 2)
+		byPartition[part] = append(byPartition[part], id.String())
+	}
+	events, err := r.GetEvents(ctx, eventid.Zero, 0, 0, store.Filter{})
+	require.NoError(t, err)
+
+	// partition 1 consumed its lowest event and partition 2 consumed nothing
+	var consumed eventsourcing.Event
+	for _, e := range events {
+		if common.WhichPartition(common.Hash(e.AggregateID), 2) != 1 {
+			continue
+		}
+		if consumed.ID.IsZero() || e.ID.Compare(consumed.ID) < 0 {
+			consumed = e
+		}
+	}
+	token := consumed.ID
+	var expected []string
+	for _, e := range events {
+		if e.ID != token {
+			expected = append(expected, e.AggregateID)
+		}
+	}
+
+	p := poller.New(log.NopLogger{}, r,
+		poller.WithPartitions(2, 1, 2),
+		poller.WithInterval(time.Millisecond),
+		poller.WithTrailingLag(0),
+	)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	var ids []string
+	err = p.Poll(ctx, player.StartAtPartitions(map[uint32]eventid.EventID{1: token}), func(ctx context.Context, e eventsourcing.Event) error {
+		ids = append(ids, e.AggregateID)
+		if len(ids) == len(expected) {
+			cancel()
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	// partitions are polled independently
+	assert.ElementsMatch(t, expected, ids)
+}
+
+func TestFeedColdStartFromNow(t *testing.T) {
+	ctx := context.Background()
+	r := inmem.NewStore()
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{})
+
+	err := es.Save(ctx, test.CreateAccount("Paulo", uuid.New(), 100))
+	require.NoError(t, err)
+
+	p := poller.New(log.NopLogger{}, r,
+		poller.WithInterval(time.Millisecond),
+		poller.WithTrailingLag(0),
+		poller.WithColdStart(store.StartFromNow),
+	)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	sinker := test.NewMockSink(1)
+	done := make(chan error, 1)
+	go func() {
+		done <- p.Feed(ctx, sinker)
+	}()
+	// the feed starts after the existing event
+	time.Sleep(100 * time.Millisecond)
+
+	id := uuid.New()
+	err = es.Save(ctx, test.CreateAccount("Pereira", id, 100))
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return len(sinker.GetEvents()) > 0
+	}, time.Second, 10*time.Millisecond)
+	cancel()
+	require.NoError(t, <-done)
+
+	events := sinker.GetEvents()
+	require.Len(t, events, 1)
+	assert.Equal(t, id.String(), events[0].AggregateID)
+}
+
+func TestPositionCallback(t *testing.T) {
+	ctx := context.Background()
+	r := inmem.NewStore()
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{})
+
+	acc := test.CreateAccount("Paulo", uuid.New(), 100)
+	acc.Deposit(10)
+	err := es.Save(ctx, acc)
+	require.NoError(t, err)
+	events, err := r.GetEvents(ctx, eventid.Zero, 0, 0, store.Filter{})
+	require.NoError(t, err)
+	last := events[len(events)-1].ID
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	p := poller.New(log.NopLogger{}, r,
+		poller.WithInterval(time.Millisecond),
+		poller.WithTrailingLag(0),
+		poller.WithPositionCallback(func(lastEventID eventid.EventID, at time.Time) {
+			// reported even when caught up
+			if lastEventID == last {
+				cancel()
+			}
+		}),
+	)
+	err = p.Poll(ctx, player.StartBeginning(), func(ctx context.Context, e eventsourcing.Event) error {
+		return nil
+	})
+	require.NoError(t, err)
+	require.True(t, errors.Is(ctx.Err(), context.Canceled))
+}
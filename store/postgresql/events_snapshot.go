@@ -0,0 +1,80 @@
+package postgresql
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/quintans/faults"
+
+	"github.com/quintans/eventsourcing"
+	"github.com/quintans/eventsourcing/eventid"
+	"github.com/quintans/eventsourcing/store"
+)
+
+// EventsSnapshot is a frozen, point in time, view of the events.
+// Events saved after the view was taken are not visible, no matter how long the scan takes.
+//
+// The view is kept by a read only REPEATABLE READ transaction.
+// Postgres MVCC means that no locks are held, so writers are never blocked,
+// but while the transaction is open, vacuum is unable to clean up the row versions that are still visible to it,
+// so long scans over a busy database will cause table bloat.
+// The transaction also holds a connection from the pool until Close is called.
+type EventsSnapshot struct {
+	tx       *sqlx.Tx
+	tenantID string
+	filter   store.Filter
+	after    eventid.EventID
+}
+
+// GetEventsSnapshot starts a point in time view over the events matching the filter.
+// Close must always be called when done.
+func (r *EsRepository) GetEventsSnapshot(ctx context.Context, filter store.Filter) (*EventsSnapshot, error) {
+	tenantID, err := r.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := r.db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelRepeatableRead,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		return nil, faults.Errorf("Unable to start the events snapshot: %w", err)
+	}
+
+	return &EventsSnapshot{
+		tx:       tx,
+		tenantID: tenantID,
+		filter:   filter,
+	}, nil
+}
+
+// Next returns the next batch of events, in ID order. An empty batch means that there are no more events.
+func (s *EventsSnapshot) Next(ctx context.Context, batchSize int) ([]eventsourcing.Event, error) {
+	var query bytes.Buffer
+	query.WriteString("SELECT * FROM events WHERE id > $1 ")
+	args := []interface{}{s.after.String()}
+	args = tenantFilter(s.tenantID, &query, args)
+	args = buildFilter(s.filter, &query, args)
+	query.WriteString(" ORDER BY id ASC")
+	if batchSize > 0 {
+		query.WriteString(" LIMIT ")
+		query.WriteString(strconv.Itoa(batchSize))
+	}
+
+	events, err := queryEvents(ctx, s.tx, query.String(), args...)
+	if err != nil {
+		return nil, faults.Errorf("Unable to get events after '%s' from snapshot: %w", s.after, err)
+	}
+	if len(events) > 0 {
+		s.after = events[len(events)-1].ID
+	}
+	return events, nil
+}
+
+// Close releases the snapshot
+func (s *EventsSnapshot) Close() error {
+	return faults.Wrap(s.tx.Rollback())
+}
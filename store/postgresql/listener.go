@@ -1,10 +1,8 @@
 package postgresql
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
-	"errors"
 	"strings"
 	"time"
 
@@ -30,9 +28,12 @@ type FeedEvent struct {
 	AggregateType    eventsourcing.AggregateType `json:"aggregate_type,omitempty"`
 	Kind             eventsourcing.EventKind     `json:"kind,omitempty"`
 	Body             encoding.Json               `json:"body,omitempty"`
+	ContentType      string                      `json:"content_type,omitempty"`
 	IdempotencyKey   string                      `json:"idempotency_key,omitempty"`
 	Metadata         encoding.Json               `json:"metadata,omitempty"`
 	CreatedAt        PgTime                      `json:"created_at,omitempty"`
+	EventVersion     uint16                      `json:"event_version,omitempty"`
+	TenantID         string                      `json:"tenant_id,omitempty"`
 }
 
 type PgTime time.Time
@@ -53,18 +54,21 @@ func (pgt *PgTime) UnmarshalJSON(b []byte) error {
 }
 
 type Feed struct {
-	logger         log.Logger
-	play           player.Player
-	repository     player.Repository
-	limit          int
-	dbURL          string
-	offset         time.Duration
-	channel        string
-	aggregateTypes []eventsourcing.AggregateType
-	metadata       store.Metadata
-	partitions     uint32
-	partitionsLow  uint32
-	partitionsHi   uint32
+	logger        log.Logger
+	play          player.Player
+	repository    player.Repository
+	limit         int
+	dbURL         string
+	offset        time.Duration
+	channel       string
+	filter        store.Filter
+	partitions    uint32
+	partitionsLow uint32
+	partitionsHi  uint32
+	coldStart     store.ColdStart
+
+	reconnectInitial time.Duration
+	reconnectMax     time.Duration
 }
 
 type FeedOption func(*Feed)
@@ -94,6 +98,34 @@ func WithPartitions(partitions, partitionsLow, partitionsHi uint32) FeedOption {
 	}
 }
 
+// WithColdStart sets from where to start when the sink has no messages for the partitions of the feed.
+// It defaults to store.StartFromBeginning.
+func WithColdStart(start store.ColdStart) FeedOption {
+	return func(p *Feed) {
+		p.coldStart = start
+	}
+}
+
+// WithReconnectBackoff sets the interval to wait before the first reconnection, when the connection is lost,
+// and the maximum interval that it grows to, exponentially and with jitter, while the reconnections fail.
+func WithReconnectBackoff(initial, max time.Duration) FeedOption {
+	return func(p *Feed) {
+		p.reconnectInitial = initial
+		p.reconnectMax = max
+	}
+}
+
+// WithFeedFilter only feeds the events passing the filter.
+// The filter is applied in the queries replaying the events, and in memory to the notified events,
+// where a raw condition is not evaluated.
+func WithFeedFilter(filters ...store.FilterOption) FeedOption {
+	return func(p *Feed) {
+		for _, f := range filters {
+			f(&p.filter)
+		}
+	}
+}
+
 // NewFeedListenNotify instantiates a new PgListener.
 // important:repo should NOT implement lag
 func NewFeedListenNotify(logger log.Logger, connString string, repository player.Repository, channel string, options ...FeedOption) Feed {
@@ -104,6 +136,9 @@ func NewFeedListenNotify(logger log.Logger, connString string, repository player
 		repository: repository,
 		dbURL:      connString,
 		channel:    channel,
+
+		reconnectInitial: backoff.DefaultInitialInterval,
+		reconnectMax:     backoff.DefaultMaxInterval,
 	}
 
 	for _, o := range options {
@@ -115,19 +150,21 @@ func NewFeedListenNotify(logger log.Logger, connString string, repository player
 	return p
 }
 
-// Feed will forward messages to the sinker
+// Feed will forward messages to the sinker.
+// Each partition resumes after its own last message in the sink, so that restarting one partition doesn't rewind the others.
+// If the connection is lost, eg: on a database failover, it reconnects with an exponential backoff, with jitter,
+// and resumes after the last event forwarded. It only returns when the context is cancelled.
 // important: sinker.LastMessage should implement lag
 func (p Feed) Feed(ctx context.Context, sinker sink.Sinker) error {
-	afterEventID := []byte{}
-	err := store.ForEachResumeTokenInSinkPartitions(ctx, sinker, p.partitionsLow, p.partitionsHi, func(message *eventsourcing.Event) error {
-		if bytes.Compare(message.ResumeToken, afterEventID) > 0 {
-			afterEventID = message.ResumeToken
-		}
-		return nil
-	})
+	tokens, err := store.LastEventIDsInSink(ctx, sinker, p.partitionsLow, p.partitionsHi)
 	if err != nil {
 		return err
 	}
+	tokens, err = p.coldStartTokens(ctx, tokens)
+	if err != nil {
+		return err
+	}
+	lastID := p.resumeAfter(tokens)
 
 	pool, err := pgxpool.Connect(context.Background(), p.dbURL)
 	if err != nil {
@@ -135,27 +172,89 @@ func (p Feed) Feed(ctx context.Context, sinker sink.Sinker) error {
 	}
 	defer pool.Close()
 
-	p.logger.Info("Starting to feed from event ID:", afterEventID)
+	logger := p.logger.WithTags(log.PartitionTags(p.partitionsLow, p.partitionsHi))
+	logger.WithTags(log.Tags{log.TagLastEventID: lastID}).Info("Starting to feed")
 
-	// TODO should be configured
 	b := backoff.NewExponentialBackOff()
-	b.MaxElapsedTime = 10 * time.Second
+	b.InitialInterval = p.reconnectInitial
+	b.MaxInterval = p.reconnectMax
+	// never gives up
+	b.MaxElapsedTime = 0
 
-	lastID, err := eventid.Parse(string(afterEventID))
-	if err != nil {
+	sinked := p.sinked(tokens)
+	err = backoff.RetryNotify(func() error {
+		var err error
+		lastID, err = p.forward(ctx, logger, pool, lastID, sinked, sinker, b)
 		return err
+	}, backoff.WithContext(b, ctx), func(err error, wait time.Duration) {
+		logger.WithTags(log.Tags{"backoff": wait, log.TagLastEventID: lastID}).
+			WithError(err).
+			Warn("Failure feeding from PostgreSQL notifications. Reconnecting.")
+	})
+	if ctx.Err() != nil {
+		return nil
 	}
-	return backoff.Retry(func() error {
-		var err error
-		lastID, err = p.forward(ctx, pool, lastID, sinker, b)
-		if errors.Is(err, context.Canceled) {
-			return backoff.Permanent(err)
+	return err
+}
+
+// coldStartTokens positions the partitions of the feed without messages in the sink at the last event ID, for store.StartFromNow.
+// Otherwise they are left without a position, so that they start from the beginning, backfilling their own history,
+// while the events of the other partitions, up to their own position, are skipped.
+func (p Feed) coldStartTokens(ctx context.Context, tokens map[uint32]eventid.EventID) (map[uint32]eventid.EventID, error) {
+	if p.coldStart != store.StartFromNow {
+		return tokens, nil
+	}
+	last, err := p.repository.GetLastEventID(ctx, 0, store.Filter{})
+	if err != nil {
+		return nil, faults.Errorf("Unable to get the last event ID to start from: %w", err)
+	}
+
+	positioned := make(map[uint32]eventid.EventID, len(tokens))
+	for i := p.partitionsLow; i <= p.partitionsHi; i++ {
+		token, ok := tokens[i]
+		if !ok {
+			token = last
 		}
-		return err
-	}, b)
+		positioned[i] = token
+	}
+	return positioned, nil
 }
 
-func (p Feed) forward(ctx context.Context, pool *pgxpool.Pool, afterEventID eventid.EventID, sinker sink.Sinker, b backoff.BackOff) (eventid.EventID, error) {
+// resumeAfter returns the lowest event ID of the partitions of the feed, from where all of them can be resumed,
+// or a zero event ID if a partition has no position
+func (p Feed) resumeAfter(tokens map[uint32]eventid.EventID) eventid.EventID {
+	var after eventid.EventID
+	for i := p.partitionsLow; i <= p.partitionsHi; i++ {
+		token, ok := tokens[i]
+		if !ok {
+			return eventid.Zero
+		}
+		if i == p.partitionsLow || token.Compare(after) < 0 {
+			after = token
+		}
+	}
+	return after
+}
+
+// sinked returns a function telling if an event was already sinked, according to the last event ID of its partition in the sink
+func (p Feed) sinked(tokens map[uint32]eventid.EventID) func(eventsourcing.Event) bool {
+	return func(e eventsourcing.Event) bool {
+		token, ok := tokens[common.WhichPartition(e.AggregateIDHash, p.partitions)]
+		return ok && e.ID.Compare(token) <= 0
+	}
+}
+
+// forward replays the events missed since afterEventID and then forwards the notified events.
+// It returns the ID of the last event that was forwarded, or skipped, so that a retry resumes after it.
+func (p Feed) forward(
+	ctx context.Context,
+	logger log.Logger,
+	pool *pgxpool.Pool,
+	afterEventID eventid.EventID,
+	sinked func(eventsourcing.Event) bool,
+	sinker sink.Sinker,
+	b backoff.BackOff,
+) (eventid.EventID, error) {
 	lastID := afterEventID
 	conn, err := pool.Acquire(ctx)
 	if err != nil {
@@ -169,16 +268,28 @@ func (p Feed) forward(ctx context.Context, pool *pgxpool.Pool, afterEventID even
 		return lastID, faults.Errorf("Error listening to %s channel: %w", p.channel, err)
 	}
 
-	// replay events applying a safety margin, in case we missed events
-	lastID = lastID.OffsetTime(-p.offset)
+	// replay events applying a safety margin, in case we missed events,
+	// but without sinking again the events up to where we left off
+	resumeID := lastID
+	replayID := lastID.OffsetTime(-p.offset)
 
-	p.logger.Infof("Replaying events from %s", lastID)
+	logger.WithTags(log.Tags{log.TagLastEventID: lastID}).Info("Replaying events")
 	filters := []store.FilterOption{
-		store.WithAggregateTypes(p.aggregateTypes...),
-		store.WithMetadata(p.metadata),
+		store.WithFilter(p.filter),
 		store.WithPartitions(p.partitions, p.partitionsLow, p.partitionsHi),
 	}
-	lastID, err = p.play.Replay(ctx, sinker.Sink, lastID, filters...)
+	sinkResumable := resumable(sinker, resumeID, sinked)
+	handler := func(ctx context.Context, e eventsourcing.Event) error {
+		err := sinkResumable(ctx, e)
+		if err != nil {
+			return err
+		}
+		if e.ID.Compare(lastID) > 0 {
+			lastID = e.ID
+		}
+		return nil
+	}
+	replayID, err = p.play.Replay(ctx, handler, replayID, filters...)
 	if err != nil {
 		return lastID, faults.Errorf("Error replaying events: %w", err)
 	}
@@ -186,46 +297,66 @@ func (p Feed) forward(ctx context.Context, pool *pgxpool.Pool, afterEventID even
 	for _, f := range filters {
 		f(&filter)
 	}
-	// remaining records due to the safety margin
-	events, err := p.repository.GetEvents(ctx, lastID, 0, p.offset, filter)
+	// remaining records due to the safety margin.
+	// Since the events committed after the LISTEN are notified, only the ones before it have to be read, without lag.
+	events, err := p.repository.GetEvents(ctx, replayID, 0, 0, filter)
 	if err != nil {
 		return lastID, faults.Errorf("Error getting all events events: %w", err)
 	}
 	for _, event := range events {
-		err = sinker.Sink(ctx, event)
+		err = handler(ctx, event)
 		if err != nil {
-			return lastID, faults.Errorf("Error handling event %+v: %w", event, backoff.Permanent(err))
+			return lastID, faults.Errorf("Error handling event %+v: %w", event, err)
 		}
-		lastID = event.ID
 	}
 
-	return p.listen(ctx, conn, lastID, sinker, b)
+	return p.listen(ctx, logger, conn, lastID, sinked, sinker, b)
 }
 
-func (p Feed) listen(ctx context.Context, conn *pgxpool.Conn, thresholdID eventid.EventID, sinker sink.Sinker, b backoff.BackOff) (lastID eventid.EventID, err error) {
+// resumable sets the event ID as the resume token of the replayed events, like the notified ones,
+// so that the feed resumes exactly after the last event in the sink.
+// Events up to resumeID, or already sinked in their partition, are skipped.
+func resumable(sinker sink.Sinker, resumeID eventid.EventID, sinked func(eventsourcing.Event) bool) func(context.Context, eventsourcing.Event) error {
+	return func(ctx context.Context, e eventsourcing.Event) error {
+		if e.ID.Compare(resumeID) <= 0 || sinked(e) {
+			return nil
+		}
+		e.ResumeToken = []byte(e.ID.String())
+		return sinker.Sink(ctx, e)
+	}
+}
+
+// listen forwards the notified events after thresholdID, returning the ID of the last event that was forwarded, or skipped
+func (p Feed) listen(
+	ctx context.Context,
+	logger log.Logger,
+	conn *pgxpool.Conn,
+	thresholdID eventid.EventID,
+	sinked func(eventsourcing.Event) bool,
+	sinker sink.Sinker,
+	b backoff.BackOff,
+) (eventid.EventID, error) {
 	defer conn.Release()
 
-	p.logger.Infof("Listening for PostgreSQL notifications on channel %s starting at %s", p.channel, thresholdID)
+	lastID := thresholdID
+	logger.WithTags(log.Tags{"channel": p.channel, log.TagLastEventID: thresholdID}).Info("Listening for PostgreSQL notifications")
 	for {
 		msg, err := conn.Conn().WaitForNotification(ctx)
-		select {
-		case <-ctx.Done():
-			return lastID, backoff.Permanent(context.Canceled)
-		default:
-			if err != nil {
-				return lastID, faults.Errorf("Error waiting for notification: %w", err)
+		if err != nil {
+			if ctx.Err() != nil {
+				return lastID, backoff.Permanent(ctx.Err())
 			}
+			return lastID, faults.Errorf("Error waiting for notification: %w", err)
 		}
 
 		// the event is JSON encoded
 		pgEvent := FeedEvent{}
 		err = json.Unmarshal([]byte(msg.Payload), &pgEvent)
 		if err != nil {
-			return eventid.Zero, faults.Errorf("error unmarshalling Postgresql Event: %w", backoff.Permanent(err))
+			return lastID, faults.Errorf("error unmarshalling Postgresql Event: %w", err)
 		}
-		lastID = pgEvent.ID
 
-		if pgEvent.ID.Compare(thresholdID) <= 0 {
+		if pgEvent.ID.Compare(lastID) <= 0 {
 			// ignore events already handled
 			continue
 		}
@@ -233,13 +364,14 @@ func (p Feed) listen(ctx context.Context, conn *pgxpool.Conn, thresholdID eventi
 		// check if the event is to be forwarded to the sinker
 		part := common.WhichPartition(pgEvent.AggregateIDHash, p.partitions)
 		if part < p.partitionsLow || part > p.partitionsHi {
+			lastID = pgEvent.ID
 			continue
 		}
 
 		metadata := map[string]interface{}{}
 		err = json.Unmarshal(pgEvent.Metadata, &metadata)
 		if err != nil {
-			return eventid.Zero, faults.Errorf("Unable unmarshal metadata to map: %w", backoff.Permanent(err))
+			return lastID, faults.Errorf("Unable unmarshal metadata to map: %w", err)
 		}
 		event := eventsourcing.Event{
 			ID:               pgEvent.ID,
@@ -250,16 +382,22 @@ func (p Feed) listen(ctx context.Context, conn *pgxpool.Conn, thresholdID eventi
 			AggregateType:    pgEvent.AggregateType,
 			Kind:             pgEvent.Kind,
 			Body:             []byte(pgEvent.Body),
+			ContentType:      pgEvent.ContentType,
 			IdempotencyKey:   pgEvent.IdempotencyKey,
 			Metadata:         metadata,
 			CreatedAt:        time.Time(pgEvent.CreatedAt),
+			TenantID:         pgEvent.TenantID,
+			EventVersion:     pgEvent.EventVersion,
 		}
-
-		err = sinker.Sink(ctx, event)
-		if err != nil {
-			return eventid.Zero, faults.Errorf("Error handling event %+v: %w", event, backoff.Permanent(err))
+		if p.filter.Matches(event) && !sinked(event) {
+			err = sinker.Sink(ctx, event)
+			if err != nil {
+				return lastID, faults.Errorf("Error handling event %+v: %w", event, err)
+			}
 		}
+		lastID = pgEvent.ID
 
+		// the connection is healthy
 		b.Reset()
 	}
 }
@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"strconv"
 	"time"
 
@@ -20,6 +19,7 @@ import (
 	"github.com/quintans/eventsourcing"
 	"github.com/quintans/eventsourcing/common"
 	"github.com/quintans/eventsourcing/eventid"
+	"github.com/quintans/eventsourcing/log"
 	"github.com/quintans/eventsourcing/sink"
 	"github.com/quintans/eventsourcing/store"
 )
@@ -48,6 +48,13 @@ func WithPublication(publicationName string) FeedLogreplOption {
 	}
 }
 
+// WithLogRepLogger sets the logger of the feed. By default nothing is logged.
+func WithLogRepLogger(logger log.Logger) FeedLogreplOption {
+	return func(p *FeedLogrepl) {
+		p.logger = logger
+	}
+}
+
 func WithBackoffMaxElapsedTime(duration time.Duration) FeedLogreplOption {
 	return func(p *FeedLogrepl) {
 		p.backoffMaxElapsedTime = duration
@@ -55,6 +62,7 @@ func WithBackoffMaxElapsedTime(duration time.Duration) FeedLogreplOption {
 }
 
 type FeedLogrepl struct {
+	logger                log.Logger
 	dburl                 string
 	partitions            uint32
 	partitionsLow         uint32
@@ -65,7 +73,8 @@ type FeedLogrepl struct {
 	backoffMaxElapsedTime time.Duration
 }
 
-// NewFeed creates a new Postgresql 10+ logic replication feed.
+// NewFeed creates a new Postgresql 10+ logic replication feed, decoding the inserts into the events table from the pgoutput stream.
+// Unlike the listen/notify feed, it does not depend on triggers and it resumes from the WAL position (LSN) of the last message in the sink.
 // slotIndex is the index of this feed in a group of feeds. Its value should be between 1 and totalSlots.
 // slotIndex=1 has a special maintenance behaviour of dropping any slot above totalSlots.
 func NewFeed(connString string, slotIndex, totalSlots int, options ...FeedLogreplOption) (FeedLogrepl, error) {
@@ -73,6 +82,7 @@ func NewFeed(connString string, slotIndex, totalSlots int, options ...FeedLogrep
 		return FeedLogrepl{}, faults.Errorf("slotIndex must be between 1 and %d, got %d", totalSlots, slotIndex)
 	}
 	f := FeedLogrepl{
+		logger:                log.NopLogger{},
 		dburl:                 connString,
 		publicationName:       defaultSlotName,
 		slotIndex:             slotIndex,
@@ -87,6 +97,11 @@ func NewFeed(connString string, slotIndex, totalSlots int, options ...FeedLogrep
 	return f, nil
 }
 
+// NewFeedReplication creates a logical replication feed, the alternative to NewFeedListenNotify that doesn't depend on triggers. See NewFeed.
+func NewFeedReplication(connString string, slotIndex, totalSlots int, options ...FeedLogreplOption) (FeedLogrepl, error) {
+	return NewFeed(connString, slotIndex, totalSlots, options...)
+}
+
 // Feed listens to replication logs and pushes them to sinker
 // https://github.com/jackc/pglogrepl/blob/master/example/pglogrepl_demo/main.go
 func (f FeedLogrepl) Feed(ctx context.Context, sinker sink.Sinker) error {
@@ -113,17 +128,17 @@ func (f FeedLogrepl) Feed(ctx context.Context, sinker sink.Sinker) error {
 
 	listSlots, err := f.listReplicationSlot(ctx, conn)
 	if err != nil {
-		faults.Errorf("listReplicationSlot failed: %w", err)
+		return faults.Errorf("listReplicationSlot failed: %w", err)
 	}
 	if err := f.dropSlotsInExcess(ctx, conn, listSlots); err != nil {
-		faults.Errorf("dropSlotsInExcess failed: %w", err)
+		return faults.Errorf("dropSlotsInExcess failed: %w", err)
 	}
 
 	slotName := f.publicationName + "_" + strconv.Itoa(f.slotIndex)
 	if !listSlots[slotName] {
 		_, err = pglogrepl.CreateReplicationSlot(ctx, conn, slotName, outputPlugin, pglogrepl.CreateReplicationSlotOptions{Temporary: false})
 		if err != nil {
-			faults.Errorf("CreateReplicationSlot failed: %w", err)
+			return faults.Errorf("CreateReplicationSlot failed: %w", err)
 		}
 	}
 
@@ -132,6 +147,10 @@ func (f FeedLogrepl) Feed(ctx context.Context, sinker sink.Sinker) error {
 		return faults.Errorf("StartReplication failed: %w", err)
 	}
 
+	f.logger.WithTags(log.PartitionTags(f.partitionsLow, f.partitionsHi)).
+		WithTags(log.Tags{"slot": slotName, "lsn": lastResumeToken.String()}).
+		Info("Starting to feed")
+
 	clientXLogPos := lastResumeToken
 	standbyMessageTimeout := time.Second * 10
 	nextStandbyMessageDeadline := time.Now().Add(standbyMessageTimeout)
@@ -200,7 +219,7 @@ func (f FeedLogrepl) Feed(ctx context.Context, sinker sink.Sinker) error {
 					}
 				}
 			default:
-				log.Printf("Received unexpected message: %#v\n", msg)
+				f.logger.Warnf("Received unexpected message: %#v", msg)
 			}
 
 			b.Reset()
@@ -248,9 +267,12 @@ func (f FeedLogrepl) parse(set *pgoutput.RelationSet, WALData []byte, skip bool)
 		var aggregateType string
 		var kind string
 		body := []byte{}
+		var contentType string
 		var idempotencyKey string
 		var metadata string
 		var createdAt time.Time
+		var eventVersion int16
+		var tenantID string
 		err = extract(values, map[string]interface{}{
 			"id":                &id,
 			"aggregate_id":      &aggregateID,
@@ -258,9 +280,12 @@ func (f FeedLogrepl) parse(set *pgoutput.RelationSet, WALData []byte, skip bool)
 			"aggregate_type":    &aggregateType,
 			"kind":              &kind,
 			"body":              &body,
+			"content_type":      &contentType,
 			"idempotency_key":   &idempotencyKey,
 			"metadata":          &metadata,
 			"created_at":        &createdAt,
+			"event_version":     &eventVersion,
+			"tenant_id":         &tenantID,
 		})
 		if err != nil {
 			return nil, faults.Wrap(err)
@@ -278,8 +303,11 @@ func (f FeedLogrepl) parse(set *pgoutput.RelationSet, WALData []byte, skip bool)
 			AggregateType:    eventsourcing.AggregateType(aggregateType),
 			Kind:             eventsourcing.EventKind(kind),
 			Body:             body,
+			ContentType:      contentType,
 			IdempotencyKey:   idempotencyKey,
 			CreatedAt:        createdAt,
+			TenantID:         tenantID,
+			EventVersion:     uint16(eventVersion),
 		}
 
 		if metadata != "" {
@@ -298,7 +326,7 @@ func (f FeedLogrepl) parse(set *pgoutput.RelationSet, WALData []byte, skip bool)
 func extract(values map[string]pgtype.Value, targets map[string]interface{}) error {
 	for k, v := range targets {
 		val := values[k]
-		if val.Get() == nil {
+		if val == nil || val.Get() == nil {
 			continue
 		}
 		err := val.AssignTo(v)
@@ -0,0 +1,62 @@
+package postgresql
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/quintans/eventsourcing"
+	"github.com/quintans/eventsourcing/eventid"
+	"github.com/quintans/eventsourcing/store"
+)
+
+type lastEventIDRepository struct {
+	lastID eventid.EventID
+}
+
+func (r lastEventIDRepository) GetLastEventID(context.Context, time.Duration, store.Filter) (eventid.EventID, error) {
+	return r.lastID, nil
+}
+
+func (r lastEventIDRepository) GetEvents(context.Context, eventid.EventID, int, time.Duration, store.Filter) ([]eventsourcing.Event, error) {
+	return nil, nil
+}
+
+func TestResumeWithEmptyPartition(t *testing.T) {
+	now := time.Now()
+	older, err := eventid.New(now.Add(-time.Hour), eventid.EntropyFactory(now))
+	require.NoError(t, err)
+	newer, err := eventid.New(now.Add(-time.Minute), eventid.EntropyFactory(now))
+	require.NoError(t, err)
+	last, err := eventid.New(now, eventid.EntropyFactory(now))
+	require.NoError(t, err)
+	// partition 2 has no messages in the sink
+	tokens := map[uint32]eventid.EventID{1: older, 3: newer}
+
+	feed := Feed{
+		repository:    lastEventIDRepository{lastID: last},
+		partitions:    3,
+		partitionsLow: 1,
+		partitionsHi:  3,
+		coldStart:     store.StartFromNow,
+	}
+	positioned, err := feed.coldStartTokens(context.Background(), tokens)
+	require.NoError(t, err)
+	assert.Equal(t, map[uint32]eventid.EventID{1: older, 2: last, 3: newer}, positioned)
+	assert.Equal(t, older, feed.resumeAfter(positioned))
+
+	// the empty partition starts from the beginning, to backfill its history
+	feed.coldStart = store.StartFromBeginning
+	positioned, err = feed.coldStartTokens(context.Background(), tokens)
+	require.NoError(t, err)
+	assert.Equal(t, tokens, positioned)
+	assert.Equal(t, eventid.Zero, feed.resumeAfter(positioned))
+
+	// without any message in the sink, it starts from the beginning
+	positioned, err = feed.coldStartTokens(context.Background(), map[uint32]eventid.EventID{})
+	require.NoError(t, err)
+	assert.Equal(t, eventid.Zero, feed.resumeAfter(positioned))
+}
@@ -0,0 +1,151 @@
+package postgresql
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/quintans/faults"
+
+	"github.com/quintans/eventsourcing/eventid"
+	"github.com/quintans/eventsourcing/log"
+	"github.com/quintans/eventsourcing/sink"
+	"github.com/quintans/eventsourcing/store"
+)
+
+// writeOutbox adds the events to the outbox, to be published by the OutboxRelay
+func writeOutbox(ctx context.Context, tx *sql.Tx, ids []eventid.EventID) error {
+	_, err := tx.ExecContext(ctx, "INSERT INTO outbox (id) SELECT unnest($1::VARCHAR[])", pq.Array(eventIDs(ids)))
+	if err != nil {
+		return faults.Errorf("Unable to write %d events to the outbox: %w", len(ids), err)
+	}
+	return nil
+}
+
+func eventIDs(ids []eventid.EventID) []string {
+	s := make([]string, len(ids))
+	for k, id := range ids {
+		s[k] = id.String()
+	}
+	return s
+}
+
+var _ store.Feeder = (*OutboxRelay)(nil)
+
+type OutboxRelayOption func(*OutboxRelay)
+
+// WithRelayBatchSize sets the maximum number of events published by each transaction
+func WithRelayBatchSize(size int) OutboxRelayOption {
+	return func(o *OutboxRelay) {
+		if size > 0 {
+			o.batchSize = size
+		}
+	}
+}
+
+// WithRelayInterval sets how long to wait between polls, when the outbox was drained
+func WithRelayInterval(interval time.Duration) OutboxRelayOption {
+	return func(o *OutboxRelay) {
+		o.interval = interval
+	}
+}
+
+// OutboxRelay publishes the events written to the outbox table by a repository with OutboxOption, marking them as published.
+// Since the outbox is written in the same transaction as the events, every saved event is eventually published, at least once.
+// The events are read with SKIP LOCKED, so several relays can run, but only a single relay keeps the order of the events.
+type OutboxRelay struct {
+	logger    log.Logger
+	db        *sqlx.DB
+	batchSize int
+	interval  time.Duration
+}
+
+// NewOutboxRelay creates a relay for the outbox of the repository
+func NewOutboxRelay(logger log.Logger, repository *EsRepository, options ...OutboxRelayOption) OutboxRelay {
+	o := OutboxRelay{
+		logger:    logger,
+		db:        repository.db,
+		batchSize: 100,
+		interval:  500 * time.Millisecond,
+	}
+	for _, opt := range options {
+		opt(&o)
+	}
+	return o
+}
+
+// Feed publishes the events of the outbox to the sinker, until the context is cancelled
+func (o OutboxRelay) Feed(ctx context.Context, sinker sink.Sinker) error {
+	wait := o.interval
+	for {
+		n, err := o.Relay(ctx, sinker)
+		if err != nil {
+			wait += 2 * wait
+			if wait > time.Minute {
+				wait = time.Minute
+			}
+			o.logger.WithTags(log.Tags{"backoff": wait}).
+				WithError(err).
+				Error("Failure relaying the outbox. Backing off.")
+		} else {
+			wait = o.interval
+		}
+
+		// keep draining while the batches are full
+		if err == nil && n == o.batchSize {
+			continue
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil
+		case <-t.C:
+		}
+	}
+}
+
+// Relay publishes a batch of unpublished events to the sinker, returning how many were published.
+// If the sinker fails, the events published until then are still marked as published.
+func (o OutboxRelay) Relay(ctx context.Context, sinker sink.Sinker) (int, error) {
+	tx, err := o.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, faults.Wrap(err)
+	}
+	// does nothing after the commit
+	defer tx.Rollback()
+
+	events, err := queryEvents(ctx, tx,
+		`SELECT e.* FROM events e WHERE e.id IN (
+			SELECT id FROM outbox WHERE published_at IS NULL ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED
+		) ORDER BY e.id`, o.batchSize)
+	if err != nil {
+		return 0, faults.Errorf("Unable to read the outbox: %w", err)
+	}
+
+	published := make([]string, 0, len(events))
+	var sinkErr error
+	for _, e := range events {
+		if sinkErr = sinker.Sink(ctx, e); sinkErr != nil {
+			break
+		}
+		published = append(published, e.ID.String())
+	}
+	if len(published) == 0 {
+		return 0, sinkErr
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE outbox SET published_at = NOW()::TIMESTAMP WHERE id = ANY($1)", pq.Array(published))
+	if err != nil {
+		return 0, faults.Errorf("Unable to mark %d events as published: %w", len(published), err)
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, faults.Wrap(err)
+	}
+	if sinkErr != nil {
+		return len(published), faults.Errorf("Unable to sink event: %w", sinkErr)
+	}
+	return len(published), nil
+}
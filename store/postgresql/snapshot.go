@@ -0,0 +1,210 @@
+package postgresql
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/quintans/faults"
+
+	"github.com/quintans/eventsourcing"
+)
+
+var (
+	_ eventsourcing.SnapshotStore             = (*SnapshotStore)(nil)
+	_ eventsourcing.BoundedSnapshotGetter     = (*SnapshotStore)(nil)
+	_ eventsourcing.TimeBoundedSnapshotGetter = (*SnapshotStore)(nil)
+	_ eventsourcing.SnapshotPruner            = (*SnapshotStore)(nil)
+	_ eventsourcing.SnapshotDeleter           = (*SnapshotStore)(nil)
+)
+
+// SnapshotStore keeps the snapshots in a database of their own, or in the same database through a separate connection pool,
+// so that the snapshot reads and writes do not compete with the saving of the events.
+// It is used with eventsourcing.WithSnapshotStore, and since the events are in another database,
+// its snapshots table must not have the foreign key to the events table.
+type SnapshotStore struct {
+	snapshots
+}
+
+type SnapshotOption func(*SnapshotStore)
+
+// SnapshotMultiTenantOption writes the tenant of the snapshots to the tenant_id column, failing the saves without a tenant,
+// and constrains the reads of the snapshots to the tenant of the context, like MultiTenantOption does for the repository.
+func SnapshotMultiTenantOption() SnapshotOption {
+	return func(r *SnapshotStore) {
+		r.multiTenant = true
+	}
+}
+
+func NewSnapshotStore(connString string, options ...SnapshotOption) (*SnapshotStore, error) {
+	db, err := sql.Open(driverName, connString)
+	if err != nil {
+		return nil, faults.Wrap(err)
+	}
+
+	r := &SnapshotStore{
+		snapshots: snapshots{db: sqlx.NewDb(db, driverName)},
+	}
+
+	for _, o := range options {
+		o(r)
+	}
+
+	return r, nil
+}
+
+// DeleteSnapshot deletes all the snapshots of the aggregate, when it is forgotten
+func (r *SnapshotStore) DeleteSnapshot(ctx context.Context, aggregateID string) error {
+	tenantID, err := r.tenant(ctx)
+	if err != nil {
+		return err
+	}
+	var query bytes.Buffer
+	query.WriteString("DELETE FROM snapshots WHERE aggregate_id = $1")
+	args := tenantFilter(tenantID, &query, []interface{}{aggregateID})
+	_, err = r.db.ExecContext(ctx, query.String(), args...)
+	if err != nil {
+		return faults.Errorf("Unable to delete the snapshots of aggregate '%s': %w", aggregateID, err)
+	}
+	return nil
+}
+
+// snapshots handles the snapshots table, for the EsRepository and the SnapshotStore
+type snapshots struct {
+	db          *sqlx.DB
+	multiTenant bool
+}
+
+// tenant returns the tenant constraining the reads, or empty if they are not constrained
+func (r *snapshots) tenant(ctx context.Context) (string, error) {
+	if !r.multiTenant {
+		return "", nil
+	}
+	return eventsourcing.TenantScope(ctx)
+}
+
+// getSnapshot gets the newest snapshot of the aggregate, of the tenant of the context, matching the extra condition, if any
+func (r *snapshots) getSnapshot(ctx context.Context, aggregateID, condition string, args ...interface{}) (eventsourcing.Snapshot, error) {
+	tenantID, err := r.tenant(ctx)
+	if err != nil {
+		return eventsourcing.Snapshot{}, err
+	}
+	var query bytes.Buffer
+	query.WriteString("SELECT * FROM snapshots WHERE aggregate_id = $1")
+	query.WriteString(condition)
+	args = tenantFilter(tenantID, &query, append([]interface{}{aggregateID}, args...))
+	query.WriteString(" ORDER BY id DESC LIMIT 1")
+
+	snap := Snapshot{}
+	if err := r.db.GetContext(ctx, &snap, query.String(), args...); err != nil {
+		if err == sql.ErrNoRows {
+			return eventsourcing.Snapshot{}, nil
+		}
+		return eventsourcing.Snapshot{}, faults.Wrap(err)
+	}
+	return toSnapshot(aggregateID, snap), nil
+}
+
+func (r *snapshots) GetSnapshot(ctx context.Context, aggregateID string) (eventsourcing.Snapshot, error) {
+	snap, err := r.getSnapshot(ctx, aggregateID, "")
+	if err != nil {
+		return eventsourcing.Snapshot{}, faults.Errorf("Unable to get snapshot for aggregate '%s': %w", aggregateID, err)
+	}
+
+	return snap, nil
+}
+
+// GetSnapshotUpTo gets the newest snapshot not exceeding the version
+func (r *snapshots) GetSnapshotUpTo(ctx context.Context, aggregateID string, maxVersion uint32) (eventsourcing.Snapshot, error) {
+	snap, err := r.getSnapshot(ctx, aggregateID, " AND aggregate_version <= $2", maxVersion)
+	if err != nil {
+		return eventsourcing.Snapshot{}, faults.Errorf("Unable to get snapshot for aggregate '%s' up to version %d: %w", aggregateID, maxVersion, err)
+	}
+
+	return snap, nil
+}
+
+// GetSnapshotUntil gets the newest snapshot created until the time
+func (r *snapshots) GetSnapshotUntil(ctx context.Context, aggregateID string, at time.Time) (eventsourcing.Snapshot, error) {
+	snap, err := r.getSnapshot(ctx, aggregateID, " AND created_at <= $2", at.UTC())
+	if err != nil {
+		return eventsourcing.Snapshot{}, faults.Errorf("Unable to get snapshot for aggregate '%s' until %s: %w", aggregateID, at, err)
+	}
+
+	return snap, nil
+}
+
+func toSnapshot(aggregateID string, snap Snapshot) eventsourcing.Snapshot {
+	return eventsourcing.Snapshot{
+		ID:               snap.ID,
+		AggregateID:      aggregateID,
+		AggregateVersion: snap.AggregateVersion,
+		AggregateType:    snap.AggregateType,
+		Body:             snap.Body,
+		CreatedAt:        snap.CreatedAt,
+		TenantID:         string(snap.TenantID),
+	}
+}
+
+func (r *snapshots) SaveSnapshot(ctx context.Context, snapshot eventsourcing.Snapshot) error {
+	if r.multiTenant && snapshot.TenantID == "" {
+		return faults.Errorf("%w: saving snapshot of aggregate '%s'", eventsourcing.ErrMissingTenant, snapshot.AggregateID)
+	}
+	s := Snapshot{
+		ID:               snapshot.ID,
+		AggregateID:      snapshot.AggregateID,
+		AggregateVersion: snapshot.AggregateVersion,
+		AggregateType:    snapshot.AggregateType,
+		Body:             snapshot.Body,
+		CreatedAt:        snapshot.CreatedAt,
+		TenantID:         NilString(snapshot.TenantID),
+	}
+	query := `INSERT INTO snapshots (id, aggregate_id, aggregate_version, aggregate_type, body, created_at)
+	     VALUES (:id, :aggregate_id, :aggregate_version, :aggregate_type, :body, :created_at)`
+	if r.multiTenant {
+		query = `INSERT INTO snapshots (id, aggregate_id, aggregate_version, aggregate_type, body, created_at, tenant_id)
+	     VALUES (:id, :aggregate_id, :aggregate_version, :aggregate_type, :body, :created_at, :tenant_id)`
+	}
+	_, err := r.db.NamedExecContext(ctx, query, s)
+
+	return faults.Wrap(err)
+}
+
+func (r *snapshots) DeleteSnapshots(ctx context.Context, aggregateID string, keepLast int) error {
+	tenantID, err := r.tenant(ctx)
+	if err != nil {
+		return err
+	}
+	var query bytes.Buffer
+	query.WriteString(`DELETE FROM snapshots WHERE id IN (
+			SELECT id FROM (
+				SELECT id, ROW_NUMBER() OVER (ORDER BY aggregate_version DESC) AS pos FROM snapshots WHERE aggregate_id = $1`)
+	args := tenantFilter(tenantID, &query, []interface{}{aggregateID, keepLast})
+	query.WriteString(`
+			) AS s WHERE pos > $2
+		)`)
+	_, err = r.db.ExecContext(ctx, query.String(), args...)
+	if err != nil {
+		return faults.Errorf("Unable to delete the snapshots of aggregate '%s': %w", aggregateID, err)
+	}
+	return nil
+}
+
+func (r *snapshots) PruneSnapshots(ctx context.Context, keepLast int) (int64, error) {
+	res, err := r.db.ExecContext(ctx,
+		`DELETE FROM snapshots WHERE id IN (
+			SELECT id FROM (
+				SELECT id, ROW_NUMBER() OVER (PARTITION BY aggregate_id ORDER BY aggregate_version DESC) AS pos FROM snapshots
+			) AS s WHERE pos > $1
+		)`, keepLast)
+	if err != nil {
+		return 0, faults.Errorf("Unable to prune the snapshots: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, faults.Wrap(err)
+	}
+	return n, nil
+}
@@ -6,8 +6,10 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/jmoiron/sqlx"
@@ -15,7 +17,6 @@ import (
 	"github.com/quintans/faults"
 
 	"github.com/quintans/eventsourcing"
-	"github.com/quintans/eventsourcing/common"
 	"github.com/quintans/eventsourcing/eventid"
 	"github.com/quintans/eventsourcing/store"
 )
@@ -25,6 +26,16 @@ const (
 	pgUniqueViolation = "23505"
 )
 
+// forgetBatchSize is the number of rows updated by each statement when forgetting
+const forgetBatchSize = 100
+
+// DefaultCopyThreshold is the number of events of a record above which they are inserted with COPY
+const DefaultCopyThreshold = 100
+
+// DefaultIdempotencyConstraints are the names of the unique indexes on the idempotency key,
+// global and scoped by aggregate ID, used to tell a repeated idempotency key from a concurrent modification
+var DefaultIdempotencyConstraints = []string{"evt_idempot_uk", "evt_agg_idempot_uk"}
+
 // Event is the event data stored in the database
 type Event struct {
 	ID               eventid.EventID             `db:"id"`
@@ -34,9 +45,13 @@ type Event struct {
 	AggregateType    eventsourcing.AggregateType `db:"aggregate_type"`
 	Kind             eventsourcing.EventKind     `db:"kind"`
 	Body             []byte                      `db:"body"`
+	ContentType      NilString                   `db:"content_type"`
 	IdempotencyKey   NilString                   `db:"idempotency_key"`
 	Metadata         []byte                      `db:"metadata"`
 	CreatedAt        time.Time                   `db:"created_at"`
+	EventVersion     uint16                      `db:"event_version"`
+	ForgottenAt      sql.NullTime                `db:"forgotten_at"`
+	TenantID         NilString                   `db:"tenant_id"`
 }
 
 // NilString converts nil to empty string
@@ -65,9 +80,15 @@ type Snapshot struct {
 	AggregateType    eventsourcing.AggregateType `db:"aggregate_type,omitempty"`
 	Body             []byte                      `db:"body,omitempty"`
 	CreatedAt        time.Time                   `db:"created_at,omitempty"`
+	TenantID         NilString                   `db:"tenant_id"`
 }
 
-var _ eventsourcing.EsRepository = (*EsRepository)(nil)
+var (
+	_ eventsourcing.EsRepository              = (*EsRepository)(nil)
+	_ eventsourcing.BoundedSnapshotGetter     = (*EsRepository)(nil)
+	_ eventsourcing.TimeBoundedSnapshotGetter = (*EsRepository)(nil)
+	_ eventsourcing.SnapshotPruner            = (*EsRepository)(nil)
+)
 
 type StoreOption func(*EsRepository)
 
@@ -79,9 +100,99 @@ func ProjectorFactoryOption(fn ProjectorFactory) StoreOption {
 	}
 }
 
+// IdempotencyConstraintsOption sets the names of the unique indexes on the idempotency key,
+// when they differ from DefaultIdempotencyConstraints
+func IdempotencyConstraintsOption(constraints ...string) StoreOption {
+	return func(r *EsRepository) {
+		r.idempotencyConstraints = constraints
+	}
+}
+
+// MaxOpenConnsOption sets the maximum number of open connections to the database.
+// The default, zero, is unlimited, which under load may exhaust the connections accepted by the database.
+func MaxOpenConnsOption(n int) StoreOption {
+	return func(r *EsRepository) {
+		r.db.SetMaxOpenConns(n)
+	}
+}
+
+// MaxIdleConnsOption sets the maximum number of idle connections kept in the pool. The default is 2.
+func MaxIdleConnsOption(n int) StoreOption {
+	return func(r *EsRepository) {
+		r.db.SetMaxIdleConns(n)
+	}
+}
+
+// ConnMaxLifetimeOption sets for how long a connection can be reused. The default, zero, is forever.
+func ConnMaxLifetimeOption(d time.Duration) StoreOption {
+	return func(r *EsRepository) {
+		r.db.SetConnMaxLifetime(d)
+	}
+}
+
+// StatementTimeoutOption sets a statement timeout on the transactions and on the reads of the events,
+// so that a stuck query is aborted by the server, even if the cancellation of the context does not reach it
+func StatementTimeoutOption(timeout time.Duration) StoreOption {
+	return func(r *EsRepository) {
+		r.statementTimeout = timeout
+	}
+}
+
+// CopyThresholdOption sets the number of events of a record above which they are inserted with COPY, eg: for imports.
+// Zero always inserts the events one by one. COPY is not used with a projector, so that every event is projected.
+func CopyThresholdOption(threshold int) StoreOption {
+	return func(r *EsRepository) {
+		r.copyThreshold = threshold
+	}
+}
+
+// OutboxOption writes the IDs of the saved events to the outbox table, in the same transaction,
+// so that an OutboxRelay eventually publishes every saved event
+func OutboxOption() StoreOption {
+	return func(r *EsRepository) {
+		r.outbox = true
+	}
+}
+
+// EventIDGeneratorOption sets how the IDs of the events are generated, replacing eventid.Generate.
+// The IDs must have the creation time of the events, since the feeds rely on the IDs being ordered by creation time.
+func EventIDGeneratorOption(generator eventid.Generator) StoreOption {
+	return func(r *EsRepository) {
+		r.idGenerator = generator
+	}
+}
+
+// HashFuncOption sets the function that computes the aggregate ID hash, used to partition the events, replacing eventsourcing.HashAggregateID.
+// eg: eventsourcing.HashLabel("tenant") partitions the events by tenant.
+func HashFuncOption(fn eventsourcing.HashFunc) StoreOption {
+	return func(r *EsRepository) {
+		r.hashFunc = fn
+	}
+}
+
+// MultiTenantOption writes the tenant of the events and of the snapshots to the tenant_id column, failing the saves without a tenant,
+// and constrains the reads of the events and of the snapshots to the tenant of the context.
+// See eventsourcing.WithTenant and eventsourcing.WithAllTenants.
+func MultiTenantOption() StoreOption {
+	return func(r *EsRepository) {
+		r.multiTenant = true
+	}
+}
+
 type EsRepository struct {
-	db               *sqlx.DB
-	projectorFactory ProjectorFactory
+	snapshots
+	db                     *sqlx.DB
+	projectorFactory       ProjectorFactory
+	idempotencyConstraints []string
+	statementTimeout       time.Duration
+	copyThreshold          int
+	outbox                 bool
+	idGenerator            eventid.Generator
+	hashFunc               eventsourcing.HashFunc
+
+	// insertStmt is the prepared insert of the events, shared by all the transactions
+	insertMu   sync.Mutex
+	insertStmt *sql.Stmt
 }
 
 func NewStore(connString string, options ...StoreOption) (*EsRepository, error) {
@@ -92,7 +203,12 @@ func NewStore(connString string, options ...StoreOption) (*EsRepository, error)
 
 	dbx := sqlx.NewDb(db, driverName)
 	r := &EsRepository{
-		db: dbx,
+		snapshots:              snapshots{db: dbx},
+		db:                     dbx,
+		idempotencyConstraints: DefaultIdempotencyConstraints,
+		copyThreshold:          DefaultCopyThreshold,
+		idGenerator:            eventid.Generate,
+		hashFunc:               eventsourcing.HashAggregateID,
 	}
 
 	for _, o := range options {
@@ -102,10 +218,96 @@ func NewStore(connString string, options ...StoreOption) (*EsRepository, error)
 	return r, nil
 }
 
+var _ eventsourcing.AggregateHasher = (*EsRepository)(nil)
+
+// AggregateIDHash returns the hash that partitions the events of the aggregate
+func (r *EsRepository) AggregateIDHash(aggregateID string, labels map[string]interface{}) uint32 {
+	return r.hashFunc(aggregateID, labels)
+}
+
+var _ eventsourcing.BatchSaver = (*EsRepository)(nil)
+
 func (r *EsRepository) SaveEvent(ctx context.Context, eRec eventsourcing.EventRecord) (eventid.EventID, uint32, error) {
+	ids, version, err := r.SaveEventIDs(ctx, eRec)
+	if err != nil {
+		return eventid.Zero, 0, err
+	}
+	return ids[len(ids)-1], version, nil
+}
+
+var _ eventsourcing.EventIDsSaver = (*EsRepository)(nil)
+
+// SaveEventIDs saves the events of the record, returning the IDs of all of them
+func (r *EsRepository) SaveEventIDs(ctx context.Context, eRec eventsourcing.EventRecord) ([]eventid.EventID, uint32, error) {
+	var ids []eventid.EventID
+	var version uint32
+	err := r.withTx(ctx, func(c context.Context, tx *sql.Tx) error {
+		projector := r.newProjector(tx)
+		var err error
+		ids, version, err = r.saveEvent(c, tx, projector, eRec)
+		if err != nil {
+			return err
+		}
+		return store.Flush(projector)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return ids, version, nil
+}
+
+// SaveEvents saves the events of several aggregates in a single transaction.
+// If any of the records fails to be saved, none is.
+func (r *EsRepository) SaveEvents(ctx context.Context, eRecs []eventsourcing.EventRecord) ([]eventsourcing.EventRecordResult, error) {
+	results := make([]eventsourcing.EventRecordResult, len(eRecs))
+	err := r.withTx(ctx, func(c context.Context, tx *sql.Tx) error {
+		projector := r.newProjector(tx)
+		for k, eRec := range eRecs {
+			ids, version, err := r.saveEvent(c, tx, projector, eRec)
+			if err != nil {
+				return err
+			}
+			results[k] = eventsourcing.EventRecordResult{
+				ID:      ids[len(ids)-1],
+				Version: version,
+			}
+		}
+		return store.Flush(projector)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+func (r *EsRepository) newProjector(tx *sql.Tx) store.Projector {
+	if r.projectorFactory == nil {
+		return nil
+	}
+	return r.projectorFactory(tx)
+}
+
+func (r *EsRepository) saveEvent(ctx context.Context, tx *sql.Tx, projector store.Projector, eRec eventsourcing.EventRecord) ([]eventid.EventID, uint32, error) {
+	ids, version, err := r.insertEvents(ctx, tx, projector, eRec)
+	if err != nil || !r.outbox {
+		return ids, version, err
+	}
+	err = writeOutbox(ctx, tx, ids)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ids, version, nil
+}
+
+func (r *EsRepository) insertEvents(ctx context.Context, tx *sql.Tx, projector store.Projector, eRec eventsourcing.EventRecord) ([]eventid.EventID, uint32, error) {
+	if r.multiTenant && eRec.TenantID == "" {
+		return nil, 0, faults.Errorf("%w: saving events of aggregate '%s'", eventsourcing.ErrMissingTenant, eRec.AggregateID)
+	}
 	metadata, err := json.Marshal(eRec.Labels)
 	if err != nil {
-		return eventid.Zero, 0, faults.Wrap(err)
+		return nil, 0, faults.Wrap(err)
 	}
 
 	var idempotencyKey *string
@@ -113,56 +315,141 @@ func (r *EsRepository) SaveEvent(ctx context.Context, eRec eventsourcing.EventRe
 		idempotencyKey = &eRec.IdempotencyKey
 	}
 
+	if projector == nil && r.copyThreshold > 0 && len(eRec.Details) > r.copyThreshold {
+		return r.copyEvents(ctx, tx, eRec, idempotencyKey, metadata)
+	}
+
+	insert, err := r.insertEventStmt(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	// the statement of the transaction is closed when the transaction ends, even if rolled back
+	stmt := tx.StmtContext(ctx, insert)
+	defer stmt.Close()
+
 	version := eRec.Version
-	var id eventid.EventID
-	err = r.withTx(ctx, func(c context.Context, tx *sql.Tx) error {
-		var projector store.Projector
-		if r.projectorFactory != nil {
-			projector = r.projectorFactory(tx)
-		}
-		entropy := eventid.EntropyFactory(eRec.CreatedAt)
-		for _, e := range eRec.Details {
-			id, err = eventid.New(eRec.CreatedAt, entropy)
-			if err != nil {
-				return faults.Wrap(err)
+	ids := make([]eventid.EventID, 0, len(eRec.Details))
+	entropy := eventid.NewEntropy()
+	for _, e := range eRec.Details {
+		id, err := r.idGenerator.New(entropy, eRec.CreatedAt, eRec.AggregateID, version+1)
+		if err != nil {
+			return nil, 0, faults.Wrap(err)
+		}
+		version++
+		hash := r.hashFunc(eRec.AggregateID, eRec.Labels)
+		args := []interface{}{id.String(), eRec.AggregateID, version, eRec.AggregateType, e.Kind, e.Body, eRec.ContentType, idempotencyKey, metadata, eRec.CreatedAt, int32ring(hash), eventVersion(e.EventVersion)}
+		if r.multiTenant {
+			args = append(args, eRec.TenantID)
+		}
+		_, err = stmt.ExecContext(ctx, args...)
+
+		if err != nil {
+			if e := r.dupError(err); e != nil {
+				return nil, 0, e
 			}
-			version++
-			hash := common.Hash(eRec.AggregateID)
-			_, err = tx.ExecContext(ctx,
-				`INSERT INTO events (id, aggregate_id, aggregate_version, aggregate_type, kind, body, idempotency_key, metadata, created_at, aggregate_id_hash)
-			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
-				id.String(), eRec.AggregateID, version, eRec.AggregateType, e.Kind, e.Body, idempotencyKey, metadata, eRec.CreatedAt, int32ring(hash))
+			return nil, 0, faults.Errorf("Unable to insert event: %w", err)
+		}
+		ids = append(ids, id)
 
-			if err != nil {
-				if isDup(err) {
-					return eventsourcing.ErrConcurrentModification
-				}
-				return faults.Errorf("Unable to insert event: %w", err)
+		if projector != nil {
+			evt := eventsourcing.Event{
+				ID:               id,
+				AggregateID:      eRec.AggregateID,
+				AggregateIDHash:  hash,
+				AggregateVersion: version,
+				AggregateType:    eRec.AggregateType,
+				Kind:             e.Kind,
+				Body:             e.Body,
+				ContentType:      eRec.ContentType,
+				Metadata:         eRec.Labels,
+				CreatedAt:        eRec.CreatedAt,
+				TenantID:         eRec.TenantID,
+				EventVersion:     eventVersion(e.EventVersion),
 			}
+			projector.Project(evt)
+		}
+	}
 
-			if projector != nil {
-				evt := eventsourcing.Event{
-					ID:               id,
-					AggregateID:      eRec.AggregateID,
-					AggregateIDHash:  hash,
-					AggregateVersion: version,
-					AggregateType:    eRec.AggregateType,
-					Kind:             e.Kind,
-					Body:             e.Body,
-					Metadata:         eRec.Labels,
-					CreatedAt:        eRec.CreatedAt,
-				}
-				projector.Project(evt)
+	return ids, version, nil
+}
+
+// copyEvents inserts the events of the record with COPY, that is faster than one insert per event
+func (r *EsRepository) copyEvents(ctx context.Context, tx *sql.Tx, eRec eventsourcing.EventRecord, idempotencyKey *string, metadata []byte) ([]eventid.EventID, uint32, error) {
+	columns := []string{"id", "aggregate_id", "aggregate_version", "aggregate_type", "kind", "body", "content_type",
+		"idempotency_key", "metadata", "created_at", "aggregate_id_hash", "event_version"}
+	if r.multiTenant {
+		columns = append(columns, "tenant_id")
+	}
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn("events", columns...))
+	if err != nil {
+		return nil, 0, faults.Errorf("Unable to prepare the copy of events: %w", err)
+	}
+	defer stmt.Close()
+
+	version := eRec.Version
+	ids := make([]eventid.EventID, 0, len(eRec.Details))
+	hash := int32ring(r.hashFunc(eRec.AggregateID, eRec.Labels))
+	entropy := eventid.NewEntropy()
+	for _, e := range eRec.Details {
+		id, err := r.idGenerator.New(entropy, eRec.CreatedAt, eRec.AggregateID, version+1)
+		if err != nil {
+			return nil, 0, faults.Wrap(err)
+		}
+		version++
+		// the metadata goes as text, since COPY would send bytes as bytea
+		args := []interface{}{id.String(), eRec.AggregateID, version, eRec.AggregateType, e.Kind, e.Body, eRec.ContentType,
+			idempotencyKey, string(metadata), eRec.CreatedAt, hash, eventVersion(e.EventVersion)}
+		if r.multiTenant {
+			args = append(args, eRec.TenantID)
+		}
+		_, err = stmt.ExecContext(ctx, args...)
+		if err != nil {
+			// a failure of a previous row may only be reported now
+			if e := r.dupError(err); e != nil {
+				return nil, 0, e
 			}
+			return nil, 0, faults.Errorf("Unable to copy event: %w", err)
 		}
+		ids = append(ids, id)
+	}
 
-		return nil
-	})
+	// the rows are only checked against the constraints when the copy is flushed
+	_, err = stmt.ExecContext(ctx)
 	if err != nil {
-		return eventid.Zero, 0, err
+		if e := r.dupError(err); e != nil {
+			return nil, 0, e
+		}
+		return nil, 0, faults.Errorf("Unable to copy events: %w", err)
 	}
 
-	return id, version, nil
+	return ids, version, nil
+}
+
+const insertEventQuery = `INSERT INTO events (id, aggregate_id, aggregate_version, aggregate_type, kind, body, content_type, idempotency_key, metadata, created_at, aggregate_id_hash, event_version)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`
+
+const insertTenantEventQuery = `INSERT INTO events (id, aggregate_id, aggregate_version, aggregate_type, kind, body, content_type, idempotency_key, metadata, created_at, aggregate_id_hash, event_version, tenant_id)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`
+
+// insertEventStmt prepares the insert of the events on first use, so that it is not parsed on every save.
+// database/sql prepares it again on each connection where it is used.
+func (r *EsRepository) insertEventStmt(ctx context.Context) (*sql.Stmt, error) {
+	r.insertMu.Lock()
+	defer r.insertMu.Unlock()
+
+	if r.insertStmt != nil {
+		return r.insertStmt, nil
+	}
+	query := insertEventQuery
+	if r.multiTenant {
+		query = insertTenantEventQuery
+	}
+	stmt, err := r.db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, faults.Errorf("Unable to prepare the insert of events: %w", err)
+	}
+	r.insertStmt = stmt
+	return stmt, nil
 }
 
 func int32ring(x uint32) int32 {
@@ -176,68 +463,242 @@ func int32ring(x uint32) int32 {
 	return h
 }
 
-func isDup(err error) bool {
+// dupError converts a unique violation into ErrDuplicateIdempotencyKey, if the violated constraint is an idempotency one,
+// or ErrConcurrentModification otherwise, keeping the database error as the cause. Other errors return nil.
+func (r *EsRepository) dupError(err error) error {
 	pgerr, ok := err.(*pq.Error)
-	return ok && pgerr.Code == pgUniqueViolation
+	if !ok || pgerr.Code != pgUniqueViolation {
+		return nil
+	}
+	for _, c := range r.idempotencyConstraints {
+		if pgerr.Constraint == c {
+			return eventsourcing.WrapCause(eventsourcing.ErrDuplicateIdempotencyKey, pgerr)
+		}
+	}
+	return eventsourcing.WrapCause(eventsourcing.ErrConcurrentModification, pgerr)
 }
 
-func (r *EsRepository) GetSnapshot(ctx context.Context, aggregateID string) (eventsourcing.Snapshot, error) {
-	snap := Snapshot{}
-	if err := r.db.GetContext(ctx, &snap, "SELECT * FROM snapshots WHERE aggregate_id = $1 ORDER BY id DESC LIMIT 1", aggregateID); err != nil {
-		if err == sql.ErrNoRows {
-			return eventsourcing.Snapshot{}, nil
+func (r *EsRepository) GetAggregateEvents(ctx context.Context, aggregateID string, snapVersion int) ([]eventsourcing.Event, error) {
+	tenantID, err := r.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	query, args := aggregateEventsQuery(tenantID, aggregateID, snapVersion, -1, time.Time{})
+	events, err := r.queryEvents(ctx, query, args...)
+	if err != nil {
+		return nil, faults.Errorf("Unable to get events for Aggregate '%s': %w", aggregateID, err)
+	}
+
+	return events, nil
+}
+
+var _ eventsourcing.BoundedEventsGetter = (*EsRepository)(nil)
+
+// GetAggregateEventsUpTo gets the events of the aggregate after the snapshot version, up to and including the max version
+func (r *EsRepository) GetAggregateEventsUpTo(ctx context.Context, aggregateID string, snapVersion int, maxVersion uint32) ([]eventsourcing.Event, error) {
+	tenantID, err := r.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	query, args := aggregateEventsQuery(tenantID, aggregateID, snapVersion, int64(maxVersion), time.Time{})
+	events, err := r.queryEvents(ctx, query, args...)
+	if err != nil {
+		return nil, faults.Errorf("Unable to get events for Aggregate '%s' up to version %d: %w", aggregateID, maxVersion, err)
+	}
+
+	return events, nil
+}
+
+var _ eventsourcing.AggregateLoader = (*EsRepository)(nil)
+
+// loadAggregateQuery gets the latest snapshot, as the first row, followed by the events after it.
+// The snapshot row fills the event columns that it does not have. The snapshot and the events can be further constrained by the %s condition.
+const loadAggregateQuery = `WITH s AS (SELECT * FROM snapshots WHERE aggregate_id = $1%[1]s ORDER BY id DESC LIMIT 1)
+SELECT true AS is_snapshot, id, aggregate_id, 0 AS aggregate_id_hash, aggregate_version, aggregate_type, '' AS kind, body,
+	NULL AS content_type, NULL AS idempotency_key, '{}' AS metadata, created_at, 1 AS event_version, NULL AS forgotten_at
+FROM s
+UNION ALL
+SELECT false, id, aggregate_id, aggregate_id_hash, aggregate_version, aggregate_type, kind, body,
+	content_type, idempotency_key, metadata, created_at, event_version, forgotten_at
+FROM events
+WHERE aggregate_id = $1%[1]s AND aggregate_version > COALESCE((SELECT aggregate_version FROM s), 0)
+ORDER BY is_snapshot DESC, aggregate_version ASC`
+
+type aggregateRow struct {
+	IsSnapshot bool `db:"is_snapshot"`
+	Event
+}
+
+// LoadAggregate gets the latest snapshot and the events after it, in a single query
+func (r *EsRepository) LoadAggregate(ctx context.Context, aggregateID string) (eventsourcing.Snapshot, []eventsourcing.Event, error) {
+	tenantID, err := r.tenant(ctx)
+	if err != nil {
+		return eventsourcing.Snapshot{}, nil, err
+	}
+	query := fmt.Sprintf(loadAggregateQuery, "")
+	args := []interface{}{aggregateID}
+	if tenantID != "" {
+		query = fmt.Sprintf(loadAggregateQuery, " AND tenant_id = $2")
+		args = append(args, tenantID)
+	}
+
+	snap := eventsourcing.Snapshot{}
+	events := []eventsourcing.Event{}
+	err = r.read(ctx, func(ctx context.Context, q sqlx.QueryerContext) error {
+		rows, err := q.QueryxContext(ctx, query, args...)
+		if err != nil {
+			return faults.Errorf("Unable to load aggregate '%s': %w", aggregateID, err)
 		}
-		return eventsourcing.Snapshot{}, faults.Errorf("Unable to get snapshot for aggregate '%s': %w", aggregateID, err)
+		defer rows.Close()
+
+		for rows.Next() {
+			row := aggregateRow{}
+			err := rows.StructScan(&row)
+			if err != nil {
+				return faults.Errorf("Unable to scan to struct: %w", err)
+			}
+			if row.IsSnapshot {
+				snap = toSnapshot(aggregateID, Snapshot{
+					ID:               row.ID,
+					AggregateVersion: row.AggregateVersion,
+					AggregateType:    row.AggregateType,
+					Body:             row.Body,
+					CreatedAt:        row.CreatedAt,
+					TenantID:         NilString(tenantID),
+				})
+				continue
+			}
+			evt, err := toEvent(row.Event)
+			if err != nil {
+				return err
+			}
+			events = append(events, evt)
+		}
+		if err := rows.Err(); err != nil {
+			return faults.Errorf("Unable to load aggregate '%s': %w", aggregateID, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return eventsourcing.Snapshot{}, nil, err
 	}
 
-	return eventsourcing.Snapshot{
-		ID:               snap.ID,
-		AggregateID:      aggregateID,
-		AggregateVersion: snap.AggregateVersion,
-		AggregateType:    snap.AggregateType,
-		Body:             snap.Body,
-		CreatedAt:        snap.CreatedAt,
-	}, nil
+	return snap, events, nil
 }
 
-func (r *EsRepository) SaveSnapshot(ctx context.Context, snapshot eventsourcing.Snapshot) error {
-	s := Snapshot{
-		ID:               snapshot.ID,
-		AggregateID:      snapshot.AggregateID,
-		AggregateVersion: snapshot.AggregateVersion,
-		AggregateType:    snapshot.AggregateType,
-		Body:             snapshot.Body,
-		CreatedAt:        snapshot.CreatedAt,
+var _ eventsourcing.TimeBoundedEventsGetter = (*EsRepository)(nil)
+
+// GetAggregateEventsUntil gets the events of the aggregate after the snapshot version, created until, and including, the time
+func (r *EsRepository) GetAggregateEventsUntil(ctx context.Context, aggregateID string, snapVersion int, at time.Time) ([]eventsourcing.Event, error) {
+	tenantID, err := r.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	query, args := aggregateEventsQuery(tenantID, aggregateID, snapVersion, -1, at)
+	events, err := r.queryEvents(ctx, query, args...)
+	if err != nil {
+		return nil, faults.Errorf("Unable to get events for Aggregate '%s' until %s: %w", aggregateID, at, err)
 	}
-	_, err := r.db.NamedExecContext(ctx,
-		`INSERT INTO snapshots (id, aggregate_id, aggregate_version, aggregate_type, body, created_at)
-	     VALUES (:id, :aggregate_id, :aggregate_version, :aggregate_type, :body, :created_at)`, s)
 
-	return faults.Wrap(err)
+	return events, nil
 }
 
-func (r *EsRepository) GetAggregateEvents(ctx context.Context, aggregateID string, snapVersion int) ([]eventsourcing.Event, error) {
+var _ eventsourcing.EventStreamer = (*EsRepository)(nil)
+
+// GetAggregateEventsStream streams the events of an aggregate, reading them one row at a time.
+// The events channel is closed when there are no more events.
+// If an error occurs, or the context is cancelled, it is sent to the error channel before closing the events channel.
+func (r *EsRepository) GetAggregateEventsStream(ctx context.Context, aggregateID string, snapVersion int) (<-chan eventsourcing.Event, <-chan error) {
+	events := make(chan eventsourcing.Event)
+	errCh := make(chan error, 1)
+
+	go func() {
+		defer close(events)
+		defer close(errCh)
+
+		tenantID, err := r.tenant(ctx)
+		if err != nil {
+			errCh <- err
+			return
+		}
+
+		var q sqlx.QueryerContext = r.db
+		if r.statementTimeout > 0 {
+			tx, err := r.beginTxx(ctx)
+			if err != nil {
+				errCh <- faults.Errorf("Unable to get events for Aggregate '%s': %w", aggregateID, err)
+				return
+			}
+			// nothing was changed
+			defer tx.Rollback()
+			q = tx
+		}
+
+		query, args := aggregateEventsQuery(tenantID, aggregateID, snapVersion, -1, time.Time{})
+		rows, err := q.QueryxContext(ctx, query, args...)
+		if err != nil {
+			errCh <- faults.Errorf("Unable to get events for Aggregate '%s': %w", aggregateID, err)
+			return
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			evt, err := scanEvent(rows)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			select {
+			case events <- evt:
+			case <-ctx.Done():
+				errCh <- faults.Wrap(ctx.Err())
+				return
+			}
+		}
+		if err := rows.Err(); err != nil {
+			errCh <- faults.Errorf("Unable to get events for Aggregate '%s': %w", aggregateID, err)
+		}
+	}()
+
+	return events, errCh
+}
+
+// aggregateEventsQuery builds the query for the events of the aggregate, of the tenant, after the snapshot version, up to the max version
+// and created until the time. An empty tenant, a negative max version and a zero time mean no constraint.
+func aggregateEventsQuery(tenantID, aggregateID string, snapVersion int, maxVersion int64, until time.Time) (string, []interface{}) {
 	var query bytes.Buffer
 	query.WriteString("SELECT * FROM events e WHERE e.aggregate_id = $1")
 	args := []interface{}{aggregateID}
+	if tenantID != "" {
+		args = append(args, tenantID)
+		query.WriteString(fmt.Sprintf(" AND e.tenant_id = $%d", len(args)))
+	}
 	if snapVersion > -1 {
-		query.WriteString(" AND e.aggregate_version > $2")
 		args = append(args, snapVersion)
+		query.WriteString(fmt.Sprintf(" AND e.aggregate_version > $%d", len(args)))
 	}
-	query.WriteString(" ORDER BY aggregate_version ASC")
-
-	events, err := r.queryEvents(ctx, query.String(), args...)
-	if err != nil {
-		return nil, faults.Errorf("Unable to get events for Aggregate '%s': %w", aggregateID, err)
+	if maxVersion > -1 {
+		args = append(args, maxVersion)
+		query.WriteString(fmt.Sprintf(" AND e.aggregate_version <= $%d", len(args)))
+	}
+	if !until.IsZero() {
+		args = append(args, until.UTC())
+		query.WriteString(fmt.Sprintf(" AND e.created_at <= $%d", len(args)))
 	}
+	query.WriteString(" ORDER BY aggregate_version ASC")
+	return query.String(), args
+}
 
-	return events, nil
+func (r *EsRepository) withTx(ctx context.Context, fn func(context.Context, *sql.Tx) error) error {
+	return r.withTxx(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		return fn(ctx, tx.Tx)
+	})
 }
 
-func (r *EsRepository) withTx(ctx context.Context, fn func(context.Context, *sql.Tx) error) (err error) {
-	tx, err := r.db.BeginTx(ctx, nil)
+func (r *EsRepository) withTxx(ctx context.Context, fn func(context.Context, *sqlx.Tx) error) (err error) {
+	tx, err := r.beginTxx(ctx)
 	if err != nil {
-		return faults.Wrap(err)
+		return err
 	}
 	defer func() {
 		if r := recover(); r != nil {
@@ -255,71 +716,264 @@ func (r *EsRepository) withTx(ctx context.Context, fn func(context.Context, *sql
 	return tx.Commit()
 }
 
+// beginTxx begins a transaction, setting the statement timeout if there is one
+func (r *EsRepository) beginTxx(ctx context.Context) (*sqlx.Tx, error) {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, faults.Wrap(err)
+	}
+	if r.statementTimeout > 0 {
+		_, err = tx.ExecContext(ctx, fmt.Sprintf("SET LOCAL statement_timeout = %d", r.statementTimeout.Milliseconds()))
+		if err != nil {
+			tx.Rollback()
+			return nil, faults.Errorf("Unable to set the statement timeout: %w", err)
+		}
+	}
+	return tx, nil
+}
+
+// read runs the reads with the database or, if there is a statement timeout, inside a transaction where it is set
+func (r *EsRepository) read(ctx context.Context, fn func(context.Context, sqlx.QueryerContext) error) error {
+	if r.statementTimeout == 0 {
+		return fn(ctx, r.db)
+	}
+	return r.withTxx(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		return fn(ctx, tx)
+	})
+}
+
 func (r *EsRepository) HasIdempotencyKey(ctx context.Context, idempotencyKey string) (bool, error) {
+	tenantID, err := r.tenant(ctx)
+	if err != nil {
+		return false, err
+	}
+	var query bytes.Buffer
+	query.WriteString("SELECT EXISTS(SELECT 1 FROM events WHERE idempotency_key = $1")
+	args := tenantFilter(tenantID, &query, []interface{}{idempotencyKey})
+	query.WriteString(`) AS "EXISTS"`)
 	var exists bool
-	err := r.db.GetContext(ctx, &exists, `SELECT EXISTS(SELECT 1 FROM events WHERE idempotency_key=$1) AS "EXISTS"`, idempotencyKey)
+	err = r.read(ctx, func(ctx context.Context, q sqlx.QueryerContext) error {
+		return sqlx.GetContext(ctx, q, &exists, query.String(), args...)
+	})
 	if err != nil {
 		return false, faults.Errorf("Unable to verify the existence of the idempotency key: %w", err)
 	}
 	return exists, nil
 }
 
-func (r *EsRepository) Forget(ctx context.Context, request eventsourcing.ForgetRequest, forget func(kind string, body []byte) ([]byte, error)) error {
-	// When Forget() is called, the aggregate is no longer used, therefore if it fails, it can be called again.
+var _ eventsourcing.AggregateIdempotencyKeyChecker = (*EsRepository)(nil)
 
-	// Forget events
-	events, err := r.queryEvents(ctx, "SELECT * FROM events WHERE aggregate_id = $1 AND kind = $2", request.AggregateID, request.EventKind)
+// HasAggregateIdempotencyKey checks if the idempotency key was used by the aggregate
+func (r *EsRepository) HasAggregateIdempotencyKey(ctx context.Context, aggregateID, idempotencyKey string) (bool, error) {
+	tenantID, err := r.tenant(ctx)
 	if err != nil {
-		return faults.Errorf("Unable to get events for Aggregate '%s' and event kind '%s': %w", request.AggregateID, request.EventKind, err)
+		return false, err
 	}
+	var query bytes.Buffer
+	query.WriteString("SELECT EXISTS(SELECT 1 FROM events WHERE aggregate_id = $1 AND idempotency_key = $2")
+	args := tenantFilter(tenantID, &query, []interface{}{aggregateID, idempotencyKey})
+	query.WriteString(`) AS "EXISTS"`)
+	var exists bool
+	err = r.read(ctx, func(ctx context.Context, q sqlx.QueryerContext) error {
+		return sqlx.GetContext(ctx, q, &exists, query.String(), args...)
+	})
+	if err != nil {
+		return false, faults.Errorf("Unable to verify the existence of the idempotency key for aggregate '%s': %w", aggregateID, err)
+	}
+	return exists, nil
+}
 
-	for _, evt := range events {
-		body, err := forget(evt.Kind.String(), evt.Body)
-		if err != nil {
-			return err
+var _ eventsourcing.StatsGetter = (*EsRepository)(nil)
+
+type statsRow struct {
+	AggregateType string          `db:"aggregate_type"`
+	Events        int64           `db:"events"`
+	FirstEventID  eventid.EventID `db:"first_id"`
+	LastEventID   eventid.EventID `db:"last_id"`
+	Oldest        time.Time       `db:"oldest"`
+	Newest        time.Time       `db:"newest"`
+}
+
+func (r *EsRepository) Stats(ctx context.Context) (eventsourcing.StoreStats, error) {
+	tenantID, err := r.tenant(ctx)
+	if err != nil {
+		return eventsourcing.StoreStats{}, err
+	}
+	var query bytes.Buffer
+	query.WriteString(`SELECT aggregate_type, COUNT(*) AS events, MIN(id) AS first_id, MAX(id) AS last_id, MIN(created_at) AS oldest, MAX(created_at) AS newest
+		FROM events WHERE 1 = 1`)
+	args := tenantFilter(tenantID, &query, []interface{}{})
+	query.WriteString(" GROUP BY aggregate_type")
+
+	rows := []statsRow{}
+	err = r.read(ctx, func(ctx context.Context, q sqlx.QueryerContext) error {
+		return sqlx.SelectContext(ctx, q, &rows, query.String(), args...)
+	})
+	if err != nil {
+		return eventsourcing.StoreStats{}, faults.Errorf("Unable to compute the events statistics: %w", err)
+	}
+	byType := make(map[eventsourcing.AggregateType]eventsourcing.EventsStats, len(rows))
+	for _, row := range rows {
+		byType[eventsourcing.AggregateType(row.AggregateType)] = eventsourcing.EventsStats{
+			Events:       row.Events,
+			FirstEventID: row.FirstEventID,
+			LastEventID:  row.LastEventID,
+			Oldest:       row.Oldest,
+			Newest:       row.Newest,
 		}
-		_, err = r.db.ExecContext(ctx, "UPDATE events SET body = $1 WHERE ID = $2", body, evt.ID.String())
+	}
+	return eventsourcing.NewStoreStats(byType), nil
+}
+
+func (r *EsRepository) Forget(ctx context.Context, request eventsourcing.ForgetRequest, forget func(kind string, body []byte) ([]byte, error)) error {
+	tenantID, err := r.tenant(ctx)
+	if err != nil {
+		return err
+	}
+	// events and snapshots are forgotten atomically, so that an erasure is all or nothing
+	return r.withTxx(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		// Forget events
+		query, args := forgetEventsQuery("*", tenantID, request)
+		events, err := queryEvents(ctx, tx, query, args...)
 		if err != nil {
-			return faults.Errorf("Unable to forget event ID %s: %w", evt.ID, err)
+			return faults.Errorf("Unable to get events for Aggregate '%s' and event kind '%s': %w", request.AggregateID, request.EventKind, err)
 		}
-	}
 
-	// forget snapshots
-	snaps := []Snapshot{}
-	if err := r.db.SelectContext(ctx, &snaps, "SELECT * FROM snapshots WHERE aggregate_id = $1", request.AggregateID); err != nil {
-		if err == sql.ErrNoRows {
-			return nil
+		forgottenAt := time.Now().UTC()
+		for len(events) > 0 {
+			size := len(events)
+			if size > forgetBatchSize {
+				size = forgetBatchSize
+			}
+			args := []interface{}{forgottenAt}
+			for _, evt := range events[:size] {
+				body, err := forget(evt.Kind.String(), evt.Body)
+				if err != nil {
+					return err
+				}
+				args = append(args, evt.ID.String(), body)
+			}
+			_, err = tx.ExecContext(ctx, bulkBodyUpdate("events", ", forgotten_at = $1", 1, size), args...)
+			if err != nil {
+				return faults.Errorf("Unable to forget %d events of aggregate '%s': %w", size, request.AggregateID, err)
+			}
+			events = events[size:]
+		}
+
+		// forget snapshots
+		snaps := []Snapshot{}
+		query, args = forgetSnapshotsQuery("*", tenantID, request)
+		if err := tx.SelectContext(ctx, &snaps, query, args...); err != nil {
+			return faults.Errorf("Unable to get snapshot for aggregate '%s': %w", request.AggregateID, err)
+		}
+
+		for len(snaps) > 0 {
+			size := len(snaps)
+			if size > forgetBatchSize {
+				size = forgetBatchSize
+			}
+			args := []interface{}{}
+			for _, snap := range snaps[:size] {
+				body, err := forget(snap.AggregateType.String(), snap.Body)
+				if err != nil {
+					return err
+				}
+				args = append(args, snap.ID, body)
+			}
+			_, err = tx.ExecContext(ctx, bulkBodyUpdate("snapshots", "", 0, size), args...)
+			if err != nil {
+				return faults.Errorf("Unable to forget %d snapshots of aggregate '%s': %w", size, request.AggregateID, err)
+			}
+			snaps = snaps[size:]
 		}
-		return faults.Errorf("Unable to get snapshot for aggregate '%s': %w", request.AggregateID, err)
-	}
 
-	for _, snap := range snaps {
-		body, err := forget(snap.AggregateType.String(), snap.Body)
+		return nil
+	})
+}
+
+var _ eventsourcing.ForgetPreviewer = (*EsRepository)(nil)
+
+func (r *EsRepository) PreviewForget(ctx context.Context, request eventsourcing.ForgetRequest) (eventsourcing.ForgetPreview, error) {
+	preview := eventsourcing.ForgetPreview{
+		EventIDs:    []eventid.EventID{},
+		SnapshotIDs: []eventid.EventID{},
+	}
+	tenantID, err := r.tenant(ctx)
+	if err != nil {
+		return eventsourcing.ForgetPreview{}, err
+	}
+	err = r.read(ctx, func(ctx context.Context, q sqlx.QueryerContext) error {
+		query, args := forgetEventsQuery("id", tenantID, request)
+		err := sqlx.SelectContext(ctx, q, &preview.EventIDs, query+" ORDER BY id ASC", args...)
 		if err != nil {
-			return err
+			return faults.Errorf("Unable to get events for Aggregate '%s' and event kind '%s': %w", request.AggregateID, request.EventKind, err)
 		}
-		_, err = r.db.ExecContext(ctx, "UPDATE snapshots SET body = $1 WHERE ID = $2", body, snap.ID)
+		query, args = forgetSnapshotsQuery("id", tenantID, request)
+		err = sqlx.SelectContext(ctx, q, &preview.SnapshotIDs, query+" ORDER BY id ASC", args...)
 		if err != nil {
-			return faults.Errorf("Unable to forget snapshot ID %s: %w", snap.ID, err)
+			return faults.Errorf("Unable to get snapshots for aggregate '%s': %w", request.AggregateID, err)
 		}
+		return nil
+	})
+	if err != nil {
+		return eventsourcing.ForgetPreview{}, err
 	}
+	return preview, nil
+}
 
-	return nil
+// forgetEventsQuery builds the query for the columns of the events to forget, of the tenant, if any
+func forgetEventsQuery(columns, tenantID string, request eventsourcing.ForgetRequest) (string, []interface{}) {
+	var query bytes.Buffer
+	query.WriteString("SELECT " + columns + " FROM events WHERE aggregate_id = $1 AND kind = $2")
+	args := tenantFilter(tenantID, &query, []interface{}{request.AggregateID, request.EventKind})
+	return query.String(), args
+}
+
+// forgetSnapshotsQuery builds the query for the columns of the snapshots to forget, of the tenant, if any
+func forgetSnapshotsQuery(columns, tenantID string, request eventsourcing.ForgetRequest) (string, []interface{}) {
+	var query bytes.Buffer
+	query.WriteString("SELECT " + columns + " FROM snapshots WHERE aggregate_id = $1")
+	args := tenantFilter(tenantID, &query, []interface{}{request.AggregateID})
+	return query.String(), args
+}
+
+// bulkBodyUpdate builds an UPDATE of the body of several rows of the table, from a list of (id, body) pairs.
+// The placeholders of the pairs come after the first offset placeholders, that can be used by the extra set clause.
+func bulkBodyUpdate(table, set string, offset, rows int) string {
+	var query strings.Builder
+	query.WriteString("UPDATE " + table + " AS t SET body = v.body" + set + " FROM (VALUES ")
+	for i := 0; i < rows; i++ {
+		if i > 0 {
+			query.WriteString(", ")
+		}
+		p := offset + 2*i + 1
+		query.WriteString(fmt.Sprintf("($%d, $%d::bytea)", p, p+1))
+	}
+	query.WriteString(") AS v(id, body) WHERE t.id = v.id")
+	return query.String()
 }
 
 func (r *EsRepository) GetLastEventID(ctx context.Context, trailingLag time.Duration, filter store.Filter) (eventid.EventID, error) {
+	tenantID, err := r.tenant(ctx)
+	if err != nil {
+		return eventid.Zero, err
+	}
 	var query bytes.Buffer
-	query.WriteString("SELECT * FROM events ")
+	query.WriteString("SELECT id FROM events WHERE 1 = 1 ")
 	args := []interface{}{}
 	if trailingLag != time.Duration(0) {
 		safetyMargin := time.Now().UTC().Add(-trailingLag)
 		args = append(args, safetyMargin)
-		query.WriteString("created_at <= $1 ")
+		query.WriteString("AND created_at <= $1 ")
 	}
+	args = tenantFilter(tenantID, &query, args)
 	args = buildFilter(filter, &query, args)
 	query.WriteString(" ORDER BY id DESC LIMIT 1")
 	var eventID eventid.EventID
-	if err := r.db.GetContext(ctx, &eventID, query.String(), args...); err != nil {
+	err = r.read(ctx, func(ctx context.Context, q sqlx.QueryerContext) error {
+		return sqlx.GetContext(ctx, q, &eventID, query.String(), args...)
+	})
+	if err != nil {
 		if err != sql.ErrNoRows {
 			return eventid.Zero, faults.Errorf("unable to get the last event ID: %w", err)
 		}
@@ -329,6 +983,10 @@ func (r *EsRepository) GetLastEventID(ctx context.Context, trailingLag time.Dura
 }
 
 func (r *EsRepository) GetEvents(ctx context.Context, afterEventID eventid.EventID, batchSize int, trailingLag time.Duration, filter store.Filter) ([]eventsourcing.Event, error) {
+	tenantID, err := r.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
 	var records []eventsourcing.Event
 	for len(records) < batchSize {
 		var query bytes.Buffer
@@ -339,6 +997,7 @@ func (r *EsRepository) GetEvents(ctx context.Context, afterEventID eventid.Event
 			args = append(args, safetyMargin)
 			query.WriteString("AND created_at <= $2 ")
 		}
+		args = tenantFilter(tenantID, &query, args)
 		args = buildFilter(filter, &query, args)
 		query.WriteString(" ORDER BY id ASC")
 		if batchSize > 0 {
@@ -360,6 +1019,97 @@ func (r *EsRepository) GetEvents(ctx context.Context, afterEventID eventid.Event
 	return records, nil
 }
 
+// GetEventsByIDs gets the events with the IDs, in one query, in the order of the IDs.
+// The IDs that were not found, eg: of events of another tenant, are returned instead of failing.
+func (r *EsRepository) GetEventsByIDs(ctx context.Context, ids []eventid.EventID) ([]eventsourcing.Event, []eventid.EventID, error) {
+	if len(ids) == 0 {
+		return []eventsourcing.Event{}, nil, nil
+	}
+	tenantID, err := r.tenant(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	var query bytes.Buffer
+	query.WriteString("SELECT * FROM events WHERE id = ANY($1)")
+	args := []interface{}{pq.Array(eventIDs(ids))}
+	args = tenantFilter(tenantID, &query, args)
+
+	rows, err := r.queryEvents(ctx, query.String(), args...)
+	if err != nil {
+		return nil, nil, faults.Errorf("Unable to get events by IDs: %w", err)
+	}
+
+	found := make(map[eventid.EventID]eventsourcing.Event, len(rows))
+	for _, e := range rows {
+		found[e.ID] = e
+	}
+	events := make([]eventsourcing.Event, 0, len(rows))
+	var missing []eventid.EventID
+	for _, id := range ids {
+		e, ok := found[id]
+		if !ok {
+			missing = append(missing, id)
+			continue
+		}
+		events = append(events, e)
+	}
+	return events, missing, nil
+}
+
+// CountAggregateEvents counts the events of the aggregate, without reading them
+func (r *EsRepository) CountAggregateEvents(ctx context.Context, aggregateID string) (int, error) {
+	tenantID, err := r.tenant(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var query bytes.Buffer
+	query.WriteString("SELECT COUNT(*) FROM events WHERE aggregate_id = $1")
+	args := []interface{}{aggregateID}
+	args = tenantFilter(tenantID, &query, args)
+
+	var count int
+	err = r.read(ctx, func(ctx context.Context, q sqlx.QueryerContext) error {
+		return sqlx.GetContext(ctx, q, &count, query.String(), args...)
+	})
+	if err != nil {
+		return 0, faults.Errorf("Unable to count the events of aggregate '%s': %w", aggregateID, err)
+	}
+	return count, nil
+}
+
+// CountEvents counts the events passing the filter, without reading them, eg: to size a projection rebuild.
+// The filter is applied as in GetEvents.
+func (r *EsRepository) CountEvents(ctx context.Context, filter store.Filter) (int64, error) {
+	tenantID, err := r.tenant(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var query bytes.Buffer
+	query.WriteString("SELECT COUNT(*) FROM events WHERE 1 = 1")
+	args := []interface{}{}
+	args = tenantFilter(tenantID, &query, args)
+	args = buildFilter(filter, &query, args)
+
+	var count int64
+	err = r.read(ctx, func(ctx context.Context, q sqlx.QueryerContext) error {
+		return sqlx.GetContext(ctx, q, &count, query.String(), args...)
+	})
+	if err != nil {
+		return 0, faults.Errorf("Unable to count the events for filter %+v: %w", filter, err)
+	}
+	return count, nil
+}
+
+// tenantFilter constrains the query to the rows of the tenant, if any
+func tenantFilter(tenantID string, query *bytes.Buffer, args []interface{}) []interface{} {
+	if tenantID == "" {
+		return args
+	}
+	args = append(args, tenantID)
+	query.WriteString(fmt.Sprintf(" AND tenant_id = $%d", len(args)))
+	return args
+}
+
 func buildFilter(filter store.Filter, query *bytes.Buffer, args []interface{}) []interface{} {
 	if len(filter.AggregateTypes) > 0 {
 		query.WriteString(" AND (")
@@ -372,6 +1122,41 @@ func buildFilter(filter store.Filter, query *bytes.Buffer, args []interface{}) [
 		}
 		query.WriteString(")")
 	}
+	if len(filter.ExcludeAggregateTypes) > 0 {
+		query.WriteString(" AND aggregate_type NOT IN (")
+		for k, v := range filter.ExcludeAggregateTypes {
+			if k > 0 {
+				query.WriteString(", ")
+			}
+			args = append(args, v)
+			query.WriteString(fmt.Sprintf("$%d", len(args)))
+		}
+		query.WriteString(")")
+	}
+
+	if len(filter.AggregateIDs) > 0 {
+		query.WriteString(" AND aggregate_id IN (")
+		for k, v := range filter.AggregateIDs {
+			if k > 0 {
+				query.WriteString(", ")
+			}
+			args = append(args, v)
+			query.WriteString(fmt.Sprintf("$%d", len(args)))
+		}
+		query.WriteString(")")
+	}
+
+	if len(filter.EventKinds) > 0 {
+		query.WriteString(" AND kind IN (")
+		for k, v := range filter.EventKinds {
+			if k > 0 {
+				query.WriteString(", ")
+			}
+			args = append(args, v)
+			query.WriteString(fmt.Sprintf("$%d", len(args)))
+		}
+		query.WriteString(")")
+	}
 
 	if filter.Partitions > 1 {
 		size := len(args)
@@ -380,7 +1165,7 @@ func buildFilter(filter store.Filter, query *bytes.Buffer, args []interface{}) [
 			query.WriteString(fmt.Sprintf(" AND MOD(aggregate_id_hash, $%d) = $%d", size+1, size+2))
 		} else {
 			args = append(args, filter.Partitions, filter.PartitionLow-1, filter.PartitionHi-1)
-			query.WriteString(fmt.Sprintf(" AND MOD(aggregate_id_hash, $%d) BETWEEN $%d AND $%d", size+1, size+2, size+4))
+			query.WriteString(fmt.Sprintf(" AND MOD(aggregate_id_hash, $%d) BETWEEN $%d AND $%d", size+1, size+2, size+3))
 		}
 	}
 
@@ -393,50 +1178,120 @@ func buildFilter(filter store.Filter, query *bytes.Buffer, args []interface{}) [
 					query.WriteString(" OR ")
 				}
 				v = escape(v)
-				query.WriteString(fmt.Sprintf(`metadata  @> '{"%s": "%s"}'`, k, v))
-				query.WriteString(")")
+				query.WriteString(fmt.Sprintf(`metadata @> '{"%s": "%s"}'`, k, v))
 			}
+			query.WriteString(")")
 		}
 	}
+	for k, values := range filter.ExcludeMetadata {
+		k = escape(k)
+		query.WriteString(" AND NOT (")
+		for idx, v := range values {
+			if idx > 0 {
+				query.WriteString(" OR ")
+			}
+			query.WriteString(fmt.Sprintf(`metadata @> '{"%s": "%s"}'`, k, escape(v)))
+		}
+		query.WriteString(")")
+	}
+	for _, k := range filter.MetadataExists {
+		query.WriteString(fmt.Sprintf(` AND metadata ? '%s'`, escape(k)))
+	}
+	if filter.RawCondition != "" {
+		query.WriteString(" AND (")
+		query.WriteString(offsetPlaceholders(filter.RawCondition, len(args)))
+		query.WriteString(")")
+		args = append(args, filter.RawArgs...)
+	}
 	return args
 }
 
+var placeholderRe = regexp.MustCompile(`\$(\d+)`)
+
+// offsetPlaceholders renumbers the placeholders of the fragment, that start at $1, to follow the ones already in the query
+func offsetPlaceholders(fragment string, offset int) string {
+	return placeholderRe.ReplaceAllStringFunc(fragment, func(p string) string {
+		n, _ := strconv.Atoi(p[1:])
+		return "$" + strconv.Itoa(n+offset)
+	})
+}
+
 func escape(s string) string {
 	return strings.ReplaceAll(s, "'", "''")
 }
 
 func (r *EsRepository) queryEvents(ctx context.Context, query string, args ...interface{}) ([]eventsourcing.Event, error) {
-	rows, err := r.db.QueryxContext(ctx, query, args...)
+	var events []eventsourcing.Event
+	err := r.read(ctx, func(ctx context.Context, q sqlx.QueryerContext) error {
+		var err error
+		events, err = queryEvents(ctx, q, query, args...)
+		return err
+	})
+	return events, err
+}
+
+func queryEvents(ctx context.Context, q sqlx.QueryerContext, query string, args ...interface{}) ([]eventsourcing.Event, error) {
+	rows, err := q.QueryxContext(ctx, query, args...)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return []eventsourcing.Event{}, nil
 		}
 		return nil, faults.Errorf("Unable to query events: %w", err)
 	}
+	defer rows.Close()
+
 	events := []eventsourcing.Event{}
 	for rows.Next() {
-		pg := Event{}
-		err := rows.StructScan(&pg)
+		evt, err := scanEvent(rows)
 		if err != nil {
-			return nil, faults.Errorf("Unable to scan to struct: %w", err)
+			return nil, err
 		}
-		metadata := map[string]interface{}{}
-		err = json.Unmarshal(pg.Metadata, &metadata)
-		if err != nil {
-			return nil, faults.Errorf("Unable to unmarshal metadata to map: %w", err)
-		}
-
-		events = append(events, eventsourcing.Event{
-			ID:               pg.ID,
-			AggregateID:      pg.AggregateID,
-			AggregateIDHash:  uint32(pg.AggregateIDHash),
-			AggregateVersion: pg.AggregateVersion,
-			AggregateType:    pg.AggregateType,
-			Kind:             pg.Kind,
-			Body:             pg.Body,
-			Metadata:         metadata,
-			CreatedAt:        pg.CreatedAt,
-		})
+		events = append(events, evt)
+	}
+	// a cancelled context, or a statement timeout, may stop the iteration
+	if err := rows.Err(); err != nil {
+		return nil, faults.Errorf("Unable to query events: %w", err)
 	}
 	return events, nil
 }
+
+func scanEvent(rows *sqlx.Rows) (eventsourcing.Event, error) {
+	pg := Event{}
+	err := rows.StructScan(&pg)
+	if err != nil {
+		return eventsourcing.Event{}, faults.Errorf("Unable to scan to struct: %w", err)
+	}
+	return toEvent(pg)
+}
+
+func toEvent(pg Event) (eventsourcing.Event, error) {
+	metadata := map[string]interface{}{}
+	err := json.Unmarshal(pg.Metadata, &metadata)
+	if err != nil {
+		return eventsourcing.Event{}, faults.Errorf("Unable to unmarshal metadata to map: %w", err)
+	}
+
+	return eventsourcing.Event{
+		ID:               pg.ID,
+		AggregateID:      pg.AggregateID,
+		AggregateIDHash:  uint32(pg.AggregateIDHash),
+		AggregateVersion: pg.AggregateVersion,
+		AggregateType:    pg.AggregateType,
+		Kind:             pg.Kind,
+		Body:             pg.Body,
+		ContentType:      string(pg.ContentType),
+		Metadata:         metadata,
+		CreatedAt:        pg.CreatedAt,
+		TenantID:         string(pg.TenantID),
+		EventVersion:     pg.EventVersion,
+		ForgottenAt:      pg.ForgottenAt.Time,
+	}, nil
+}
+
+// eventVersion defaults the event version to 1
+func eventVersion(v uint16) uint16 {
+	if v == 0 {
+		return 1
+	}
+	return v
+}
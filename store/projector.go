@@ -0,0 +1,71 @@
+package store
+
+import (
+	"github.com/quintans/eventsourcing"
+)
+
+// Flusher is implemented by the projectors that defer their work.
+// The repositories call Flush after saving all the events and just before committing, and an error rolls back the save.
+type Flusher interface {
+	Flush() error
+}
+
+// Flush flushes the projector if it is a Flusher
+func Flush(projector Projector) error {
+	if f, ok := projector.(Flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+var (
+	_ Projector = (*BatchProjector)(nil)
+	_ Flusher   = (*BatchProjector)(nil)
+)
+
+// BatchProjector accumulates the projected events and hands them to the project function in batches,
+// so that a save of many events does not make one call per event inside the write transaction.
+// The remaining events are handed over just before the commit.
+// A new BatchProjector must be created for every transaction, eg: in the ProjectorFactory of the repository.
+type BatchProjector struct {
+	batchSize int
+	project   func(events []eventsourcing.Event) error
+	events    []eventsourcing.Event
+	err       error
+}
+
+// NewBatchProjector creates a BatchProjector. With a batch size of zero, all the events are handed over just before the commit.
+func NewBatchProjector(batchSize int, project func(events []eventsourcing.Event) error) *BatchProjector {
+	return &BatchProjector{
+		batchSize: batchSize,
+		project:   project,
+	}
+}
+
+func (p *BatchProjector) Project(e eventsourcing.Event) {
+	if p.err != nil {
+		return
+	}
+	p.events = append(p.events, e)
+	if p.batchSize > 0 && len(p.events) >= p.batchSize {
+		// since Project cannot fail, the error is kept to be returned by Flush
+		p.err = p.flush()
+	}
+}
+
+func (p *BatchProjector) Flush() error {
+	if p.err != nil {
+		return p.err
+	}
+	p.err = p.flush()
+	return p.err
+}
+
+func (p *BatchProjector) flush() error {
+	if len(p.events) == 0 {
+		return nil
+	}
+	events := p.events
+	p.events = nil
+	return p.project(events)
+}
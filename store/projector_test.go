@@ -0,0 +1,39 @@
+package store_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/quintans/eventsourcing"
+	"github.com/quintans/eventsourcing/store"
+)
+
+func TestBatchProjector(t *testing.T) {
+	var batches [][]eventsourcing.Event
+	p := store.NewBatchProjector(2, func(events []eventsourcing.Event) error {
+		batches = append(batches, events)
+		return nil
+	})
+	for i := 0; i < 5; i++ {
+		p.Project(eventsourcing.Event{AggregateVersion: uint32(i + 1)})
+	}
+	require.Len(t, batches, 2)
+	require.NoError(t, store.Flush(p))
+	require.Len(t, batches, 3)
+	require.Len(t, batches[2], 1)
+	require.Equal(t, uint32(5), batches[2][0].AggregateVersion)
+
+	// a failed batch is reported by the flush
+	fail := errors.New("failed")
+	calls := 0
+	p = store.NewBatchProjector(1, func(events []eventsourcing.Event) error {
+		calls++
+		return fail
+	})
+	p.Project(eventsourcing.Event{})
+	p.Project(eventsourcing.Event{})
+	require.True(t, errors.Is(store.Flush(p), fail))
+	require.Equal(t, 1, calls)
+}
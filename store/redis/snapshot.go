@@ -0,0 +1,189 @@
+package redis
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/quintans/faults"
+
+	"github.com/quintans/eventsourcing"
+	"github.com/quintans/eventsourcing/eventid"
+)
+
+const (
+	defaultPrefix = "snapshot"
+
+	fieldID               = "id"
+	fieldAggregateVersion = "aggregate_version"
+	fieldAggregateType    = "aggregate_type"
+	fieldBody             = "body"
+	fieldCreatedAt        = "created_at"
+	fieldTenantID         = "tenant_id"
+)
+
+// saveScript only writes the snapshot if it is more recent than the one already stored,
+// so that out of order writes (eg: async snapshots) never replace a newer snapshot.
+// KEYS[1] - snapshot key
+// ARGV[1] - aggregate version
+// ARGV[2] - expiration in milliseconds (0 for none)
+// ARGV[3..] - field/value pairs
+var saveScript = redis.NewScript(`
+local current = redis.call('HGET', KEYS[1], 'aggregate_version')
+if current and tonumber(current) >= tonumber(ARGV[1]) then
+	return 0
+end
+redis.call('DEL', KEYS[1])
+redis.call('HSET', KEYS[1], unpack(ARGV, 3))
+if tonumber(ARGV[2]) > 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 1
+`)
+
+var (
+	_ eventsourcing.SnapshotStore   = (*SnapshotStore)(nil)
+	_ eventsourcing.SnapshotDeleter = (*SnapshotStore)(nil)
+)
+
+type SnapshotOption func(*SnapshotStore)
+
+// WithPrefix sets the prefix of the keys holding the snapshots
+func WithPrefix(prefix string) SnapshotOption {
+	return func(r *SnapshotStore) {
+		r.prefix = prefix
+	}
+}
+
+// WithExpiration sets how long a snapshot is kept. By default snapshots never expire.
+func WithExpiration(expiration time.Duration) SnapshotOption {
+	return func(r *SnapshotStore) {
+		r.expiration = expiration
+	}
+}
+
+// WithMultiTenant keys the snapshots by tenant, failing the saves without a tenant,
+// and constrains the reads to the tenant of the context.
+// Since the snapshot of an aggregate is looked up by key, a context for all the tenants is not enough to read it.
+// Without this option the store is single tenant and the snapshots of all the tenants share the same keys.
+func WithMultiTenant() SnapshotOption {
+	return func(r *SnapshotStore) {
+		r.multiTenant = true
+	}
+}
+
+// SnapshotStore keeps the latest snapshot of each aggregate in a redis hash
+type SnapshotStore struct {
+	rdb         redis.UniversalClient
+	prefix      string
+	expiration  time.Duration
+	multiTenant bool
+}
+
+func NewSnapshotStore(rdb redis.UniversalClient, options ...SnapshotOption) *SnapshotStore {
+	r := &SnapshotStore{
+		rdb:    rdb,
+		prefix: defaultPrefix,
+	}
+	for _, o := range options {
+		o(r)
+	}
+	return r
+}
+
+func (r *SnapshotStore) key(tenantID, aggregateID string) string {
+	if tenantID == "" {
+		return r.prefix + ":" + aggregateID
+	}
+	return r.prefix + ":" + tenantID + ":" + aggregateID
+}
+
+// tenant returns the tenant of the context that the keys are scoped to, or empty if the store is single tenant
+func (r *SnapshotStore) tenant(ctx context.Context) (string, error) {
+	if !r.multiTenant {
+		return "", nil
+	}
+	tenantID, err := eventsourcing.TenantScope(ctx)
+	if err != nil {
+		return "", err
+	}
+	if tenantID == "" {
+		return "", faults.Errorf("%w: a snapshot is only reachable through its tenant", eventsourcing.ErrMissingTenant)
+	}
+	return tenantID, nil
+}
+
+func (r *SnapshotStore) GetSnapshot(ctx context.Context, aggregateID string) (eventsourcing.Snapshot, error) {
+	tenantID, err := r.tenant(ctx)
+	if err != nil {
+		return eventsourcing.Snapshot{}, err
+	}
+	values, err := r.rdb.HGetAll(ctx, r.key(tenantID, aggregateID)).Result()
+	if err != nil {
+		return eventsourcing.Snapshot{}, faults.Errorf("unable to get snapshot for aggregate '%s': %w", aggregateID, err)
+	}
+	if len(values) == 0 {
+		return eventsourcing.Snapshot{}, nil
+	}
+
+	id, err := eventid.Parse(values[fieldID])
+	if err != nil {
+		return eventsourcing.Snapshot{}, faults.Errorf("unable to parse snapshot ID '%s': %w", values[fieldID], err)
+	}
+	version, err := strconv.ParseUint(values[fieldAggregateVersion], 10, 32)
+	if err != nil {
+		return eventsourcing.Snapshot{}, faults.Errorf("unable to parse snapshot version '%s': %w", values[fieldAggregateVersion], err)
+	}
+	createdAt, err := time.Parse(time.RFC3339Nano, values[fieldCreatedAt])
+	if err != nil {
+		return eventsourcing.Snapshot{}, faults.Errorf("unable to parse snapshot creation time '%s': %w", values[fieldCreatedAt], err)
+	}
+
+	return eventsourcing.Snapshot{
+		ID:               id,
+		AggregateID:      aggregateID,
+		AggregateVersion: uint32(version),
+		AggregateType:    eventsourcing.AggregateType(values[fieldAggregateType]),
+		Body:             []byte(values[fieldBody]),
+		CreatedAt:        createdAt,
+		TenantID:         values[fieldTenantID],
+	}, nil
+}
+
+func (r *SnapshotStore) SaveSnapshot(ctx context.Context, snapshot eventsourcing.Snapshot) error {
+	if r.multiTenant && snapshot.TenantID == "" {
+		return faults.Errorf("%w: saving snapshot of aggregate '%s'", eventsourcing.ErrMissingTenant, snapshot.AggregateID)
+	}
+	tenantID := ""
+	if r.multiTenant {
+		tenantID = snapshot.TenantID
+	}
+	version := strconv.FormatUint(uint64(snapshot.AggregateVersion), 10)
+	err := saveScript.Run(
+		ctx,
+		r.rdb,
+		[]string{r.key(tenantID, snapshot.AggregateID)},
+		version,
+		r.expiration.Milliseconds(),
+		fieldID, snapshot.ID.String(),
+		fieldAggregateVersion, version,
+		fieldAggregateType, string(snapshot.AggregateType),
+		fieldBody, snapshot.Body,
+		fieldCreatedAt, snapshot.CreatedAt.UTC().Format(time.RFC3339Nano),
+		fieldTenantID, snapshot.TenantID,
+	).Err()
+	if err != nil {
+		return faults.Errorf("unable to save snapshot for aggregate '%s': %w", snapshot.AggregateID, err)
+	}
+	return nil
+}
+
+func (r *SnapshotStore) DeleteSnapshot(ctx context.Context, aggregateID string) error {
+	tenantID, err := r.tenant(ctx)
+	if err != nil {
+		return err
+	}
+	err = r.rdb.Del(ctx, r.key(tenantID, aggregateID)).Err()
+	return faults.Wrap(err)
+}
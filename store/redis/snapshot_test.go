@@ -0,0 +1,101 @@
+package redis_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/require"
+
+	"github.com/quintans/eventsourcing"
+	"github.com/quintans/eventsourcing/eventid"
+	rstore "github.com/quintans/eventsourcing/store/redis"
+)
+
+func newSnapshot(t *testing.T, version uint32, body string) eventsourcing.Snapshot {
+	now := time.Now().UTC()
+	id, err := eventid.New(now, eventid.EntropyFactory(now))
+	require.NoError(t, err)
+	return eventsourcing.Snapshot{
+		ID:               id,
+		AggregateID:      "123",
+		AggregateVersion: version,
+		AggregateType:    "Account",
+		Body:             []byte(body),
+		CreatedAt:        now,
+	}
+}
+
+func TestSnapshotStore(t *testing.T) {
+	mr, err := miniredis.Run()
+	require.NoError(t, err)
+	defer mr.Close()
+
+	ctx := context.Background()
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	s := rstore.NewSnapshotStore(rdb, rstore.WithExpiration(time.Hour))
+
+	snap, err := s.GetSnapshot(ctx, "123")
+	require.NoError(t, err)
+	require.True(t, snap.ID.IsZero())
+
+	snap10 := newSnapshot(t, 10, `{"balance":10}`)
+	require.NoError(t, s.SaveSnapshot(ctx, snap10))
+
+	// an older snapshot does not replace a newer one
+	require.NoError(t, s.SaveSnapshot(ctx, newSnapshot(t, 5, `{"balance":5}`)))
+
+	snap, err = s.GetSnapshot(ctx, "123")
+	require.NoError(t, err)
+	require.Equal(t, snap10.ID, snap.ID)
+	require.Equal(t, uint32(10), snap.AggregateVersion)
+	require.Equal(t, eventsourcing.AggregateType("Account"), snap.AggregateType)
+	require.Equal(t, snap10.Body, snap.Body)
+	require.True(t, snap10.CreatedAt.Equal(snap.CreatedAt))
+	require.Equal(t, time.Hour, mr.TTL("snapshot:123"))
+
+	require.NoError(t, s.DeleteSnapshot(ctx, "123"))
+	snap, err = s.GetSnapshot(ctx, "123")
+	require.NoError(t, err)
+	require.True(t, snap.ID.IsZero())
+}
+
+func TestMultiTenantSnapshotStore(t *testing.T) {
+	mr, err := miniredis.Run()
+	require.NoError(t, err)
+	defer mr.Close()
+
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	s := rstore.NewSnapshotStore(rdb, rstore.WithMultiTenant())
+
+	ctxA := eventsourcing.WithTenant(context.Background(), "A")
+	ctxB := eventsourcing.WithTenant(context.Background(), "B")
+
+	snap10 := newSnapshot(t, 10, `{"balance":10}`)
+	err = s.SaveSnapshot(ctxA, snap10)
+	require.True(t, errors.Is(err, eventsourcing.ErrMissingTenant), err)
+	snap10.TenantID = "A"
+	require.NoError(t, s.SaveSnapshot(ctxA, snap10))
+
+	snap, err := s.GetSnapshot(ctxA, "123")
+	require.NoError(t, err)
+	require.Equal(t, snap10.ID, snap.ID)
+	require.Equal(t, "A", snap.TenantID)
+	// the snapshot is not found by the other tenants
+	snap, err = s.GetSnapshot(ctxB, "123")
+	require.NoError(t, err)
+	require.True(t, snap.ID.IsZero())
+	_, err = s.GetSnapshot(context.Background(), "123")
+	require.True(t, errors.Is(err, eventsourcing.ErrMissingTenant), err)
+	_, err = s.GetSnapshot(eventsourcing.WithAllTenants(context.Background()), "123")
+	require.True(t, errors.Is(err, eventsourcing.ErrMissingTenant), err)
+
+	// deleting by another tenant changes nothing
+	require.NoError(t, s.DeleteSnapshot(ctxB, "123"))
+	snap, err = s.GetSnapshot(ctxA, "123")
+	require.NoError(t, err)
+	require.Equal(t, snap10.ID, snap.ID)
+}
@@ -0,0 +1,782 @@
+package sqlite
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/mattn/go-sqlite3"
+	"github.com/quintans/faults"
+
+	"github.com/quintans/eventsourcing"
+	"github.com/quintans/eventsourcing/eventid"
+	"github.com/quintans/eventsourcing/player"
+	"github.com/quintans/eventsourcing/store"
+)
+
+const driverName = "sqlite3"
+
+// Schema creates the tables used by the store
+const Schema = `
+CREATE TABLE IF NOT EXISTS events(
+	id VARCHAR (50) PRIMARY KEY,
+	aggregate_id VARCHAR (50) NOT NULL,
+	aggregate_id_hash INTEGER NOT NULL,
+	aggregate_version INTEGER NOT NULL,
+	aggregate_type VARCHAR (50) NOT NULL,
+	kind VARCHAR (50) NOT NULL,
+	body BLOB NOT NULL,
+	content_type VARCHAR (50),
+	idempotency_key VARCHAR (50),
+	metadata TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	forgotten_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS evt_agg_id_idx ON events (aggregate_id);
+CREATE UNIQUE INDEX IF NOT EXISTS evt_agg_id_ver_uk ON events (aggregate_id, aggregate_version);
+CREATE UNIQUE INDEX IF NOT EXISTS evt_idempot_uk ON events (idempotency_key);
+
+CREATE TABLE IF NOT EXISTS snapshots(
+	id VARCHAR (50) PRIMARY KEY,
+	aggregate_id VARCHAR (50) NOT NULL,
+	aggregate_version INTEGER NOT NULL,
+	aggregate_type VARCHAR (50) NOT NULL,
+	body BLOB NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	FOREIGN KEY (id) REFERENCES events (id)
+);
+CREATE INDEX IF NOT EXISTS snap_agg_id_idx ON snapshots (aggregate_id);
+`
+
+// AggregateIdempotencySchema replaces the global unique index on the idempotency key by one scoped by aggregate ID.
+// It is applied after Schema, when using eventsourcing.IdempotencyScopeAggregate.
+const AggregateIdempotencySchema = `
+DROP INDEX IF EXISTS evt_idempot_uk;
+CREATE UNIQUE INDEX IF NOT EXISTS evt_agg_idempot_uk ON events (aggregate_id, idempotency_key);
+`
+
+// Event is the event data stored in the database
+type Event struct {
+	ID               string                      `db:"id"`
+	AggregateID      string                      `db:"aggregate_id"`
+	AggregateIDHash  int32                       `db:"aggregate_id_hash"`
+	AggregateVersion uint32                      `db:"aggregate_version"`
+	AggregateType    eventsourcing.AggregateType `db:"aggregate_type"`
+	Kind             eventsourcing.EventKind     `db:"kind"`
+	Body             []byte                      `db:"body"`
+	ContentType      NilString                   `db:"content_type"`
+	IdempotencyKey   NilString                   `db:"idempotency_key"`
+	Metadata         string                      `db:"metadata"`
+	CreatedAt        time.Time                   `db:"created_at"`
+	ForgottenAt      sql.NullTime                `db:"forgotten_at"`
+}
+
+// NilString converts nil to empty string
+type NilString string
+
+// Scan implements the Scanner interface.
+func (ns *NilString) Scan(value interface{}) error {
+	if value == nil {
+		*ns = ""
+		return nil
+	}
+
+	switch s := value.(type) {
+	case string:
+		*ns = NilString(s)
+	case []byte:
+		*ns = NilString(s)
+	}
+	return nil
+}
+
+type Snapshot struct {
+	ID               string                      `db:"id,omitempty"`
+	AggregateID      string                      `db:"aggregate_id,omitempty"`
+	AggregateVersion uint32                      `db:"aggregate_version,omitempty"`
+	AggregateType    eventsourcing.AggregateType `db:"aggregate_type,omitempty"`
+	Body             []byte                      `db:"body,omitempty"`
+	CreatedAt        time.Time                   `db:"created_at,omitempty"`
+}
+
+var (
+	_ eventsourcing.EsRepository = (*EsRepository)(nil)
+	_ eventsourcing.BatchSaver   = (*EsRepository)(nil)
+	_ player.Repository          = (*EsRepository)(nil)
+)
+
+type StoreOption func(*EsRepository)
+
+type ProjectorFactory func(*sql.Tx) store.Projector
+
+func ProjectorFactoryOption(fn ProjectorFactory) StoreOption {
+	return func(r *EsRepository) {
+		r.projectorFactory = fn
+	}
+}
+
+// IdempotencyScopeOption sets the scope of the unique index on the idempotency key created by CreateSchema.
+// It must match the scope used by the event store.
+func IdempotencyScopeOption(scope eventsourcing.IdempotencyScope) StoreOption {
+	return func(r *EsRepository) {
+		r.idempotencyScope = scope
+	}
+}
+
+// EventIDGeneratorOption sets how the IDs of the events are generated, replacing eventid.Generate.
+// The IDs must have the creation time of the events, since the feeds rely on the IDs being ordered by creation time.
+func EventIDGeneratorOption(generator eventid.Generator) StoreOption {
+	return func(r *EsRepository) {
+		r.idGenerator = generator
+	}
+}
+
+// HashFuncOption sets the function that computes the aggregate ID hash, used to partition the events, replacing eventsourcing.HashAggregateID.
+// eg: eventsourcing.HashLabel("tenant") partitions the events by tenant.
+func HashFuncOption(fn eventsourcing.HashFunc) StoreOption {
+	return func(r *EsRepository) {
+		r.hashFunc = fn
+	}
+}
+
+type EsRepository struct {
+	db               *sqlx.DB
+	projectorFactory ProjectorFactory
+	idempotencyScope eventsourcing.IdempotencyScope
+	idGenerator      eventid.Generator
+	hashFunc         eventsourcing.HashFunc
+}
+
+// NewStore creates a store for the sqlite database in the data source, eg: file:events.db
+// Since sqlite only allows one writer at a time, the connection pool is limited to one connection.
+func NewStore(dataSourceName string, options ...StoreOption) (*EsRepository, error) {
+	db, err := sql.Open(driverName, dataSourceName)
+	if err != nil {
+		return nil, faults.Wrap(err)
+	}
+	db.SetMaxOpenConns(1)
+
+	dbx := sqlx.NewDb(db, driverName)
+	r := &EsRepository{
+		db:          dbx,
+		idGenerator: eventid.Generate,
+		hashFunc:    eventsourcing.HashAggregateID,
+	}
+
+	for _, o := range options {
+		o(r)
+	}
+
+	return r, nil
+}
+
+// CreateSchema creates the tables, if they do not exist
+func (r *EsRepository) CreateSchema(ctx context.Context) error {
+	_, err := r.db.ExecContext(ctx, Schema)
+	if err != nil {
+		return faults.Errorf("Unable to create schema: %w", err)
+	}
+	if r.idempotencyScope == eventsourcing.IdempotencyScopeAggregate {
+		_, err = r.db.ExecContext(ctx, AggregateIdempotencySchema)
+		if err != nil {
+			return faults.Errorf("Unable to create aggregate idempotency index: %w", err)
+		}
+	}
+	return nil
+}
+
+func (r *EsRepository) Close() error {
+	return faults.Wrap(r.db.Close())
+}
+
+var _ eventsourcing.AggregateHasher = (*EsRepository)(nil)
+
+// AggregateIDHash returns the hash that partitions the events of the aggregate
+func (r *EsRepository) AggregateIDHash(aggregateID string, labels map[string]interface{}) uint32 {
+	return r.hashFunc(aggregateID, labels)
+}
+
+func (r *EsRepository) SaveEvent(ctx context.Context, eRec eventsourcing.EventRecord) (eventid.EventID, uint32, error) {
+	ids, version, err := r.SaveEventIDs(ctx, eRec)
+	if err != nil {
+		return eventid.Zero, 0, err
+	}
+	return ids[len(ids)-1], version, nil
+}
+
+var _ eventsourcing.EventIDsSaver = (*EsRepository)(nil)
+
+// SaveEventIDs saves the events of the record, returning the IDs of all of them
+func (r *EsRepository) SaveEventIDs(ctx context.Context, eRec eventsourcing.EventRecord) ([]eventid.EventID, uint32, error) {
+	var ids []eventid.EventID
+	var version uint32
+	err := r.withTx(ctx, func(c context.Context, tx *sql.Tx) error {
+		projector := r.newProjector(tx)
+		var err error
+		ids, version, err = r.saveEvent(c, tx, projector, eRec)
+		if err != nil {
+			return err
+		}
+		return store.Flush(projector)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return ids, version, nil
+}
+
+// SaveEvents saves the events of several aggregates in a single transaction.
+// If any of the records fails to be saved, none is.
+func (r *EsRepository) SaveEvents(ctx context.Context, eRecs []eventsourcing.EventRecord) ([]eventsourcing.EventRecordResult, error) {
+	results := make([]eventsourcing.EventRecordResult, len(eRecs))
+	err := r.withTx(ctx, func(c context.Context, tx *sql.Tx) error {
+		projector := r.newProjector(tx)
+		for k, eRec := range eRecs {
+			ids, version, err := r.saveEvent(c, tx, projector, eRec)
+			if err != nil {
+				return err
+			}
+			results[k] = eventsourcing.EventRecordResult{
+				ID:      ids[len(ids)-1],
+				Version: version,
+			}
+		}
+		return store.Flush(projector)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+func (r *EsRepository) newProjector(tx *sql.Tx) store.Projector {
+	if r.projectorFactory == nil {
+		return nil
+	}
+	return r.projectorFactory(tx)
+}
+
+func (r *EsRepository) saveEvent(ctx context.Context, tx *sql.Tx, projector store.Projector, eRec eventsourcing.EventRecord) ([]eventid.EventID, uint32, error) {
+	metadata, err := json.Marshal(eRec.Labels)
+	if err != nil {
+		return nil, 0, faults.Wrap(err)
+	}
+
+	var idempotencyKey *string
+	if eRec.IdempotencyKey != eventsourcing.EmptyIdempotencyKey {
+		idempotencyKey = &eRec.IdempotencyKey
+	}
+
+	version := eRec.Version
+	ids := make([]eventid.EventID, 0, len(eRec.Details))
+	entropy := eventid.NewEntropy()
+	for _, e := range eRec.Details {
+		id, err := r.idGenerator.New(entropy, eRec.CreatedAt, eRec.AggregateID, version+1)
+		if err != nil {
+			return nil, 0, faults.Wrap(err)
+		}
+		version++
+		hash := r.hashFunc(eRec.AggregateID, eRec.Labels)
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO events (id, aggregate_id, aggregate_version, aggregate_type, kind, body, content_type, idempotency_key, metadata, created_at, aggregate_id_hash)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			id.String(), eRec.AggregateID, version, eRec.AggregateType, e.Kind, e.Body, eRec.ContentType, idempotencyKey, string(metadata), eRec.CreatedAt, int32ring(hash))
+
+		if err != nil {
+			if e := dupError(err); e != nil {
+				return nil, 0, e
+			}
+			return nil, 0, faults.Errorf("Unable to insert event: %w", err)
+		}
+		ids = append(ids, id)
+
+		if projector != nil {
+			evt := eventsourcing.Event{
+				ID:               id,
+				AggregateID:      eRec.AggregateID,
+				AggregateIDHash:  hash,
+				AggregateVersion: version,
+				AggregateType:    eRec.AggregateType,
+				Kind:             e.Kind,
+				Body:             e.Body,
+				ContentType:      eRec.ContentType,
+				Metadata:         eRec.Labels,
+				CreatedAt:        eRec.CreatedAt,
+			}
+			projector.Project(evt)
+		}
+	}
+
+	return ids, version, nil
+}
+
+func int32ring(x uint32) int32 {
+	h := int32(x)
+	// we want a positive value so that partitioning (mod) results in a positive value.
+	// if h overflows, becoming negative, setting sign bit to zero will make the overflow start from zero
+	if h < 0 {
+		// setting sign bit to zero
+		h &= 0x7fffffff
+	}
+	return h
+}
+
+// dupError converts a unique violation into ErrDuplicateIdempotencyKey, if the idempotency key column is one of the violated ones,
+// or ErrConcurrentModification otherwise, keeping the database error as the cause. Other errors return nil.
+func dupError(err error) error {
+	se, ok := err.(sqlite3.Error)
+	if !ok || (se.ExtendedCode != sqlite3.ErrConstraintUnique && se.ExtendedCode != sqlite3.ErrConstraintPrimaryKey) {
+		return nil
+	}
+	// eg: UNIQUE constraint failed: events.idempotency_key
+	if strings.Contains(se.Error(), "idempotency_key") {
+		return eventsourcing.WrapCause(eventsourcing.ErrDuplicateIdempotencyKey, se)
+	}
+	return eventsourcing.WrapCause(eventsourcing.ErrConcurrentModification, se)
+}
+
+func (r *EsRepository) GetSnapshot(ctx context.Context, aggregateID string) (eventsourcing.Snapshot, error) {
+	snap := Snapshot{}
+	if err := r.db.GetContext(ctx, &snap, "SELECT * FROM snapshots WHERE aggregate_id = ? ORDER BY id DESC LIMIT 1", aggregateID); err != nil {
+		if err == sql.ErrNoRows {
+			return eventsourcing.Snapshot{}, nil
+		}
+		return eventsourcing.Snapshot{}, faults.Errorf("Unable to get snapshot for aggregate '%s': %w", aggregateID, err)
+	}
+	eventID, err := eventid.Parse(snap.ID)
+	if err != nil {
+		return eventsourcing.Snapshot{}, faults.Wrap(err)
+	}
+	return eventsourcing.Snapshot{
+		ID:               eventID,
+		AggregateID:      aggregateID,
+		AggregateVersion: snap.AggregateVersion,
+		AggregateType:    snap.AggregateType,
+		Body:             snap.Body,
+		CreatedAt:        snap.CreatedAt,
+	}, nil
+}
+
+func (r *EsRepository) SaveSnapshot(ctx context.Context, snapshot eventsourcing.Snapshot) error {
+	s := Snapshot{
+		ID:               snapshot.ID.String(),
+		AggregateID:      snapshot.AggregateID,
+		AggregateVersion: snapshot.AggregateVersion,
+		AggregateType:    snapshot.AggregateType,
+		Body:             snapshot.Body,
+		CreatedAt:        snapshot.CreatedAt,
+	}
+	_, err := r.db.NamedExecContext(ctx,
+		`INSERT INTO snapshots (id, aggregate_id, aggregate_version, aggregate_type, body, created_at)
+	     VALUES (:id, :aggregate_id, :aggregate_version, :aggregate_type, :body, :created_at)`, s)
+
+	return faults.Wrap(err)
+}
+
+var _ eventsourcing.SnapshotPruner = (*EsRepository)(nil)
+
+func (r *EsRepository) DeleteSnapshots(ctx context.Context, aggregateID string, keepLast int) error {
+	_, err := r.db.ExecContext(ctx,
+		`DELETE FROM snapshots WHERE id IN (
+			SELECT id FROM (
+				SELECT id, ROW_NUMBER() OVER (ORDER BY aggregate_version DESC) AS pos FROM snapshots WHERE aggregate_id = ?
+			) AS s WHERE pos > ?
+		)`, aggregateID, keepLast)
+	if err != nil {
+		return faults.Errorf("Unable to delete the snapshots of aggregate '%s': %w", aggregateID, err)
+	}
+	return nil
+}
+
+func (r *EsRepository) PruneSnapshots(ctx context.Context, keepLast int) (int64, error) {
+	res, err := r.db.ExecContext(ctx,
+		`DELETE FROM snapshots WHERE id IN (
+			SELECT id FROM (
+				SELECT id, ROW_NUMBER() OVER (PARTITION BY aggregate_id ORDER BY aggregate_version DESC) AS pos FROM snapshots
+			) AS s WHERE pos > ?
+		)`, keepLast)
+	if err != nil {
+		return 0, faults.Errorf("Unable to prune the snapshots: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, faults.Wrap(err)
+	}
+	return n, nil
+}
+
+func (r *EsRepository) GetAggregateEvents(ctx context.Context, aggregateID string, snapVersion int) ([]eventsourcing.Event, error) {
+	var query bytes.Buffer
+	query.WriteString("SELECT * FROM events e WHERE e.aggregate_id = ?")
+	args := []interface{}{aggregateID}
+	if snapVersion > -1 {
+		query.WriteString(" AND e.aggregate_version > ?")
+		args = append(args, snapVersion)
+	}
+	query.WriteString(" ORDER BY aggregate_version ASC")
+
+	events, err := r.queryEvents(ctx, query.String(), args...)
+	if err != nil {
+		return nil, faults.Errorf("Unable to get events for Aggregate '%s': %w", aggregateID, err)
+	}
+
+	return events, nil
+}
+
+func (r *EsRepository) withTx(ctx context.Context, fn func(context.Context, *sql.Tx) error) (err error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return faults.Wrap(err)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+			panic(r)
+		}
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	err = fn(ctx, tx)
+	if err != nil {
+		return err
+	}
+	return faults.Wrap(tx.Commit())
+}
+
+func (r *EsRepository) HasIdempotencyKey(ctx context.Context, idempotencyKey string) (bool, error) {
+	var exists bool
+	err := r.db.GetContext(ctx, &exists, `SELECT EXISTS(SELECT 1 FROM events WHERE idempotency_key=?) AS "EXISTS"`, idempotencyKey)
+	if err != nil {
+		return false, faults.Errorf("Unable to verify the existence of the idempotency key: %w", err)
+	}
+	return exists, nil
+}
+
+var _ eventsourcing.AggregateIdempotencyKeyChecker = (*EsRepository)(nil)
+
+// HasAggregateIdempotencyKey checks if the idempotency key was used by the aggregate
+func (r *EsRepository) HasAggregateIdempotencyKey(ctx context.Context, aggregateID, idempotencyKey string) (bool, error) {
+	var exists bool
+	err := r.db.GetContext(ctx, &exists, `SELECT EXISTS(SELECT 1 FROM events WHERE aggregate_id=? AND idempotency_key=?) AS "EXISTS"`, aggregateID, idempotencyKey)
+	if err != nil {
+		return false, faults.Errorf("Unable to verify the existence of the idempotency key for aggregate '%s': %w", aggregateID, err)
+	}
+	return exists, nil
+}
+
+var _ eventsourcing.StatsGetter = (*EsRepository)(nil)
+
+type statsRow struct {
+	AggregateType string          `db:"aggregate_type"`
+	Events        int64           `db:"events"`
+	FirstEventID  eventid.EventID `db:"first_id"`
+	LastEventID   eventid.EventID `db:"last_id"`
+	// the result of an aggregate function has no declared type, so the driver does not convert it to a time
+	Oldest string `db:"oldest"`
+	Newest string `db:"newest"`
+}
+
+func (r *EsRepository) Stats(ctx context.Context) (eventsourcing.StoreStats, error) {
+	rows := []statsRow{}
+	err := r.db.SelectContext(ctx, &rows,
+		`SELECT aggregate_type, COUNT(*) AS events, MIN(id) AS first_id, MAX(id) AS last_id, MIN(created_at) AS oldest, MAX(created_at) AS newest
+		FROM events GROUP BY aggregate_type`)
+	if err != nil {
+		return eventsourcing.StoreStats{}, faults.Errorf("Unable to compute the events statistics: %w", err)
+	}
+	byType := make(map[eventsourcing.AggregateType]eventsourcing.EventsStats, len(rows))
+	for _, row := range rows {
+		oldest, err := parseTimestamp(row.Oldest)
+		if err != nil {
+			return eventsourcing.StoreStats{}, err
+		}
+		newest, err := parseTimestamp(row.Newest)
+		if err != nil {
+			return eventsourcing.StoreStats{}, err
+		}
+		byType[eventsourcing.AggregateType(row.AggregateType)] = eventsourcing.EventsStats{
+			Events:       row.Events,
+			FirstEventID: row.FirstEventID,
+			LastEventID:  row.LastEventID,
+			Oldest:       oldest,
+			Newest:       newest,
+		}
+	}
+	return eventsourcing.NewStoreStats(byType), nil
+}
+
+// parseTimestamp parses a timestamp the way the driver does for the columns declared as TIMESTAMP
+func parseTimestamp(s string) (time.Time, error) {
+	s = strings.TrimSuffix(s, "Z")
+	for _, format := range sqlite3.SQLiteTimestampFormats {
+		if t, err := time.ParseInLocation(format, s, time.UTC); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, faults.Errorf("Unable to parse the timestamp '%s'", s)
+}
+
+func (r *EsRepository) Forget(ctx context.Context, req eventsourcing.ForgetRequest, forget func(kind string, body []byte) ([]byte, error)) error {
+	// When Forget() is called, the aggregate is no longer used, therefore if it fails, it can be called again.
+
+	// Forget events
+	events, err := r.queryEvents(ctx, "SELECT * FROM events WHERE aggregate_id = ? AND kind = ?", req.AggregateID, req.EventKind)
+	if err != nil {
+		return faults.Errorf("Unable to get events for Aggregate '%s' and event kind '%s': %w", req.AggregateID, req.EventKind, err)
+	}
+
+	forgottenAt := time.Now().UTC()
+	for _, evt := range events {
+		body, err := forget(evt.Kind.String(), evt.Body)
+		if err != nil {
+			return err
+		}
+		_, err = r.db.ExecContext(ctx, "UPDATE events SET body = ?, forgotten_at = ? WHERE ID = ?", body, forgottenAt, evt.ID.String())
+		if err != nil {
+			return faults.Errorf("Unable to forget event ID %s: %w", evt.ID, err)
+		}
+	}
+
+	// forget snapshots
+	snaps := []Snapshot{}
+	if err := r.db.SelectContext(ctx, &snaps, "SELECT * FROM snapshots WHERE aggregate_id = ?", req.AggregateID); err != nil {
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return faults.Errorf("Unable to get snapshot for aggregate '%s': %w", req.AggregateID, err)
+	}
+
+	for _, snap := range snaps {
+		body, err := forget(snap.AggregateType.String(), snap.Body)
+		if err != nil {
+			return err
+		}
+		_, err = r.db.ExecContext(ctx, "UPDATE snapshots SET body = ? WHERE ID = ?", body, snap.ID)
+		if err != nil {
+			return faults.Errorf("Unable to forget snapshot ID %s: %w", snap.ID, err)
+		}
+	}
+
+	return nil
+}
+
+var _ eventsourcing.ForgetPreviewer = (*EsRepository)(nil)
+
+func (r *EsRepository) PreviewForget(ctx context.Context, req eventsourcing.ForgetRequest) (eventsourcing.ForgetPreview, error) {
+	preview := eventsourcing.ForgetPreview{
+		EventIDs:    []eventid.EventID{},
+		SnapshotIDs: []eventid.EventID{},
+	}
+	err := r.db.SelectContext(ctx, &preview.EventIDs, "SELECT id FROM events WHERE aggregate_id = ? AND kind = ? ORDER BY id ASC", req.AggregateID, req.EventKind)
+	if err != nil {
+		return eventsourcing.ForgetPreview{}, faults.Errorf("Unable to get events for Aggregate '%s' and event kind '%s': %w", req.AggregateID, req.EventKind, err)
+	}
+	err = r.db.SelectContext(ctx, &preview.SnapshotIDs, "SELECT id FROM snapshots WHERE aggregate_id = ? ORDER BY id ASC", req.AggregateID)
+	if err != nil {
+		return eventsourcing.ForgetPreview{}, faults.Errorf("Unable to get snapshots for aggregate '%s': %w", req.AggregateID, err)
+	}
+	return preview, nil
+}
+
+func (r *EsRepository) GetLastEventID(ctx context.Context, trailingLag time.Duration, filter store.Filter) (eventid.EventID, error) {
+	var query bytes.Buffer
+	query.WriteString("SELECT id FROM events WHERE 1 = 1 ")
+	args := []interface{}{}
+	if trailingLag != time.Duration(0) {
+		safetyMargin := time.Now().UTC().Add(-trailingLag)
+		args = append(args, safetyMargin)
+		query.WriteString("AND created_at <= ? ")
+	}
+	args = buildFilter(filter, &query, args)
+	query.WriteString(" ORDER BY id DESC LIMIT 1")
+	var eventID string
+	if err := r.db.GetContext(ctx, &eventID, query.String(), args...); err != nil {
+		if err == sql.ErrNoRows {
+			return eventid.Zero, nil
+		}
+		return eventid.Zero, faults.Errorf("unable to get the last event ID: %w", err)
+	}
+	eID, err := eventid.Parse(eventID)
+	if err != nil {
+		return eventid.Zero, faults.Errorf("unable to parse event ID '%s': %w", eventID, err)
+	}
+	return eID, nil
+}
+
+func (r *EsRepository) GetEvents(ctx context.Context, afterEventID eventid.EventID, batchSize int, trailingLag time.Duration, filter store.Filter) ([]eventsourcing.Event, error) {
+	var query bytes.Buffer
+	query.WriteString("SELECT * FROM events WHERE id > ? ")
+	args := []interface{}{afterEventID.String()}
+	if trailingLag != time.Duration(0) {
+		safetyMargin := time.Now().UTC().Add(-trailingLag)
+		args = append(args, safetyMargin)
+		query.WriteString("AND created_at <= ? ")
+	}
+	args = buildFilter(filter, &query, args)
+	query.WriteString(" ORDER BY id ASC")
+	if batchSize > 0 {
+		query.WriteString(" LIMIT ")
+		query.WriteString(strconv.Itoa(batchSize))
+	}
+
+	events, err := r.queryEvents(ctx, query.String(), args...)
+	if err != nil {
+		return nil, faults.Errorf("Unable to get events after '%s' for filter %+v: %w", afterEventID, filter, err)
+	}
+	return events, nil
+}
+
+func buildFilter(filter store.Filter, query *bytes.Buffer, args []interface{}) []interface{} {
+	if len(filter.AggregateTypes) > 0 {
+		query.WriteString(" AND (")
+		for k, v := range filter.AggregateTypes {
+			if k > 0 {
+				query.WriteString(" OR ")
+			}
+			args = append(args, v)
+			query.WriteString("aggregate_type = ?")
+		}
+		query.WriteString(")")
+	}
+	if len(filter.ExcludeAggregateTypes) > 0 {
+		query.WriteString(" AND aggregate_type NOT IN (")
+		for k, v := range filter.ExcludeAggregateTypes {
+			if k > 0 {
+				query.WriteString(", ")
+			}
+			args = append(args, v)
+			query.WriteString("?")
+		}
+		query.WriteString(")")
+	}
+
+	if len(filter.AggregateIDs) > 0 {
+		query.WriteString(" AND aggregate_id IN (")
+		for k, v := range filter.AggregateIDs {
+			if k > 0 {
+				query.WriteString(", ")
+			}
+			args = append(args, v)
+			query.WriteString("?")
+		}
+		query.WriteString(")")
+	}
+
+	if len(filter.EventKinds) > 0 {
+		query.WriteString(" AND kind IN (")
+		for k, v := range filter.EventKinds {
+			if k > 0 {
+				query.WriteString(", ")
+			}
+			args = append(args, v)
+			query.WriteString("?")
+		}
+		query.WriteString(")")
+	}
+
+	if filter.Partitions > 1 {
+		if filter.PartitionLow == filter.PartitionHi {
+			args = append(args, filter.Partitions, filter.PartitionLow-1)
+			query.WriteString(" AND (aggregate_id_hash % ?) = ?")
+		} else {
+			args = append(args, filter.Partitions, filter.PartitionLow-1, filter.PartitionHi-1)
+			query.WriteString(" AND (aggregate_id_hash % ?) BETWEEN ? AND ?")
+		}
+	}
+
+	if len(filter.Metadata) > 0 {
+		for k, values := range filter.Metadata {
+			k = escape(k)
+			query.WriteString(" AND (")
+			for idx, v := range values {
+				if idx > 0 {
+					query.WriteString(" OR ")
+				}
+				v = escape(v)
+				query.WriteString(fmt.Sprintf(`json_extract(metadata, '$.%s') = '%s'`, k, v))
+			}
+			query.WriteString(")")
+		}
+	}
+	// a missing key makes the comparison NULL, so it is turned into false to keep the event
+	for k, values := range filter.ExcludeMetadata {
+		k = escape(k)
+		query.WriteString(" AND NOT COALESCE(")
+		for idx, v := range values {
+			if idx > 0 {
+				query.WriteString(" OR ")
+			}
+			query.WriteString(fmt.Sprintf(`json_extract(metadata, '$.%s') = '%s'`, k, escape(v)))
+		}
+		query.WriteString(", FALSE)")
+	}
+	// json_type is only NULL when the key is missing, not when its value is null
+	for _, k := range filter.MetadataExists {
+		query.WriteString(fmt.Sprintf(` AND json_type(metadata, '$.%s') IS NOT NULL`, escape(k)))
+	}
+	if filter.RawCondition != "" {
+		query.WriteString(" AND (")
+		query.WriteString(filter.RawCondition)
+		query.WriteString(")")
+		args = append(args, filter.RawArgs...)
+	}
+	return args
+}
+
+func escape(s string) string {
+	return strings.ReplaceAll(s, "'", "''")
+}
+
+func (r *EsRepository) queryEvents(ctx context.Context, query string, args ...interface{}) ([]eventsourcing.Event, error) {
+	rows, err := r.db.QueryxContext(ctx, query, args...)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return []eventsourcing.Event{}, nil
+		}
+		return nil, faults.Errorf("unable to query events with %s: %w", query, err)
+	}
+	defer rows.Close()
+
+	events := []eventsourcing.Event{}
+	for rows.Next() {
+		event := Event{}
+		err := rows.StructScan(&event)
+		if err != nil {
+			return nil, faults.Errorf("unable to scan to struct: %w", err)
+		}
+		metadata := map[string]interface{}{}
+		err = json.Unmarshal([]byte(event.Metadata), &metadata)
+		if err != nil {
+			return nil, faults.Errorf("unable to unmarshal metadata to map: %w", err)
+		}
+
+		id, err := eventid.Parse(event.ID)
+		if err != nil {
+			return nil, faults.Errorf("unable to parse event ID '%s': %w", event.ID, err)
+		}
+		events = append(events, eventsourcing.Event{
+			ID:               id,
+			AggregateID:      event.AggregateID,
+			AggregateIDHash:  uint32(event.AggregateIDHash),
+			AggregateVersion: event.AggregateVersion,
+			AggregateType:    event.AggregateType,
+			Kind:             event.Kind,
+			Body:             event.Body,
+			ContentType:      string(event.ContentType),
+			IdempotencyKey:   string(event.IdempotencyKey),
+			Metadata:         metadata,
+			CreatedAt:        event.CreatedAt,
+			ForgottenAt:      event.ForgottenAt.Time,
+		})
+	}
+	return events, nil
+}
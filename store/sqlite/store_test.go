@@ -0,0 +1,458 @@
+package sqlite_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/quintans/eventsourcing"
+	"github.com/quintans/eventsourcing/eventid"
+	"github.com/quintans/eventsourcing/store"
+	"github.com/quintans/eventsourcing/store/sqlite"
+	"github.com/quintans/eventsourcing/test"
+)
+
+func newStore(t *testing.T, options ...sqlite.StoreOption) *sqlite.EsRepository {
+	dir, err := ioutil.TempDir("", "eventsourcing")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+
+	r, err := sqlite.NewStore("file:"+filepath.Join(dir, "events.db"), options...)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		r.Close()
+	})
+	err = r.CreateSchema(context.Background())
+	require.NoError(t, err)
+	return r
+}
+
+func TestSaveAndGet(t *testing.T) {
+	ctx := context.Background()
+	r := newStore(t)
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{}, eventsourcing.WithSnapshotThreshold(3))
+
+	id := uuid.New()
+	acc := test.CreateAccount("Paulo", id, 100)
+	acc.Deposit(10)
+	acc.Deposit(20)
+	err := es.Save(ctx, acc)
+	require.NoError(t, err)
+	acc.Deposit(5)
+	err = es.Save(ctx, acc, eventsourcing.WithIdempotencyKey("idempotency-key"))
+	require.NoError(t, err)
+
+	snap, err := r.GetSnapshot(ctx, id.String())
+	require.NoError(t, err)
+	assert.Equal(t, uint32(3), snap.AggregateVersion)
+
+	a, err := es.GetByID(ctx, id.String())
+	require.NoError(t, err)
+	acc2 := a.(*test.Account)
+	assert.Equal(t, id, acc2.ID)
+	assert.Equal(t, uint32(4), acc2.GetVersion())
+	assert.Equal(t, int64(135), acc2.Balance)
+
+	found, err := es.HasIdempotencyKey(ctx, "idempotency-key")
+	require.NoError(t, err)
+	require.True(t, found)
+
+	acc.Deposit(5)
+	err = es.Save(ctx, acc, eventsourcing.WithIdempotencyKey("idempotency-key"))
+	require.True(t, errors.Is(err, eventsourcing.ErrDuplicateIdempotencyKey))
+
+	// stale version
+	acc2.Deposit(5)
+	acc2.SetVersion(2)
+	err = es.Save(ctx, acc2)
+	require.True(t, errors.Is(err, eventsourcing.ErrConcurrentModification))
+	var se sqlite3.Error
+	require.True(t, errors.As(err, &se))
+	assert.Equal(t, sqlite3.ErrConstraint, se.Code)
+}
+
+func TestSaveEventIDs(t *testing.T) {
+	ctx := context.Background()
+	r := newStore(t)
+
+	id := uuid.New().String()
+	ids, version, err := r.SaveEventIDs(ctx, eventsourcing.EventRecord{
+		AggregateID:   id,
+		AggregateType: "Account",
+		CreatedAt:     time.Now().UTC(),
+		Details: []eventsourcing.EventRecordDetail{
+			{Kind: "MoneyDeposited", Body: []byte(`{"money":10}`)},
+			{Kind: "MoneyDeposited", Body: []byte(`{"money":20}`)},
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, uint32(2), version)
+
+	events, err := r.GetAggregateEvents(ctx, id, -1)
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	assert.Equal(t, []eventid.EventID{events[0].ID, events[1].ID}, ids)
+}
+
+func TestForget(t *testing.T) {
+	ctx := context.Background()
+	r := newStore(t)
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{})
+
+	id := uuid.New()
+	acc := test.CreateAccount("Paulo", id, 100)
+	acc.UpdateOwner("Paulo Quintans")
+	err := es.Save(ctx, acc)
+	require.NoError(t, err)
+
+	preview, err := es.PreviewForget(ctx, eventsourcing.ForgetRequest{
+		AggregateID: id.String(),
+		EventKind:   "OwnerUpdated",
+	})
+	require.NoError(t, err)
+	events, err := r.GetAggregateEvents(ctx, id.String(), -1)
+	require.NoError(t, err)
+	assert.Equal(t, []eventid.EventID{events[1].ID}, preview.EventIDs)
+	assert.Empty(t, preview.SnapshotIDs)
+	assert.False(t, events[1].IsForgotten())
+
+	err = es.Forget(ctx,
+		eventsourcing.ForgetRequest{
+			AggregateID: id.String(),
+			EventKind:   "OwnerUpdated",
+		},
+		func(i interface{}) interface{} {
+			if t, ok := i.(test.OwnerUpdated); ok {
+				t.Owner = ""
+				return t
+			}
+			return i
+		},
+	)
+	require.NoError(t, err)
+
+	events, err = r.GetAggregateEvents(ctx, id.String(), -1)
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	assert.False(t, events[0].IsForgotten())
+	assert.True(t, events[1].IsForgotten())
+}
+
+func TestAggregateIdempotencyScope(t *testing.T) {
+	ctx := context.Background()
+	r := newStore(t, sqlite.IdempotencyScopeOption(eventsourcing.IdempotencyScopeAggregate))
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{}, eventsourcing.WithIdempotencyScope(eventsourcing.IdempotencyScopeAggregate))
+
+	id1 := uuid.New()
+	acc1 := test.CreateAccount("Paulo", id1, 100)
+	err := es.Save(ctx, acc1, eventsourcing.WithIdempotencyKey("idempotency-key"))
+	require.NoError(t, err)
+
+	// another aggregate can reuse the key
+	id2 := uuid.New()
+	acc2 := test.CreateAccount("Pereira", id2, 100)
+	err = es.Save(ctx, acc2, eventsourcing.WithIdempotencyKey("idempotency-key"))
+	require.NoError(t, err)
+
+	found, err := es.HasAggregateIdempotencyKey(ctx, id1.String(), "idempotency-key")
+	require.NoError(t, err)
+	assert.True(t, found)
+	found, err = es.HasAggregateIdempotencyKey(ctx, uuid.New().String(), "idempotency-key")
+	require.NoError(t, err)
+	assert.False(t, found)
+
+	// but not the same aggregate
+	acc1.Deposit(5)
+	err = es.Save(ctx, acc1, eventsourcing.WithIdempotencyKey("idempotency-key"))
+	require.True(t, errors.Is(err, eventsourcing.ErrDuplicateIdempotencyKey))
+}
+
+func TestGetEventsWithFilter(t *testing.T) {
+	ctx := context.Background()
+	r := newStore(t)
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{})
+
+	acc1 := test.CreateAccount("Paulo", uuid.New(), 100)
+	err := es.Save(ctx, acc1, eventsourcing.WithMetadata(map[string]interface{}{"geo": "EU"}))
+	require.NoError(t, err)
+	acc2 := test.CreateAccount("Pereira", uuid.New(), 100)
+	err = es.Save(ctx, acc2, eventsourcing.WithMetadata(map[string]interface{}{"geo": "US"}))
+	require.NoError(t, err)
+
+	events, err := r.GetEvents(ctx, eventid.Zero, 10, 0, store.Filter{
+		Metadata: store.Metadata{"geo": []string{"EU"}},
+	})
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, acc1.GetID(), events[0].AggregateID)
+
+	lastID, err := r.GetLastEventID(ctx, 0, store.Filter{AggregateTypes: []eventsourcing.AggregateType{"Account"}})
+	require.NoError(t, err)
+	all, err := r.GetEvents(ctx, eventid.Zero, 0, 0, store.Filter{})
+	require.NoError(t, err)
+	require.Len(t, all, 2)
+	assert.Equal(t, all[1].ID, lastID)
+}
+
+func TestGetEventsWithMetadataExists(t *testing.T) {
+	ctx := context.Background()
+	r := newStore(t)
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{})
+
+	acc1 := test.CreateAccount("Paulo", uuid.New(), 100)
+	err := es.Save(ctx, acc1, eventsourcing.WithMetadata(map[string]interface{}{"geo": nil}))
+	require.NoError(t, err)
+	acc2 := test.CreateAccount("Pereira", uuid.New(), 100)
+	err = es.Save(ctx, acc2)
+	require.NoError(t, err)
+
+	events, err := r.GetEvents(ctx, eventid.Zero, 10, 0, store.Filter{
+		MetadataExists: []string{"geo"},
+	})
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, acc1.GetID(), events[0].AggregateID)
+}
+
+func TestGetEventsWithExclusions(t *testing.T) {
+	ctx := context.Background()
+	r := newStore(t)
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{})
+
+	acc1 := test.CreateAccount("Paulo", uuid.New(), 100)
+	err := es.Save(ctx, acc1, eventsourcing.WithMetadata(map[string]interface{}{"geo": "EU"}))
+	require.NoError(t, err)
+	acc2 := test.CreateAccount("Pereira", uuid.New(), 100)
+	err = es.Save(ctx, acc2, eventsourcing.WithMetadata(map[string]interface{}{"geo": "US"}))
+	require.NoError(t, err)
+	acc3 := test.CreateAccount("Quintans", uuid.New(), 100)
+	err = es.Save(ctx, acc3)
+	require.NoError(t, err)
+
+	// events without the key are kept
+	events, err := r.GetEvents(ctx, eventid.Zero, 10, 0, store.Filter{
+		ExcludeMetadata: store.Metadata{"geo": []string{"EU"}},
+	})
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	assert.ElementsMatch(t, []string{acc2.GetID(), acc3.GetID()}, aggregateIDs(events))
+
+	events, err = r.GetEvents(ctx, eventid.Zero, 10, 0, store.Filter{
+		ExcludeAggregateTypes: []eventsourcing.AggregateType{"Account"},
+	})
+	require.NoError(t, err)
+	require.Len(t, events, 0)
+}
+
+func TestGetEventsWithAggregateIDs(t *testing.T) {
+	ctx := context.Background()
+	r := newStore(t)
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{})
+
+	accs := []*test.Account{
+		test.CreateAccount("Paulo", uuid.New(), 100),
+		test.CreateAccount("Pereira", uuid.New(), 100),
+		test.CreateAccount("Quintans", uuid.New(), 100),
+	}
+	for _, acc := range accs {
+		err := es.Save(ctx, acc)
+		require.NoError(t, err)
+	}
+
+	events, err := r.GetEvents(ctx, eventid.Zero, 10, 0, store.Filter{AggregateIDs: []string{}})
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+
+	events, err = r.GetEvents(ctx, eventid.Zero, 10, 0, store.Filter{AggregateIDs: []string{accs[1].GetID()}})
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, accs[1].GetID(), events[0].AggregateID)
+
+	events, err = r.GetEvents(ctx, eventid.Zero, 10, 0, store.Filter{AggregateIDs: []string{accs[0].GetID(), accs[2].GetID()}})
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	assert.ElementsMatch(t, []string{accs[0].GetID(), accs[2].GetID()}, aggregateIDs(events))
+}
+
+func TestGetEventsWithEventKinds(t *testing.T) {
+	ctx := context.Background()
+	r := newStore(t)
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{})
+
+	acc := test.CreateAccount("Paulo", uuid.New(), 100)
+	acc.Deposit(10)
+	acc.Withdraw(5)
+	err := es.Save(ctx, acc)
+	require.NoError(t, err)
+
+	events, err := r.GetEvents(ctx, eventid.Zero, 10, 0, store.Filter{
+		EventKinds: []eventsourcing.EventKind{"MoneyDeposited", "MoneyWithdrawn"},
+	})
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	assert.Equal(t, eventsourcing.EventKind("MoneyDeposited"), events[0].Kind)
+	assert.Equal(t, eventsourcing.EventKind("MoneyWithdrawn"), events[1].Kind)
+}
+
+func TestGetEventsWithRawCondition(t *testing.T) {
+	ctx := context.Background()
+	r := newStore(t)
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{})
+
+	acc := test.CreateAccount("Paulo", uuid.New(), 100)
+	acc.Deposit(10)
+	err := es.Save(ctx, acc)
+	require.NoError(t, err)
+
+	events, err := r.GetEvents(ctx, eventid.Zero, 10, 0, store.Filter{
+		AggregateTypes: []eventsourcing.AggregateType{"Account"},
+		RawCondition:   "kind = ? OR kind = ?",
+		RawArgs:        []interface{}{"MoneyDeposited", "unknown"},
+	})
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, eventsourcing.EventKind("MoneyDeposited"), events[0].Kind)
+}
+
+func TestBatchProjector(t *testing.T) {
+	ctx := context.Background()
+	var batches [][]eventsourcing.Event
+	fail := false
+	r := newStore(t, sqlite.ProjectorFactoryOption(func(tx *sql.Tx) store.Projector {
+		return store.NewBatchProjector(0, func(events []eventsourcing.Event) error {
+			if fail {
+				return errors.New("projection failure")
+			}
+			batches = append(batches, events)
+			return nil
+		})
+	}))
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{})
+
+	id := uuid.New()
+	acc := test.CreateAccount("Paulo", id, 100)
+	acc.Deposit(10)
+	acc.Deposit(20)
+	err := es.Save(ctx, acc)
+	require.NoError(t, err)
+	// all the events in a single call, before the commit
+	require.Len(t, batches, 1)
+	require.Len(t, batches[0], 3)
+
+	// a failed projection rolls back the save
+	fail = true
+	acc.Deposit(5)
+	err = es.Save(ctx, acc)
+	require.Error(t, err)
+	events, err := r.GetAggregateEvents(ctx, id.String(), -1)
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+}
+
+func TestStats(t *testing.T) {
+	ctx := context.Background()
+	r := newStore(t)
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{})
+
+	stats, err := es.Stats(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), stats.Events)
+	assert.True(t, stats.LastEventID.IsZero())
+	assert.Empty(t, stats.ByAggregateType)
+
+	acc1 := test.CreateAccount("Paulo", uuid.New(), 100)
+	acc1.Deposit(10)
+	err = es.Save(ctx, acc1)
+	require.NoError(t, err)
+	acc2 := test.CreateAccount("Pereira", uuid.New(), 100)
+	err = es.Save(ctx, acc2)
+	require.NoError(t, err)
+
+	events, err := r.GetEvents(ctx, eventid.Zero, 10, 0, store.Filter{})
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+
+	first, last := events[0].ID, events[0].ID
+	oldest, newest := events[0].CreatedAt, events[0].CreatedAt
+	for _, e := range events[1:] {
+		if e.ID.Compare(first) < 0 {
+			first = e.ID
+		}
+		if e.ID.Compare(last) > 0 {
+			last = e.ID
+		}
+		if e.CreatedAt.Before(oldest) {
+			oldest = e.CreatedAt
+		}
+		if e.CreatedAt.After(newest) {
+			newest = e.CreatedAt
+		}
+	}
+
+	stats, err = es.Stats(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), stats.Events)
+	assert.Equal(t, first, stats.FirstEventID)
+	assert.Equal(t, last, stats.LastEventID)
+	assert.True(t, oldest.Equal(stats.Oldest))
+	assert.True(t, newest.Equal(stats.Newest))
+	require.Len(t, stats.ByAggregateType, 1)
+	assert.Equal(t, stats.EventsStats, stats.ByAggregateType["Account"])
+}
+
+func TestPruneSnapshots(t *testing.T) {
+	ctx := context.Background()
+	r := newStore(t)
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{}, eventsourcing.WithSnapshotThreshold(1))
+
+	id1 := uuid.New()
+	acc1 := test.CreateAccount("Paulo", id1, 100)
+	id2 := uuid.New()
+	acc2 := test.CreateAccount("Pereira", id2, 100)
+	for i := 0; i < 3; i++ {
+		acc1.Deposit(10)
+		err := es.Save(ctx, acc1)
+		require.NoError(t, err)
+		acc2.Deposit(10)
+		err = es.Save(ctx, acc2)
+		require.NoError(t, err)
+	}
+
+	err := r.DeleteSnapshots(ctx, id1.String(), 1)
+	require.NoError(t, err)
+	snap, err := r.GetSnapshot(ctx, id1.String())
+	require.NoError(t, err)
+	assert.Equal(t, uint32(4), snap.AggregateVersion)
+
+	// only the snapshots of the second aggregate are left to prune
+	deleted, err := r.PruneSnapshots(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), deleted)
+	snap, err = r.GetSnapshot(ctx, id2.String())
+	require.NoError(t, err)
+	assert.Equal(t, uint32(4), snap.AggregateVersion)
+
+	deleted, err = r.PruneSnapshots(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), deleted)
+}
+
+func aggregateIDs(events []eventsourcing.Event) []string {
+	ids := make([]string, 0, len(events))
+	for _, e := range events {
+		ids = append(ids, e.AggregateID)
+	}
+	return ids
+}
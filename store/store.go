@@ -1,15 +1,45 @@
 package store
 
-import "github.com/quintans/eventsourcing"
+import (
+	"errors"
+	"fmt"
+
+	"github.com/quintans/eventsourcing"
+	"github.com/quintans/eventsourcing/common"
+)
+
+// ErrRawConditionNotSupported is returned by the repositories that are not SQL based when the filter has a raw condition
+var ErrRawConditionNotSupported = errors.New("raw condition not supported")
+
+// ErrInvalidPartitions is returned when partition ranges are invalid, or don't cover all the partitions
+var ErrInvalidPartitions = errors.New("invalid partitions")
 
 type Filter struct {
 	AggregateTypes []eventsourcing.AggregateType
+	// AggregateIDs restricts the events to the ones of these aggregates, eg: to rebuild the projection of a single tenant
+	AggregateIDs []string
+	// EventKinds restricts the events to the ones of these kinds
+	EventKinds []eventsourcing.EventKind
+	// ExcludeAggregateTypes are the aggregate types to leave out
+	ExcludeAggregateTypes []eventsourcing.AggregateType
 	// Metadata filters on top of metadata. Every key of the map is ANDed with every OR of the values
 	// eg: [{"geo": "EU"}, {"geo": "USA"}, {"membership": "prime"}] equals to:  geo IN ("EU", "USA") AND membership = "prime"
-	Metadata     Metadata
-	Partitions   uint32
-	PartitionLow uint32
-	PartitionHi  uint32
+	Metadata Metadata
+	// ExcludeMetadata leaves out the events matching any of the values of any of the keys.
+	// Events without the key are kept.
+	ExcludeMetadata Metadata
+	// MetadataExists are the metadata keys that must be present, with any value
+	MetadataExists []string
+	Partitions     uint32
+	PartitionLow   uint32
+	PartitionHi    uint32
+	// RawCondition is an SQL fragment, ANDed with the other conditions, for what the structured filter cannot express,
+	// eg: a JSON path condition on the body. Only the SQL repositories support it.
+	// The fragment is trusted and is written verbatim into the query, so it must never be built from user input.
+	// The values must go in RawArgs and be referenced by placeholders, in the database syntax.
+	// Numbered placeholders ($1, $2, ...) are relative to RawArgs and are offset to match their position in the query.
+	RawCondition string
+	RawArgs      []interface{}
 }
 
 type FilterOption func(*Filter)
@@ -17,10 +47,17 @@ type FilterOption func(*Filter)
 func WithFilter(filter Filter) FilterOption {
 	return func(f *Filter) {
 		f.AggregateTypes = filter.AggregateTypes
+		f.AggregateIDs = filter.AggregateIDs
+		f.EventKinds = filter.EventKinds
+		f.ExcludeAggregateTypes = filter.ExcludeAggregateTypes
 		f.Metadata = filter.Metadata
+		f.ExcludeMetadata = filter.ExcludeMetadata
+		f.MetadataExists = filter.MetadataExists
 		f.Partitions = filter.Partitions
 		f.PartitionLow = filter.PartitionLow
 		f.PartitionHi = filter.PartitionHi
+		f.RawCondition = filter.RawCondition
+		f.RawArgs = filter.RawArgs
 	}
 }
 
@@ -30,6 +67,27 @@ func WithAggregateTypes(at ...eventsourcing.AggregateType) FilterOption {
 	}
 }
 
+// WithAggregateIDs filters the events of the aggregates
+func WithAggregateIDs(ids ...string) FilterOption {
+	return func(f *Filter) {
+		f.AggregateIDs = ids
+	}
+}
+
+// WithEventKinds filters the events of the kinds, eg: for projections that only care about a few of them
+func WithEventKinds(kinds ...eventsourcing.EventKind) FilterOption {
+	return func(f *Filter) {
+		f.EventKinds = kinds
+	}
+}
+
+// WithExcludeAggregateTypes leaves out the events of the aggregate types
+func WithExcludeAggregateTypes(at ...eventsourcing.AggregateType) FilterOption {
+	return func(f *Filter) {
+		f.ExcludeAggregateTypes = at
+	}
+}
+
 func WithMetadataKV(key, value string) FilterOption {
 	return func(f *Filter) {
 		if f.Metadata == nil {
@@ -45,6 +103,24 @@ func WithMetadataKV(key, value string) FilterOption {
 	}
 }
 
+// WithMetadataExists filters the events that have the metadata key, whatever the value.
+// eg: to tell apart the events that were tagged from the ones that were not, during a rollout
+func WithMetadataExists(key string) FilterOption {
+	return func(f *Filter) {
+		f.MetadataExists = append(f.MetadataExists, key)
+	}
+}
+
+// WithExcludeMetadataKV leaves out the events with the metadata value. Events without the key are kept.
+func WithExcludeMetadataKV(key, value string) FilterOption {
+	return func(f *Filter) {
+		if f.ExcludeMetadata == nil {
+			f.ExcludeMetadata = Metadata{}
+		}
+		f.ExcludeMetadata[key] = append(f.ExcludeMetadata[key], value)
+	}
+}
+
 type Metadata map[string][]string
 
 func WithMetadata(metadata Metadata) FilterOption {
@@ -64,6 +140,107 @@ func WithPartitions(partitions, partitionsLow, partitionsHi uint32) FilterOption
 	}
 }
 
+// WithRawCondition adds a trusted SQL fragment to the filter. See Filter.RawCondition
+func WithRawCondition(condition string, args ...interface{}) FilterOption {
+	return func(f *Filter) {
+		f.RawCondition = condition
+		f.RawArgs = args
+	}
+}
+
+// Matches checks in memory if the event passes the filter, eg: for the events pushed by a feed.
+// The RawCondition is not evaluated.
+func (f Filter) Matches(e eventsourcing.Event) bool {
+	if len(f.AggregateTypes) > 0 {
+		found := false
+		for _, v := range f.AggregateTypes {
+			if e.AggregateType == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	for _, v := range f.ExcludeAggregateTypes {
+		if e.AggregateType == v {
+			return false
+		}
+	}
+
+	if len(f.AggregateIDs) > 0 {
+		found := false
+		for _, v := range f.AggregateIDs {
+			if e.AggregateID == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(f.EventKinds) > 0 {
+		found := false
+		for _, v := range f.EventKinds {
+			if e.Kind == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if f.Partitions > 1 {
+		part := common.WhichPartition(e.AggregateIDHash, f.Partitions)
+		if part < f.PartitionLow || part > f.PartitionHi {
+			return false
+		}
+	}
+
+	for k, values := range f.ExcludeMetadata {
+		v, ok := e.Metadata[k]
+		if !ok {
+			continue
+		}
+		for _, value := range values {
+			if fmt.Sprint(v) == value {
+				return false
+			}
+		}
+	}
+
+	for _, k := range f.MetadataExists {
+		if _, ok := e.Metadata[k]; !ok {
+			return false
+		}
+	}
+
+	for k, values := range f.Metadata {
+		v, ok := e.Metadata[k]
+		if !ok {
+			return false
+		}
+		found := false
+		for _, value := range values {
+			if fmt.Sprint(v) == value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
 type Projector interface {
 	Project(eventsourcing.Event)
 }
@@ -299,3 +299,106 @@ func (s NatsProjectionSubscriber) CancelProjection(ctx context.Context, projecti
 
 	return nil
 }
+
+func (s NatsProjectionSubscriber) freezeTopic() string {
+	return s.managerTopic + "-freeze"
+}
+
+func (s NatsProjectionSubscriber) ListenFreezeProjection(ctx context.Context, freezer projection.Freezer) error {
+	logger := s.logger.WithTags(log.Tags{"topic": s.freezeTopic()})
+	sub, err := s.queue.Subscribe(s.freezeTopic(), func(msg *nats.Msg) {
+		n := projection.Notification{}
+		err := json.Unmarshal(msg.Data, &n)
+		if err != nil {
+			logger.Errorf("Unable to unmarshal %v", faults.Wrap(err))
+			return
+		}
+		if n.Projection != freezer.Name() {
+			return
+		}
+
+		switch n.Action {
+		case projection.Freeze:
+			freezer.Freeze()
+			// acknowledge only after being frozen
+			if msg.Reply != "" {
+				err = msg.Respond(nil)
+				if err != nil {
+					logger.Errorf("Unable to acknowledge freeze: %v", faults.Wrap(err))
+				}
+			}
+		case projection.Unfreeze:
+			freezer.Unfreeze()
+		default:
+			logger.WithTags(log.Tags{"notification": n}).Error("Unknown notification")
+		}
+	})
+	if err != nil {
+		return faults.Wrap(err)
+	}
+
+	go func() {
+		<-ctx.Done()
+		sub.Unsubscribe()
+	}()
+
+	return nil
+}
+
+func (s NatsProjectionSubscriber) FreezeProjection(ctx context.Context, projectionName string, members int) (int, error) {
+	s.logger.WithTags(log.Tags{"projection": projectionName}).Info("Freezing projection")
+
+	payload, err := json.Marshal(projection.Notification{
+		Projection: projectionName,
+		Action:     projection.Freeze,
+	})
+	if err != nil {
+		return 0, faults.Wrap(err)
+	}
+
+	replyTo := nats.NewInbox()
+	sub, err := s.queue.SubscribeSync(replyTo)
+	if err != nil {
+		return 0, faults.Wrap(err)
+	}
+	defer sub.Unsubscribe()
+	err = s.queue.Flush()
+	if err != nil {
+		return 0, faults.Wrap(err)
+	}
+
+	err = s.queue.PublishRequest(s.freezeTopic(), replyTo, payload)
+	if err != nil {
+		return 0, faults.Wrap(err)
+	}
+
+	// wait for the acknowledgements of all members
+	count := 0
+	for count < members {
+		_, err = sub.NextMsgWithContext(ctx)
+		if err != nil {
+			break
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+func (s NatsProjectionSubscriber) UnfreezeProjection(ctx context.Context, projectionName string) error {
+	s.logger.WithTags(log.Tags{"projection": projectionName}).Info("Unfreezing projection")
+
+	payload, err := json.Marshal(projection.Notification{
+		Projection: projectionName,
+		Action:     projection.Unfreeze,
+	})
+	if err != nil {
+		return faults.Wrap(err)
+	}
+
+	err = s.queue.Publish(s.freezeTopic(), payload)
+	if err != nil {
+		return faults.Wrap(err)
+	}
+	return faults.Wrap(s.queue.Flush())
+}
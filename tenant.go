@@ -0,0 +1,45 @@
+package eventsourcing
+
+import (
+	"context"
+
+	"github.com/quintans/faults"
+)
+
+type tenantKey struct{}
+
+// allTenants is the context value of the processes that read the events of all the tenants
+type allTenants struct{}
+
+// WithTenant returns a context for the tenant. The events saved with it belong to the tenant,
+// and multi tenant repositories only read the events of the tenant.
+func WithTenant(ctx context.Context, tenantID string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenantID)
+}
+
+// WithAllTenants returns a context to read the events of all the tenants from multi tenant repositories,
+// eg: for the feeds forwarding the events to a sink. Events can't be saved with it.
+func WithAllTenants(ctx context.Context) context.Context {
+	return context.WithValue(ctx, tenantKey{}, allTenants{})
+}
+
+// TenantOf returns the tenant of the context, or empty if it has none or it is for all the tenants
+func TenantOf(ctx context.Context) string {
+	tenantID, _ := ctx.Value(tenantKey{}).(string)
+	return tenantID
+}
+
+// TenantScope returns the tenant that the reads of a multi tenant repository must be constrained to,
+// or empty if the context is for all the tenants. A context without a tenant fails with ErrMissingTenant,
+// so that a missing tenant never reads the events of all the tenants.
+func TenantScope(ctx context.Context) (string, error) {
+	switch t := ctx.Value(tenantKey{}).(type) {
+	case allTenants:
+		return "", nil
+	case string:
+		if t != "" {
+			return t, nil
+		}
+	}
+	return "", faults.Wrap(ErrMissingTenant)
+}
@@ -0,0 +1,31 @@
+package eventsourcing_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/quintans/eventsourcing"
+)
+
+func TestTenantScope(t *testing.T) {
+	ctx := context.Background()
+	_, err := eventsourcing.TenantScope(ctx)
+	require.True(t, errors.Is(err, eventsourcing.ErrMissingTenant), err)
+	_, err = eventsourcing.TenantScope(eventsourcing.WithTenant(ctx, ""))
+	require.True(t, errors.Is(err, eventsourcing.ErrMissingTenant), err)
+
+	tenantID, err := eventsourcing.TenantScope(eventsourcing.WithTenant(ctx, "A"))
+	require.NoError(t, err)
+	assert.Equal(t, "A", tenantID)
+	assert.Equal(t, "A", eventsourcing.TenantOf(eventsourcing.WithTenant(ctx, "A")))
+
+	all := eventsourcing.WithAllTenants(ctx)
+	tenantID, err = eventsourcing.TenantScope(all)
+	require.NoError(t, err)
+	assert.Empty(t, tenantID)
+	assert.Empty(t, eventsourcing.TenantOf(all))
+}
@@ -2,6 +2,7 @@ package mongodb
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"testing"
 	"time"
@@ -100,7 +101,7 @@ func TestSaveAndGet(t *testing.T) {
 
 	acc.Deposit(5)
 	err = es.Save(ctx, acc, eventsourcing.WithIdempotencyKey("idempotency-key"))
-	require.Error(t, err)
+	require.True(t, errors.Is(err, eventsourcing.ErrDuplicateIdempotencyKey))
 }
 
 func getEvents(ctx context.Context, dbConfig DBConfig, id uuid.UUID) ([]mongodb.Event, error) {
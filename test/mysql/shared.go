@@ -99,9 +99,11 @@ func dbSchema(dbURL string) error {
 			aggregate_type VARCHAR (50) NOT NULL,
 			kind VARCHAR (50) NOT NULL,
 			body VARBINARY(60000) NOT NULL,
+			content_type VARCHAR (50),
 			idempotency_key VARCHAR (50),
 			metadata JSON NOT NULL,
-			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			forgotten_at TIMESTAMP NULL
 		)ENGINE=innodb;`,
 		`CREATE UNIQUE INDEX agg_id_ver_idx ON events(aggregate_id, aggregate_version);`,
 		`CREATE UNIQUE INDEX idempot_idx ON events(idempotency_key);`,
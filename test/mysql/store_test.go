@@ -3,6 +3,7 @@ package mysql
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"sync"
 	"testing"
 	"time"
@@ -100,7 +101,7 @@ func TestSaveAndGet(t *testing.T) {
 
 	acc.Deposit(5)
 	err = es.Save(ctx, acc, eventsourcing.WithIdempotencyKey("idempotency-key"))
-	require.Error(t, err)
+	require.True(t, errors.Is(err, eventsourcing.ErrDuplicateIdempotencyKey))
 }
 
 func TestPollListener(t *testing.T) {
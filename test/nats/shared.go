@@ -0,0 +1,47 @@
+package nats
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/docker/go-connections/nat"
+	testcontainers "github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+func setup() (string, func(), error) {
+	tcpPort := "4222"
+	natPort := nat.Port(tcpPort)
+
+	req := testcontainers.ContainerRequest{
+		Image:        "nats:2.2",
+		ExposedPorts: []string{tcpPort + "/tcp"},
+		Cmd:          []string{"-js"},
+		WaitingFor:   wait.ForListeningPort(natPort),
+	}
+	ctx := context.Background()
+	container, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: req,
+		Started:          true,
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	tearDown := func() {
+		container.Terminate(ctx)
+	}
+
+	ip, err := container.Host(ctx)
+	if err != nil {
+		tearDown()
+		return "", nil, err
+	}
+	port, err := container.MappedPort(ctx, natPort)
+	if err != nil {
+		tearDown()
+		return "", nil, err
+	}
+
+	return fmt.Sprintf("nats://%s:%s", ip, port.Port()), tearDown, nil
+}
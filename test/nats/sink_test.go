@@ -0,0 +1,69 @@
+package nats
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/quintans/eventsourcing"
+	"github.com/quintans/eventsourcing/common"
+	"github.com/quintans/eventsourcing/eventid"
+	"github.com/quintans/eventsourcing/log"
+	"github.com/quintans/eventsourcing/sink/nats"
+)
+
+var logger = log.NewLogrus(logrus.StandardLogger())
+
+func newEvent(t *testing.T, aggregateID string, version uint32) eventsourcing.Event {
+	now := time.Now().UTC()
+	id, err := eventid.New(now, eventid.EntropyFactory(now))
+	require.NoError(t, err)
+	return eventsourcing.Event{
+		ID:               id,
+		AggregateID:      aggregateID,
+		AggregateIDHash:  common.Hash(aggregateID),
+		AggregateVersion: version,
+		AggregateType:    "Account",
+		Kind:             "MoneyDeposited",
+		Body:             []byte(`{"money":10}`),
+		CreatedAt:        now,
+	}
+}
+
+func TestSinkAndLastMessage(t *testing.T) {
+	url, tearDown, err := setup()
+	require.NoError(t, err)
+	defer tearDown()
+
+	ctx := context.Background()
+	partitions := uint32(2)
+	s, err := nats.NewSink(logger, "events", partitions, url)
+	require.NoError(t, err)
+	defer s.Close()
+
+	for p := uint32(1); p <= partitions; p++ {
+		last, err := s.LastMessage(ctx, p)
+		require.NoError(t, err)
+		assert.Nil(t, last)
+	}
+
+	id := uuid.New().String()
+	partition := common.WhichPartition(common.Hash(id), partitions)
+	e1 := newEvent(t, id, 1)
+	e2 := newEvent(t, id, 2)
+	require.NoError(t, s.Sink(ctx, e1))
+	require.NoError(t, s.Sink(ctx, e2))
+	// republishing is discarded by the dedup window
+	require.NoError(t, s.Sink(ctx, e1))
+
+	last, err := s.LastMessage(ctx, partition)
+	require.NoError(t, err)
+	require.NotNil(t, last)
+	assert.Equal(t, e2.ID, last.ID)
+	assert.Equal(t, uint32(2), last.AggregateVersion)
+}
@@ -0,0 +1,125 @@
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/require"
+
+	"github.com/quintans/eventsourcing/lock"
+)
+
+func TestAdvisoryLock(t *testing.T) {
+	dbConfig, tearDown, err := setup()
+	require.NoError(t, err)
+	defer tearDown()
+
+	ctx := context.Background()
+	db, err := sql.Open("postgres", dbConfig.Url())
+	require.NoError(t, err)
+	defer db.Close()
+
+	pool := lock.NewPgLockPool(db)
+	lock1 := pool.NewLock("balance", time.Second)
+	done1, err := lock1.Lock(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, done1, "Expected to acquire lock")
+
+	lock2 := pool.NewLock("balance", time.Second)
+	done2, err := lock2.Lock(ctx)
+	require.NoError(t, err)
+	require.Nil(t, done2, "Expected to not acquire lock")
+
+	// other names are not affected
+	other := pool.NewLock("other", time.Second)
+	done, err := other.Lock(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, done, "Expected to acquire lock")
+	// the caller context being done doesn't prevent the unlock
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	require.NoError(t, other.Unlock(cancelled))
+
+	err = lock1.Unlock(ctx)
+	require.NoError(t, err)
+
+	done2, err = lock2.Lock(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, done2, "Expected to acquire lock")
+
+	start := time.Now()
+	wait := 2 * time.Second
+	go func() {
+		time.Sleep(wait)
+		lock2.Unlock(ctx)
+	}()
+
+	err = lock1.WaitForUnlock(ctx)
+	require.NoError(t, err)
+	require.True(t, time.Since(start) > wait, "Waiting duration for lock was too short")
+}
+
+// failingUnlockConnector opens connections that fail to release the advisory locks
+type failingUnlockConnector struct {
+	driver.Connector
+}
+
+func (c failingUnlockConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return failingUnlockConn{conn}, nil
+}
+
+type failingUnlockConn struct {
+	driver.Conn
+}
+
+func (c failingUnlockConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if strings.Contains(query, "pg_advisory_unlock") {
+		return nil, errors.New("unlock failed")
+	}
+	return c.Conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+}
+
+func (c failingUnlockConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return c.Conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+}
+
+func TestAdvisoryLockFailedUnlock(t *testing.T) {
+	dbConfig, tearDown, err := setup()
+	require.NoError(t, err)
+	defer tearDown()
+
+	ctx := context.Background()
+	connector, err := pq.NewConnector(dbConfig.Url())
+	require.NoError(t, err)
+	failing := sql.OpenDB(failingUnlockConnector{connector})
+	defer failing.Close()
+	db, err := sql.Open("postgres", dbConfig.Url())
+	require.NoError(t, err)
+	defer db.Close()
+
+	lock1 := lock.NewPgLockPool(failing).NewLock("balance", time.Second)
+	done, err := lock1.Lock(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, done, "Expected to acquire lock")
+
+	require.Error(t, lock1.Unlock(ctx))
+
+	// the session holding the lock was closed, instead of going back to the pool
+	lock2 := lock.NewPgLockPool(db).NewLock("balance", time.Second)
+	require.Eventually(t, func() bool {
+		done, err := lock2.Lock(ctx)
+		require.NoError(t, err)
+		return done != nil
+	}, 2*time.Second, 50*time.Millisecond, "Expected to acquire lock")
+	require.NoError(t, lock2.Unlock(ctx))
+}
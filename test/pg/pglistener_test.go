@@ -14,6 +14,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/quintans/eventsourcing"
+	"github.com/quintans/eventsourcing/common"
 	"github.com/quintans/eventsourcing/player"
 	"github.com/quintans/eventsourcing/sink"
 	"github.com/quintans/eventsourcing/store/postgresql"
@@ -73,3 +74,153 @@ func feeding(ctx context.Context, dbConfig DBConfig, repository player.Repositor
 	<-done
 	return errCh
 }
+
+func TestPgListenerResumesEachPartition(t *testing.T) {
+	dbConfig, tearDown, err := setup()
+	require.NoError(t, err)
+	defer tearDown()
+
+	repository, err := postgresql.NewStore(dbConfig.Url())
+	require.NoError(t, err)
+	es := eventsourcing.NewEventStore(repository, test.AggregateFactory{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// accounts until both partitions have one
+	byPartition := map[uint32]string{}
+	for byPartition[1] == "" || byPartition[2] == "" {
+		id := uuid.New()
+		part := common.WhichPartition(common.Hash(id.String()), 2)
+		if byPartition[part] != "" {
+			continue
+		}
+		err = es.Save(ctx, test.CreateAccount("Paulo", id, 100))
+		require.NoError(t, err)
+		byPartition[part] = id.String()
+	}
+	events, err := repository.GetAggregateEvents(ctx, byPartition[1], -1)
+	require.NoError(t, err)
+
+	// partition 1 is up to date, while partition 2 was reset
+	s := test.NewMockSink(2)
+	s.SetLastMessages(map[uint32]eventsourcing.Event{
+		1: {ID: events[0].ID, ResumeToken: []byte(events[0].ID.String())},
+	})
+	errCh := make(chan error, 1)
+	listener := postgresql.NewFeedListenNotify(logger, dbConfig.ReplicationUrl(), repository, "events_channel",
+		postgresql.WithPartitions(2, 1, 2),
+	)
+	go func() {
+		errCh <- listener.Feed(ctx, s)
+	}()
+	time.Sleep(500 * time.Millisecond)
+
+	sinked := s.GetEvents()
+	require.Len(t, sinked, 1)
+	assert.Equal(t, byPartition[2], sinked[0].AggregateID)
+
+	cancel()
+	require.NoError(t, <-errCh, "Error feeding")
+}
+
+func TestPgListenerBackfillsEmptyPartition(t *testing.T) {
+	dbConfig, tearDown, err := setup()
+	require.NoError(t, err)
+	defer tearDown()
+
+	repository, err := postgresql.NewStore(dbConfig.Url())
+	require.NoError(t, err)
+	es := eventsourcing.NewEventStore(repository, test.AggregateFactory{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// an account in partition 2 and then one in partition 1,
+	// so that the event of the empty partition 2 is older than the position of partition 1
+	byPartition := map[uint32]string{}
+	for _, part := range []uint32{2, 1} {
+		id := uuid.New()
+		for common.WhichPartition(common.Hash(id.String()), 2) != part {
+			id = uuid.New()
+		}
+		err = es.Save(ctx, test.CreateAccount("Paulo", id, 100))
+		require.NoError(t, err)
+		byPartition[part] = id.String()
+		// the event IDs only order the events saved in different milliseconds
+		time.Sleep(5 * time.Millisecond)
+	}
+	events, err := repository.GetAggregateEvents(ctx, byPartition[1], -1)
+	require.NoError(t, err)
+
+	// partition 1 is up to date, while partition 2 was reset
+	s := test.NewMockSink(2)
+	s.SetLastMessages(map[uint32]eventsourcing.Event{
+		1: {ID: events[0].ID, ResumeToken: []byte(events[0].ID.String())},
+	})
+	errCh := make(chan error, 1)
+	listener := postgresql.NewFeedListenNotify(logger, dbConfig.ReplicationUrl(), repository, "events_channel",
+		postgresql.WithPartitions(2, 1, 2),
+	)
+	go func() {
+		errCh <- listener.Feed(ctx, s)
+	}()
+	time.Sleep(500 * time.Millisecond)
+
+	// the older event of the empty partition is not taken as sinked
+	sinked := s.GetEvents()
+	require.Len(t, sinked, 1)
+	assert.Equal(t, byPartition[2], sinked[0].AggregateID)
+
+	cancel()
+	require.NoError(t, <-errCh, "Error feeding")
+}
+
+func TestPgListenerReconnect(t *testing.T) {
+	dbConfig, tearDown, err := setup()
+	require.NoError(t, err)
+	defer tearDown()
+
+	repository, err := postgresql.NewStore(dbConfig.Url())
+	require.NoError(t, err)
+
+	s := test.NewMockSink(1)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	errCh := make(chan error, 1)
+	listener := postgresql.NewFeedListenNotify(logger, dbConfig.ReplicationUrl(), repository, "events_channel",
+		postgresql.WithReconnectBackoff(50*time.Millisecond, 200*time.Millisecond),
+	)
+	go func() {
+		errCh <- listener.Feed(ctx, s)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	es := eventsourcing.NewEventStore(repository, test.AggregateFactory{})
+	id := uuid.New()
+	acc := test.CreateAccount("Paulo", id, 100)
+	err = es.Save(ctx, acc)
+	require.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+
+	// dropping the connection of the listener, like in a failover
+	db, err := connect(dbConfig)
+	require.NoError(t, err)
+	defer db.Close()
+	_, err = db.Exec("SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE query LIKE 'listen %'")
+	require.NoError(t, err)
+
+	acc.Deposit(10)
+	acc.Deposit(20)
+	err = es.Save(ctx, acc)
+	require.NoError(t, err)
+	time.Sleep(time.Second)
+
+	// the events are forwarded once, after reconnecting
+	events := s.GetEvents()
+	require.Equal(t, 3, len(events), "event size")
+	assert.Equal(t, "AccountCreated", events[0].Kind.String())
+	assert.Equal(t, "MoneyDeposited", events[1].Kind.String())
+	assert.Equal(t, "MoneyDeposited", events[2].Kind.String())
+
+	cancel()
+	require.NoError(t, <-errCh, "Error feeding")
+}
@@ -3,6 +3,7 @@ package pg
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"sync"
 	"testing"
@@ -17,8 +18,10 @@ import (
 
 	"github.com/quintans/eventsourcing"
 	"github.com/quintans/eventsourcing/encoding"
+	"github.com/quintans/eventsourcing/eventid"
 	"github.com/quintans/eventsourcing/log"
 	"github.com/quintans/eventsourcing/player"
+	"github.com/quintans/eventsourcing/store"
 	"github.com/quintans/eventsourcing/store/poller"
 	"github.com/quintans/eventsourcing/store/postgresql"
 	"github.com/quintans/eventsourcing/test"
@@ -102,7 +105,482 @@ func TestSaveAndGet(t *testing.T) {
 
 	acc.Deposit(5)
 	err = es.Save(ctx, acc, eventsourcing.WithIdempotencyKey("idempotency-key"))
+	require.True(t, errors.Is(err, eventsourcing.ErrDuplicateIdempotencyKey))
+}
+
+func TestSaveWithAsyncSnapshots(t *testing.T) {
+	dbConfig, tearDown, err := setup()
+	require.NoError(t, err)
+	defer tearDown()
+
+	ctx := context.Background()
+	r, err := postgresql.NewStore(dbConfig.Url())
+	require.NoError(t, err)
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{},
+		eventsourcing.WithSnapshotThreshold(3),
+		eventsourcing.WithAsyncSnapshots(2, 10),
+	)
+
+	id := uuid.New()
+	acc := test.CreateAccount("Paulo", id, 100)
+	acc.Deposit(10)
+	acc.Deposit(20)
+	err = es.Save(ctx, acc)
+	require.NoError(t, err)
+
+	// flushes pending snapshots
+	err = es.Close(ctx)
+	require.NoError(t, err)
+
+	db, err := connect(dbConfig)
+	require.NoError(t, err)
+	count := 0
+	err = db.Get(&count, "SELECT count(*) FROM snapshots WHERE aggregate_id = $1", id.String())
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+
+	a, err := es.GetByID(ctx, id.String())
+	require.NoError(t, err)
+	acc2 := a.(*test.Account)
+	assert.Equal(t, uint32(3), acc2.GetVersion())
+	assert.Equal(t, int64(130), acc2.Balance)
+
+	// no more snapshots are accepted after closing, but the events are still saved
+	acc2.Deposit(1)
+	acc2.Deposit(1)
+	acc2.Deposit(1)
+	err = es.Save(ctx, acc2)
+	require.NoError(t, err)
+	assert.Empty(t, acc2.GetEvents())
+	err = db.Get(&count, "SELECT count(*) FROM snapshots WHERE aggregate_id = $1", id.String())
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+}
+
+func TestSaveWithSnapshotStore(t *testing.T) {
+	dbConfig, tearDown, err := setup()
+	require.NoError(t, err)
+	defer tearDown()
+
+	ctx := context.Background()
+	r, err := postgresql.NewStore(dbConfig.Url())
+	require.NoError(t, err)
+	// same database, but with its own connection pool
+	snaps, err := postgresql.NewSnapshotStore(dbConfig.Url())
+	require.NoError(t, err)
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{},
+		eventsourcing.WithSnapshotThreshold(3),
+		eventsourcing.WithSnapshotStore(snaps),
+	)
+
+	id := uuid.New()
+	acc := test.CreateAccount("Paulo", id, 100)
+	acc.Deposit(10)
+	acc.Deposit(20)
+	err = es.Save(ctx, acc)
+	require.NoError(t, err)
+
+	snap, err := snaps.GetSnapshot(ctx, id.String())
+	require.NoError(t, err)
+	assert.Equal(t, uint32(3), snap.AggregateVersion)
+
+	a, err := es.GetByID(ctx, id.String())
+	require.NoError(t, err)
+	acc2 := a.(*test.Account)
+	assert.Equal(t, uint32(3), acc2.GetVersion())
+	assert.Equal(t, int64(130), acc2.Balance)
+
+	err = snaps.DeleteSnapshot(ctx, id.String())
+	require.NoError(t, err)
+	snap, err = snaps.GetSnapshot(ctx, id.String())
+	require.NoError(t, err)
+	assert.True(t, snap.ID.IsZero())
+}
+
+// otherCodec simulates a new codec, identified by a different content type
+type otherCodec struct {
+	eventsourcing.JSONCodec
+}
+
+func (otherCodec) ContentType() string {
+	return "application/other"
+}
+
+func TestSaveAndGetWithDecoders(t *testing.T) {
+	dbConfig, tearDown, err := setup()
+	require.NoError(t, err)
+	defer tearDown()
+
+	ctx := context.Background()
+	r, err := postgresql.NewStore(dbConfig.Url())
+	require.NoError(t, err)
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{})
+
+	id := uuid.New()
+	acc := test.CreateAccount("Paulo", id, 100)
+	acc.Deposit(10)
+	err = es.Save(ctx, acc)
+	require.NoError(t, err)
+
+	db, err := connect(dbConfig)
+	require.NoError(t, err)
+	contentTypes := []string{}
+	err = db.Select(&contentTypes, "SELECT content_type FROM events WHERE aggregate_id = $1", id.String())
+	require.NoError(t, err)
+	require.Equal(t, []string{eventsourcing.JSONContentType, eventsourcing.JSONContentType}, contentTypes)
+
+	// the events were saved with a codec other than the current one
+	es = eventsourcing.NewEventStore(r, test.AggregateFactory{}, eventsourcing.WithCodec(otherCodec{}))
+	_, err = es.GetByID(ctx, id.String())
 	require.Error(t, err)
+
+	es = eventsourcing.NewEventStore(r, test.AggregateFactory{},
+		eventsourcing.WithCodec(otherCodec{}),
+		eventsourcing.WithDecoder(eventsourcing.JSONContentType, eventsourcing.JSONCodec{}),
+	)
+	a, err := es.GetByID(ctx, id.String())
+	require.NoError(t, err)
+	assert.Equal(t, int64(110), a.(*test.Account).Balance)
+}
+
+func TestGetAggregateEventsStream(t *testing.T) {
+	dbConfig, tearDown, err := setup()
+	require.NoError(t, err)
+	defer tearDown()
+
+	ctx := context.Background()
+	r, err := postgresql.NewStore(dbConfig.Url())
+	require.NoError(t, err)
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{})
+
+	id := uuid.New()
+	acc := test.CreateAccount("Paulo", id, 100)
+	acc.Deposit(10)
+	acc.Deposit(20)
+	err = es.Save(ctx, acc)
+	require.NoError(t, err)
+
+	events, errCh := r.GetAggregateEventsStream(ctx, id.String(), 1)
+	versions := []uint32{}
+	for e := range events {
+		versions = append(versions, e.AggregateVersion)
+	}
+	require.NoError(t, <-errCh)
+	require.Equal(t, []uint32{2, 3}, versions)
+
+	// cancelling stops the stream
+	ctx2, cancel := context.WithCancel(ctx)
+	events, errCh = r.GetAggregateEventsStream(ctx2, id.String(), -1)
+	<-events
+	cancel()
+	require.Error(t, <-errCh)
+}
+
+// streamCounter counts how the events of the aggregates are read from the repository
+type streamCounter struct {
+	*postgresql.EsRepository
+	streams int
+	loads   int
+}
+
+func (r *streamCounter) GetAggregateEventsStream(ctx context.Context, aggregateID string, snapVersion int) (<-chan eventsourcing.Event, <-chan error) {
+	r.streams++
+	return r.EsRepository.GetAggregateEventsStream(ctx, aggregateID, snapVersion)
+}
+
+func (r *streamCounter) LoadAggregate(ctx context.Context, aggregateID string) (eventsourcing.Snapshot, []eventsourcing.Event, error) {
+	r.loads++
+	return r.EsRepository.LoadAggregate(ctx, aggregateID)
+}
+
+func TestGetByIDStreamsEvents(t *testing.T) {
+	dbConfig, tearDown, err := setup()
+	require.NoError(t, err)
+	defer tearDown()
+
+	ctx := context.Background()
+	repo, err := postgresql.NewStore(dbConfig.Url())
+	require.NoError(t, err)
+	// the repository is also the snapshot store
+	r := &streamCounter{EsRepository: repo}
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{}, eventsourcing.WithSnapshotThreshold(2))
+
+	id := uuid.New()
+	acc := test.CreateAccount("Paulo", id, 100)
+	acc.Deposit(10)
+	acc.Deposit(20)
+	err = es.Save(ctx, acc)
+	require.NoError(t, err)
+
+	a, err := es.GetByID(ctx, id.String())
+	require.NoError(t, err)
+	assert.Equal(t, uint32(3), a.GetVersion())
+	assert.Equal(t, int64(130), a.(*test.Account).Balance)
+	assert.Equal(t, 1, r.streams)
+	assert.Equal(t, 0, r.loads)
+}
+
+func TestStaleSnapshot(t *testing.T) {
+	dbConfig, tearDown, err := setup()
+	require.NoError(t, err)
+	defer tearDown()
+
+	ctx := context.Background()
+	r, err := postgresql.NewStore(dbConfig.Url())
+	require.NoError(t, err)
+
+	var stale []uint32
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{},
+		eventsourcing.WithSnapshotThreshold(100),
+		eventsourcing.WithStaleSnapshotThreshold(2, func(aggregateID string, snapshotVersion, currentVersion uint32) {
+			stale = append(stale, snapshotVersion, currentVersion)
+		}),
+	)
+
+	id := uuid.New()
+	acc := test.CreateAccount("Paulo", id, 100)
+	acc.Deposit(10)
+	err = es.Save(ctx, acc)
+	require.NoError(t, err)
+
+	_, err = es.GetByID(ctx, id.String())
+	require.NoError(t, err)
+	require.Empty(t, stale)
+
+	acc.Deposit(20)
+	err = es.Save(ctx, acc)
+	require.NoError(t, err)
+
+	_, err = es.GetByID(ctx, id.String())
+	require.NoError(t, err)
+	require.Equal(t, []uint32{0, 3}, stale)
+}
+
+func TestSaveEventsBatch(t *testing.T) {
+	dbConfig, tearDown, err := setup()
+	require.NoError(t, err)
+	defer tearDown()
+
+	ctx := context.Background()
+	r, err := postgresql.NewStore(dbConfig.Url())
+	require.NoError(t, err)
+
+	id1 := uuid.New().String()
+	id2 := uuid.New().String()
+	now := time.Now().UTC()
+	newRecord := func(id string, version uint32) eventsourcing.EventRecord {
+		return eventsourcing.EventRecord{
+			AggregateID:   id,
+			Version:       version,
+			AggregateType: aggregateType,
+			CreatedAt:     now,
+			Details: []eventsourcing.EventRecordDetail{
+				{Kind: "MoneyDeposited", Body: []byte(`{"money":10}`)},
+				{Kind: "MoneyDeposited", Body: []byte(`{"money":20}`)},
+			},
+		}
+	}
+
+	results, err := r.SaveEvents(ctx, []eventsourcing.EventRecord{newRecord(id1, 0), newRecord(id2, 0)})
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	assert.Equal(t, uint32(2), results[0].Version)
+	assert.Equal(t, uint32(2), results[1].Version)
+	assert.False(t, results[0].ID.IsZero())
+
+	// the second record clashes, so nothing is saved
+	_, err = r.SaveEvents(ctx, []eventsourcing.EventRecord{newRecord(id1, 2), newRecord(id2, 1)})
+	require.True(t, errors.Is(err, eventsourcing.ErrConcurrentModification))
+
+	db, err := connect(dbConfig)
+	require.NoError(t, err)
+	count := 0
+	err = db.Get(&count, "SELECT count(*) FROM events WHERE aggregate_id IN ($1, $2)", id1, id2)
+	require.NoError(t, err)
+	require.Equal(t, 4, count)
+}
+
+func TestSaveEventWithCopy(t *testing.T) {
+	dbConfig, tearDown, err := setup()
+	require.NoError(t, err)
+	defer tearDown()
+
+	ctx := context.Background()
+	r, err := postgresql.NewStore(dbConfig.Url(), postgresql.CopyThresholdOption(2))
+	require.NoError(t, err)
+
+	id := uuid.New().String()
+	newRecord := func(version uint32) eventsourcing.EventRecord {
+		return eventsourcing.EventRecord{
+			AggregateID:   id,
+			Version:       version,
+			AggregateType: aggregateType,
+			Labels:        map[string]interface{}{"geo": "EU"},
+			CreatedAt:     time.Now().UTC(),
+			Details: []eventsourcing.EventRecordDetail{
+				{Kind: "MoneyDeposited", Body: []byte(`{"money":10}`)},
+				{Kind: "MoneyDeposited", Body: []byte(`{"money":20}`)},
+				{Kind: "MoneyDeposited", Body: []byte(`{"money":30}`)},
+			},
+		}
+	}
+
+	lastID, version, err := r.SaveEvent(ctx, newRecord(0))
+	require.NoError(t, err)
+	assert.Equal(t, uint32(3), version)
+
+	events, err := r.GetAggregateEvents(ctx, id, -1)
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+	assert.Equal(t, lastID, events[2].ID)
+	assert.Equal(t, uint32(1), events[0].AggregateVersion)
+	assert.Equal(t, "EU", events[0].Metadata["geo"])
+	assert.Equal(t, `{"money":20}`, string(events[1].Body))
+
+	_, _, err = r.SaveEvent(ctx, newRecord(1))
+	require.True(t, errors.Is(err, eventsourcing.ErrConcurrentModification))
+}
+
+func TestStatementTimeout(t *testing.T) {
+	dbConfig, tearDown, err := setup()
+	require.NoError(t, err)
+	defer tearDown()
+
+	ctx := context.Background()
+	r, err := postgresql.NewStore(dbConfig.Url(), postgresql.StatementTimeoutOption(100*time.Millisecond))
+	require.NoError(t, err)
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{})
+	err = es.Save(ctx, test.CreateAccount("Paulo", uuid.New(), 100))
+	require.NoError(t, err)
+
+	// a slow read is aborted by the server
+	filter := store.Filter{}
+	store.WithRawCondition("pg_sleep(2) IS NOT NULL")(&filter)
+	start := time.Now()
+	_, err = r.GetEvents(ctx, eventid.Zero, 10, 0, filter)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "statement timeout")
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+
+	// without a statement timeout, a cancelled context still stops the read
+	r, err = postgresql.NewStore(dbConfig.Url())
+	require.NoError(t, err)
+	ctx2, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	_, err = r.GetEvents(ctx2, eventid.Zero, 10, 0, filter)
+	require.Error(t, err)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+}
+
+func TestGetEventsSnapshot(t *testing.T) {
+	dbConfig, tearDown, err := setup()
+	require.NoError(t, err)
+	defer tearDown()
+
+	ctx := context.Background()
+	r, err := postgresql.NewStore(dbConfig.Url())
+	require.NoError(t, err)
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{})
+
+	acc := test.CreateAccount("Paulo", uuid.New(), 100)
+	acc.Deposit(10)
+	acc.Deposit(20)
+	err = es.Save(ctx, acc)
+	require.NoError(t, err)
+
+	snap, err := r.GetEventsSnapshot(ctx, store.Filter{})
+	require.NoError(t, err)
+	defer snap.Close()
+
+	events, err := snap.Next(ctx, 2)
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+
+	// events saved after the snapshot are not visible
+	acc2 := test.CreateAccount("Pereira", uuid.New(), 100)
+	err = es.Save(ctx, acc2)
+	require.NoError(t, err)
+
+	events, err = snap.Next(ctx, 2)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, "MoneyDeposited", events[0].Kind.String())
+
+	events, err = snap.Next(ctx, 2)
+	require.NoError(t, err)
+	require.Empty(t, events)
+}
+
+func TestGetEventsByIDs(t *testing.T) {
+	dbConfig, tearDown, err := setup()
+	require.NoError(t, err)
+	defer tearDown()
+
+	ctx := context.Background()
+	r, err := postgresql.NewStore(dbConfig.Url())
+	require.NoError(t, err)
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{})
+
+	acc := test.CreateAccount("Paulo", uuid.New(), 100)
+	acc.Deposit(10)
+	acc.Deposit(20)
+	err = es.Save(ctx, acc)
+	require.NoError(t, err)
+
+	events, err := r.GetEvents(ctx, eventid.Zero, 10, 0, store.Filter{})
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+
+	now := time.Now()
+	unknown, err := eventid.New(now, eventid.EntropyFactory(now))
+	require.NoError(t, err)
+
+	got, missing, err := r.GetEventsByIDs(ctx, []eventid.EventID{events[2].ID, unknown, events[0].ID})
+	require.NoError(t, err)
+	require.Len(t, got, 2)
+	assert.Equal(t, events[2].ID, got[0].ID)
+	assert.Equal(t, "MoneyDeposited", got[0].Kind.String())
+	assert.Equal(t, events[0].ID, got[1].ID)
+	assert.Equal(t, []eventid.EventID{unknown}, missing)
+}
+
+func TestCountEvents(t *testing.T) {
+	dbConfig, tearDown, err := setup()
+	require.NoError(t, err)
+	defer tearDown()
+
+	ctx := context.Background()
+	r, err := postgresql.NewStore(dbConfig.Url())
+	require.NoError(t, err)
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{})
+
+	id := uuid.New()
+	acc := test.CreateAccount("Paulo", id, 100)
+	acc.Deposit(10)
+	acc.Deposit(20)
+	err = es.Save(ctx, acc)
+	require.NoError(t, err)
+	err = es.Save(ctx, test.CreateAccount("Pereira", uuid.New(), 100))
+	require.NoError(t, err)
+
+	count, err := r.CountAggregateEvents(ctx, id.String())
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+
+	filters := []store.Filter{
+		{},
+		{EventKinds: []eventsourcing.EventKind{"MoneyDeposited"}},
+		{Partitions: 2, PartitionLow: 1, PartitionHi: 1},
+		{Partitions: 2, PartitionLow: 1, PartitionHi: 2},
+	}
+	for _, filter := range filters {
+		events, err := r.GetEvents(ctx, eventid.Zero, 10, 0, filter)
+		require.NoError(t, err)
+		total, err := r.CountEvents(ctx, filter)
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(events)), total, "filter %+v", filter)
+	}
 }
 
 func TestPollListener(t *testing.T) {
@@ -264,6 +742,189 @@ func TestListenerWithLabels(t *testing.T) {
 	assert.Equal(t, test.OPEN, acc2.Status)
 }
 
+func TestOutboxRelay(t *testing.T) {
+	dbConfig, tearDown, err := setup()
+	require.NoError(t, err)
+	defer tearDown()
+
+	ctx := context.Background()
+	r, err := postgresql.NewStore(dbConfig.Url(), postgresql.OutboxOption())
+	require.NoError(t, err)
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{})
+
+	id := uuid.New()
+	acc := test.CreateAccount("Paulo", id, 100)
+	acc.Deposit(10)
+	acc.Deposit(20)
+	err = es.Save(ctx, acc)
+	require.NoError(t, err)
+
+	relay := postgresql.NewOutboxRelay(logger, r, postgresql.WithRelayBatchSize(2))
+	s := test.NewMockSink(1)
+	n, err := relay.Relay(ctx, s)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	n, err = relay.Relay(ctx, s)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	// the published events are not relayed again
+	n, err = relay.Relay(ctx, s)
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	events := s.GetEvents()
+	require.Len(t, events, 3)
+	assert.Equal(t, id.String(), events[0].AggregateID)
+	assert.Equal(t, uint32(1), events[0].AggregateVersion)
+	assert.Equal(t, uint32(3), events[2].AggregateVersion)
+}
+
+func TestOutboxRelayEmpty(t *testing.T) {
+	dbConfig, tearDown, err := setup()
+	require.NoError(t, err)
+	defer tearDown()
+
+	ctx := context.Background()
+	r, err := postgresql.NewStore(dbConfig.Url(), postgresql.OutboxOption())
+	require.NoError(t, err)
+
+	relay := postgresql.NewOutboxRelay(logger, r)
+	s := test.NewMockSink(1)
+	for i := 0; i < 5; i++ {
+		n, err := relay.Relay(ctx, s)
+		require.NoError(t, err)
+		assert.Equal(t, 0, n)
+	}
+
+	// relaying from an empty outbox doesn't leave transactions open
+	db, err := connect(dbConfig)
+	require.NoError(t, err)
+	defer db.Close()
+	var open int
+	err = db.Get(&open, "SELECT COUNT(*) FROM pg_stat_activity WHERE state = 'idle in transaction'")
+	require.NoError(t, err)
+	assert.Equal(t, 0, open)
+}
+
+func TestMultiTenant(t *testing.T) {
+	dbConfig, tearDown, err := setup()
+	require.NoError(t, err)
+	defer tearDown()
+
+	r, err := postgresql.NewStore(dbConfig.Url(), postgresql.MultiTenantOption())
+	require.NoError(t, err)
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{})
+
+	id := uuid.New()
+	err = es.Save(context.Background(), test.CreateAccount("Paulo", id, 100))
+	require.True(t, errors.Is(err, eventsourcing.ErrMissingTenant), err)
+
+	ctxA := eventsourcing.WithTenant(context.Background(), "A")
+	err = es.Save(ctxA, test.CreateAccount("Paulo", id, 100))
+	require.NoError(t, err)
+	other := uuid.New()
+	err = es.Save(eventsourcing.WithTenant(context.Background(), "B"), test.CreateAccount("Pedro", other, 50))
+	require.NoError(t, err)
+
+	events, err := r.GetAggregateEvents(ctxA, id.String(), -1)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, "A", events[0].TenantID)
+	events, err = r.GetAggregateEvents(ctxA, other.String(), -1)
+	require.NoError(t, err)
+	require.Empty(t, events)
+	_, err = r.GetAggregateEvents(context.Background(), id.String(), -1)
+	require.True(t, errors.Is(err, eventsourcing.ErrMissingTenant), err)
+
+	events, err = r.GetEvents(ctxA, eventid.Zero, 10, 0, store.Filter{})
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	events, err = r.GetEvents(eventsourcing.WithAllTenants(context.Background()), eventid.Zero, 10, 0, store.Filter{})
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	_, err = r.GetEvents(context.Background(), eventid.Zero, 10, 0, store.Filter{})
+	require.True(t, errors.Is(err, eventsourcing.ErrMissingTenant), err)
+
+	stats, err := r.Stats(ctxA)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), stats.Events)
+	stats, err = r.Stats(eventsourcing.WithAllTenants(context.Background()))
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), stats.Events)
+	_, err = r.Stats(context.Background())
+	require.True(t, errors.Is(err, eventsourcing.ErrMissingTenant), err)
+
+	snap, err := r.GetEventsSnapshot(ctxA, store.Filter{})
+	require.NoError(t, err)
+	defer snap.Close()
+	events, err = snap.Next(ctxA, 10)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, "A", events[0].TenantID)
+	_, err = r.GetEventsSnapshot(context.Background(), store.Filter{})
+	require.True(t, errors.Is(err, eventsourcing.ErrMissingTenant), err)
+}
+
+func TestMultiTenantSnapshotsAndForget(t *testing.T) {
+	dbConfig, tearDown, err := setup()
+	require.NoError(t, err)
+	defer tearDown()
+
+	r, err := postgresql.NewStore(dbConfig.Url(), postgresql.MultiTenantOption())
+	require.NoError(t, err)
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{}, eventsourcing.WithSnapshotThreshold(3))
+
+	ctxA := eventsourcing.WithTenant(context.Background(), "A")
+	ctxB := eventsourcing.WithTenant(context.Background(), "B")
+	id := uuid.New()
+	acc := test.CreateAccount("Paulo", id, 100)
+	acc.UpdateOwner("Paulo Quintans")
+	acc.Deposit(10)
+	err = es.Save(ctxA, acc, eventsourcing.WithIdempotencyKey("key"))
+	require.NoError(t, err)
+
+	// giving time for the snapshots to write
+	time.Sleep(100 * time.Millisecond)
+
+	snap, err := r.GetSnapshot(ctxA, id.String())
+	require.NoError(t, err)
+	assert.Equal(t, "A", snap.TenantID)
+	// the snapshot is not found by the other tenants
+	snap, err = r.GetSnapshot(ctxB, id.String())
+	require.NoError(t, err)
+	assert.Empty(t, snap.ID)
+	snap, _, err = r.LoadAggregate(ctxB, id.String())
+	require.NoError(t, err)
+	assert.Empty(t, snap.ID)
+
+	found, err := r.HasIdempotencyKey(ctxB, "key")
+	require.NoError(t, err)
+	assert.False(t, found)
+	found, err = r.HasAggregateIdempotencyKey(ctxB, id.String(), "key")
+	require.NoError(t, err)
+	assert.False(t, found)
+
+	request := eventsourcing.ForgetRequest{
+		AggregateID: id.String(),
+		EventKind:   "OwnerUpdated",
+	}
+	preview, err := r.PreviewForget(ctxB, request)
+	require.NoError(t, err)
+	assert.Empty(t, preview.EventIDs)
+	assert.Empty(t, preview.SnapshotIDs)
+
+	// forgetting by another tenant changes nothing
+	err = r.Forget(ctxB, request, func(kind string, body []byte) ([]byte, error) {
+		t.Fatalf("forgetting %s of another tenant", kind)
+		return body, nil
+	})
+	require.NoError(t, err)
+	events, err := r.GetAggregateEvents(ctxA, id.String(), -1)
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+	assert.False(t, events[1].IsForgotten())
+}
+
 func TestForget(t *testing.T) {
 	dbConfig, tearDown, err := setup()
 	require.NoError(t, err)
@@ -344,6 +1005,12 @@ func TestForget(t *testing.T) {
 		assert.Empty(t, ou.Owner)
 	}
 
+	events, err := r.GetAggregateEvents(ctx, id.String(), -1)
+	require.NoError(t, err)
+	for _, e := range events {
+		assert.Equal(t, e.Kind == "OwnerUpdated", e.IsForgotten(), "event %s", e.Kind)
+	}
+
 	bodies = []encoding.Json{}
 	err = db.Select(&bodies, "SELECT body FROM snapshots WHERE aggregate_id = $1", id.String())
 	require.NoError(t, err)
@@ -375,3 +1042,36 @@ func BenchmarkDepositAndSave2(b *testing.B) {
 		}
 	})
 }
+
+func BenchmarkSaveManyEvents(b *testing.B) {
+	dbConfig, tearDown, err := setup()
+	require.NoError(b, err)
+	defer tearDown()
+
+	details := make([]eventsourcing.EventRecordDetail, 500)
+	for k := range details {
+		details[k] = eventsourcing.EventRecordDetail{Kind: "MoneyDeposited", Body: []byte(`{"money":10}`)}
+	}
+	for _, bm := range []struct {
+		name      string
+		threshold int
+	}{
+		{"insert", 0},
+		{"copy", postgresql.DefaultCopyThreshold},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			r, err := postgresql.NewStore(dbConfig.Url(), postgresql.CopyThresholdOption(bm.threshold))
+			require.NoError(b, err)
+			ctx := context.Background()
+			for i := 0; i < b.N; i++ {
+				_, _, err := r.SaveEvent(ctx, eventsourcing.EventRecord{
+					AggregateID:   uuid.New().String(),
+					AggregateType: aggregateType,
+					CreatedAt:     time.Now().UTC(),
+					Details:       details,
+				})
+				require.NoError(b, err)
+			}
+		})
+	}
+}
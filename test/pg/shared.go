@@ -104,14 +104,19 @@ func dbSchema(dbConfig DBConfig) error {
 		aggregate_type VARCHAR (50) NOT NULL,
 		kind VARCHAR (50) NOT NULL,
 		body bytea NOT NULL,
+		content_type VARCHAR (50),
 		idempotency_key VARCHAR (50),
 		metadata JSONB NOT NULL,
-		created_at TIMESTAMP NOT NULL DEFAULT NOW()::TIMESTAMP
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()::TIMESTAMP,
+		event_version SMALLINT NOT NULL DEFAULT 1,
+		forgotten_at TIMESTAMP NULL,
+		tenant_id VARCHAR (50) NULL
 	);
 	CREATE INDEX evt_agg_id_idx ON events (aggregate_id);
 	CREATE UNIQUE INDEX evt_agg_id_ver_uk ON events (aggregate_id, aggregate_version);
 	CREATE UNIQUE INDEX evt_idempot_uk ON events (idempotency_key);
 	CREATE INDEX evt_metadata_idx ON events USING GIN (metadata jsonb_path_ops);
+	CREATE INDEX evt_tenant_idx ON events (tenant_id, aggregate_id);
 
 	CREATE TABLE IF NOT EXISTS snapshots(
 		id VARCHAR (50) PRIMARY KEY,
@@ -120,9 +125,17 @@ func dbSchema(dbConfig DBConfig) error {
 		aggregate_type VARCHAR (50) NOT NULL,
 		body bytea NOT NULL,
 		created_at TIMESTAMP NOT NULL DEFAULT NOW()::TIMESTAMP,
+		tenant_id VARCHAR (50) NULL,
 		FOREIGN KEY (id) REFERENCES events (id)
 	);
 	CREATE INDEX snap_agg_id_idx ON snapshots (aggregate_id);
+
+	CREATE TABLE IF NOT EXISTS outbox(
+		id VARCHAR (50) PRIMARY KEY,
+		published_at TIMESTAMP NULL,
+		FOREIGN KEY (id) REFERENCES events (id)
+	);
+	CREATE INDEX outbox_unpublished_idx ON outbox (id) WHERE published_at IS NULL;
 	
 	CREATE OR REPLACE FUNCTION notify_event() RETURNS TRIGGER AS $FN$
 		DECLARE 
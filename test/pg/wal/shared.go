@@ -96,9 +96,12 @@ func dbSchema(config tpg.DBConfig) error {
 			aggregate_type VARCHAR (50) NOT NULL,
 			kind VARCHAR (50) NOT NULL,
 			body bytea NOT NULL,
+			content_type VARCHAR (50),
 			idempotency_key VARCHAR (50),
 			metadata JSONB NOT NULL,
-			created_at TIMESTAMP NOT NULL DEFAULT NOW()::TIMESTAMP
+			created_at TIMESTAMP NOT NULL DEFAULT NOW()::TIMESTAMP,
+			event_version SMALLINT NOT NULL DEFAULT 1,
+			forgotten_at TIMESTAMP NULL
 		);`,
 		`CREATE INDEX evt_agg_id_idx ON events (aggregate_id);`,
 		`CREATE UNIQUE INDEX evt_agg_id_ver_uk ON events (aggregate_id, aggregate_version);`,
@@ -0,0 +1,44 @@
+package eventsourcing
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/label"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	attrAggregateID      = label.Key("aggregate.id")
+	attrAggregateType    = label.Key("aggregate.type")
+	attrAggregateVersion = label.Key("aggregate.version")
+	attrAt               = label.Key("at")
+	attrEventCount       = label.Key("event.count")
+	attrEventKind        = label.Key("event.kind")
+)
+
+// WithTracer wraps the event store operations, and the repository calls made by them, in OpenTelemetry spans
+func WithTracer(tracer trace.Tracer) EsOptions {
+	return func(r *EventStore) {
+		r.tracer = tracer
+	}
+}
+
+// startSpan starts a span, if there is a tracer.
+// The returned function ends the span, recording the error, if any.
+func (es EventStore) startSpan(ctx context.Context, name string, attrs ...label.KeyValue) (context.Context, trace.Span, func(error)) {
+	if es.tracer == nil {
+		// a span that does nothing
+		span := trace.SpanFromContext(context.Background())
+		return ctx, span, func(error) {}
+	}
+
+	ctx, span := es.tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+	return ctx, span, func(err error) {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
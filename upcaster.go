@@ -0,0 +1,74 @@
+package eventsourcing
+
+// EventVersioner is implemented by the events that know their schema version.
+// Events not implementing it are considered to be in version 1.
+type EventVersioner interface {
+	EventVersion() uint16
+}
+
+// VersionedUpcaster is implemented by the upcasters that can start from the event version stored with the event,
+// instead of the version declared by the decoded event
+type VersionedUpcaster interface {
+	UpcastVersion(e Typer, version uint16) Typer
+}
+
+// UpcastFunc converts an event into the next version of its schema
+type UpcastFunc func(Typer) Typer
+
+type upcastKey struct {
+	kind        EventKind
+	fromVersion uint16
+}
+
+var (
+	_ Upcaster          = (*UpcasterChain)(nil)
+	_ VersionedUpcaster = (*UpcasterChain)(nil)
+)
+
+// UpcasterChain is an Upcaster made of small steps, each converting an event kind from one version to the next.
+// The steps are applied in sequence, until there is no step for the kind and version of the event.
+type UpcasterChain struct {
+	steps map[upcastKey]UpcastFunc
+}
+
+func NewUpcasterChain() *UpcasterChain {
+	return &UpcasterChain{
+		steps: map[upcastKey]UpcastFunc{},
+	}
+}
+
+// Register adds the step that upcasts the events of the kind from the version.
+// The step must return an event with a higher version, or the chain stops there.
+func (c *UpcasterChain) Register(kind EventKind, fromVersion uint16, fn UpcastFunc) *UpcasterChain {
+	c.steps[upcastKey{kind: kind, fromVersion: fromVersion}] = fn
+	return c
+}
+
+// Upcast applies the registered steps to the event, until it reaches the current version
+func (c *UpcasterChain) Upcast(e Typer) Typer {
+	return c.UpcastVersion(e, eventVersion(e))
+}
+
+// UpcastVersion applies the registered steps to the event, starting from the version, until it reaches the current version
+func (c *UpcasterChain) UpcastVersion(e Typer, version uint16) Typer {
+	for {
+		fn, ok := c.steps[upcastKey{kind: EventKind(e.GetType()), fromVersion: version}]
+		if !ok {
+			return e
+		}
+		e = fn(e)
+		next := eventVersion(e)
+		if next <= version {
+			// a step that does not move forward would loop forever
+			return e
+		}
+		version = next
+	}
+}
+
+func eventVersion(e Typer) uint16 {
+	if v, ok := e.(EventVersioner); ok {
+		return v.EventVersion()
+	}
+	return 1
+}
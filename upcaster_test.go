@@ -0,0 +1,119 @@
+package eventsourcing_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/quintans/eventsourcing"
+	"github.com/quintans/eventsourcing/store/inmem"
+	"github.com/quintans/eventsourcing/test"
+)
+
+type MoneyDepositedV1 struct {
+	Money int64
+}
+
+func (MoneyDepositedV1) GetType() string {
+	return "MoneyDeposited"
+}
+
+type MoneyDepositedV2 struct {
+	Amount int64
+}
+
+func (MoneyDepositedV2) GetType() string {
+	return "MoneyDeposited"
+}
+
+func (MoneyDepositedV2) EventVersion() uint16 {
+	return 2
+}
+
+type MoneyDepositedV3 struct {
+	Amount   int64
+	Currency string
+}
+
+func (MoneyDepositedV3) GetType() string {
+	return "MoneyDeposited"
+}
+
+func (MoneyDepositedV3) EventVersion() uint16 {
+	return 3
+}
+
+type v1Factory struct{}
+
+func (v1Factory) New(kind string) (eventsourcing.Typer, error) {
+	return &MoneyDepositedV1{}, nil
+}
+
+func TestUpcasterChain(t *testing.T) {
+	chain := eventsourcing.NewUpcasterChain().
+		Register("MoneyDeposited", 1, func(e eventsourcing.Typer) eventsourcing.Typer {
+			return &MoneyDepositedV2{Amount: e.(*MoneyDepositedV1).Money}
+		}).
+		Register("MoneyDeposited", 2, func(e eventsourcing.Typer) eventsourcing.Typer {
+			return &MoneyDepositedV3{Amount: e.(*MoneyDepositedV2).Amount, Currency: "EUR"}
+		})
+
+	e, err := eventsourcing.RehydrateEvent(v1Factory{}, eventsourcing.JSONCodec{}, chain, "MoneyDeposited", []byte(`{"Money":10}`))
+	require.NoError(t, err)
+	assert.Equal(t, MoneyDepositedV3{Amount: 10, Currency: "EUR"}, e)
+
+	// events already in the current version are untouched
+	v3 := &MoneyDepositedV3{Amount: 5, Currency: "USD"}
+	assert.Equal(t, v3, chain.Upcast(v3))
+
+	// unknown kinds are untouched
+	other := &MoneyDepositedV1{Money: 1}
+	assert.Equal(t, other, eventsourcing.NewUpcasterChain().Upcast(other))
+}
+
+// MoneyDepositedRaw does not declare its version, so it relies on the stored event version
+type MoneyDepositedRaw struct {
+	Amount int64
+}
+
+func (MoneyDepositedRaw) GetType() string {
+	return "MoneyDeposited"
+}
+
+type rawFactory struct{}
+
+func (rawFactory) New(kind string) (eventsourcing.Typer, error) {
+	return &MoneyDepositedRaw{}, nil
+}
+
+func TestUpcasterChainFromStoredVersion(t *testing.T) {
+	chain := eventsourcing.NewUpcasterChain().
+		Register("MoneyDeposited", 1, func(e eventsourcing.Typer) eventsourcing.Typer {
+			panic("should start from the stored version")
+		}).
+		Register("MoneyDeposited", 2, func(e eventsourcing.Typer) eventsourcing.Typer {
+			return &MoneyDepositedV3{Amount: e.(*MoneyDepositedRaw).Amount, Currency: "EUR"}
+		})
+
+	e, err := eventsourcing.RehydrateEventVersion(rawFactory{}, eventsourcing.JSONCodec{}, chain, "MoneyDeposited", 2, []byte(`{"Amount":10}`))
+	require.NoError(t, err)
+	assert.Equal(t, MoneyDepositedV3{Amount: 10, Currency: "EUR"}, e)
+}
+
+func TestEventVersionIsStored(t *testing.T) {
+	ctx := context.Background()
+	r := inmem.NewStore()
+	es := eventsourcing.NewEventStore(r, test.AggregateFactory{})
+
+	acc := test.CreateAccount("Paulo", uuid.New(), 100)
+	err := es.Save(ctx, acc)
+	require.NoError(t, err)
+
+	events, err := r.GetAggregateEvents(ctx, acc.GetID(), -1)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, uint16(1), events[0].EventVersion)
+}
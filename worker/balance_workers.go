@@ -2,6 +2,7 @@ package worker
 
 import (
 	"context"
+	"sort"
 	"time"
 
 	"github.com/quintans/eventsourcing/log"
@@ -18,6 +19,12 @@ type Memberlister interface {
 	Register(context.Context, []string) error
 }
 
+// MembershipWatcher is an optional interface of a Memberlister that signals membership changes,
+// so that the workers are rebalanced without waiting for the next heartbeat.
+type MembershipWatcher interface {
+	Watch(ctx context.Context) <-chan struct{}
+}
+
 type Worker interface {
 	Name() string
 	IsRunning() bool
@@ -25,53 +32,190 @@ type Worker interface {
 	Stop(context.Context)
 }
 
-func BalanceWorkers(ctx context.Context, logger log.Logger, member Memberlister, workers []Worker, heartbeat time.Duration) {
+// StartFailureHandler is called when a worker fails to start, with the number of consecutive failures of that worker
+type StartFailureHandler func(worker string, failures int)
+
+// Recorder receives the measurements of the balancing, to be exported as metrics
+type Recorder interface {
+	// WorkerStartFailed is called each time a worker fails to start
+	WorkerStartFailed(worker string)
+}
+
+type balanceOptions struct {
+	less         func(a, b string) bool
+	startFailure StartFailureHandler
+	recorder     Recorder
+	partitions   uint32
+	slots        []PartitionSlot
+}
+
+type BalanceOption func(*balanceOptions)
+
+// WithMemberRanking sets how the members are ranked when the workers cannot be evenly distributed.
+// Only the best ranked members, up to the number of leftover workers, claim an extra worker.
+// By default, members are ranked by name.
+func WithMemberRanking(less func(a, b string) bool) BalanceOption {
+	return func(o *balanceOptions) {
+		o.less = less
+	}
+}
+
+// WithStartFailureHandler sets a handler that is called when a worker fails to start, eg: to record a metric.
+// Start failures are always logged.
+func WithStartFailureHandler(handler StartFailureHandler) BalanceOption {
+	return func(o *balanceOptions) {
+		o.startFailure = handler
+	}
+}
+
+// WithMetrics sets the recorder that counts the start failures of the workers
+func WithMetrics(recorder Recorder) BalanceOption {
+	return func(o *balanceOptions) {
+		o.recorder = recorder
+	}
+}
+
+// WithPartitionSlots makes BalanceWorkers check, before balancing, that the partition slots of the workers
+// cover each of the partitions exactly once. Otherwise, it logs the error and returns without starting any worker,
+// since the events of a partition without a worker would never be forwarded.
+func WithPartitionSlots(partitions uint32, slots []PartitionSlot) BalanceOption {
+	return func(o *balanceOptions) {
+		o.partitions = partitions
+		o.slots = slots
+	}
+}
+
+func BalanceWorkers(ctx context.Context, logger log.Logger, member Memberlister, workers []Worker, heartbeat time.Duration, options ...BalanceOption) {
+	opts := balanceOptions{
+		less: func(a, b string) bool {
+			return a < b
+		},
+		recorder: nopRecorder{},
+	}
+	for _, o := range options {
+		o(&opts)
+	}
+	if opts.slots != nil {
+		if err := ValidateSlots(opts.partitions, opts.slots); err != nil {
+			logger.WithError(err).Error("Invalid partition slots. Not balancing the workers.")
+			return
+		}
+	}
+
 	ticker := time.NewTicker(heartbeat)
 	defer ticker.Stop()
+	var changes <-chan struct{}
+	if w, ok := member.(MembershipWatcher); ok {
+		changes = w.Watch(ctx)
+	}
+	failures := map[string]int{}
 	for {
-		err := run(ctx, member, workers)
+		running, failed, err := run(ctx, member, workers, opts)
 		if err != nil {
 			logger.Warnf("Error while balancing partitions: %v", err)
 		}
+		trackStartFailures(logger, failures, running, failed, opts)
+		if !waitRebalance(ctx, ticker.C, &changes) {
+			return
+		}
+	}
+}
+
+// waitRebalance blocks until the next heartbeat or membership change, returning false if the context is done.
+// When the watch ends, it falls back to the heartbeat.
+func waitRebalance(ctx context.Context, tick <-chan time.Time, changes *<-chan struct{}) bool {
+	for {
+		// a cancelled context takes precedence over pending changes
+		if ctx.Err() != nil {
+			return false
+		}
 		select {
 		case <-ctx.Done():
-			return
-		case <-ticker.C:
+			return false
+		case <-tick:
+			return true
+		case _, ok := <-*changes:
+			if !ok {
+				*changes = nil
+				continue
+			}
+			if !drain(*changes) {
+				*changes = nil
+			}
+			return true
 		}
 	}
 }
 
-func run(ctx context.Context, member Memberlister, workers []Worker) error {
-	members, err := member.List(ctx)
-	if err != nil {
-		return err
+// trackStartFailures counts the consecutive start failures of each worker, reporting the failed ones
+func trackStartFailures(logger log.Logger, failures map[string]int, running, failed []string, opts balanceOptions) {
+	for _, v := range running {
+		delete(failures, v)
+	}
+	for _, v := range failed {
+		failures[v]++
+		logger.WithTags(log.Tags{
+			"worker":   v,
+			"failures": failures[v],
+		}).Warnf("Worker failed to start %d consecutive time(s)", failures[v])
+		opts.recorder.WorkerStartFailed(v)
+		if opts.startFailure != nil {
+			opts.startFailure(v, failures[v])
+		}
 	}
+}
 
-	// if current member is not in the list, add it to the member count
-	present := false
-	for _, v := range members {
-		if v.Name == member.Name() {
-			present = true
-			break
+// nopRecorder is the recorder used when no recorder is configured
+type nopRecorder struct{}
+
+func (nopRecorder) WorkerStartFailed(string) {}
+
+// drain discards the pending notifications, so that a burst of changes only triggers one rebalance.
+// It returns false if the channel was closed.
+func drain(ch <-chan struct{}) bool {
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return false
+			}
+		default:
+			return true
 		}
 	}
-	membersCount := len(members)
-	if !present {
-		membersCount++
+}
+
+// run balances the workers, returning the running workers and the ones that failed to start
+func run(ctx context.Context, member Memberlister, workers []Worker, opts balanceOptions) ([]string, []string, error) {
+	members, err := member.List(ctx)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	monitorsNo := len(workers)
+	if monitorsNo == 0 {
+		// nothing to balance, but we still let the others know about this member
+		return nil, nil, member.Register(ctx, []string{})
+	}
+
+	// a member listed more than once, eg: while the list is being updated, is only counted once
+	names := map[string]bool{}
+	for _, v := range members {
+		names[v.Name] = true
+	}
+	// if current member is not in the list, add it to the member count
+	names[member.Name()] = true
+	membersCount := len(names)
+
 	workersToAcquire := monitorsNo / membersCount
+	// only the best ranked members claim the leftover workers, one each,
+	// so that the targets of all members add up to the number of workers and no worker bounces between members
+	if rank(member.Name(), names, opts.less) < monitorsNo%membersCount {
+		workersToAcquire++
+	}
 
-	// check if all members have the minimum workers. Only after that, any additional can be picked up.
-	allHaveMinWorkers := true
 	workersInUse := map[string]bool{}
 	for _, m := range members {
-		// checking if others have min required workers running.
-		// This member might be included
-		if len(m.Workers) < workersToAcquire {
-			allHaveMinWorkers = false
-		}
 		// map only other members workers
 		if m.Name != member.Name() {
 			for _, v := range m.Workers {
@@ -87,28 +231,20 @@ func run(ctx context.Context, member Memberlister, workers []Worker) error {
 			myRunningWorkers[v.Name()] = true
 		}
 	}
-	// if my current running workers are less, then not all members have the min workers
-	if len(myRunningWorkers) < workersToAcquire {
-		allHaveMinWorkers = false
-	}
-
-	if allHaveMinWorkers && monitorsNo%membersCount != 0 {
-		workersToAcquire++
-	}
-
-	locks := balance(ctx, workers, workersToAcquire, workersInUse, myRunningWorkers)
-	member.Register(ctx, locks)
 
-	return nil
+	locks, failed := balance(ctx, workers, workersToAcquire, workersInUse, myRunningWorkers)
+	return locks, failed, member.Register(ctx, locks)
 }
 
-func balance(ctx context.Context, workers []Worker, workersToAcquire int, workersInUse, myRunningWorkers map[string]bool) []string {
+func balance(ctx context.Context, workers []Worker, workersToAcquire int, workersInUse, myRunningWorkers map[string]bool) ([]string, []string) {
 	running := len(myRunningWorkers)
 	if running == workersToAcquire {
-		return mapToString(myRunningWorkers)
+		return mapToString(myRunningWorkers), nil
 	}
 
-	for _, v := range workers {
+	failed := []string{}
+
+	for _, v := range sortWorkers(workers) {
 		if running > workersToAcquire {
 			if !v.IsRunning() {
 				continue
@@ -125,13 +261,43 @@ func balance(ctx context.Context, workers []Worker, workersToAcquire int, worker
 			if v.Start(ctx) {
 				myRunningWorkers[v.Name()] = true
 				running++
+			} else {
+				failed = append(failed, v.Name())
 			}
 		}
 		if running == workersToAcquire {
 			break
 		}
 	}
-	return mapToString(myRunningWorkers)
+	return mapToString(myRunningWorkers), failed
+}
+
+// rank returns the position of the member among all the members
+func rank(name string, names map[string]bool, less func(a, b string) bool) int {
+	sorted := make([]string, 0, len(names))
+	for k := range names {
+		sorted = append(sorted, k)
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return less(sorted[i], sorted[j])
+	})
+	for k, v := range sorted {
+		if v == name {
+			return k
+		}
+	}
+	return len(sorted)
+}
+
+// sortWorkers returns a copy of the workers sorted by name,
+// so that members with the same inputs take the same decisions.
+func sortWorkers(workers []Worker) []Worker {
+	sorted := make([]Worker, len(workers))
+	copy(sorted, workers)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Name() < sorted[j].Name()
+	})
+	return sorted
 }
 
 func mapToString(m map[string]bool) []string {
@@ -139,5 +305,6 @@ func mapToString(m map[string]bool) []string {
 	for k := range m {
 		s = append(s, k)
 	}
+	sort.Strings(s)
 	return s
 }
@@ -8,8 +8,10 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/quintans/eventsourcing/estest"
 	"github.com/quintans/eventsourcing/lock"
 	"github.com/quintans/eventsourcing/log"
 	"github.com/quintans/eventsourcing/worker"
@@ -47,7 +49,7 @@ func TestMembersList(t *testing.T) {
 	count3 := countRunningWorkers(w3)
 	require.True(t, count3 >= 1 && count3 <= 2)
 
-	require.Equal(t, 4, count+count2+count3)
+	require.Equal(t, 4, count1+count2+count3)
 
 	// after a while we expect to still have he same values
 	time.Sleep(time.Second)
@@ -92,6 +94,221 @@ func TestMembersList(t *testing.T) {
 	cancel2()
 }
 
+func TestBalanceWithFakes(t *testing.T) {
+	members := estest.NewMemberList()
+	members.Set("other", "worker-1", "worker-2")
+	me := members.Member("me")
+	ws := []*estest.Worker{
+		estest.NewWorker("worker-1"),
+		estest.NewWorker("worker-2"),
+		estest.NewWorker("worker-3"),
+		estest.NewWorker("worker-4"),
+	}
+	workers := make([]worker.Worker, len(ws))
+	for k, w := range ws {
+		workers[k] = w
+	}
+
+	// a cancelled context runs a single balancing round
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	worker.BalanceWorkers(ctx, log.NopLogger{}, me, workers, time.Second)
+	assert.ElementsMatch(t, []string{"worker-3", "worker-4"}, members.Workers("me"))
+	assert.Equal(t, 0, ws[0].Starts())
+	assert.Equal(t, 0, ws[1].Starts())
+
+	// the other member leaves
+	members.Remove("other")
+	worker.BalanceWorkers(ctx, log.NopLogger{}, me, workers, time.Second)
+	assert.ElementsMatch(t, []string{"worker-1", "worker-2", "worker-3", "worker-4"}, members.Workers("me"))
+	for _, w := range ws {
+		assert.True(t, w.IsRunning())
+		assert.Equal(t, 0, w.Stops())
+	}
+}
+
+func TestBalanceIsDeterministic(t *testing.T) {
+	members := estest.NewMemberList()
+	members.Set("other")
+	me := members.Member("me")
+	ws := []*estest.Worker{
+		estest.NewWorker("worker-3"),
+		estest.NewWorker("worker-1"),
+		estest.NewWorker("worker-4"),
+		estest.NewWorker("worker-2"),
+	}
+	workers := make([]worker.Worker, len(ws))
+	for k, w := range ws {
+		workers[k] = w
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	worker.BalanceWorkers(ctx, log.NopLogger{}, me, workers, time.Second)
+	require.Equal(t, []string{"worker-1", "worker-2"}, members.Workers("me"))
+
+	// giving away workers also follows the name order
+	members.Set("other2")
+	members.Set("other3")
+	worker.BalanceWorkers(ctx, log.NopLogger{}, me, workers, time.Second)
+	require.Equal(t, []string{"worker-2"}, members.Workers("me"))
+}
+
+func TestBalanceOnMembershipChange(t *testing.T) {
+	members := estest.NewMemberList()
+	members.Set("other", "worker-1", "worker-2")
+	me := members.Member("me")
+	workers := []worker.Worker{
+		estest.NewWorker("worker-1"),
+		estest.NewWorker("worker-2"),
+		estest.NewWorker("worker-3"),
+		estest.NewWorker("worker-4"),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// the heartbeat is too long to be the trigger of the rebalance
+	go worker.BalanceWorkers(ctx, log.NopLogger{}, me, workers, time.Hour)
+
+	require.Eventually(t, func() bool {
+		return countRunningWorkers(workers) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	members.Remove("other")
+	require.Eventually(t, func() bool {
+		return countRunningWorkers(workers) == 4
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestBalanceWithoutWorkers(t *testing.T) {
+	members := estest.NewMemberList()
+	members.Set("other", "worker-1")
+	me := members.Member("me")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	worker.BalanceWorkers(ctx, log.NopLogger{}, me, nil, time.Second)
+	require.Equal(t, []string{}, members.Workers("me"))
+}
+
+// duplicatedMemberList lists every member twice
+type duplicatedMemberList struct {
+	*estest.Member
+}
+
+func (m duplicatedMemberList) List(ctx context.Context) ([]worker.MemberWorkers, error) {
+	members, err := m.Member.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return append(members, members...), nil
+}
+
+func TestBalanceWithDuplicatedMembers(t *testing.T) {
+	members := estest.NewMemberList()
+	members.Set("other", "worker-1")
+	me := duplicatedMemberList{members.Member("me")}
+	workers := []worker.Worker{
+		estest.NewWorker("worker-1"),
+		estest.NewWorker("worker-2"),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	worker.BalanceWorkers(ctx, log.NopLogger{}, me, workers, time.Second)
+	require.Equal(t, []string{"worker-2"}, members.Workers("me"))
+	// running again, this member is also listed twice
+	worker.BalanceWorkers(ctx, log.NopLogger{}, me, workers, time.Second)
+	require.Equal(t, []string{"worker-2"}, members.Workers("me"))
+}
+
+func TestBalanceLeftoverWorkers(t *testing.T) {
+	newWorkers := func() []worker.Worker {
+		return []worker.Worker{
+			estest.NewWorker("worker-1"),
+			estest.NewWorker("worker-2"),
+			estest.NewWorker("worker-3"),
+			estest.NewWorker("worker-4"),
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	members := estest.NewMemberList()
+	members.Set("a", "worker-1")
+	members.Set("b", "worker-2")
+	me := members.Member("c")
+
+	// by default, the leftover worker goes to the first member by name
+	worker.BalanceWorkers(ctx, log.NopLogger{}, me, newWorkers(), time.Second)
+	require.Equal(t, []string{"worker-3"}, members.Workers("c"))
+
+	members.Remove("c")
+	worker.BalanceWorkers(ctx, log.NopLogger{}, me, newWorkers(), time.Second, worker.WithMemberRanking(func(a, b string) bool {
+		return a > b
+	}))
+	require.Equal(t, []string{"worker-3", "worker-4"}, members.Workers("c"))
+}
+
+func TestBalanceStartFailures(t *testing.T) {
+	members := estest.NewMemberList()
+	me := members.Member("me")
+	stuck := estest.NewWorker("worker-1")
+	stuck.SetStartable(false)
+	workers := []worker.Worker{stuck, estest.NewWorker("worker-2")}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	failures := map[string]int{}
+	handler := worker.WithStartFailureHandler(func(name string, count int) {
+		failures[name] = count
+	})
+	rec := &startFailureRecorder{failed: map[string]int{}}
+	worker.BalanceWorkers(ctx, log.NopLogger{}, me, workers, time.Second, handler, worker.WithMetrics(rec))
+	require.Equal(t, map[string]int{"worker-1": 1}, failures)
+	require.Equal(t, map[string]int{"worker-1": 1}, rec.failed)
+	require.Equal(t, []string{"worker-2"}, members.Workers("me"))
+
+	stuck.SetStartable(true)
+	failures = map[string]int{}
+	worker.BalanceWorkers(ctx, log.NopLogger{}, me, workers, time.Second, handler, worker.WithMetrics(rec))
+	require.Empty(t, failures)
+	require.Equal(t, map[string]int{"worker-1": 1}, rec.failed)
+	require.Equal(t, []string{"worker-1", "worker-2"}, members.Workers("me"))
+}
+
+type startFailureRecorder struct {
+	failed map[string]int
+}
+
+func (r *startFailureRecorder) WorkerStartFailed(worker string) {
+	r.failed[worker]++
+}
+
+func TestBalanceWithInvalidPartitionSlots(t *testing.T) {
+	members := estest.NewMemberList()
+	me := members.Member("me")
+	workers := []worker.Worker{estest.NewWorker("worker-1"), estest.NewWorker("worker-2")}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	slots, err := worker.ParseSlots([]string{"1-6", "8-12"})
+	require.NoError(t, err)
+	worker.BalanceWorkers(ctx, log.NopLogger{}, me, workers, time.Second, worker.WithPartitionSlots(12, slots))
+	require.Empty(t, members.Workers("me"))
+
+	slots, err = worker.ParseSlots([]string{"1-6", "7-12"})
+	require.NoError(t, err)
+	worker.BalanceWorkers(ctx, log.NopLogger{}, me, workers, time.Second, worker.WithPartitionSlots(12, slots))
+	require.Equal(t, []string{"worker-1", "worker-2"}, members.Workers("me"))
+}
+
 func newBalancer(members *sync.Map) ([]worker.Worker, context.CancelFunc) {
 	return newBalancerWithTimeout(members, 0)
 }
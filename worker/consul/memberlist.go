@@ -0,0 +1,211 @@
+package consul
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hashicorp/consul/api"
+	"github.com/quintans/faults"
+
+	"github.com/quintans/eventsourcing/worker"
+)
+
+var (
+	_ worker.Memberlister      = (*MemberList)(nil)
+	_ worker.MembershipWatcher = (*MemberList)(nil)
+)
+
+// MemberList keeps the members, and their workers, under the consul KV prefix, each in a key locked by the member session.
+// Since the session is created with the delete behaviour, the key of a member that stops sending heartbeats
+// is removed when the session TTL expires.
+type MemberList struct {
+	client     *api.Client
+	prefix     string
+	name       string
+	expiration time.Duration
+
+	mu  sync.Mutex
+	sID string
+}
+
+// NewMemberList creates a member. The expiration is used as the session TTL (consul requires, at least, 10s)
+// and should be greater than the balancing heartbeat.
+func NewMemberList(client *api.Client, prefix string, expiration time.Duration) *MemberList {
+	return &MemberList{
+		client:     client,
+		prefix:     prefix,
+		name:       prefix + "/" + uuid.New().String(),
+		expiration: expiration,
+	}
+}
+
+func (c *MemberList) Name() string {
+	return c.name
+}
+
+// List lists the live members and the workers under each of them
+func (c *MemberList) List(ctx context.Context) ([]worker.MemberWorkers, error) {
+	options := &api.QueryOptions{}
+	options = options.WithContext(ctx)
+	pairs, _, err := c.client.KV().List(c.prefix+"/", options)
+	if err != nil {
+		return nil, faults.Wrap(err)
+	}
+
+	members := []worker.MemberWorkers{}
+	for _, kv := range pairs {
+		// a key without a session belongs to a member that is no longer alive
+		if kv.Session == "" {
+			continue
+		}
+		members = append(members, worker.MemberWorkers{
+			Name:    kv.Key,
+			Workers: split(string(kv.Value)),
+		})
+	}
+
+	return members, nil
+}
+
+func split(s string) []string {
+	if s == "" {
+		return []string{}
+	}
+	return strings.Split(s, ",")
+}
+
+// Register registers the workers under this member, renewing the member session.
+// If the session expired, a new one is created.
+func (c *MemberList) Register(ctx context.Context, workers []string) error {
+	options := &api.WriteOptions{}
+	options = options.WithContext(ctx)
+
+	sID, err := c.session(options)
+	if err != nil {
+		return err
+	}
+
+	kv := &api.KVPair{
+		Session: sID,
+		Key:     c.name,
+		Value:   []byte(strings.Join(workers, ",")),
+	}
+	acquired, _, err := c.client.KV().Acquire(kv, options)
+	if err != nil {
+		return faults.Wrap(err)
+	}
+	if !acquired {
+		return faults.Errorf("Unable to register member %s", c.name)
+	}
+
+	return nil
+}
+
+func (c *MemberList) session(options *api.WriteOptions) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.sID != "" {
+		entry, _, err := c.client.Session().Renew(c.sID, options)
+		if err != nil {
+			return "", faults.Wrap(err)
+		}
+		if entry != nil {
+			return c.sID, nil
+		}
+		// session expired
+		c.sID = ""
+	}
+
+	sID, _, err := c.client.Session().Create(&api.SessionEntry{
+		Name:     c.name,
+		TTL:      c.expiration.String(),
+		Behavior: api.SessionBehaviorDelete,
+	}, options)
+	if err != nil {
+		return "", faults.Wrap(err)
+	}
+	c.sID = sID
+
+	return sID, nil
+}
+
+// Unregister removes this member, destroying its session
+func (c *MemberList) Unregister(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.sID == "" {
+		return nil
+	}
+	options := &api.WriteOptions{}
+	options = options.WithContext(ctx)
+	_, err := c.client.Session().Destroy(c.sID, options)
+	if err != nil {
+		return faults.Wrap(err)
+	}
+	c.sID = ""
+
+	return nil
+}
+
+// Watch signals when members join or leave, using consul blocking queries.
+// Changes to the workers of a member are not signalled.
+func (c *MemberList) Watch(ctx context.Context) <-chan struct{} {
+	ch := make(chan struct{}, 1)
+	go func() {
+		defer close(ch)
+
+		var index uint64
+		var names string
+		first := true
+		for {
+			options := &api.QueryOptions{WaitIndex: index}
+			options = options.WithContext(ctx)
+			pairs, meta, err := c.client.KV().List(c.prefix+"/", options)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				// retry later
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(time.Second):
+				}
+				continue
+			}
+
+			current := memberNames(pairs)
+			if !first && current != names {
+				select {
+				case ch <- struct{}{}:
+				default:
+				}
+			}
+			first = false
+			names = current
+			if meta.LastIndex < index {
+				// the index went backwards, so it is reset, as recommended by consul
+				index = 0
+			} else {
+				index = meta.LastIndex
+			}
+		}
+	}()
+	return ch
+}
+
+func memberNames(pairs api.KVPairs) string {
+	names := []string{}
+	for _, kv := range pairs {
+		if kv.Session != "" {
+			names = append(names, kv.Key)
+		}
+	}
+	// consul returns the keys sorted
+	return strings.Join(names, ",")
+}
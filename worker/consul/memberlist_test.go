@@ -0,0 +1,98 @@
+package consul_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	testcontainers "github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+
+	"github.com/quintans/eventsourcing/worker/consul"
+)
+
+func setup(ctx context.Context) (testcontainers.Container, string, error) {
+	tcpPort := "8500"
+	natPort := nat.Port(tcpPort)
+
+	req := testcontainers.ContainerRequest{
+		Image:        "bitnami/consul:latest",
+		ExposedPorts: []string{tcpPort + "/tcp"},
+		WaitingFor:   wait.ForListeningPort(natPort),
+	}
+	container, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: req,
+		Started:          true,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	ip, err := container.Host(ctx)
+	if err != nil {
+		container.Terminate(ctx)
+		return nil, "", err
+	}
+	port, err := container.MappedPort(ctx, natPort)
+	if err != nil {
+		container.Terminate(ctx)
+		return nil, "", err
+	}
+	consulAddr := fmt.Sprintf("%s:%s", ip, port.Port())
+	time.Sleep(2 * time.Second)
+
+	return container, consulAddr, nil
+}
+
+func TestMemberList(t *testing.T) {
+	ctx := context.Background()
+	container, addr, err := setup(ctx)
+	require.NoError(t, err)
+	defer container.Terminate(ctx)
+
+	client, err := api.NewClient(&api.Config{Address: addr})
+	require.NoError(t, err)
+
+	m1 := consul.NewMemberList(client, "forwarder", 10*time.Second)
+	m2 := consul.NewMemberList(client, "forwarder", 10*time.Second)
+
+	members, err := m1.List(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, members)
+
+	require.NoError(t, m1.Register(ctx, []string{"w1", "w2"}))
+	require.NoError(t, m2.Register(ctx, []string{}))
+	// registering again renews the session
+	require.NoError(t, m1.Register(ctx, []string{"w1"}))
+
+	members, err = m2.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, members, 2)
+	for _, m := range members {
+		switch m.Name {
+		case m1.Name():
+			assert.Equal(t, []string{"w1"}, m.Workers)
+		case m2.Name():
+			assert.Empty(t, m.Workers)
+		default:
+			t.Fatalf("unexpected member %s", m.Name)
+		}
+	}
+
+	require.NoError(t, m2.Unregister(ctx))
+	members, err = m1.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, members, 1)
+	assert.Equal(t, m1.Name(), members[0].Name)
+
+	// the member registers again with a new session
+	require.NoError(t, m2.Register(ctx, []string{"w2"}))
+	members, err = m1.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, members, 2)
+}
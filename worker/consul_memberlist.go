@@ -15,6 +15,8 @@ import (
 var _ Memberlister = (*ConsulMemberList)(nil)
 
 // NewConsulMemberList is a member of a list of servers managing distributed workers backed by consul.
+//
+// Deprecated: use the MemberList of the worker/consul package, that recreates the member session if it expires.
 type ConsulMemberList struct {
 	client     *api.Client
 	prefix     string
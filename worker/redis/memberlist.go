@@ -0,0 +1,88 @@
+package redis
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/quintans/faults"
+
+	"github.com/quintans/eventsourcing/worker"
+)
+
+var _ worker.Memberlister = (*MemberList)(nil)
+
+// MemberList keeps the members, and their workers, in redis keys that expire if the member stops sending heartbeats.
+// Each member registers itself under the key <prefix>:<uuid>.
+type MemberList struct {
+	rdb        redis.UniversalClient
+	prefix     string
+	name       string
+	expiration time.Duration
+}
+
+// NewMemberList creates a member. The expiration should be greater than the balancing heartbeat,
+// otherwise the member will drop out of the list between heartbeats.
+func NewMemberList(rdb redis.UniversalClient, prefix string, expiration time.Duration) *MemberList {
+	return &MemberList{
+		rdb:        rdb,
+		prefix:     prefix,
+		name:       prefix + ":" + uuid.New().String(),
+		expiration: expiration,
+	}
+}
+
+func (r *MemberList) Name() string {
+	return r.name
+}
+
+// List returns the members that have not expired
+func (r *MemberList) List(ctx context.Context) ([]worker.MemberWorkers, error) {
+	var cursor uint64
+	members := []worker.MemberWorkers{}
+	for {
+		var keys []string
+		var err error
+		keys, cursor, err = r.rdb.Scan(ctx, cursor, r.prefix+":*", 10).Result()
+		if err != nil {
+			return nil, faults.Wrap(err)
+		}
+		if len(keys) > 0 {
+			vals, err := r.rdb.MGet(ctx, keys...).Result()
+			if err != nil {
+				return nil, faults.Wrap(err)
+			}
+			for k, v := range vals {
+				s, ok := v.(string)
+				if !ok {
+					// expired after being scanned
+					continue
+				}
+				members = append(members, worker.MemberWorkers{
+					Name:    keys[k],
+					Workers: split(s),
+				})
+			}
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+	return members, nil
+}
+
+func split(s string) []string {
+	if s == "" {
+		return []string{}
+	}
+	return strings.Split(s, ",")
+}
+
+// Register sets the workers of this member, refreshing its expiration
+func (r *MemberList) Register(ctx context.Context, workers []string) error {
+	s := strings.Join(workers, ",")
+	err := r.rdb.Set(ctx, r.name, s, r.expiration).Err()
+	return faults.Wrap(err)
+}
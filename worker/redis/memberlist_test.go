@@ -0,0 +1,60 @@
+package redis_test
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/quintans/eventsourcing/worker"
+	rworker "github.com/quintans/eventsourcing/worker/redis"
+)
+
+func TestMemberList(t *testing.T) {
+	mr, err := miniredis.Run()
+	require.NoError(t, err)
+	defer mr.Close()
+
+	ctx := context.Background()
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	m1 := rworker.NewMemberList(rdb, "forwarder", 5*time.Second)
+	m2 := rworker.NewMemberList(rdb, "forwarder", 5*time.Second)
+	other := rworker.NewMemberList(rdb, "projection", 10*time.Second)
+
+	members, err := m1.List(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, members)
+
+	require.NoError(t, m1.Register(ctx, []string{"w1", "w2"}))
+	require.NoError(t, m2.Register(ctx, []string{}))
+	require.NoError(t, other.Register(ctx, []string{"w1"}))
+
+	members, err = m1.List(ctx)
+	require.NoError(t, err)
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Name < members[j].Name
+	})
+	expected := []worker.MemberWorkers{
+		{Name: m1.Name(), Workers: []string{"w1", "w2"}},
+		{Name: m2.Name(), Workers: []string{}},
+	}
+	sort.Slice(expected, func(i, j int) bool {
+		return expected[i].Name < expected[j].Name
+	})
+	assert.Equal(t, expected, members)
+
+	// registering refreshes the TTL and the member that stopped registering drops out
+	mr.FastForward(4 * time.Second)
+	require.NoError(t, m1.Register(ctx, []string{"w1"}))
+	mr.FastForward(2 * time.Second)
+	members, err = m1.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, members, 1)
+	assert.Equal(t, m1.Name(), members[0].Name)
+	assert.Equal(t, []string{"w1"}, members[0].Workers)
+}
@@ -12,6 +12,9 @@ import (
 
 var _ Memberlister = (*RedisMemberList)(nil)
 
+// RedisMemberList is a redis backed member list.
+//
+// Deprecated: use the MemberList of the worker/redis package, that accepts any redis client and tolerates members expiring while listing.
 type RedisMemberList struct {
 	rdb        *redis.Client
 	prefix     string
@@ -10,6 +10,7 @@ import (
 
 	"github.com/quintans/eventsourcing/lock"
 	"github.com/quintans/eventsourcing/log"
+	"github.com/quintans/eventsourcing/store"
 )
 
 // Tasker is the interface for tasks that need to be balanced among a set of workers
@@ -122,6 +123,15 @@ func ParseSlots(slots []string) ([]PartitionSlot, error) {
 	return pslots, nil
 }
 
+// ValidateSlots checks that the slots cover each of the partitions exactly once
+func ValidateSlots(partitions uint32, slots []PartitionSlot) error {
+	ranges := make([][2]uint32, len(slots))
+	for k, v := range slots {
+		ranges[k] = [2]uint32{v.From, v.To}
+	}
+	return store.ValidatePartitionCoverage(partitions, ranges)
+}
+
 func ParseSlot(slot string) (PartitionSlot, error) {
 	ps := strings.Split(slot, "-")
 	s := PartitionSlot{}